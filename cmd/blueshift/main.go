@@ -1,16 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rand"
 	"fmt"
+	"github.com/gravesm/blueshift/pkg/importer"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/scrobble"
 	"github.com/gravesm/blueshift/pkg/server"
 	"github.com/gravesm/blueshift/pkg/services"
 	"github.com/gravesm/blueshift/pkg/store"
 	"github.com/jinzhu/gorm"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,14 +31,336 @@ func main() {
 		{
 			Name: "init",
 			Action: func(c *cli.Context) error {
-				db, err := gorm.Open("sqlite3", "test.db")
+				db, err := openDatabase()
 				if err != nil {
 					return err
 				}
-				store.Initialize(db)
+				return store.Initialize(db)
+			},
+		},
+		{
+			Name:      "scan",
+			Usage:     "Import the audio files in a directory",
+			ArgsUsage: "<dir>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "in-place",
+					Usage: "Reference files where they are instead of copying them",
+				},
+				cli.BoolFlag{
+					Name:  "incremental",
+					Usage: "Skip files that have not changed since the last scan",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.NewExitError("scan requires a directory", 1)
+				}
+				db, err := openDatabase()
+				if err != nil {
+					return err
+				}
+				defer db.Close()
+				collection := store.NewDbCollection(db)
+				scanner := importer.NewScanner(collection, services.FileStreamHandler{Directory: "files"})
+				scanner.InPlace = c.Bool("in-place")
+				scanner.Incremental = c.Bool("incremental")
+				report, err := scanner.Scan(c.Args().First())
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%d added, %d updated, %d unchanged, %d skipped\n",
+					report.Added, report.Updated, report.Unchanged, report.Skipped)
 				return nil
 			},
 		},
+		{
+			Name:  "playlist",
+			Usage: "Manage playlists",
+			Subcommands: []cli.Command{
+				{
+					Name:      "import",
+					Usage:     "Import M3U, M3U8, PLS or XSPF playlists",
+					ArgsUsage: "<file>...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "Name the playlist instead of using the name in the file",
+						},
+						cli.StringFlag{
+							Name:  "user",
+							Usage: "Give the playlist to the user with this name",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() == 0 {
+							return cli.NewExitError("playlist import requires a file", 1)
+						}
+						db, err := openDatabase()
+						if err != nil {
+							return err
+						}
+						defer db.Close()
+						collection := store.NewDbCollection(db)
+						var owner models.User
+						if name := c.String("user"); name != "" {
+							if owner, err = collection.GetUserByName(name); err != nil {
+								return err
+							}
+						}
+						im := importer.NewImporter(collection, services.FileStreamHandler{Directory: "files"})
+						for _, name := range c.Args() {
+							if err := importPlaylist(im, name, c.String("name"), owner.ID); err != nil {
+								return err
+							}
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "user",
+			Usage: "Manage the users who can log in",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "Add a user, asking for their password",
+					ArgsUsage: "<name>",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "admin",
+							Usage: "Let the user upload and edit",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.NewExitError("user add requires a name", 1)
+						}
+						collection, db, err := openCollection()
+						if err != nil {
+							return err
+						}
+						defer db.Close()
+						u := models.User{Name: c.Args().First(), Admin: c.Bool("admin")}
+						password, err := readPassword()
+						if err != nil {
+							return err
+						}
+						if err := u.SetPassword(password); err != nil {
+							return err
+						}
+						return collection.CreateUser(&u)
+					},
+				},
+				{
+					Name:      "passwd",
+					Usage:     "Change the password of a user",
+					ArgsUsage: "<name>",
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.NewExitError("user passwd requires a name", 1)
+						}
+						collection, db, err := openCollection()
+						if err != nil {
+							return err
+						}
+						defer db.Close()
+						u, err := collection.GetUserByName(c.Args().First())
+						if err != nil {
+							return err
+						}
+						password, err := readPassword()
+						if err != nil {
+							return err
+						}
+						if err := u.SetPassword(password); err != nil {
+							return err
+						}
+						return collection.SaveUser(u)
+					},
+				},
+				{
+					Name:      "delete",
+					Usage:     "Delete a user",
+					ArgsUsage: "<name>",
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.NewExitError("user delete requires a name", 1)
+						}
+						collection, db, err := openCollection()
+						if err != nil {
+							return err
+						}
+						defer db.Close()
+						u, err := collection.GetUserByName(c.Args().First())
+						if err != nil {
+							return err
+						}
+						return collection.DeleteUser(u.ID)
+					},
+				},
+				{
+					Name:      "listenbrainz",
+					Usage:     "Submit the plays of a user to ListenBrainz",
+					ArgsUsage: "<name>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "url",
+							Usage: "API root of a ListenBrainz-compatible service",
+							Value: services.DefaultListenBrainzURL,
+						},
+						cli.StringFlag{
+							Name:  "token",
+							Usage: "User token of the ListenBrainz account",
+						},
+						cli.BoolFlag{
+							Name:  "disable",
+							Usage: "Stop submitting plays",
+						},
+						cli.StringFlag{
+							Name:  "backfill-since",
+							Usage: "Also submit the plays since a date, YYYY-MM-DD",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.NewExitError("user listenbrainz requires a name", 1)
+						}
+						collection, db, err := openCollection()
+						if err != nil {
+							return err
+						}
+						defer db.Close()
+						u, err := collection.GetUserByName(c.Args().First())
+						if err != nil {
+							return err
+						}
+						if url := strings.TrimRight(c.String("url"), "/"); url != services.DefaultListenBrainzURL {
+							u.ListenBrainzURL = url
+						} else {
+							u.ListenBrainzURL = ""
+						}
+						if c.Bool("disable") {
+							u.ListenBrainzToken = ""
+						} else if t := c.String("token"); t != "" {
+							u.ListenBrainzToken = t
+						}
+						if err := collection.SaveUser(u); err != nil {
+							return err
+						}
+						if since := c.String("backfill-since"); since != "" {
+							if u.ListenBrainzToken == "" {
+								return cli.NewExitError("backfill needs a token", 1)
+							}
+							at, err := time.ParseInLocation("2006-01-02", since, time.Local)
+							if err != nil {
+								return err
+							}
+							fwd := scrobble.NewForwarder(collection, services.ListenBrainzClient{})
+							n, err := fwd.Backfill(u, at)
+							if err != nil {
+								return err
+							}
+							fmt.Printf("%d plays queued; the server submits them\n", n)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "token",
+			Usage: "Manage the API tokens of users",
+			Subcommands: []cli.Command{
+				{
+					Name:      "create",
+					Usage:     "Create a token and print it",
+					ArgsUsage: "<user> <name>",
+					Flags: []cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "scope",
+							Usage: "Let the token read, stream, upload or admin",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 2 {
+							return cli.NewExitError("token create requires a user and a name", 1)
+						}
+						collection, db, err := openCollection()
+						if err != nil {
+							return err
+						}
+						defer db.Close()
+						u, err := collection.GetUserByName(c.Args().Get(0))
+						if err != nil {
+							return err
+						}
+						_, secret, err := server.CreateToken(collection, u, c.Args().Get(1), c.StringSlice("scope"))
+						if err != nil {
+							return err
+						}
+						fmt.Println(secret)
+						return nil
+					},
+				},
+				{
+					Name:      "list",
+					Usage:     "List the tokens of a user",
+					ArgsUsage: "<user>",
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.NewExitError("token list requires a user", 1)
+						}
+						collection, db, err := openCollection()
+						if err != nil {
+							return err
+						}
+						defer db.Close()
+						u, err := collection.GetUserByName(c.Args().First())
+						if err != nil {
+							return err
+						}
+						tokens, err := collection.Tokens(u.ID)
+						if err != nil {
+							return err
+						}
+						for _, t := range tokens {
+							used := "never used"
+							if t.LastUsedAt != nil {
+								used = "last used " + t.LastUsedAt.Format(time.RFC3339)
+							}
+							fmt.Printf("%d\t%s\t%s\t%s\n", t.ID, t.Name, t.Scopes, used)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "revoke",
+					Usage:     "Revoke a token of a user",
+					ArgsUsage: "<user> <id>",
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 2 {
+							return cli.NewExitError("token revoke requires a user and a token ID", 1)
+						}
+						id, err := strconv.ParseInt(c.Args().Get(1), 10, 64)
+						if err != nil {
+							return err
+						}
+						collection, db, err := openCollection()
+						if err != nil {
+							return err
+						}
+						defer db.Close()
+						u, err := collection.GetUserByName(c.Args().First())
+						if err != nil {
+							return err
+						}
+						return collection.DeleteToken(u.ID, id)
+					},
+				},
+			},
+		},
 		{
 			Name: "server",
 			Flags: []cli.Flag{
@@ -36,19 +369,155 @@ func main() {
 					Value: ":6000",
 					Usage: "Address to listen on",
 				},
+				cli.StringSliceFlag{
+					Name:  "subsonic-user",
+					Usage: "Enable the Subsonic API for a user given as name:password",
+				},
+				cli.StringFlag{
+					Name:  "watch",
+					Usage: "Keep the library in sync with the audio files in `DIR`",
+				},
+				cli.BoolFlag{
+					Name:  "in-place",
+					Usage: "Reference watched files where they are instead of copying them",
+				},
+				cli.StringFlag{
+					Name:  "thumbnail-cache",
+					Value: "thumbnails",
+					Usage: "Directory to cache cover thumbnails in",
+				},
+				cli.BoolFlag{
+					Name:  "webp",
+					Usage: "Make WebP cover thumbnails on request with cwebp",
+				},
+				cli.BoolFlag{
+					Name:  "transcode",
+					Usage: "Transcode streams on request, to mp3, ogg or opus with ffmpeg by default",
+				},
+				cli.StringSliceFlag{
+					Name:  "transcode-command",
+					Usage: "Transcode to a format with a command given as format:command",
+				},
+				cli.StringFlag{
+					Name:  "transcode-cache",
+					Value: "transcodes",
+					Usage: "Directory to cache transcoded streams in",
+				},
+				cli.StringFlag{
+					Name:  "spool",
+					Value: "uploads",
+					Usage: "Directory to keep uploaded releases in until they are imported",
+				},
+				cli.IntFlag{
+					Name:  "import-workers",
+					Value: 2,
+					Usage: "Number of uploaded releases imported at the same time",
+				},
+				cli.Int64Flag{
+					Name:  "max-upload-file",
+					Value: importer.MaxArchiveFileSize >> 20,
+					Usage: "Largest file, in MiB, that an uploaded release may unpack to",
+				},
+				cli.Int64Flag{
+					Name:  "max-upload",
+					Value: importer.MaxArchiveSize >> 20,
+					Usage: "Most data, in MiB, that an uploaded release may unpack to",
+				},
+				cli.BoolFlag{
+					Name:  "no-login",
+					Usage: "Let anyone in without logging in, such as behind a proxy that does",
+				},
 			},
 			Action: func(c *cli.Context) error {
-				db, err := gorm.Open("sqlite3", "test.db")
+				db, err := openDatabase()
 				if err != nil {
 					log.Fatal(err)
 				}
+				if err := store.Migrate(db); err != nil {
+					return err
+				}
+				if fts, err := store.FullTextSearch(db); err != nil {
+					return err
+				} else if !fts {
+					log.Print("search results are not ranked; build with -tags sqlite_fts5, as make does, for full-text search")
+				}
 				collection := store.NewDbCollection(db)
-				server := server.NewServer(collection, services.FileStreamHandler{"files"}, "templates")
+				sh := services.FileStreamHandler{Directory: "files"}
+				importer.MaxArchiveFileSize = c.Int64("max-upload-file") << 20
+				importer.MaxArchiveSize = c.Int64("max-upload") << 20
+				if dir := c.String("watch"); dir != "" {
+					scanner := importer.NewScanner(collection, sh)
+					scanner.InPlace = c.Bool("in-place")
+					watcher, err := importer.NewWatcher(scanner, dir)
+					if err != nil {
+						return err
+					}
+					go func() {
+						if err := watcher.Sync(); err != nil {
+							log.Printf("watch %s: %v", dir, err)
+						}
+						watcher.Run(nil)
+					}()
+				}
+				fwd := scrobble.NewForwarder(collection, services.ListenBrainzClient{})
+				go fwd.Run(nil)
+				// Uploaded releases are imported in the background, so that
+				// uploads of large ones need not wait for the import.
+				jobs := importer.NewJobs(collection, sh, c.String("spool"))
+				jobs.Workers = c.Int("import-workers")
+				go jobs.Run(nil)
+				opts := []server.Option{
+					server.WithThumbnailCache(c.String("thumbnail-cache")),
+					server.WithForwarder(fwd),
+					server.WithJobs(jobs),
+				}
+				if c.Bool("webp") {
+					opts = append(opts, server.WithWebPThumbnails(services.DefaultWebPCommand))
+				}
+				if !c.Bool("no-login") {
+					users, err := collection.Users()
+					if err != nil {
+						return err
+					}
+					if len(users) == 0 {
+						log.Print("no users can log in; add one with blueshift user add --admin <name>")
+					}
+					key, err := signingKey()
+					if err != nil {
+						return err
+					}
+					opts = append(opts, server.WithLogin(), server.WithSigningKey(key))
+				}
+				if users := c.StringSlice("subsonic-user"); len(users) > 0 {
+					subsonic := make(map[string]string)
+					for _, u := range users {
+						parts := strings.SplitN(u, ":", 2)
+						if len(parts) != 2 {
+							return fmt.Errorf("invalid Subsonic user %q", u)
+						}
+						subsonic[parts[0]] = parts[1]
+					}
+					opts = append(opts, server.WithSubsonicUsers(subsonic))
+				}
+				if c.Bool("transcode") || len(c.StringSlice("transcode-command")) > 0 {
+					commands, err := transcodeCommands(c.StringSlice("transcode-command"))
+					if err != nil {
+						return err
+					}
+					opts = append(opts, server.WithTranscoder(services.CommandTranscoder{
+						Commands:  commands,
+						Directory: c.String("transcode-cache"),
+					}))
+				}
+				server := server.NewServer(collection, sh, "templates", opts...)
+				// Only headers and idle connections have deadlines. Uploads,
+				// streams and job events may take as long as they take, and
+				// stop when their client goes away.
 				srv := &http.Server{
-					Handler:      server,
-					Addr:         c.String("address"),
-					WriteTimeout: 15 * time.Second,
-					ReadTimeout:  15 * time.Second,
+					Handler:           server,
+					Addr:              c.String("address"),
+					ReadHeaderTimeout: 15 * time.Second,
+					IdleTimeout:       2 * time.Minute,
 				}
 				log.Fatal(srv.ListenAndServe())
 				return nil
@@ -61,3 +530,132 @@ func main() {
 		fmt.Println(err)
 	}
 }
+
+// database is the SQLite database. The server's requests, watcher, jobs and
+// forwarder write to it at once, so writers wait for each other for a while
+// rather than fail, transactions take the write lock when they begin, and
+// the write-ahead log lets reads go on during writes.
+const database = "test.db?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+
+// openDatabase opens the database.
+func openDatabase() (*gorm.DB, error) {
+	return gorm.Open("sqlite3", database)
+}
+
+// openCollection opens the database, migrating it to the current schema.
+func openCollection() (models.Collection, *gorm.DB, error) {
+	db, err := openDatabase()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := store.Migrate(db); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return store.NewDbCollection(db), db, nil
+}
+
+// signingKeyFile keeps the key that signs the stream URLs of playlist
+// exports, so that they keep playing when the server restarts.
+const signingKeyFile = "signing.key"
+
+// signingKey reads the signing key, or makes one the first time.
+func signingKey() ([]byte, error) {
+	key, err := ioutil.ReadFile(signingKeyFile)
+	if err == nil && len(key) > 0 {
+		return key, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(signingKeyFile, key, 0600)
+}
+
+// readPassword reads a password from the terminal, twice to confirm it, or
+// the first line of standard input if it is not a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Print("Password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("Repeat password: ")
+	again, err := terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if string(again) != string(password) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(password), nil
+}
+
+// importPlaylist imports the playlist file at path for the user with
+// userID and prints the entries that matched no track.
+func importPlaylist(im importer.Importer, path, name string, userID int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pf, err := importer.ParsePlaylist(f, path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if name != "" {
+		pf.Name = name
+	}
+	report, err := im.ImportPlaylist(pf, userID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: playlist %d, %d matched, %d unmatched\n", report.Playlist.Name,
+		report.Playlist.ID, len(report.Matches)-report.Unmatched, report.Unmatched)
+	for _, m := range report.Matches {
+		if m.TrackID == 0 {
+			fmt.Printf("  unmatched: %s\n", m.Item.Location)
+		}
+	}
+	return nil
+}
+
+// transcodeCommands returns the default transcode commands with those given
+// as format:command added. Commands for formats without a default output
+// the mimetype of the format's file extension at 192 kbps by default.
+func transcodeCommands(specs []string) (map[string]services.TranscodeCommand, error) {
+	commands := make(map[string]services.TranscodeCommand)
+	for f, cmd := range services.DefaultTranscodeCommands {
+		commands[f] = cmd
+	}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || len(strings.Fields(parts[1])) == 0 {
+			return nil, fmt.Errorf("invalid transcode command %q", spec)
+		}
+		format := strings.ToLower(parts[0])
+		cmd, ok := commands[format]
+		if !ok {
+			cmd.Mimetype = mime.TypeByExtension("." + format)
+			if cmd.Mimetype == "" {
+				cmd.Mimetype = "application/octet-stream"
+			}
+			cmd.DefaultBitRate = 192
+		}
+		cmd.Args = strings.Fields(parts[1])
+		commands[format] = cmd
+	}
+	return commands, nil
+}
@@ -0,0 +1,162 @@
+package importer
+
+import (
+	"archive/zip"
+	"fmt"
+	"github.com/dhowden/tag"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// archiveTrack is an audio file of a release archive whose stream has been
+// stored.
+type archiveTrack struct {
+	file   int // index of the file in the archive
+	meta   tag.Metadata
+	stream models.Stream
+}
+
+// ImportArchive creates a release from the files of a zip archive. Either
+// every audio file is imported or, if any fails, none is and whatever was
+// stored is removed again. Files that hold no audio are skipped. What became
+// of each file is returned in archive order, and passed to progress, if it
+// is not nil, as each is done. Archives that unpack to more than
+// MaxArchiveFileSize or MaxArchiveSize fail.
+//
+// The audio files are stored first, so that the release is created from
+// their tags in a transaction that is only open for a short while.
+func (im Importer) ImportArchive(files []*zip.File, progress func(models.ImportedFile)) (models.Release, []models.ImportedFile, error) {
+	var rel models.Release
+	results := make([]models.ImportedFile, len(files))
+	staged := services.NewStagedStreams(im.streamhdlr)
+	stage := Importer{collection: im.collection, streamhdlr: staged}
+	var u unpacked
+	done := func(i int, result string, err error) error {
+		results[i].Name = files[i].Name
+		results[i].Result = result
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+		if progress != nil {
+			progress(results[i])
+		}
+		return err
+	}
+
+	var tracks []archiveTrack
+	err := func() error {
+		// A cover image in the archive takes the place of embedded
+		// pictures, so it is stored first.
+		for i, f := range files {
+			if !IsCoverFile(f.Name) || rel.Cover != "" {
+				continue
+			}
+			if err := stage.archiveCover(&rel, f, &u); err != nil {
+				return done(i, models.FileFailed, err)
+			}
+			done(i, models.FileCover, nil)
+		}
+		for i, f := range files {
+			if results[i].Result != "" || f.FileInfo().IsDir() {
+				continue
+			}
+			if kind := SideFileKind(f.Name); kind != "" {
+				results[i].Kind = kind
+				done(i, models.FileSkipped, nil)
+				continue
+			}
+			t, err := stage.archiveStream(f, &u)
+			if services.IsUnsupported(err) {
+				results[i].Kind = "unsupported"
+				done(i, models.FileSkipped, err)
+				continue
+			} else if err != nil {
+				return done(i, models.FileFailed, err)
+			}
+			t.file = i
+			tracks = append(tracks, t)
+			done(i, models.FileTrack, nil)
+		}
+		if len(tracks) == 0 {
+			return services.UnsupportedError{Err: fmt.Errorf("no audio files in archive")}
+		}
+		return im.collection.Transaction(func(c models.Collection) error {
+			tx := Importer{collection: c, streamhdlr: staged}
+			for _, at := range tracks {
+				var t models.Track
+				if err := tx.Release(&rel, at.meta); err != nil {
+					return err
+				}
+				if err := tx.Track(&t, at.meta); err != nil {
+					return err
+				}
+				t.AddStream(at.stream)
+				rel.AddTrack(t)
+			}
+			return c.CreateRelease(&rel)
+		})
+	}()
+
+	if err == nil {
+		for i, at := range tracks {
+			results[at.file].TrackID = rel.Tracks[i].ID
+		}
+	}
+	var reported []models.ImportedFile
+	for _, res := range results {
+		if res.Result != "" {
+			reported = append(reported, res)
+		}
+	}
+	if err != nil {
+		if rerr := staged.Rollback(); rerr != nil {
+			log.Printf("import archive: %v", rerr)
+		}
+		return rel, reported, err
+	}
+	// Only files replaced by the import are left to delete, which need not
+	// fail it.
+	if err := staged.Commit(); err != nil {
+		log.Printf("import archive: %v", err)
+	}
+	return rel, reported, nil
+}
+
+// archiveCover stores an image from a release archive as the cover of rel.
+func (im Importer) archiveCover(rel *models.Release, f *zip.File, u *unpacked) error {
+	img, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	return im.Cover(rel, u.reader(f.Name, img))
+}
+
+// archiveStream reads the tags of an audio file from a release archive and
+// stores its stream.
+func (im Importer) archiveStream(f *zip.File, u *unpacked) (archiveTrack, error) {
+	var t archiveTrack
+	rdr, err := f.Open()
+	if err != nil {
+		return t, err
+	}
+	defer rdr.Close()
+	tmp, err := ioutil.TempFile("", "blueshift-")
+	if err != nil {
+		return t, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, u.reader(f.Name, rdr)); err != nil {
+		return t, err
+	}
+	if t.meta, err = services.FileMetadata(tmp); err != nil {
+		return t, err
+	}
+	err = im.Stream(&t.stream, t.meta, tmp)
+	return t, err
+}
@@ -0,0 +1,249 @@
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dhowden/tag"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Importer fills in collection entries from the tags of audio files. Artists
+// named in the tags are created in the collection as they are found, but the
+// releases, tracks and streams it fills in are left for the caller to save.
+type Importer struct {
+	collection models.Collection
+	streamhdlr services.StreamHandler
+}
+
+func NewImporter(c models.Collection, sh services.StreamHandler) Importer {
+	return Importer{collection: c, streamhdlr: sh}
+}
+
+// Track sets the fields and artist credit of t from m, replacing any
+// existing credit.
+func (im Importer) Track(t *models.Track, m tag.Metadata) error {
+	raw := m.Raw()
+	p, _ := m.Track()
+	d, _ := m.Disc()
+	t.Title = m.Title()
+	t.Position = p
+	t.Disc = d
+	t.MBID = rawString(raw, "musicbrainz_trackid")
+	t.Artists = nil
+	for _, c := range splitCredit(m.Artist(), rawString(raw, "musicbrainz_artistid")) {
+		a, err := im.Artist(c.Name, c.MBID)
+		if err != nil {
+			return err
+		}
+		t.AddCredit(a, c.JoinPhrase)
+	}
+	return nil
+}
+
+// Stream stores the data in f with the stream handler and sets the path,
+// format and audio properties of strm.
+func (im Importer) Stream(strm *models.Stream, m tag.Metadata, f io.ReadSeeker) error {
+	format, err := im.Format(m)
+	if err != nil {
+		return err
+	}
+	if err := im.Properties(strm, m, f); err != nil {
+		return err
+	}
+	path, err := im.streamhdlr.Store(f)
+	if err != nil {
+		return err
+	}
+	strm.Path = path
+	strm.Format = format
+	return nil
+}
+
+// Properties sets the duration, bitrate and other audio properties of strm
+// from the headers of f, and leaves f at its start. Properties that cannot be
+// read are left unknown rather than failing the import, since the file's tags
+// could be read.
+func (im Importer) Properties(strm *models.Stream, m tag.Metadata, f io.ReadSeeker) error {
+	info, err := services.ReadAudioInfo(f, m.FileType())
+	if err != nil && !services.IsUnsupported(err) {
+		return err
+	}
+	strm.Duration = info.Duration
+	strm.Bitrate = info.Bitrate
+	strm.SampleRate = info.SampleRate
+	strm.BitDepth = info.BitDepth
+	strm.Channels = info.Channels
+	strm.Size = info.Size
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Format returns the stored format of a file. Formats that are not in the
+// collection are reported as unsupported.
+func (im Importer) Format(m tag.Metadata) (models.Format, error) {
+	format, err := im.collection.GetFormat(string(m.FileType()))
+	if models.IsNotFound(err) {
+		return format, services.UnsupportedError{Err: err}
+	}
+	return format, err
+}
+
+// Release sets the fields of r from m. The artist credit and cover are only
+// set if r does not have them yet.
+func (im Importer) Release(r *models.Release, m tag.Metadata) error {
+	raw := m.Raw()
+	r.Title = m.Album()
+	r.MBID = rawString(raw, "musicbrainz_albumid")
+	r.Year, _ = strconv.Atoi(rawString(raw, "originalyear"))
+	if pic := m.Picture(); pic != nil && len(pic.Data) > 0 && r.Cover == "" {
+		if err := im.Cover(r, bytes.NewReader(pic.Data)); err != nil {
+			return err
+		}
+	}
+	if len(r.Artists) > 0 {
+		return nil
+	}
+	name, mbid := m.AlbumArtist(), rawString(raw, "musicbrainz_albumartistid")
+	if name == "" {
+		name, mbid = m.Artist(), rawString(raw, "musicbrainz_artistid")
+	}
+	for _, c := range splitCredit(name, mbid) {
+		a, err := im.Artist(c.Name, c.MBID)
+		if err != nil {
+			return err
+		}
+		r.AddCredit(a, c.JoinPhrase)
+	}
+	return nil
+}
+
+// Cover stores the image read from f as the cover of r. A cover r already
+// had is removed from storage.
+func (im Importer) Cover(r *models.Release, f io.Reader) error {
+	path, err := im.streamhdlr.Store(f)
+	if err != nil {
+		return err
+	}
+	if r.Cover != "" {
+		im.streamhdlr.Delete(r.Cover)
+	}
+	r.Cover = path
+	return nil
+}
+
+// coverFile matches the names of image files that hold a release's cover.
+var coverFile = regexp.MustCompile(`(?i)^(cover|folder|front)\.(jpe?g|png)$`)
+
+// IsCoverFile reports whether a file named name that comes with a release is
+// its cover image.
+func IsCoverFile(name string) bool {
+	return coverFile.MatchString(filepath.Base(name))
+}
+
+// sideFiles maps the extensions of files that come with releases but hold no
+// audio to their kind.
+var sideFiles = map[string]string{
+	".cue": "cue", ".log": "log", ".accurip": "log",
+	".jpg": "image", ".jpeg": "image", ".png": "image", ".gif": "image", ".bmp": "image",
+	".txt": "text", ".nfo": "text", ".pdf": "text", ".md": "text",
+	".m3u": "playlist", ".m3u8": "playlist", ".pls": "playlist", ".xspf": "playlist",
+	".md5": "checksum", ".sfv": "checksum", ".ffp": "checksum", ".sha1": "checksum",
+}
+
+// SideFileKind returns the kind of a file named name that comes with a
+// release but is not audio, such as "cue" or "log", or the empty string if
+// the file may be audio. Hidden files, such as the resource forks in
+// archives made on macOS, are of kind "hidden".
+func SideFileKind(name string) string {
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") || strings.HasPrefix(name, "__MACOSX/") {
+		return "hidden"
+	}
+	return sideFiles[strings.ToLower(filepath.Ext(base))]
+}
+
+// Artist returns the stored artist with the given name, creating it if it
+// does not yet exist.
+func (im Importer) Artist(name string, mbid string) (models.Artist, error) {
+	a, err := im.collection.GetArtistByName(name)
+	if models.IsNotFound(err) {
+		a = models.Artist{Name: name, MBID: mbid}
+		err = im.collection.CreateArtist(&a)
+	} else if err == nil && a.MBID == "" && mbid != "" {
+		a.MBID = mbid
+		err = im.collection.SaveArtist(a)
+	}
+	return a, err
+}
+
+// discDir matches directory names such as "CD1" or "Disc 2" that hold one
+// disc of a multi-disc release.
+var discDir = regexp.MustCompile(`(?i)^(cd|dis[ck])\s*\d+$`)
+
+// ReleaseKey returns the key that files are grouped into releases by. Files
+// with a MusicBrainz release ID are grouped by it. Other files are grouped by
+// album and album artist within the directory dir that holds them, where
+// per-disc subdirectories count as their parent.
+func ReleaseKey(m tag.Metadata, dir string) string {
+	if mbid := rawString(m.Raw(), "musicbrainz_albumid"); mbid != "" {
+		return "mbid:" + mbid
+	}
+	if discDir.MatchString(filepath.Base(dir)) {
+		dir = filepath.Dir(dir)
+	}
+	return strings.Join([]string{"dir:" + dir, m.Album(), m.AlbumArtist()}, "\x00")
+}
+
+// credit is one artist parsed from an artist tag.
+type credit struct {
+	Name       string
+	MBID       string
+	JoinPhrase string
+}
+
+// featuring lists the join phrases that splitCredit separates artists on.
+// Phrases such as " & " are left alone since they are commonly part of an
+// artist's name.
+var featuring = []string{" feat. ", " ft. ", " featuring ", " Feat. ", " Ft. ", " Featuring "}
+
+// splitCredit splits an artist tag such as "A feat. B" into its credited
+// artists. The MusicBrainz ID is only kept when the tag names one artist.
+func splitCredit(tag string, mbid string) []credit {
+	var credits []credit
+	for tag != "" {
+		idx, phrase := -1, ""
+		for _, f := range featuring {
+			if i := strings.Index(tag, f); i >= 0 && (idx < 0 || i < idx) {
+				idx, phrase = i, f
+			}
+		}
+		if idx < 0 {
+			credits = append(credits, credit{Name: tag})
+			break
+		}
+		credits = append(credits, credit{Name: tag[:idx], JoinPhrase: phrase})
+		tag = tag[idx+len(phrase):]
+	}
+	if len(credits) == 1 {
+		credits[0].MBID = mbid
+	}
+	return credits
+}
+
+// rawString returns the raw tag value for key as a string, or the empty
+// string if the tag is not present.
+func rawString(raw map[string]interface{}, key string) string {
+	v, ok := raw[key]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
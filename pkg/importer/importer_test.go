@@ -0,0 +1,135 @@
+package importer
+
+import (
+	"github.com/dhowden/tag"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// pictureMetadata replaces the picture of the wrapped metadata.
+type pictureMetadata struct {
+	tag.Metadata
+	picture *tag.Picture
+}
+
+func (m pictureMetadata) Picture() *tag.Picture {
+	return m.picture
+}
+
+func TestImporter(t *testing.T) {
+	Convey("Test Importer", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		tmp, err := ioutil.TempDir("", "blueshift-")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		im := NewImporter(coll, services.FileStreamHandler{Directory: tmp})
+
+		f, err := os.Open("../testdata/papageno.ogg")
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		meta, err := services.FileMetadata(f)
+		if err != nil {
+			panic(err)
+		}
+
+		Convey("should fill in track", func() {
+			var trk models.Track
+			So(im.Track(&trk, meta), ShouldBeNil)
+			So(trk.Title, ShouldEqual, "Der Vogelfänger bin ich ja")
+			So(trk.Position, ShouldEqual, 2)
+			So(trk.Disc, ShouldEqual, 1)
+			So(trk.MBID, ShouldEqual, "")
+			So(trk.ArtistCredit(), ShouldEqual, "Wolfgang Amadeus Mozart")
+		})
+
+		Convey("should fill in release", func() {
+			var rel models.Release
+			So(im.Release(&rel, meta), ShouldBeNil)
+			So(rel.Title, ShouldEqual, "Die Zauberflöte")
+			So(rel.Year, ShouldEqual, 1791)
+			So(rel.MBID, ShouldEqual, "7a2d5b8e-1c43-4b9c-9d61-3f0e8a6c2b10")
+			So(len(rel.Artists), ShouldEqual, 1)
+		})
+
+		Convey("should store embedded picture as cover", func() {
+			var rel models.Release
+			pic := &tag.Picture{MIMEType: "image/jpeg", Data: []byte("jpeg")}
+			So(im.Release(&rel, pictureMetadata{meta, pic}), ShouldBeNil)
+			data, err := ioutil.ReadFile(rel.Cover)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "jpeg")
+			cover := rel.Cover
+			So(im.Release(&rel, pictureMetadata{meta, &tag.Picture{Data: []byte("other")}}), ShouldBeNil)
+			So(rel.Cover, ShouldEqual, cover)
+		})
+
+		Convey("should recognise cover files", func() {
+			So(IsCoverFile("Album/Folder.jpg"), ShouldBeTrue)
+			So(IsCoverFile("cover.png"), ShouldBeTrue)
+			So(IsCoverFile("back.jpg"), ShouldBeFalse)
+		})
+
+		Convey("should classify files that hold no audio", func() {
+			So(SideFileKind("Album/Album.CUE"), ShouldEqual, "cue")
+			So(SideFileKind("Album/rip.log"), ShouldEqual, "log")
+			So(SideFileKind("Album/back.jpg"), ShouldEqual, "image")
+			So(SideFileKind("Album/._01.flac"), ShouldEqual, "hidden")
+			So(SideFileKind("__MACOSX/Album/01.flac"), ShouldEqual, "hidden")
+			So(SideFileKind("Album/01.flac"), ShouldEqual, "")
+		})
+
+		Convey("should store stream", func() {
+			var strm models.Stream
+			So(im.Stream(&strm, meta, f), ShouldBeNil)
+			So(strm.Format.Name, ShouldEqual, "OGG")
+			So(strm.SampleRate, ShouldEqual, 44100)
+			So(strm.Channels, ShouldEqual, 2)
+			So(strm.Size, ShouldEqual, 22679)
+			So(strm.Duration, ShouldAlmostEqual, 3398*time.Millisecond, time.Millisecond)
+			info, err := os.Stat(strm.Path)
+			So(err, ShouldBeNil)
+			So(info.Size(), ShouldEqual, 22679)
+		})
+
+		Convey("should reuse existing artist", func() {
+			a, err := im.Artist("Artist 1", "")
+			So(err, ShouldBeNil)
+			b, err := im.Artist("Artist 1", "mbid")
+			So(err, ShouldBeNil)
+			So(b.ID, ShouldEqual, a.ID)
+			So(b.MBID, ShouldEqual, "mbid")
+		})
+
+		Convey("should group disc directories by MusicBrainz ID", func() {
+			So(ReleaseKey(meta, "/music/a/CD1"), ShouldEqual, ReleaseKey(meta, "/music/b"))
+		})
+
+		Convey("should split featured artists", func() {
+			credits := splitCredit("A feat. B ft. C", "mbid")
+			So(len(credits), ShouldEqual, 3)
+			So(credits[0], ShouldResemble, credit{Name: "A", JoinPhrase: " feat. "})
+			So(credits[2], ShouldResemble, credit{Name: "C"})
+			credits = splitCredit("Simon & Garfunkel", "mbid")
+			So(credits, ShouldResemble, []credit{{Name: "Simon & Garfunkel", MBID: "mbid"}})
+		})
+	})
+}
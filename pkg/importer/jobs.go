@@ -0,0 +1,302 @@
+package importer
+
+import (
+	"archive/zip"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Jobs imports uploaded release archives in the background with a pool of
+// workers. Archives are spooled to Directory and their jobs queued in the
+// collection, so that jobs left unfinished by a restart are run again.
+// What a job stores is recorded with it, so that a restart can also remove
+// what an unfinished job left behind.
+type Jobs struct {
+	collection models.Collection
+	streams    services.StreamHandler
+	Directory  string
+
+	// Workers is the number of jobs run at the same time, and Interval how
+	// often the queue is checked for jobs queued by other processes.
+	Workers  int
+	Interval time.Duration
+
+	wake     chan struct{}
+	mu       sync.Mutex
+	running  map[int64]models.Job
+	watchers map[int64][]chan models.Job
+}
+
+func NewJobs(c models.Collection, sh services.StreamHandler, dir string) *Jobs {
+	return &Jobs{
+		collection: c,
+		streams:    sh,
+		Directory:  dir,
+		Workers:    2,
+		Interval:   time.Minute,
+		wake:       make(chan struct{}, 1),
+		running:    make(map[int64]models.Job),
+		watchers:   make(map[int64][]chan models.Job),
+	}
+}
+
+// Enqueue spools the release archive read from r and queues a job to import
+// it for a user. Archives are spooled as zip archives, see SpoolArchive, and
+// data that is not an archive is refused with an UnsupportedError.
+func (j *Jobs) Enqueue(userID int64, r io.Reader) (models.Job, error) {
+	job := models.Job{UserID: userID}
+	if err := os.MkdirAll(j.Directory, 0755); err != nil {
+		return job, err
+	}
+	f, err := ioutil.TempFile(j.Directory, "upload-")
+	if err != nil {
+		return job, err
+	}
+	err = SpoolArchive(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		job.Archive, err = filepath.Abs(f.Name())
+	}
+	if err == nil {
+		job.Total, err = countFiles(f.Name())
+	}
+	if err == nil {
+		err = j.collection.CreateJob(&job)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return job, err
+	}
+	j.poke()
+	return job, nil
+}
+
+// countFiles returns the number of files in a zip archive.
+func countFiles(path string) (int, error) {
+	arxv, err := zip.OpenReader(path)
+	if err != nil {
+		return 0, services.UnsupportedError{Err: err}
+	}
+	defer arxv.Close()
+	n := 0
+	for _, f := range arxv.File {
+		if !f.FileInfo().IsDir() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Job returns a job, with the files imported so far if it is running.
+func (j *Jobs) Job(id int64) (models.Job, error) {
+	j.mu.Lock()
+	job, ok := j.running[id]
+	j.mu.Unlock()
+	if ok {
+		return job, nil
+	}
+	return j.collection.GetJob(id)
+}
+
+// Watch returns a channel that receives a job whenever it changes, until
+// the returned function is called. Receivers that fall behind only get the
+// latest change.
+func (j *Jobs) Watch(id int64) (<-chan models.Job, func()) {
+	ch := make(chan models.Job, 1)
+	j.mu.Lock()
+	j.watchers[id] = append(j.watchers[id], ch)
+	j.mu.Unlock()
+	return ch, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		watchers := j.watchers[id]
+		for i, w := range watchers {
+			if w == ch {
+				j.watchers[id] = append(watchers[:i:i], watchers[i+1:]...)
+			}
+		}
+		if len(j.watchers[id]) == 0 {
+			delete(j.watchers, id)
+		}
+	}
+}
+
+// Run runs queued jobs with the workers until stop is closed. Jobs left
+// running, by a restart, are queued again first, once the files they stored
+// have been swept.
+func (j *Jobs) Run(stop <-chan struct{}) {
+	if err := j.sweep(); err != nil {
+		log.Printf("jobs: %v", err)
+	}
+	if err := j.collection.RequeueJobs(); err != nil {
+		log.Printf("jobs: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < j.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j.work(stop)
+		}()
+	}
+	wg.Wait()
+}
+
+// sweep removes the files stored by jobs left running that no stream or
+// cover uses. The imports that stored them did not finish, so they would
+// otherwise stay in storage for good.
+func (j *Jobs) sweep() error {
+	jobs, err := j.collection.RunningJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		paths := job.StagedPaths()
+		if len(paths) == 0 {
+			continue
+		}
+		used, err := j.collection.UsedPaths(paths)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			if used[p] {
+				continue
+			}
+			if err := j.streams.Delete(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		job.Staged = ""
+		if err := j.collection.SaveJob(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// work runs jobs one at a time as they are queued.
+func (j *Jobs) work(stop <-chan struct{}) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		job, err := j.collection.ClaimJob()
+		if err == nil {
+			// Other workers may find more jobs.
+			j.poke()
+			j.run(job)
+			continue
+		}
+		if !models.IsNotFound(err) {
+			log.Printf("jobs: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-j.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// poke wakes a waiting worker.
+func (j *Jobs) poke() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run imports the archive of a job and removes it.
+func (j *Jobs) run(job models.Job) {
+	job.SetFiles(nil)
+	job.Staged = ""
+	job.Error = ""
+	j.update(job)
+
+	var done []models.ImportedFile
+	streams := jobStreams{j.streams, func(path string) error {
+		job.AddStaged(path)
+		return j.collection.SaveJob(job)
+	}}
+	im := NewImporter(j.collection, streams)
+	rel, files, err := j.importArchive(im, job.Archive, func(f models.ImportedFile) {
+		done = append(done, f)
+		job.SetFiles(done)
+		j.update(job)
+	})
+	job.SetFiles(files)
+	// Whatever the import stored is now either used or removed.
+	job.Staged = ""
+	if err != nil {
+		job.Status = models.JobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = models.JobDone
+		job.ReleaseID = rel.ID
+	}
+	if err := j.collection.SaveJob(job); err != nil {
+		log.Printf("jobs: %v", err)
+	}
+	if err := os.Remove(job.Archive); err != nil && !os.IsNotExist(err) {
+		log.Printf("jobs: %v", err)
+	}
+	j.update(job)
+}
+
+func (j *Jobs) importArchive(im Importer, path string, progress func(models.ImportedFile)) (models.Release, []models.ImportedFile, error) {
+	arxv, err := zip.OpenReader(path)
+	if err != nil {
+		return models.Release{}, nil, err
+	}
+	defer arxv.Close()
+	return im.ImportArchive(arxv.File, progress)
+}
+
+// jobStreams is the StreamHandler of a running job. It records each path it
+// stores with stored before the import goes on, and removes what it could
+// not record.
+type jobStreams struct {
+	services.StreamHandler
+	stored func(path string) error
+}
+
+func (js jobStreams) Store(d io.Reader) (string, error) {
+	p, err := js.StreamHandler.Store(d)
+	if err != nil {
+		return p, err
+	}
+	if err := js.stored(p); err != nil {
+		js.StreamHandler.Delete(p)
+		return "", err
+	}
+	return p, nil
+}
+
+// update records the progress of a running job and passes it on to its
+// watchers.
+func (j *Jobs) update(job models.Job) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if job.Finished() {
+		delete(j.running, job.ID)
+	} else {
+		j.running[job.ID] = job
+	}
+	for _, ch := range j.watchers[job.ID] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- job
+	}
+}
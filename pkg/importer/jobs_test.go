@@ -0,0 +1,194 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// releaseArchive returns a zip archive of the test audio files and a cue
+// sheet.
+func releaseArchive() *bytes.Buffer {
+	var buf bytes.Buffer
+	arxv := zip.NewWriter(&buf)
+	for _, name := range []string{"magic_flute.ogg", "papageno.ogg"} {
+		audio, _ := ioutil.ReadFile("../testdata/" + name)
+		f, _ := arxv.Create("Album/" + name)
+		f.Write(audio)
+	}
+	f, _ := arxv.Create("Album/Album.cue")
+	f.Write([]byte("FILE \"papageno.ogg\" WAVE\n"))
+	arxv.Close()
+	return &buf
+}
+
+// recordJobs is a collection that keeps the paths staged by the jobs it
+// saves.
+type recordJobs struct {
+	models.Collection
+	staged *[]string
+}
+
+func (c recordJobs) SaveJob(job models.Job) error {
+	if paths := job.StagedPaths(); len(paths) > 0 {
+		*c.staged = paths
+	}
+	return c.Collection.SaveJob(job)
+}
+
+func TestJobs(t *testing.T) {
+	Convey("Test Jobs", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		// Every connection to an in-memory database has a database of its
+		// own.
+		db.DB().SetMaxOpenConns(1)
+		tmp, err := ioutil.TempDir("", "blueshift-")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		spool := filepath.Join(tmp, "spool")
+		jobs := NewJobs(coll, services.FileStreamHandler{Directory: tmp}, spool)
+		stop := make(chan struct{})
+		wait := func(id int64) models.Job {
+			ch, cancel := jobs.Watch(id)
+			defer cancel()
+			job, _ := jobs.Job(id)
+			for !job.Finished() {
+				select {
+				case job = <-ch:
+				case <-time.After(5 * time.Second):
+					panic("job did not finish")
+				}
+			}
+			return job
+		}
+
+		Convey("should import spooled archive", func() {
+			job, err := jobs.Enqueue(1, releaseArchive())
+			So(err, ShouldBeNil)
+			So(job.Status, ShouldEqual, models.JobQueued)
+			So(job.Total, ShouldEqual, 3)
+			go jobs.Run(stop)
+			defer close(stop)
+
+			job = wait(job.ID)
+			So(job.Status, ShouldEqual, models.JobDone)
+			So(job.Error, ShouldBeEmpty)
+			rel, err := coll.GetRelease(job.ReleaseID)
+			So(err, ShouldBeNil)
+			So(len(rel.Tracks), ShouldEqual, 2)
+			files := job.Files()
+			So(len(files), ShouldEqual, 3)
+			So(files[0].Result, ShouldEqual, models.FileTrack)
+			So(files[2].Kind, ShouldEqual, "cue")
+			_, err = os.Stat(job.Archive)
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			stored, err := coll.GetJob(job.ID)
+			So(err, ShouldBeNil)
+			So(stored.ReleaseID, ShouldEqual, job.ReleaseID)
+		})
+
+		Convey("should fail archives that unpack to too much", func() {
+			defer func(max int64) { MaxArchiveSize = max }(MaxArchiveSize)
+			MaxArchiveSize = 1000
+			job, err := jobs.Enqueue(1, releaseArchive())
+			So(err, ShouldBeNil)
+			go jobs.Run(stop)
+			defer close(stop)
+
+			job = wait(job.ID)
+			So(job.Status, ShouldEqual, models.JobFailed)
+			So(job.Error, ShouldContainSubstring, "archive unpacks to more than 1000 bytes")
+			stored, _ := ioutil.ReadDir(tmp)
+			So(len(stored), ShouldEqual, 1) // the spool directory
+		})
+
+		Convey("should refuse data that is not a zip archive", func() {
+			_, err := jobs.Enqueue(1, strings.NewReader("not a zip"))
+			So(services.IsUnsupported(err), ShouldBeTrue)
+			spooled, _ := ioutil.ReadDir(spool)
+			So(spooled, ShouldBeEmpty)
+		})
+
+		Convey("should run jobs left running again", func() {
+			job, _ := jobs.Enqueue(1, releaseArchive())
+			job.Status = models.JobRunning
+			coll.SaveJob(job)
+			go jobs.Run(stop)
+			defer close(stop)
+
+			job = wait(job.ID)
+			So(job.Status, ShouldEqual, models.JobDone)
+		})
+
+		Convey("should remove files left by jobs left running", func() {
+			sh := services.FileStreamHandler{Directory: tmp}
+			orphan, _ := sh.Store(strings.NewReader("orphan"))
+			cover, _ := sh.Store(strings.NewReader("cover"))
+			coll.CreateRelease(&models.Release{Title: "Release 1", Cover: cover})
+			job, _ := jobs.Enqueue(1, releaseArchive())
+			job.Status = models.JobRunning
+			job.AddStaged(orphan)
+			job.AddStaged(cover)
+			coll.SaveJob(job)
+			go jobs.Run(stop)
+			defer close(stop)
+
+			job = wait(job.ID)
+			So(job.Status, ShouldEqual, models.JobDone)
+			_, err := os.Stat(orphan)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(cover)
+			So(err, ShouldBeNil)
+			job, _ = coll.GetJob(job.ID)
+			So(job.Staged, ShouldEqual, "")
+		})
+
+		Convey("should record what a job stores until it finishes", func() {
+			job, _ := jobs.Enqueue(1, releaseArchive())
+			var staged []string
+			jobs.collection = recordJobs{coll, &staged}
+			go jobs.Run(stop)
+			defer close(stop)
+
+			job = wait(job.ID)
+			So(job.Status, ShouldEqual, models.JobDone)
+			So(len(staged), ShouldEqual, 2)
+			rel, _ := coll.GetRelease(job.ReleaseID)
+			So(staged, ShouldContain, rel.Tracks[0].Streams[0].Path)
+			job, _ = coll.GetJob(job.ID)
+			So(job.Staged, ShouldEqual, "")
+		})
+
+		Convey("should fail job without archive", func() {
+			job := models.Job{Archive: filepath.Join(spool, "missing")}
+			coll.CreateJob(&job)
+			go jobs.Run(stop)
+			defer close(stop)
+
+			job = wait(job.ID)
+			So(job.Status, ShouldEqual, models.JobFailed)
+			So(job.Error, ShouldNotBeEmpty)
+		})
+	})
+}
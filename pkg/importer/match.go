@@ -0,0 +1,278 @@
+package importer
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Ways a playlist item is matched to a track.
+const (
+	MatchedByURL   = "url"   // a stream URL of this server
+	MatchedByPath  = "path"  // the path of the file a track was scanned from
+	MatchedByMBID  = "mbid"  // the MusicBrainz recording ID
+	MatchedByTitle = "title" // the artist, title and duration
+)
+
+// PlaylistMatch is the track matched to a playlist item. TrackID is zero and
+// By is empty if no track matched.
+type PlaylistMatch struct {
+	Item    PlaylistItem
+	TrackID int64
+	By      string
+}
+
+// PlaylistReport reports how the items of an imported playlist file were
+// matched. Unmatched items are left out of the playlist.
+type PlaylistReport struct {
+	Playlist  models.Playlist
+	Matches   []PlaylistMatch
+	Unmatched int
+}
+
+// ImportPlaylist creates a playlist of the tracks matching the items of pf.
+// Items are matched by stream URL, then by the path they were scanned from,
+// then by MusicBrainz ID, and last by artist, title and duration. The
+// playlist belongs to the user with userID, or to nobody if it is zero.
+func (im Importer) ImportPlaylist(pf PlaylistFile, userID int64) (PlaylistReport, error) {
+	report := PlaylistReport{Playlist: models.Playlist{Name: pf.Name, UserID: userID}}
+	for _, item := range pf.Items {
+		m, err := im.MatchPlaylistItem(item)
+		if err != nil {
+			return report, err
+		}
+		report.Matches = append(report.Matches, m)
+		if m.TrackID == 0 {
+			report.Unmatched++
+			continue
+		}
+		report.Playlist.AddTrack(models.Track{ID: m.TrackID})
+	}
+	if err := im.collection.CreatePlaylist(&report.Playlist); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// streamURL matches the paths of stream URLs of this server.
+var streamURL = regexp.MustCompile(`^/tracks/(\d+)/stream$`)
+
+// MatchPlaylistItem finds the track of a playlist item.
+func (im Importer) MatchPlaylistItem(item PlaylistItem) (PlaylistMatch, error) {
+	c := im.collection
+	m := PlaylistMatch{Item: item}
+	if u, err := url.Parse(item.Location); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		if sm := streamURL.FindStringSubmatch(u.Path); sm != nil {
+			id, _ := strconv.ParseInt(sm[1], 10, 64)
+			if _, err := c.GetTrack(id); err == nil {
+				m.TrackID, m.By = id, MatchedByURL
+				return m, nil
+			} else if !models.IsNotFound(err) {
+				return m, err
+			}
+		}
+	}
+
+	if p := locationPath(item.Location); p != "" {
+		id, err := im.matchPath(p)
+		if err != nil {
+			return m, err
+		}
+		if id != 0 {
+			m.TrackID, m.By = id, MatchedByPath
+			return m, nil
+		}
+	}
+
+	if item.MBID != "" {
+		t, err := c.GetTrackByMBID(item.MBID)
+		if err == nil {
+			m.TrackID, m.By = t.ID, MatchedByMBID
+			return m, nil
+		} else if !models.IsNotFound(err) {
+			return m, err
+		}
+	}
+
+	if item.Title == "" {
+		// M3U files without EXTINF lines only have the file name to go by.
+		base := filepath.Base(locationPath(item.Location))
+		item.Title = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	id, err := im.matchTitle(item)
+	if err != nil {
+		return m, err
+	}
+	if id != 0 {
+		m.TrackID, m.By = id, MatchedByTitle
+	}
+	return m, nil
+}
+
+// matchPath finds the track scanned from a file at p, which may be a path
+// on another machine. The trailing directories and file name of p are
+// matched against the scanned paths, from the last three down to the last
+// two, and the match must be unique.
+func (im Importer) matchPath(p string) (int64, error) {
+	parts := strings.FieldsFunc(p, func(r rune) bool { return r == '/' })
+	min := 2
+	if len(parts) < min {
+		min = len(parts)
+	}
+	for n := 3; n >= min && n > 0; n-- {
+		if n > len(parts) {
+			continue
+		}
+		suffix := filepath.Join(parts[len(parts)-n:]...)
+		streams, err := im.collection.GetStreamsBySourceSuffix(suffix)
+		if err != nil {
+			return 0, err
+		}
+		tracks := make(map[int64]bool)
+		for _, s := range streams {
+			tracks[s.TrackID] = true
+		}
+		if len(tracks) == 1 {
+			return streams[0].TrackID, nil
+		}
+		if len(tracks) > 1 {
+			break
+		}
+	}
+	return 0, nil
+}
+
+// Thresholds for matching by title.
+const (
+	minTitleSimilarity  = 0.85
+	minArtistSimilarity = 0.6
+	maxDurationDiff     = 5 * time.Second
+)
+
+// matchTitle finds the track most like item by title, artist and duration.
+// Tracks must have a similar title, a similar artist if the item names one,
+// and a close duration if both durations are known.
+func (im Importer) matchTitle(item PlaylistItem) (int64, error) {
+	words := strings.Fields(normalize(stripBrackets(item.Title)))
+	if len(words) == 0 {
+		return 0, nil
+	}
+	result, err := im.collection.Search(strings.Join(words, " "), 0, 50)
+	if err != nil {
+		return 0, err
+	}
+	var best int64
+	bestScore := 0.0
+	for _, t := range result.Tracks {
+		score := titleSimilarity(item.Title, t.Title)
+		if score < minTitleSimilarity {
+			continue
+		}
+		if item.Artist != "" {
+			a := artistSimilarity(item.Artist, t.ArtistCredit())
+			if a < minArtistSimilarity {
+				continue
+			}
+			score += a
+		}
+		if d := t.Duration(); item.Duration > 0 && d > 0 {
+			diff := item.Duration - d
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff > maxDurationDiff {
+				continue
+			}
+			score += 1 - float64(diff)/float64(maxDurationDiff)
+		}
+		if score > bestScore {
+			best, bestScore = t.ID, score
+		}
+	}
+	return best, nil
+}
+
+// titleSimilarity compares two titles, with and without the parts in
+// brackets, such as "(Remastered)".
+func titleSimilarity(a, b string) float64 {
+	s := similarity(normalize(a), normalize(b))
+	if t := similarity(normalize(stripBrackets(a)), normalize(stripBrackets(b))); t > s {
+		s = t
+	}
+	return s
+}
+
+// artistSimilarity compares two artist names. A name that is part of the
+// other, as "Mozart" is of "Wolfgang Amadeus Mozart", counts as just similar
+// enough.
+func artistSimilarity(a, b string) float64 {
+	a, b = normalize(a), normalize(b)
+	s := similarity(a, b)
+	if s < minArtistSimilarity && a != "" && b != "" &&
+		(strings.Contains(" "+b+" ", " "+a+" ") || strings.Contains(" "+a+" ", " "+b+" ")) {
+		s = minArtistSimilarity
+	}
+	return s
+}
+
+var brackets = regexp.MustCompile(`\s*[(\[][^)\]]*[)\]]`)
+
+func stripBrackets(s string) string {
+	if stripped := brackets.ReplaceAllString(s, ""); strings.TrimSpace(stripped) != "" {
+		return stripped
+	}
+	return s
+}
+
+// normalize lowercases s and reduces it to its words, separated by single
+// spaces.
+func normalize(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// similarity returns one less the edit distance between a and b relative to
+// the longer of them, from 0 for nothing in common to 1 for equal strings.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
+
+func minInt(n int, ns ...int) int {
+	for _, m := range ns {
+		if m < n {
+			n = m
+		}
+	}
+	return n
+}
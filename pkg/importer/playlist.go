@@ -0,0 +1,215 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// PlaylistFile is a playlist read from an M3U, M3U8, PLS or XSPF file.
+type PlaylistFile struct {
+	Name  string
+	Items []PlaylistItem
+}
+
+// PlaylistItem is an entry of a playlist file. Fields the file does not give
+// are empty.
+type PlaylistItem struct {
+	Location string // a path or URL
+	Title    string
+	Artist   string
+	Duration time.Duration
+	MBID     string // of the recording
+}
+
+// ParsePlaylist reads a playlist file. The format is recognised from the
+// content, with name, the file's name, telling M3U8 from M3U: M3U files that
+// are not valid UTF-8 are read as Latin-1. The playlist is named after the
+// file unless the file gives a name.
+func ParsePlaylist(r io.Reader, name string) (PlaylistFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return PlaylistFile{}, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	var pf PlaylistFile
+	start := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(start, []byte("<")):
+		pf, err = parseXSPF(data)
+	case bytes.HasPrefix(bytes.ToLower(start), []byte("[playlist]")):
+		pf, err = parsePLS(latin1(data, name))
+	default:
+		pf, err = parseM3U(latin1(data, name))
+	}
+	if err != nil {
+		return pf, err
+	}
+	if pf.Name == "" {
+		base := path.Base(strings.Replace(name, `\`, "/", -1))
+		pf.Name = strings.TrimSuffix(base, path.Ext(base))
+	}
+	return pf, nil
+}
+
+// latin1 returns data as UTF-8, converting it from Latin-1 if it is not
+// valid UTF-8 and does not come from a file that must be UTF-8.
+func latin1(data []byte, name string) string {
+	if utf8.Valid(data) || strings.EqualFold(path.Ext(name), ".m3u8") {
+		return string(data)
+	}
+	rs := make([]rune, len(data))
+	for i, b := range data {
+		rs[i] = rune(b)
+	}
+	return string(rs)
+}
+
+func parseM3U(data string) (PlaylistFile, error) {
+	var pf PlaylistFile
+	var item PlaylistItem
+	sc := bufio.NewScanner(strings.NewReader(data))
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// #EXTINF:<seconds>[ attributes],<artist> - <title>
+			info := strings.TrimPrefix(line, "#EXTINF:")
+			parts := strings.SplitN(info, ",", 2)
+			if secs, err := strconv.ParseFloat(strings.Fields(parts[0] + " ")[0], 64); err == nil && secs > 0 {
+				item.Duration = time.Duration(secs * float64(time.Second))
+			}
+			if len(parts) == 2 {
+				item.Artist, item.Title = splitDisplayTitle(parts[1])
+			}
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			pf.Name = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+		case strings.HasPrefix(line, "#"):
+		default:
+			item.Location = line
+			pf.Items = append(pf.Items, item)
+			item = PlaylistItem{}
+		}
+	}
+	return pf, sc.Err()
+}
+
+// plsKey matches the numbered keys of a PLS file.
+var plsKey = regexp.MustCompile(`(?i)^(file|title|length)(\d+)$`)
+
+func parsePLS(data string) (PlaylistFile, error) {
+	var pf PlaylistFile
+	items := make(map[int]*PlaylistItem)
+	for _, line := range strings.Split(data, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		m := plsKey.FindStringSubmatch(strings.TrimSpace(parts[0]))
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		item, ok := items[n]
+		if !ok {
+			item = &PlaylistItem{}
+			items[n] = item
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.ToLower(m[1]) {
+		case "file":
+			item.Location = value
+		case "title":
+			item.Artist, item.Title = splitDisplayTitle(value)
+		case "length":
+			if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+				item.Duration = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	var numbers []int
+	for n, item := range items {
+		if item.Location != "" {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		pf.Items = append(pf.Items, *items[n])
+	}
+	return pf, nil
+}
+
+func parseXSPF(data []byte) (PlaylistFile, error) {
+	var doc struct {
+		XMLName xml.Name `xml:"playlist"`
+		Title   string   `xml:"title"`
+		Tracks  []struct {
+			Locations   []string `xml:"location"`
+			Identifiers []string `xml:"identifier"`
+			Title       string   `xml:"title"`
+			Creator     string   `xml:"creator"`
+			Duration    int64    `xml:"duration"`
+		} `xml:"trackList>track"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return PlaylistFile{}, fmt.Errorf("invalid XSPF playlist: %v", err)
+	}
+	pf := PlaylistFile{Name: strings.TrimSpace(doc.Title)}
+	for _, t := range doc.Tracks {
+		item := PlaylistItem{
+			Title:    strings.TrimSpace(t.Title),
+			Artist:   strings.TrimSpace(t.Creator),
+			Duration: time.Duration(t.Duration) * time.Millisecond,
+		}
+		if len(t.Locations) > 0 {
+			item.Location = strings.TrimSpace(t.Locations[0])
+		}
+		for _, id := range t.Identifiers {
+			if m := recordingMBID.FindStringSubmatch(id); m != nil {
+				item.MBID = strings.ToLower(m[1])
+			}
+		}
+		pf.Items = append(pf.Items, item)
+	}
+	return pf, nil
+}
+
+// recordingMBID matches the MusicBrainz recording URLs that identify XSPF
+// tracks.
+var recordingMBID = regexp.MustCompile(`(?i)musicbrainz\.org/recording/([0-9a-f-]{36})`)
+
+// splitDisplayTitle splits the "artist - title" of M3U and PLS entries.
+func splitDisplayTitle(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, " - "); i >= 0 {
+		return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+3:])
+	}
+	return "", s
+}
+
+// locationPath returns the path of a playlist location, which is either a
+// file URL or a path using either kind of separator. Other URLs return an
+// empty path.
+func locationPath(loc string) string {
+	if u, err := url.Parse(loc); err == nil && u.Scheme != "" && len(u.Scheme) > 1 {
+		if u.Scheme != "file" {
+			return ""
+		}
+		loc = u.Path
+	}
+	return strings.Replace(loc, `\`, "/", -1)
+}
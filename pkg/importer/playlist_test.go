@@ -0,0 +1,175 @@
+package importer
+
+import (
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	Convey("Test ParsePlaylist", t, func() {
+		Convey("should parse M3U", func() {
+			pf, err := ParsePlaylist(strings.NewReader("\xef\xbb\xbf#EXTM3U\n"+
+				"#PLAYLIST:Mix\n"+
+				"#EXTINF:123,Artist A - Track 1\n"+
+				"/music/Artist A/Album/01.flac\n"+
+				"\n# comment\n"+
+				"C:\\Music\\02.mp3\n"), "mix.m3u8")
+			So(err, ShouldBeNil)
+			So(pf.Name, ShouldEqual, "Mix")
+			So(pf.Items, ShouldResemble, []PlaylistItem{
+				{Location: "/music/Artist A/Album/01.flac", Artist: "Artist A",
+					Title: "Track 1", Duration: 123 * time.Second},
+				{Location: "C:\\Music\\02.mp3"},
+			})
+		})
+
+		Convey("should read Latin-1 M3U and name it after the file", func() {
+			pf, err := ParsePlaylist(strings.NewReader("#EXTINF:-1,Caf\xe9\ncafe.mp3\n"),
+				"/tmp/Old list.m3u")
+			So(err, ShouldBeNil)
+			So(pf.Name, ShouldEqual, "Old list")
+			So(pf.Items[0].Title, ShouldEqual, "Café")
+			So(pf.Items[0].Duration, ShouldEqual, 0)
+		})
+
+		Convey("should parse PLS", func() {
+			pf, err := ParsePlaylist(strings.NewReader("[playlist]\n"+
+				"File2=b.ogg\nTitle2=B\n"+
+				"File1=a.ogg\nTitle1=Artist - A\nLength1=61\n"+
+				"NumberOfEntries=2\nVersion=2\n"), "list.pls")
+			So(err, ShouldBeNil)
+			So(pf.Items, ShouldResemble, []PlaylistItem{
+				{Location: "a.ogg", Artist: "Artist", Title: "A", Duration: 61 * time.Second},
+				{Location: "b.ogg", Title: "B"},
+			})
+		})
+
+		Convey("should parse XSPF", func() {
+			pf, err := ParsePlaylist(strings.NewReader(`<?xml version="1.0"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <title>Favourites</title>
+  <trackList>
+    <track>
+      <location>file:///music/a.ogg</location>
+      <identifier>https://musicbrainz.org/recording/0E7AC5B1-5E2C-4A55-9B5E-5B5C1E6E9A01</identifier>
+      <title>A</title>
+      <creator>Artist</creator>
+      <duration>61500</duration>
+    </track>
+  </trackList>
+</playlist>`), "favourites.xspf")
+			So(err, ShouldBeNil)
+			So(pf.Name, ShouldEqual, "Favourites")
+			So(pf.Items, ShouldResemble, []PlaylistItem{{
+				Location: "file:///music/a.ogg", Title: "A", Artist: "Artist",
+				Duration: 61500 * time.Millisecond, MBID: "0e7ac5b1-5e2c-4a55-9b5e-5b5c1e6e9a01",
+			}})
+		})
+
+		Convey("should reject invalid XSPF", func() {
+			_, err := ParsePlaylist(strings.NewReader("<playlist><trackList>"), "x.xspf")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestImportPlaylist(t *testing.T) {
+	Convey("Test ImportPlaylist", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		im := NewImporter(coll, services.FileStreamHandler{Directory: "files"})
+
+		a := models.Artist{Name: "Wolfgang Amadeus Mozart"}
+		coll.CreateArtist(&a)
+		track := func(title, source, mbid string, d time.Duration) models.Track {
+			t := models.Track{Title: title, MBID: mbid}
+			t.AddArtist(a)
+			t.AddStream(models.Stream{Path: "foo", Source: source, Duration: d})
+			coll.CreateTrack(&t)
+			return t
+		}
+		vogel := track("Der Vogelfänger bin ich ja", "/home/me/Music/Zauberflöte/CD1/02.ogg",
+			"", 172*time.Second)
+		holle := track("Der Hölle Rache kocht in meinem Herzen", "/home/me/Music/Zauberflöte/CD1/14.ogg",
+			"1e4d2a8c-0b6a-4f4e-9a0e-2f0c9f0a8a11", 180*time.Second)
+		other := track("Der Vogelfänger bin ich ja", "/home/me/Music/Other/02.ogg", "", 0)
+
+		match := func(item PlaylistItem) PlaylistMatch {
+			m, err := im.MatchPlaylistItem(item)
+			So(err, ShouldBeNil)
+			return m
+		}
+
+		Convey("should match stream URLs", func() {
+			m := match(PlaylistItem{Location: fmt.Sprintf("http://music.example.com/tracks/%d/stream", holle.ID)})
+			So(m.TrackID, ShouldEqual, holle.ID)
+			So(m.By, ShouldEqual, MatchedByURL)
+		})
+
+		Convey("should match paths from another machine", func() {
+			m := match(PlaylistItem{Location: `D:\Music\Zauberflöte\CD1\02.ogg`})
+			So(m.TrackID, ShouldEqual, vogel.ID)
+			So(m.By, ShouldEqual, MatchedByPath)
+			m = match(PlaylistItem{Location: "file:///mnt/Other/02.ogg"})
+			So(m.TrackID, ShouldEqual, other.ID)
+		})
+
+		Convey("should match MusicBrainz IDs", func() {
+			m := match(PlaylistItem{Location: "http://elsewhere/x.ogg", MBID: holle.MBID})
+			So(m.TrackID, ShouldEqual, holle.ID)
+			So(m.By, ShouldEqual, MatchedByMBID)
+		})
+
+		Convey("should match artist, title and duration", func() {
+			m := match(PlaylistItem{Location: "/elsewhere/x.ogg", Artist: "Mozart",
+				Title: "Der Hölle Rache kocht in meinem Herzen (Live)", Duration: 182 * time.Second})
+			So(m.By, ShouldEqual, MatchedByTitle)
+			So(m.TrackID, ShouldEqual, holle.ID)
+
+			m = match(PlaylistItem{Location: "/elsewhere/x.ogg", Artist: "Mozart",
+				Title: "der Vogelfänger, bin ich ja!", Duration: 172 * time.Second})
+			So(m.TrackID, ShouldEqual, vogel.ID)
+		})
+
+		Convey("should not match unknown items", func() {
+			m := match(PlaylistItem{Location: "/elsewhere/x.ogg", Title: "Something else"})
+			So(m.TrackID, ShouldEqual, 0)
+			m = match(PlaylistItem{Location: "/elsewhere/x.ogg", Artist: "Mozart",
+				Title: "Der Hölle Rache kocht in meinem Herzen", Duration: 300 * time.Second})
+			So(m.TrackID, ShouldEqual, 0)
+		})
+
+		Convey("should create playlist and report unmatched items", func() {
+			report, err := im.ImportPlaylist(PlaylistFile{Name: "Arias", Items: []PlaylistItem{
+				{Location: "/x/Zauberflöte/CD1/14.ogg"},
+				{Location: "/x/unknown.ogg"},
+				{Location: "/x/Zauberflöte/CD1/02.ogg"},
+			}}, 7)
+			So(err, ShouldBeNil)
+			So(report.Unmatched, ShouldEqual, 1)
+			So(len(report.Matches), ShouldEqual, 3)
+			So(report.Matches[1].TrackID, ShouldEqual, 0)
+			p, err := coll.GetPlaylist(report.Playlist.ID)
+			So(err, ShouldBeNil)
+			So(p.Name, ShouldEqual, "Arias")
+			So(p.UserID, ShouldEqual, 7)
+			So(len(p.Entries), ShouldEqual, 2)
+			So(p.Entries[0].TrackID, ShouldEqual, holle.ID)
+			So(p.Entries[1].TrackID, ShouldEqual, vogel.ID)
+		})
+	})
+}
@@ -0,0 +1,311 @@
+package importer
+
+import (
+	"github.com/dhowden/tag"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Scanner imports the audio files in a directory tree into a collection.
+// Files that were imported by an earlier scan are updated rather than added
+// again.
+type Scanner struct {
+	importer Importer
+
+	// InPlace makes streams reference files where they are instead of
+	// copying them into the stream handler's storage.
+	InPlace bool
+
+	// Incremental skips files whose size and modification time have not
+	// changed since they were last scanned.
+	Incremental bool
+
+	// releases maps release keys to the IDs of the releases seen so far.
+	releases map[string]int64
+}
+
+// FileStatus is the outcome of scanning a single file.
+type FileStatus int
+
+const (
+	Unchanged FileStatus = iota
+	Added
+	Updated
+)
+
+// ScanReport counts the files seen by a scan.
+type ScanReport struct {
+	Added     int
+	Updated   int
+	Unchanged int
+	Skipped   int
+}
+
+func NewScanner(c models.Collection, sh services.StreamHandler) *Scanner {
+	return &Scanner{importer: NewImporter(c, sh)}
+}
+
+// Scan imports every audio file below root. Files that are not audio files,
+// or are in a format the collection does not know, are skipped.
+func (sc *Scanner) Scan(root string) (ScanReport, error) {
+	var report ScanReport
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return report, err
+	}
+	sc.releases = make(map[string]int64)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		hidden := strings.HasPrefix(info.Name(), ".") && path != root
+		if info.IsDir() {
+			if hidden {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if hidden || !info.Mode().IsRegular() {
+			return nil
+		}
+		status, err := sc.ScanFile(path, info)
+		switch {
+		case services.IsUnsupported(err):
+			report.Skipped++
+		case err != nil:
+			return err
+		case status == Added:
+			report.Added++
+		case status == Updated:
+			report.Updated++
+		default:
+			report.Unchanged++
+		}
+		return nil
+	})
+	return report, err
+}
+
+// ScanFile imports or updates a single file. A file is Unchanged only if it
+// was skipped by an incremental scan. Files that cannot be read as audio
+// return an UnsupportedError.
+func (sc *Scanner) ScanFile(path string, info os.FileInfo) (FileStatus, error) {
+	c := sc.importer.collection
+	strm, err := c.GetStreamBySource(path)
+	exists := err == nil
+	if err != nil && !models.IsNotFound(err) {
+		return Unchanged, err
+	}
+	if exists && sc.Incremental && strm.SourceSize == info.Size() &&
+		strm.SourceModTime.Equal(info.ModTime()) {
+		return Unchanged, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Unchanged, services.UnsupportedError{Err: err}
+	}
+	defer f.Close()
+	meta, err := services.FileMetadata(f)
+	if err != nil {
+		return Unchanged, err
+	}
+
+	var t models.Track
+	if exists {
+		t, err = c.GetTrack(strm.TrackID)
+		if err != nil {
+			return Unchanged, err
+		}
+	}
+	relID, err := sc.release(meta, filepath.Dir(path), t.ReleaseID)
+	if err != nil {
+		return Unchanged, err
+	}
+	if err := sc.importer.Track(&t, meta); err != nil {
+		return Unchanged, err
+	}
+	t.ReleaseID = relID
+
+	// A stream that was copied into storage has its copy replaced.
+	copied := exists && strm.Path != strm.Source
+	oldPath := strm.Path
+	if sc.InPlace {
+		strm.Format, err = sc.importer.Format(meta)
+		if err == nil {
+			err = sc.importer.Properties(&strm, meta, f)
+		}
+		strm.Path = path
+	} else {
+		err = sc.importer.Stream(&strm, meta, f)
+	}
+	if err != nil {
+		return Unchanged, err
+	}
+	strm.Source = path
+	strm.SourceSize = info.Size()
+	strm.SourceModTime = info.ModTime()
+
+	if !exists {
+		t.AddStream(strm)
+		return Added, c.CreateTrack(&t)
+	}
+	for i := range t.Streams {
+		if t.Streams[i].ID == strm.ID {
+			t.Streams[i] = strm
+		}
+	}
+	if err := c.SaveTrack(t); err != nil {
+		return Unchanged, err
+	}
+	if copied && oldPath != strm.Path {
+		sc.importer.streamhdlr.Delete(oldPath)
+	}
+	return Updated, nil
+}
+
+// Move records that the source file of strm has moved to path.
+func (sc *Scanner) Move(strm models.Stream, path string) error {
+	c := sc.importer.collection
+	t, err := c.GetTrack(strm.TrackID)
+	if err != nil {
+		return err
+	}
+	for i, s := range t.Streams {
+		if s.ID != strm.ID {
+			continue
+		}
+		if s.Path == s.Source {
+			t.Streams[i].Path = path
+		}
+		t.Streams[i].Source = path
+	}
+	return c.SaveTrack(t)
+}
+
+// Remove deletes the track of a stream whose source file is gone, along with
+// the stored copy of the file. The track's release and its cover are deleted
+// if it has no other tracks.
+func (sc *Scanner) Remove(strm models.Stream) error {
+	c := sc.importer.collection
+	t, err := c.GetTrack(strm.TrackID)
+	if err != nil {
+		return err
+	}
+	if err := c.DeleteTrack(t.ID); err != nil {
+		return err
+	}
+	for _, s := range t.Streams {
+		if s.Path != s.Source {
+			sc.importer.streamhdlr.Delete(s.Path)
+		}
+	}
+	if t.ReleaseID == 0 {
+		return nil
+	}
+	rel, err := c.GetRelease(t.ReleaseID)
+	if models.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(rel.Tracks) > 0 {
+		return nil
+	}
+	if err := c.DeleteRelease(rel.ID); err != nil {
+		return err
+	}
+	if rel.Cover != "" {
+		sc.importer.streamhdlr.Delete(rel.Cover)
+	}
+	return nil
+}
+
+// release returns the ID of the release that a file with metadata m in dir
+// belongs to. The stored release is the release of the file itself if it was
+// imported before (existing), a release with the same MusicBrainz ID, or the
+// release of an imported file in the same directory with the same album.
+// Otherwise a new release is created. The first file of each release seen in
+// a scan updates the stored release.
+func (sc *Scanner) release(m tag.Metadata, dir string, existing int64) (int64, error) {
+	if sc.releases == nil {
+		sc.releases = make(map[string]int64)
+	}
+	key := ReleaseKey(m, dir)
+	if id, ok := sc.releases[key]; ok {
+		return id, nil
+	}
+	c := sc.importer.collection
+	mbid := rawString(m.Raw(), "musicbrainz_albumid")
+	var rel models.Release
+	var err error = models.NotFoundError{Kind: "release", Key: key}
+	if existing != 0 {
+		rel, err = c.GetRelease(existing)
+		if err == nil && !releaseMatches(rel, m) {
+			err = models.NotFoundError{Kind: "release", Key: key}
+		}
+	}
+	if models.IsNotFound(err) && mbid != "" {
+		rel, err = c.GetReleaseByMBID(mbid)
+	} else if models.IsNotFound(err) {
+		rel, err = sc.siblingRelease(m, dir)
+	}
+	switch {
+	case models.IsNotFound(err):
+		rel = models.Release{}
+		if err := sc.importer.Release(&rel, m); err != nil {
+			return 0, err
+		}
+		err = c.CreateRelease(&rel)
+	case err == nil:
+		rel.Tracks = nil
+		if err := sc.importer.Release(&rel, m); err != nil {
+			return 0, err
+		}
+		err = c.SaveRelease(rel)
+	}
+	if err != nil {
+		return 0, err
+	}
+	sc.releases[key] = rel.ID
+	return rel.ID, nil
+}
+
+// siblingRelease returns the release of an imported file in dir that
+// matches m.
+func (sc *Scanner) siblingRelease(m tag.Metadata, dir string) (models.Release, error) {
+	c := sc.importer.collection
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return models.Release{}, err
+	}
+	for _, info := range infos {
+		strm, err := c.GetStreamBySource(filepath.Join(dir, info.Name()))
+		if models.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return models.Release{}, err
+		}
+		t, err := c.GetTrack(strm.TrackID)
+		if err != nil || t.ReleaseID == 0 {
+			continue
+		}
+		rel, err := c.GetRelease(t.ReleaseID)
+		if err == nil && releaseMatches(rel, m) {
+			return rel, nil
+		}
+	}
+	return models.Release{}, models.NotFoundError{Kind: "release", Key: dir}
+}
+
+// releaseMatches reports whether a file with metadata m belongs to rel.
+func releaseMatches(rel models.Release, m tag.Metadata) bool {
+	if mbid := rawString(m.Raw(), "musicbrainz_albumid"); mbid != "" {
+		return rel.MBID == mbid
+	}
+	return rel.Title == m.Album()
+}
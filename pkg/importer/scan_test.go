@@ -0,0 +1,128 @@
+package importer
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// copyFixture copies a file from the testdata directory to dst, creating
+// its parent directories.
+func copyFixture(name string, dst string) {
+	data, err := ioutil.ReadFile(filepath.Join("../testdata", name))
+	if err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(dst, data, 0644); err != nil {
+		panic(err)
+	}
+}
+
+func TestScanner(t *testing.T) {
+	Convey("Test Scanner", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		tmp, err := ioutil.TempDir("", "blueshift-")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(tmp)
+		files := filepath.Join(tmp, "files")
+		library := filepath.Join(tmp, "library")
+		os.Mkdir(files, 0755)
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		sc := NewScanner(coll, services.FileStreamHandler{Directory: files})
+
+		copyFixture("papageno.ogg", filepath.Join(library, "Zauberflöte", "CD1", "02.ogg"))
+		copyFixture("papageno.ogg", filepath.Join(library, "Zauberflöte", "CD2", "03.ogg"))
+		copyFixture("magic_flute.ogg", filepath.Join(library, "Other", "18.ogg"))
+		copyFixture("magic_flute.ogg", filepath.Join(library, "Other", "19.ogg"))
+		ioutil.WriteFile(filepath.Join(library, "Other", "notes.txt"), []byte("notes"), 0644)
+
+		count := func(model interface{}) int {
+			var n int
+			db.Model(model).Count(&n)
+			return n
+		}
+
+		Convey("should import and group files", func() {
+			report, err := sc.Scan(library)
+			So(err, ShouldBeNil)
+			So(report, ShouldResemble, ScanReport{Added: 4, Skipped: 1})
+			So(count(&models.Release{}), ShouldEqual, 2)
+			So(count(&models.Track{}), ShouldEqual, 4)
+			stored, _ := ioutil.ReadDir(files)
+			So(len(stored), ShouldEqual, 4)
+			src := filepath.Join(library, "Other", "18.ogg")
+			strm, err := coll.GetStreamBySource(src)
+			So(err, ShouldBeNil)
+			So(strm.Path, ShouldStartWith, files)
+		})
+
+		Convey("should reference files in place", func() {
+			sc.InPlace = true
+			_, err := sc.Scan(library)
+			So(err, ShouldBeNil)
+			src := filepath.Join(library, "Other", "18.ogg")
+			strm, err := coll.GetStreamBySource(src)
+			So(err, ShouldBeNil)
+			So(strm.Path, ShouldEqual, src)
+			stored, _ := ioutil.ReadDir(files)
+			So(len(stored), ShouldEqual, 0)
+		})
+
+		Convey("should skip unchanged files in incremental mode", func() {
+			sc.Scan(library)
+			sc.Incremental = true
+			report, err := sc.Scan(library)
+			So(err, ShouldBeNil)
+			So(report, ShouldResemble, ScanReport{Unchanged: 4, Skipped: 1})
+			So(count(&models.Track{}), ShouldEqual, 4)
+		})
+
+		Convey("should update changed files", func() {
+			sc.Scan(library)
+			src := filepath.Join(library, "Other", "18.ogg")
+			before, _ := coll.GetStreamBySource(src)
+			later := time.Now().Add(time.Hour)
+			os.Chtimes(src, later, later)
+			sc.Incremental = true
+			report, err := sc.Scan(library)
+			So(err, ShouldBeNil)
+			So(report.Updated, ShouldEqual, 1)
+			So(count(&models.Track{}), ShouldEqual, 4)
+			after, _ := coll.GetStreamBySource(src)
+			So(after.ID, ShouldEqual, before.ID)
+			_, err = os.Stat(before.Path)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			stored, _ := ioutil.ReadDir(files)
+			So(len(stored), ShouldEqual, 4)
+		})
+
+		Convey("should add new file to existing release", func() {
+			sc.Scan(library)
+			copyFixture("magic_flute.ogg", filepath.Join(library, "Other", "01.ogg"))
+			sc.Incremental = true
+			report, err := sc.Scan(library)
+			So(err, ShouldBeNil)
+			So(report.Added, ShouldEqual, 1)
+			So(count(&models.Release{}), ShouldEqual, 2)
+		})
+	})
+}
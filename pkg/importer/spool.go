@@ -0,0 +1,170 @@
+package importer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"path"
+	"strings"
+)
+
+// Magic numbers of the archive formats SpoolArchive reads.
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	emptyZipMagic = []byte("PK\x05\x06")
+	gzipMagic     = []byte{0x1f, 0x8b}
+	zstdMagic     = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// MaxArchiveFileSize and MaxArchiveSize limit the data unpacked from a
+// release archive, in bytes, in each of its files and in all of them, so
+// that a small compressed archive cannot fill the disk. Archives that
+// unpack to more are refused.
+var (
+	MaxArchiveFileSize int64 = 2 << 30
+	MaxArchiveSize     int64 = 16 << 30
+)
+
+// unpacked counts the data unpacked from an archive against
+// MaxArchiveFileSize and MaxArchiveSize.
+type unpacked struct {
+	total int64
+}
+
+// reader returns r, the file name of an archive, failing reads once the file
+// or the archive has unpacked to too much.
+func (u *unpacked) reader(name string, r io.Reader) io.Reader {
+	return &unpackedFile{unpacked: u, name: name, r: r}
+}
+
+type unpackedFile struct {
+	*unpacked
+	name string
+	r    io.Reader
+	n    int64
+}
+
+func (f *unpackedFile) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	f.n += int64(n)
+	f.total += int64(n)
+	if f.n > MaxArchiveFileSize {
+		return n, fmt.Errorf("%s unpacks to more than %d bytes", f.name, MaxArchiveFileSize)
+	}
+	if f.total > MaxArchiveSize {
+		return n, fmt.Errorf("archive unpacks to more than %d bytes", MaxArchiveSize)
+	}
+	return n, err
+}
+
+// SpoolArchive copies a release archive read from r to w as a zip archive,
+// which is what ImportArchive reads. Zip archives are copied as they are,
+// and tar archives, which may be compressed with gzip or zstd, are packed
+// into one. Other data is refused with an UnsupportedError.
+func SpoolArchive(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(512)
+	switch {
+	case bytes.HasPrefix(magic, zipMagic) || bytes.HasPrefix(magic, emptyZipMagic):
+		_, err := io.Copy(w, br)
+		return err
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return services.UnsupportedError{Err: err}
+		}
+		defer gz.Close()
+		return spoolTar(w, gz)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return services.UnsupportedError{Err: err}
+		}
+		defer zr.Close()
+		return spoolTar(w, zr)
+	case isTar(magic):
+		return packTar(w, br)
+	}
+	return services.UnsupportedError{Err: fmt.Errorf("not a zip or tar archive")}
+}
+
+// spoolTar packs the tar archive read from the decompressed data r into a
+// zip archive.
+func spoolTar(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(512); !isTar(magic) {
+		return services.UnsupportedError{Err: fmt.Errorf("compressed data is not a tar archive")}
+	}
+	return packTar(w, br)
+}
+
+// isTar reports whether a block starts a POSIX or GNU tar archive.
+func isTar(block []byte) bool {
+	return len(block) >= 262 && string(block[257:262]) == "ustar"
+}
+
+// packTar packs the regular files of a tar archive into a zip archive.
+func packTar(w io.Writer, r io.Reader) error {
+	tr := tar.NewReader(r)
+	aw := NewArchiveWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return services.UnsupportedError{Err: err}
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if err := aw.Add(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// ArchiveWriter packs the files of a release into a zip archive to import,
+// such as files uploaded one by one. Files are stored uncompressed, since
+// audio hardly compresses, and are limited like the files of archives.
+type ArchiveWriter struct {
+	zw       *zip.Writer
+	unpacked unpacked
+}
+
+func NewArchiveWriter(w io.Writer) *ArchiveWriter {
+	return &ArchiveWriter{zw: zip.NewWriter(w)}
+}
+
+// Add adds the file read from r to the archive. Its name may be a path,
+// which is kept relative to the archive.
+func (aw *ArchiveWriter) Add(name string, r io.Reader) error {
+	name = archiveName(name)
+	if name == "" {
+		return fmt.Errorf("file has no name")
+	}
+	f, err := aw.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, aw.unpacked.reader(name, r))
+	return err
+}
+
+// Close finishes the archive.
+func (aw *ArchiveWriter) Close() error {
+	return aw.zw.Close()
+}
+
+// archiveName returns a file name from an upload, which may be a path from
+// another system, as a slash-separated path within an archive.
+func archiveName(name string) string {
+	name = path.Clean("/" + strings.Replace(name, `\`, "/", -1))
+	return strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,130 @@
+package importer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/klauspost/compress/zstd"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSpoolArchive(t *testing.T) {
+	Convey("Test SpoolArchive", t, func() {
+		var tarball bytes.Buffer
+		tw := tar.NewWriter(&tarball)
+		tw.WriteHeader(&tar.Header{Name: "Album/", Typeflag: tar.TypeDir, Mode: 0755})
+		for _, f := range []struct{ name, data string }{
+			{"Album/01.ogg", "first"},
+			{"Album/Album.cue", "cue"},
+		} {
+			tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.data))})
+			tw.Write([]byte(f.data))
+		}
+		tw.WriteHeader(&tar.Header{Name: "Album/link", Typeflag: tar.TypeSymlink, Linkname: "01.ogg"})
+		tw.Close()
+
+		// spool returns the names and contents of the files spooled from
+		// data.
+		spool := func(data io.Reader) (map[string]string, error) {
+			var buf bytes.Buffer
+			if err := SpoolArchive(&buf, data); err != nil {
+				return nil, err
+			}
+			arxv, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				return nil, err
+			}
+			files := make(map[string]string)
+			for _, f := range arxv.File {
+				rdr, _ := f.Open()
+				b, _ := ioutil.ReadAll(rdr)
+				rdr.Close()
+				files[f.Name] = string(b)
+			}
+			return files, nil
+		}
+		want := map[string]string{"Album/01.ogg": "first", "Album/Album.cue": "cue"}
+
+		Convey("should copy zip archive", func() {
+			var buf bytes.Buffer
+			aw := NewArchiveWriter(&buf)
+			aw.Add("Album/01.ogg", strings.NewReader("first"))
+			aw.Add("Album/Album.cue", strings.NewReader("cue"))
+			aw.Close()
+			files, err := spool(&buf)
+			So(err, ShouldBeNil)
+			So(files, ShouldResemble, want)
+		})
+
+		Convey("should pack the files of tar archive", func() {
+			files, err := spool(&tarball)
+			So(err, ShouldBeNil)
+			So(files, ShouldResemble, want)
+		})
+
+		Convey("should pack gzipped tar archive", func() {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(tarball.Bytes())
+			gz.Close()
+			files, err := spool(&buf)
+			So(err, ShouldBeNil)
+			So(files, ShouldResemble, want)
+		})
+
+		Convey("should pack zstd compressed tar archive", func() {
+			var buf bytes.Buffer
+			zw, _ := zstd.NewWriter(&buf)
+			zw.Write(tarball.Bytes())
+			zw.Close()
+			files, err := spool(&buf)
+			So(err, ShouldBeNil)
+			So(files, ShouldResemble, want)
+		})
+
+		Convey("should refuse other data", func() {
+			_, err := spool(strings.NewReader("not an archive"))
+			So(services.IsUnsupported(err), ShouldBeTrue)
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write([]byte("not a tar archive"))
+			gz.Close()
+			_, err = spool(&buf)
+			So(services.IsUnsupported(err), ShouldBeTrue)
+		})
+
+		Convey("should refuse files that unpack to too much", func() {
+			defer func(file, total int64) {
+				MaxArchiveFileSize, MaxArchiveSize = file, total
+			}(MaxArchiveFileSize, MaxArchiveSize)
+			MaxArchiveFileSize = 4
+			var buf bytes.Buffer
+			zw, _ := zstd.NewWriter(&buf)
+			zw.Write(tarball.Bytes())
+			zw.Close()
+			_, err := spool(&buf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Album/01.ogg unpacks to more than 4 bytes")
+
+			MaxArchiveFileSize, MaxArchiveSize = 5, 7
+			_, err = spool(bytes.NewReader(tarball.Bytes()))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "archive unpacks to more than 7 bytes")
+			MaxArchiveSize = 8
+			_, err = spool(bytes.NewReader(tarball.Bytes()))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("should keep file names within archive", func() {
+			So(archiveName("../../etc/passwd"), ShouldEqual, "etc/passwd")
+			So(archiveName(`C:\Music\Album\01.flac`), ShouldEqual, "C:/Music/Album/01.flac")
+			So(archiveName("/Album/./01.flac"), ShouldEqual, "Album/01.flac")
+		})
+	})
+}
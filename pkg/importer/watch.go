@@ -0,0 +1,208 @@
+package importer
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Watcher keeps the collection in sync with a directory tree. It scans files
+// as they are added or changed, follows files that are moved and removes the
+// tracks of files that are deleted.
+type Watcher struct {
+	scanner *Scanner
+	root    string
+	fsw     *fsnotify.Watcher
+
+	// Delay is how long a file must be left alone before it is scanned, so
+	// that a burst of events from a tag editor or a batch copy is handled
+	// once.
+	Delay time.Duration
+
+	// pending maps paths with unhandled events to the time of the last one.
+	pending map[string]time.Time
+}
+
+// NewWatcher watches root and every directory below it. Files are imported
+// with sc, which is switched to incremental mode.
+func NewWatcher(sc *Scanner, root string) (*Watcher, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	sc.Incremental = true
+	w := &Watcher{
+		scanner: sc,
+		root:    root,
+		fsw:     fsw,
+		Delay:   2 * time.Second,
+		pending: make(map[string]time.Time),
+	}
+	if err := w.addDir(root, false); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Sync brings the collection up to date with changes made while the
+// directory was not being watched.
+func (w *Watcher) Sync() error {
+	if _, err := w.scanner.Scan(w.root); err != nil {
+		return err
+	}
+	streams, err := w.scanner.importer.collection.GetStreamsBySourceDir(w.root)
+	if err != nil {
+		return err
+	}
+	for _, strm := range streams {
+		if _, err := os.Stat(strm.Source); os.IsNotExist(err) {
+			if err := w.scanner.Remove(strm); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Run handles file system events until stop is closed, then stops watching.
+func (w *Watcher) Run(stop <-chan struct{}) error {
+	ticker := time.NewTicker(w.Delay / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return w.fsw.Close()
+		case ev := <-w.fsw.Events:
+			w.event(ev)
+		case err := <-w.fsw.Errors:
+			log.Printf("watch %s: %v", w.root, err)
+		case now := <-ticker.C:
+			w.flush(now)
+		}
+	}
+}
+
+func (w *Watcher) event(ev fsnotify.Event) {
+	if strings.HasPrefix(filepath.Base(ev.Name), ".") {
+		return
+	}
+	if ev.Op&fsnotify.Create != 0 {
+		if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+			if err := w.addDir(ev.Name, true); err != nil {
+				log.Printf("watch %s: %v", ev.Name, err)
+			}
+			return
+		}
+	}
+	w.pending[ev.Name] = time.Now()
+}
+
+// addDir watches dir and the directories below it. If mark is true the
+// files found are marked as pending, as for a directory moved into the tree.
+func (w *Watcher) addDir(dir string, mark bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return w.fsw.Add(path)
+		}
+		if mark {
+			w.pending[path] = time.Now()
+		}
+		return nil
+	})
+}
+
+// flush handles the pending paths that have been left alone for Delay.
+func (w *Watcher) flush(now time.Time) {
+	var paths []string
+	for path, t := range w.pending {
+		if now.Sub(t) >= w.Delay {
+			paths = append(paths, path)
+			delete(w.pending, path)
+		}
+	}
+	if len(paths) > 0 {
+		w.sync(paths)
+	}
+}
+
+// sync updates the collection for a batch of changed paths. A file that
+// appears with the same size and modification time as one that disappeared
+// in the same batch is treated as moved, and keeps its track.
+func (w *Watcher) sync(paths []string) {
+	c := w.scanner.importer.collection
+	w.scanner.releases = nil
+	var removed []models.Stream
+	var present []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err == nil {
+			if info.Mode().IsRegular() {
+				present = append(present, path)
+			}
+			continue
+		} else if !os.IsNotExist(err) {
+			log.Printf("watch %s: %v", path, err)
+			continue
+		}
+		strm, err := c.GetStreamBySource(path)
+		if err == nil {
+			removed = append(removed, strm)
+			continue
+		} else if !models.IsNotFound(err) {
+			log.Printf("watch %s: %v", path, err)
+			continue
+		}
+		// The path may have been a directory that was moved away.
+		streams, err := c.GetStreamsBySourceDir(path)
+		if err != nil {
+			log.Printf("watch %s: %v", path, err)
+		}
+		removed = append(removed, streams...)
+	}
+
+	for _, path := range present {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if _, err := c.GetStreamBySource(path); models.IsNotFound(err) {
+			for i, strm := range removed {
+				if strm.SourceSize == info.Size() && strm.SourceModTime.Equal(info.ModTime()) {
+					if err := w.scanner.Move(strm, path); err != nil {
+						log.Printf("watch %s: %v", path, err)
+					}
+					removed = append(removed[:i], removed[i+1:]...)
+					break
+				}
+			}
+		}
+		if _, err := w.scanner.ScanFile(path, info); err != nil && !services.IsUnsupported(err) {
+			log.Printf("watch %s: %v", path, err)
+		}
+	}
+
+	for _, strm := range removed {
+		if err := w.scanner.Remove(strm); err != nil {
+			log.Printf("watch %s: %v", strm.Source, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package importer
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// eventually polls cond until it returns true or a few seconds have passed.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestWatcher(t *testing.T) {
+	Convey("Test Watcher", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		db.DB().SetMaxOpenConns(1)
+		defer db.Close()
+		tmp, err := ioutil.TempDir("", "blueshift-")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(tmp)
+		library := filepath.Join(tmp, "library")
+		os.Mkdir(library, 0755)
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		sc := NewScanner(coll, services.FileStreamHandler{Directory: tmp})
+		sc.InPlace = true
+		copyFixture("magic_flute.ogg", filepath.Join(library, "Album", "18.ogg"))
+
+		w, err := NewWatcher(sc, library)
+		So(err, ShouldBeNil)
+		w.Delay = 50 * time.Millisecond
+		So(w.Sync(), ShouldBeNil)
+		stop := make(chan struct{})
+		done := make(chan error)
+		go func() { done <- w.Run(stop) }()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+
+		count := func(model interface{}) int {
+			var n int
+			db.Model(model).Count(&n)
+			return n
+		}
+		source := func(path string) bool {
+			_, err := coll.GetStreamBySource(path)
+			return err == nil
+		}
+
+		Convey("should import added file", func() {
+			path := filepath.Join(library, "Album", "19.ogg")
+			copyFixture("magic_flute.ogg", path)
+			So(eventually(func() bool { return source(path) }), ShouldBeTrue)
+			So(count(&models.Track{}), ShouldEqual, 2)
+			So(count(&models.Release{}), ShouldEqual, 1)
+		})
+
+		Convey("should import directory moved into tree", func() {
+			outside := filepath.Join(tmp, "New")
+			copyFixture("papageno.ogg", filepath.Join(outside, "02.ogg"))
+			os.Rename(outside, filepath.Join(library, "New"))
+			path := filepath.Join(library, "New", "02.ogg")
+			So(eventually(func() bool { return source(path) }), ShouldBeTrue)
+			So(count(&models.Release{}), ShouldEqual, 2)
+		})
+
+		Convey("should follow moved file", func() {
+			old := filepath.Join(library, "Album", "18.ogg")
+			before, _ := coll.GetStreamBySource(old)
+			path := filepath.Join(library, "Album", "renamed.ogg")
+			os.Rename(old, path)
+			So(eventually(func() bool { return source(path) }), ShouldBeTrue)
+			after, _ := coll.GetStreamBySource(path)
+			So(after.TrackID, ShouldEqual, before.TrackID)
+			So(after.Path, ShouldEqual, path)
+			So(count(&models.Track{}), ShouldEqual, 1)
+		})
+
+		Convey("should remove deleted file and empty release", func() {
+			os.Remove(filepath.Join(library, "Album", "18.ogg"))
+			So(eventually(func() bool { return count(&models.Track{}) == 0 }), ShouldBeTrue)
+			So(count(&models.Release{}), ShouldEqual, 0)
+			So(count(&models.Stream{}), ShouldEqual, 0)
+		})
+	})
+}
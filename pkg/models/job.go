@@ -0,0 +1,91 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// JobStatus is the state of an import job.
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is an uploaded release archive imported in the background. The
+// archive is kept at Archive until the job finishes, so that jobs left
+// unfinished by a restart can be run again. Report holds the JSON of the
+// files imported so far, see Files, and Staged the paths stored by a running
+// import, see StagedPaths.
+type Job struct {
+	ID        int64
+	UserID    int64
+	Status    JobStatus `gorm:"index"`
+	Archive   string
+	Total     int // number of files in the archive
+	Report    string
+	Staged    string
+	ReleaseID int64
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Finished reports whether the job is done or failed.
+func (j Job) Finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+// Files returns what became of the files of the job so far.
+func (j Job) Files() []ImportedFile {
+	var files []ImportedFile
+	if j.Report != "" {
+		json.Unmarshal([]byte(j.Report), &files)
+	}
+	return files
+}
+
+// SetFiles sets the files reported by the job.
+func (j *Job) SetFiles(files []ImportedFile) {
+	b, _ := json.Marshal(files)
+	j.Report = string(b)
+}
+
+// StagedPaths returns the paths stored by the job while it was running, so
+// that what an interrupted import left behind can be removed.
+func (j Job) StagedPaths() []string {
+	if j.Staged == "" {
+		return nil
+	}
+	return strings.Split(j.Staged, "\n")
+}
+
+// AddStaged records a path stored by the job.
+func (j *Job) AddStaged(path string) {
+	if j.Staged != "" {
+		j.Staged += "\n"
+	}
+	j.Staged += path
+}
+
+// Results of importing the files of a release archive.
+const (
+	FileTrack   = "track"
+	FileCover   = "cover"
+	FileSkipped = "skipped"
+	FileFailed  = "failed"
+)
+
+// ImportedFile reports what became of one file of a release archive. Kind
+// says what skipped files hold, such as "cue" or "log".
+type ImportedFile struct {
+	Name    string `json:"name"`
+	Result  string `json:"result"`
+	Kind    string `json:"kind,omitempty"`
+	TrackID int64  `json:"trackId,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
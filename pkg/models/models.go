@@ -1,22 +1,162 @@
 package models
 
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"time"
+)
+
+// Collection is the store of releases, tracks and artists. Methods that look
+// up a single item return a NotFoundError if it does not exist. Methods that
+// list a page of items also return the total number of items.
 type Collection interface {
-	GetFormat(name string) Format
+	GetFormat(name string) (Format, error)
+
+	CreateRelease(release *Release) error
+	SaveRelease(release Release) error
+	GetRelease(id int64) (Release, error)
+	GetReleaseByMBID(mbid string) (Release, error)
+	// GetReleases returns the releases with the given IDs by ID, with
+	// their artist credits but not their tracks.
+	GetReleases(ids []int64) (map[int64]Release, error)
+	Releases(opts ListOptions) ([]Release, int, error)
+	DeleteRelease(id int64) error
+
+	CreateTrack(track *Track) error
+	SaveTrack(track Track) error
+	GetTrack(id int64) (Track, error)
+	GetTrackByMBID(mbid string) (Track, error)
+	Tracks(opts ListOptions) ([]Track, int, error)
+	DeleteTrack(id int64) error
+
+	CreateStream(stream *Stream) error
+	GetStreamBySource(source string) (Stream, error)
+	GetStreamsBySourceDir(dir string) ([]Stream, error)
+	GetStreamsBySourceSuffix(suffix string) ([]Stream, error)
+	// UsedPaths returns which of paths are those of a stream or a cover.
+	UsedPaths(paths []string) (map[string]bool, error)
+
+	CreatePlaylist(playlist *Playlist) error
+	SavePlaylist(playlist Playlist) error
+	GetPlaylist(id int64) (Playlist, error)
+	Playlists() ([]Playlist, error)
+	AppendToPlaylist(id int64, trackIDs []int64) error
+	ReorderPlaylist(id int64, entryIDs []int64) error
+	DeletePlaylist(id int64) error
+
+	CreateUser(user *User) error
+	SaveUser(user User) error
+	GetUser(id int64) (User, error)
+	GetUserByName(name string) (User, error)
+	Users() ([]User, error)
+	DeleteUser(id int64) error
+
+	CreateSession(session *Session) error
+	GetSession(id string) (Session, error)
+	DeleteSession(id string) error
 
-	CreateRelease(release *Release)
-	SaveRelease(release Release)
-	GetRelease(id int64) Release
-	Releases(offset int, rows int) []Release
+	CreateToken(token *Token) error
+	GetTokenByHash(hash string) (Token, error)
+	Tokens(userID int64) ([]Token, error)
+	TouchToken(id int64, at time.Time) error
+	DeleteToken(userID int64, id int64) error
 
-	CreateTrack(track *Track)
-	SaveTrack(track Track)
-	GetTrack(id int64) Track
-	Tracks(offset int, rows int) []Track
+	CreatePlay(play *Play) error
+	Plays(userID int64, offset int, rows int) ([]Play, error)
+	PlayCounts(query PlayQuery) ([]PlayCount, error)
+
+	QueueListens(listens []QueuedListen) error
+	DueListens(at time.Time) ([]QueuedListen, error)
+	PostponeListens(ids []int64, until time.Time, reason string) error
+	DeleteQueuedListens(ids []int64) error
+	CountQueuedListens(userID int64) (int, error)
+
+	// ClaimJob marks the oldest queued job running and returns it,
+	// RunningJobs returns the jobs marked running, and RequeueJobs queues
+	// them again.
+	CreateJob(job *Job) error
+	SaveJob(job Job) error
+	GetJob(id int64) (Job, error)
+	ClaimJob() (Job, error)
+	RunningJobs() ([]Job, error)
+	RequeueJobs() error
+
+	// SetStarred stars or unstars an item for a user, and SetRating rates
+	// it from 1 to 5, or clears its rating with 0.
+	SetStarred(userID int64, kind ItemKind, id int64, starred bool) error
+	SetRating(userID int64, kind ItemKind, id int64, rating int) error
+	Ratings(userID int64, kind ItemKind, ids []int64) (map[int64]Rating, error)
+	Starred(userID int64) (StarredItems, error)
+
+	CreateArtist(artist *Artist) error
+	SaveArtist(artist Artist) error
+	GetArtist(id int64) (Artist, error)
+	GetArtistByName(name string) (Artist, error)
+	// Artists returns a page of artists, with the number of artists in the
+	// collection. Artists sort by name for SortTitle and SortArtist, by
+	// when they were added, and by rating, but not by year.
+	Artists(opts ListOptions) ([]Artist, int, error)
+
+	// Search returns the releases, tracks and artists matching query, each
+	// limited to rows results starting at offset. Query terms are words,
+	// which match any word with the suffix * as a prefix, and double quoted
+	// phrases. A term prefixed with artist:, title:, release: or year: only
+	// matches that field. An empty query matches everything.
+	Search(query string, offset int, rows int) (SearchResult, error)
+
+	// Transaction calls fn with a collection whose changes are committed
+	// if fn returns nil and rolled back otherwise.
+	Transaction(fn func(Collection) error) error
+}
 
-	CreateArtist(artist *Artist)
-	SaveArtist(artist Artist)
-	GetArtist(id int64) Artist
-	Artists(offset int, rows int) []Artist
+// SearchResult holds the items matching a search, best matches first.
+type SearchResult struct {
+	Releases []Release
+	Tracks   []Track
+	Artists  []Artist
+}
+
+// Sort names an order for lists of releases and tracks.
+type Sort string
+
+const (
+	SortAdded  Sort = "added"
+	SortTitle  Sort = "title"
+	SortYear   Sort = "year"
+	SortArtist Sort = "artist"
+	SortRating Sort = "rating"
+)
+
+// Sorts lists the supported orders.
+var Sorts = []Sort{SortAdded, SortTitle, SortYear, SortArtist, SortRating}
+
+// ListOptions selects a page of a sorted list. The zero value selects every
+// item by date added, oldest first. Lists sorted by rating are sorted by the
+// ratings of the user UserID, with unrated items last.
+type ListOptions struct {
+	Offset int
+	Limit  int // zero for no limit
+	Sort   Sort
+	Desc   bool
+	UserID int64
+}
+
+// NotFoundError is returned by a Collection when the requested item does not
+// exist. Kind names the type of item and Key is the value it was looked up by.
+type NotFoundError struct {
+	Kind string
+	Key  interface{}
+}
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("%s %v not found", e.Kind, e.Key)
+}
+
+// IsNotFound reports whether err is a NotFoundError.
+func IsNotFound(err error) bool {
+	_, ok := err.(NotFoundError)
+	return ok
 }
 
 type Format struct {
@@ -26,12 +166,17 @@ type Format struct {
 }
 
 type Release struct {
-	ID      int64
-	MBID    string
-	Title   string
-	Year    int
-	Tracks  []Track
-	Artists []Artist `gorm:"many2many:user_languages;"`
+	ID        int64
+	MBID      string
+	Title     string
+	Year      int
+	Tracks    []Track
+	Artists   []ReleaseArtist
+	CreatedAt time.Time
+
+	// Cover is the path of the release's cover image in stream storage, or
+	// empty if it has none. It is only set by importing.
+	Cover string `json:"-"`
 }
 
 type Track struct {
@@ -40,9 +185,10 @@ type Track struct {
 	Title     string
 	Position  int
 	Disc      int
-	Artists   []Artist `gorm:"many2many:user_languages;"`
+	Artists   []TrackArtist
 	Streams   []Stream
 	ReleaseID int64
+	CreatedAt time.Time
 }
 
 type Stream struct {
@@ -51,11 +197,217 @@ type Stream struct {
 	Format   Format `gorm:"association_autoupdate:false"`
 	FormatID int64
 	TrackID  int64
+
+	// Source is the path of the file the stream was imported from by a
+	// library scan, with its size and modification time at the time.
+	Source        string `gorm:"index"`
+	SourceSize    int64
+	SourceModTime time.Time
+
+	// The properties of the audio, read from its headers when it was
+	// imported. They are zero where they are not known, and only set by
+	// importing.
+	Duration   time.Duration `json:"-"`
+	Bitrate    int           `json:"-"` // average bits per second
+	SampleRate int           `json:"-"`
+	BitDepth   int           `json:"-"`
+	Channels   int           `json:"-"`
+	Size       int64         `json:"-"`
 }
 
 type Artist struct {
-	ID   int64
-	Name string
+	ID       int64
+	MBID     string
+	Name     string
+	Releases []Release `gorm:"many2many:release_artists;save_associations:false"`
+	Tracks   []Track   `gorm:"many2many:track_artists;save_associations:false"`
+}
+
+// ReleaseArtist credits an artist on a release. Credits are ordered by
+// Position and JoinPhrase is the text that follows the artist's name in the
+// full credit, such as " feat. " or " & ".
+type ReleaseArtist struct {
+	ReleaseID  int64  `gorm:"primary_key;auto_increment:false"`
+	ArtistID   int64  `gorm:"primary_key;auto_increment:false"`
+	Artist     Artist `gorm:"association_autoupdate:false"`
+	Position   int
+	JoinPhrase string
+}
+
+// TrackArtist credits an artist on a track. See ReleaseArtist.
+type TrackArtist struct {
+	TrackID    int64  `gorm:"primary_key;auto_increment:false"`
+	ArtistID   int64  `gorm:"primary_key;auto_increment:false"`
+	Artist     Artist `gorm:"association_autoupdate:false"`
+	Position   int
+	JoinPhrase string
+}
+
+// Playlist is an ordered list of tracks from any releases. UserID is the
+// user who made it, or zero.
+//
+// The entries of a smart playlist are the tracks matching its rules when it
+// is loaded, and cannot be changed. Rules holds the JSON of its SmartRules,
+// and is empty for other playlists.
+type Playlist struct {
+	ID        int64
+	Name      string
+	Comment   string
+	Entries   []PlaylistEntry
+	UserID    int64
+	Rules     string `json:"-"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// PlaylistEntry is a track at a position of a playlist. A track can be in a
+// playlist more than once.
+type PlaylistEntry struct {
+	ID         int64
+	PlaylistID int64 `gorm:"index"`
+	Position   int
+	TrackID    int64 `gorm:"index"`
+	Track      Track `gorm:"save_associations:false"`
+}
+
+// User is an account that can log in to the server. Only admins can upload
+// and edit.
+type User struct {
+	ID           int64
+	Name         string `gorm:"unique_index"`
+	PasswordHash string `json:"-"`
+	Admin        bool
+	CreatedAt    time.Time
+
+	// ListenBrainzURL is the API root of a ListenBrainz-compatible service
+	// that the user's plays are submitted to if ListenBrainzToken is set.
+	ListenBrainzURL   string
+	ListenBrainzToken string `json:"-"`
+}
+
+// Session is a login of a user. ID is the SHA-256 hash of the token in the
+// session cookie, so tokens cannot be taken from the database.
+type Session struct {
+	ID        string `gorm:"primary_key"`
+	UserID    int64  `gorm:"index"`
+	User      User   `gorm:"save_associations:false"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Token is a personal API token of a user, for clients that cannot log in.
+// Hash is the SHA-256 hash of the secret token, which is only shown when the
+// token is created. Scopes limits what the token can do.
+type Token struct {
+	ID         int64
+	UserID     int64 `gorm:"index"`
+	User       User  `gorm:"save_associations:false"`
+	Name       string
+	Hash       string `gorm:"unique_index"`
+	Scopes     string // separated by spaces
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// Token scopes. The admin scope includes the others.
+const (
+	ScopeRead   = "read"   // list and show the collection and playlists
+	ScopeStream = "stream" // play streams
+	ScopeUpload = "upload" // upload tracks, releases and streams
+	ScopeAdmin  = "admin"  // everything, including edits
+)
+
+// Scopes lists the token scopes.
+var Scopes = []string{ScopeRead, ScopeStream, ScopeUpload, ScopeAdmin}
+
+// Play records that a user played a track, either by streaming most of it or
+// by a client scrobbling it. UserID is zero if users do not log in.
+type Play struct {
+	ID       int64
+	UserID   int64     `gorm:"index"`
+	TrackID  int64     `gorm:"index"`
+	Track    Track     `gorm:"save_associations:false"`
+	PlayedAt time.Time `gorm:"index"`
+	Client   string
+}
+
+// QueuedListen is a play waiting to be submitted to the ListenBrainz service
+// of its user. Listen is the JSON of the listen in the ListenBrainz format.
+// Listens that could not be submitted are retried from NextAttempt.
+type QueuedListen struct {
+	ID          int64
+	UserID      int64 `gorm:"index"`
+	Listen      string
+	Attempts    int
+	NextAttempt time.Time `gorm:"index"`
+	LastError   string
+	CreatedAt   time.Time
+}
+
+// PlayGroup names what plays are counted for.
+type PlayGroup string
+
+const (
+	PlaysByTrack   PlayGroup = "tracks"
+	PlaysByRelease PlayGroup = "releases"
+	PlaysByArtist  PlayGroup = "artists"
+)
+
+// PlayQuery selects play counts. Counts are of the plays of a user, or of
+// everyone if UserID is zero, and are ordered by the number of plays, or by
+// the last play if Recent is set.
+type PlayQuery struct {
+	UserID int64
+	Group  PlayGroup
+	Recent bool
+	Limit  int // zero for no limit
+}
+
+// PlayCount is the number of plays of a track, release or artist, and when
+// it was last played. Only the item of the query's group is set.
+type PlayCount struct {
+	Track      Track
+	Release    Release
+	Artist     Artist
+	Count      int
+	LastPlayed time.Time
+}
+
+// ItemKind names a kind of item that users can star and rate.
+type ItemKind string
+
+const (
+	KindTrack   ItemKind = "track"
+	KindRelease ItemKind = "release"
+	KindArtist  ItemKind = "artist"
+)
+
+// MaxRating is the highest rating.
+const MaxRating = 5
+
+// Rating is whether a user starred a track, release or artist, and how they
+// rated it. Rating is from 1 to MaxRating, or 0 if the item is not rated.
+type Rating struct {
+	ID        int64
+	UserID    int64    `gorm:"unique_index:idx_rating_item"`
+	Kind      ItemKind `gorm:"unique_index:idx_rating_item"`
+	ItemID    int64    `gorm:"unique_index:idx_rating_item"`
+	StarredAt *time.Time
+	Rating    int
+}
+
+// StarredItems holds the items a user starred, most recently starred first.
+type StarredItems struct {
+	Releases []Release
+	Tracks   []Track
+	Artists  []Artist
+}
+
+// Credit is a single artist in a displayed artist credit.
+type Credit struct {
+	ArtistID   int64
+	Name       string
+	JoinPhrase string
 }
 
 func (r *Release) AddTrack(track Track) {
@@ -63,13 +415,171 @@ func (r *Release) AddTrack(track Track) {
 }
 
 func (r *Release) AddArtist(artist Artist) {
-	r.Artists = append(r.Artists, artist)
+	r.AddCredit(artist, "")
+}
+
+// AddCredit appends artist to the release's artist credit, followed by
+// joinPhrase.
+func (r *Release) AddCredit(artist Artist, joinPhrase string) {
+	r.Artists = append(r.Artists, ReleaseArtist{
+		ArtistID:   artist.ID,
+		Artist:     artist,
+		Position:   len(r.Artists),
+		JoinPhrase: joinPhrase,
+	})
+}
+
+// Credits returns the release's artist credit in order. Artists that were
+// added without a join phrase are separated by a comma.
+func (r Release) Credits() []Credit {
+	credits := make([]Credit, len(r.Artists))
+	for i, a := range r.Artists {
+		credits[i] = Credit{ArtistID: a.ArtistID, Name: a.Artist.Name, JoinPhrase: a.JoinPhrase}
+	}
+	return joinCredits(credits)
+}
+
+// ArtistCredit returns the full artist credit of the release as a string.
+func (r Release) ArtistCredit() string {
+	return creditString(r.Credits())
 }
 
 func (t *Track) AddArtist(artist Artist) {
-	t.Artists = append(t.Artists, artist)
+	t.AddCredit(artist, "")
+}
+
+// AddCredit appends artist to the track's artist credit, followed by
+// joinPhrase.
+func (t *Track) AddCredit(artist Artist, joinPhrase string) {
+	t.Artists = append(t.Artists, TrackArtist{
+		ArtistID:   artist.ID,
+		Artist:     artist,
+		Position:   len(t.Artists),
+		JoinPhrase: joinPhrase,
+	})
+}
+
+// Credits returns the track's artist credit in order. See Release.Credits.
+func (t Track) Credits() []Credit {
+	credits := make([]Credit, len(t.Artists))
+	for i, a := range t.Artists {
+		credits[i] = Credit{ArtistID: a.ArtistID, Name: a.Artist.Name, JoinPhrase: a.JoinPhrase}
+	}
+	return joinCredits(credits)
+}
+
+// ArtistCredit returns the full artist credit of the track as a string.
+func (t Track) ArtistCredit() string {
+	return creditString(t.Credits())
 }
 
 func (t *Track) AddStream(s Stream) {
 	t.Streams = append(t.Streams, s)
 }
+
+// Duration returns the duration of the track's first stream, or zero if it
+// has none.
+func (t Track) Duration() time.Duration {
+	if len(t.Streams) == 0 {
+		return 0
+	}
+	return t.Streams[0].Duration
+}
+
+// Duration returns the total running time of the release's tracks.
+func (r Release) Duration() time.Duration {
+	var d time.Duration
+	for _, t := range r.Tracks {
+		d += t.Duration()
+	}
+	return d
+}
+
+// AddTrack appends a track to the playlist.
+func (p *Playlist) AddTrack(track Track) {
+	p.Entries = append(p.Entries, PlaylistEntry{
+		TrackID:  track.ID,
+		Track:    track,
+		Position: len(p.Entries),
+	})
+}
+
+// Duration returns the total running time of the playlist's tracks.
+func (p Playlist) Duration() time.Duration {
+	var d time.Duration
+	for _, e := range p.Entries {
+		d += e.Track.Duration()
+	}
+	return d
+}
+
+// SetPassword replaces the user's password hash with a bcrypt hash of
+// password.
+func (u *User) SetPassword(password string) error {
+	if password == "" {
+		return fmt.Errorf("password is empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// CheckPassword reports whether password is the user's password.
+func (u User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// SetScopes sets the scopes of the token, which must be known.
+func (t *Token) SetScopes(scopes []string) error {
+	var set []string
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+		set = append(set, scope)
+	}
+	if len(set) == 0 {
+		return fmt.Errorf("token has no scopes")
+	}
+	t.Scopes = strings.Join(set, " ")
+	return nil
+}
+
+// ScopeList returns the scopes of the token.
+func (t Token) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// HasScope reports whether the token has scope, or the admin scope.
+func (t Token) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func joinCredits(credits []Credit) []Credit {
+	for i := range credits {
+		if i < len(credits)-1 && credits[i].JoinPhrase == "" {
+			credits[i].JoinPhrase = ", "
+		}
+	}
+	return credits
+}
+
+func creditString(credits []Credit) string {
+	var s string
+	for _, c := range credits {
+		s += c.Name + c.JoinPhrase
+	}
+	return s
+}
@@ -0,0 +1,237 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SmartRules select the tracks of a smart playlist. The tracks matching the
+// rules are sorted by Sort, or by the time they were added, and cut off at
+// Limit if it is not zero. Rating and play rules are of the ratings and plays
+// of the user who made the playlist.
+type SmartRules struct {
+	Match Match  `json:"match"`
+	Rules []Rule `json:"rules"`
+	Sort  Sort   `json:"sort,omitempty"`
+	Desc  bool   `json:"desc,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// Match is how the rules of a group combine.
+type Match string
+
+const (
+	MatchAll Match = "all" // every rule must match, the default
+	MatchAny Match = "any" // at least one rule must match
+)
+
+// Rule compares a field of tracks with a value, or to a range from Value to
+// To. A rule with Rules is a group of rules combined by Match instead.
+type Rule struct {
+	Field RuleField `json:"field,omitempty"`
+	Op    RuleOp    `json:"op,omitempty"`
+	Value RuleValue `json:"value,omitempty"`
+	To    RuleValue `json:"to,omitempty"`
+
+	Match Match  `json:"match,omitempty"`
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// RuleField names a field of tracks that rules compare.
+type RuleField string
+
+const (
+	FieldYear     RuleField = "year"     // year of the release
+	FieldFormat   RuleField = "format"   // format of any stream, such as flac
+	FieldArtist   RuleField = "artist"   // name of any artist of the track or release
+	FieldRating   RuleField = "rating"   // 0 if unrated
+	FieldPlays    RuleField = "plays"    // number of plays
+	FieldAdded    RuleField = "added"    // date the track was added
+	FieldPlayed   RuleField = "played"   // date the track was last played
+	FieldDuration RuleField = "duration" // seconds
+)
+
+// RuleOp names how a rule compares a field with its value.
+type RuleOp string
+
+const (
+	OpIs          RuleOp = "is"
+	OpIsNot       RuleOp = "isnot"
+	OpContains    RuleOp = "contains"
+	OpNotContains RuleOp = "notcontains"
+	OpLess        RuleOp = "lt"
+	OpGreater     RuleOp = "gt"
+	OpBetween     RuleOp = "between"   // inclusive
+	OpBefore      RuleOp = "before"    // a date, YYYY-MM-DD
+	OpAfter       RuleOp = "after"     // a date, YYYY-MM-DD
+	OpInLast      RuleOp = "inlast"    // a number of days
+	OpNotInLast   RuleOp = "notinlast" // a number of days, or never
+)
+
+// Sorts of smart playlists only, besides those of lists.
+const (
+	SortRandom   Sort = "random"
+	SortPlays    Sort = "plays"
+	SortPlayed   Sort = "played"
+	SortDuration Sort = "duration"
+)
+
+// SmartSorts lists the orders of smart playlists.
+var SmartSorts = []Sort{SortAdded, SortTitle, SortYear, SortArtist, SortRating,
+	SortRandom, SortPlays, SortPlayed, SortDuration}
+
+// ruleOps lists the operators of each field.
+var ruleOps = map[RuleField][]RuleOp{
+	FieldYear:     {OpIs, OpIsNot, OpLess, OpGreater, OpBetween},
+	FieldFormat:   {OpIs, OpIsNot},
+	FieldArtist:   {OpIs, OpIsNot, OpContains, OpNotContains},
+	FieldRating:   {OpIs, OpIsNot, OpLess, OpGreater, OpBetween},
+	FieldPlays:    {OpIs, OpIsNot, OpLess, OpGreater, OpBetween},
+	FieldAdded:    {OpBefore, OpAfter, OpInLast, OpNotInLast},
+	FieldPlayed:   {OpBefore, OpAfter, OpInLast, OpNotInLast},
+	FieldDuration: {OpIs, OpIsNot, OpLess, OpGreater, OpBetween},
+}
+
+// RuleValue is the value a rule compares with. In JSON it is a string or a
+// number.
+type RuleValue string
+
+func (v *RuleValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*v = RuleValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("rule value %s is not a string or number", b)
+	}
+	*v = RuleValue(n)
+	return nil
+}
+
+// Int returns the value as an integer.
+func (v RuleValue) Int() (int64, error) {
+	n, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a whole number", v)
+	}
+	return n, nil
+}
+
+// Date returns the value as the start of a day, YYYY-MM-DD, in loc.
+func (v RuleValue) Date(loc *time.Location) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", string(v), loc)
+	if err != nil {
+		return t, fmt.Errorf("%q is not a date", v)
+	}
+	return t, nil
+}
+
+// Validate checks that the rules only use known fields, operators and
+// sorts, with values of the right kind.
+func (r SmartRules) Validate() error {
+	if err := validateGroup(r.Match, r.Rules); err != nil {
+		return err
+	}
+	if r.Sort != "" {
+		known := false
+		for _, s := range SmartSorts {
+			known = known || s == r.Sort
+		}
+		if !known {
+			return fmt.Errorf("unknown sort %q", r.Sort)
+		}
+	}
+	if r.Limit < 0 {
+		return fmt.Errorf("limit %d is negative", r.Limit)
+	}
+	return nil
+}
+
+func validateGroup(match Match, rules []Rule) error {
+	if match != "" && match != MatchAll && match != MatchAny {
+		return fmt.Errorf("unknown match %q", match)
+	}
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r Rule) validate() error {
+	if r.Rules != nil || r.Match != "" {
+		if r.Field != "" {
+			return fmt.Errorf("rule of %s is also a group", r.Field)
+		}
+		return validateGroup(r.Match, r.Rules)
+	}
+	ops, ok := ruleOps[r.Field]
+	if !ok {
+		return fmt.Errorf("unknown rule field %q", r.Field)
+	}
+	known := false
+	for _, op := range ops {
+		known = known || op == r.Op
+	}
+	if !known {
+		return fmt.Errorf("rule of %s cannot use %q", r.Field, r.Op)
+	}
+	values := []RuleValue{r.Value}
+	if r.Op == OpBetween {
+		values = append(values, r.To)
+	}
+	for _, v := range values {
+		var err error
+		switch {
+		case r.Op == OpBefore || r.Op == OpAfter:
+			_, err = v.Date(time.UTC)
+		case r.Field == FieldFormat || r.Field == FieldArtist:
+			if v == "" {
+				err = fmt.Errorf("rule of %s has no value", r.Field)
+			}
+		default:
+			_, err = v.Int()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsSmart reports whether p is a smart playlist.
+func (p Playlist) IsSmart() bool {
+	return p.Rules != ""
+}
+
+// SmartRules returns the rules of a smart playlist.
+func (p Playlist) SmartRules() (SmartRules, error) {
+	var r SmartRules
+	if !p.IsSmart() {
+		return r, fmt.Errorf("playlist %d is not a smart playlist", p.ID)
+	}
+	err := json.Unmarshal([]byte(p.Rules), &r)
+	return r, err
+}
+
+// SetSmartRules makes p a smart playlist with the given rules, which must be
+// valid.
+func (p *Playlist) SetSmartRules(r SmartRules) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	if r.Match == "" {
+		r.Match = MatchAll
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	p.Rules = string(b)
+	return nil
+}
@@ -0,0 +1,296 @@
+// Package scrobble submits the plays of users to the ListenBrainz-compatible
+// services they have set up.
+package scrobble
+
+import (
+	"encoding/json"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"log"
+	"time"
+)
+
+// Client is the name Blueshift submits listens under.
+const Client = "Blueshift"
+
+// Retries back off exponentially from minRetry up to maxRetry.
+const (
+	minRetry = time.Minute
+	maxRetry = 6 * time.Hour
+)
+
+// Forwarder submits listens to ListenBrainz services through a queue in
+// the collection, which keeps listens while a service is down and across
+// restarts.
+type Forwarder struct {
+	collection models.Collection
+	client     services.ListenBrainzClient
+
+	// Interval is how often the queue is checked for listens to retry.
+	Interval time.Duration
+
+	wake chan struct{}
+}
+
+func NewForwarder(c models.Collection, client services.ListenBrainzClient) *Forwarder {
+	return &Forwarder{
+		collection: c,
+		client:     client,
+		Interval:   time.Minute,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Enqueue queues plays for submission to the services of their users.
+// Plays of users without a service are skipped.
+func (f *Forwarder) Enqueue(plays ...models.Play) error {
+	users := make(map[int64]models.User)
+	var queued []models.QueuedListen
+	for _, p := range plays {
+		u, ok := users[p.UserID]
+		if !ok {
+			var err error
+			if u, err = f.user(p.UserID); err != nil {
+				return err
+			}
+			users[p.UserID] = u
+		}
+		if u.ListenBrainzToken == "" {
+			continue
+		}
+		listen, err := f.listen(p.TrackID, p.Client)
+		if err != nil {
+			return err
+		}
+		listen.ListenedAt = p.PlayedAt.Unix()
+		data, err := json.Marshal(listen)
+		if err != nil {
+			return err
+		}
+		queued = append(queued, models.QueuedListen{UserID: u.ID, Listen: string(data)})
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+	if err := f.collection.QueueListens(queued); err != nil {
+		return err
+	}
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// NowPlaying tells the service of a user that they are playing a track.
+// Notifications are not queued, as they mean nothing later.
+func (f *Forwarder) NowPlaying(userID int64, trackID int64, client string) error {
+	u, err := f.user(userID)
+	if err != nil || u.ListenBrainzToken == "" {
+		return err
+	}
+	listen, err := f.listen(trackID, client)
+	if err != nil {
+		return err
+	}
+	return f.client.Submit(serviceURL(u), u.ListenBrainzToken, services.ListenPlayingNow,
+		[]services.Listen{listen})
+}
+
+// Backfill queues the plays of u since a time, to submit the plays from
+// before the service was set up. It returns the number of plays queued.
+func (f *Forwarder) Backfill(u models.User, since time.Time) (int, error) {
+	var plays []models.Play
+	for offset := 0; ; offset += services.MaxListens {
+		page, err := f.collection.Plays(u.ID, offset, services.MaxListens)
+		if err != nil {
+			return 0, err
+		}
+		for _, p := range page {
+			if p.PlayedAt.Before(since) {
+				page = nil
+				break
+			}
+			plays = append(plays, p)
+		}
+		if len(page) < services.MaxListens {
+			break
+		}
+	}
+	// Plays are listed newest first.
+	for i, j := 0, len(plays)-1; i < j; i, j = i+1, j-1 {
+		plays[i], plays[j] = plays[j], plays[i]
+	}
+	return len(plays), f.Enqueue(plays...)
+}
+
+// Flush submits the queued listens that are due, in batches per user. If a
+// service fails, the listens of its user are retried later, unless the
+// service rejected them as invalid.
+func (f *Forwarder) Flush() error {
+	due, err := f.collection.DueListens(time.Now())
+	if err != nil {
+		return err
+	}
+	var order []int64
+	byUser := make(map[int64][]models.QueuedListen)
+	for _, q := range due {
+		if _, ok := byUser[q.UserID]; !ok {
+			order = append(order, q.UserID)
+		}
+		byUser[q.UserID] = append(byUser[q.UserID], q)
+	}
+	for _, id := range order {
+		if err := f.flushUser(id, byUser[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushUser submits the due listens of a user. Only errors of the collection
+// are returned.
+func (f *Forwarder) flushUser(userID int64, queued []models.QueuedListen) error {
+	u, err := f.user(userID)
+	if err != nil {
+		return err
+	}
+	for len(queued) > 0 {
+		n := services.MaxListens
+		if n > len(queued) {
+			n = len(queued)
+		}
+		batch := queued[:n]
+		var ids []int64
+		var listens []services.Listen
+		for _, q := range batch {
+			var l services.Listen
+			if err := json.Unmarshal([]byte(q.Listen), &l); err != nil {
+				log.Printf("listenbrainz: dropping queued listen %d: %v", q.ID, err)
+			} else {
+				listens = append(listens, l)
+			}
+			ids = append(ids, q.ID)
+		}
+		kind := services.ListenImport
+		if len(listens) == 1 {
+			kind = services.ListenSingle
+		}
+		switch {
+		case u.ListenBrainzToken == "":
+			// The user turned submissions off since the plays were queued.
+		case len(listens) == 0:
+		default:
+			err = f.client.Submit(serviceURL(u), u.ListenBrainzToken, kind, listens)
+		}
+		if err != nil && !services.IsPermanent(err) {
+			// Later listens wait for earlier ones, so the rest of the queue
+			// is postponed as well.
+			var rest []int64
+			for _, q := range queued {
+				rest = append(rest, q.ID)
+			}
+			return f.collection.PostponeListens(rest, time.Now().Add(backoff(queued[0].Attempts)), err.Error())
+		}
+		if err != nil {
+			log.Printf("listenbrainz: dropping %d listens of %s: %v", len(ids), u.Name, err)
+		}
+		if err := f.collection.DeleteQueuedListens(ids); err != nil {
+			return err
+		}
+		queued = queued[n:]
+	}
+	return nil
+}
+
+// Run submits queued listens as they are queued, and retries failed ones,
+// until stop is closed.
+func (f *Forwarder) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(f.Interval)
+	defer ticker.Stop()
+	for {
+		if err := f.Flush(); err != nil {
+			log.Printf("listenbrainz: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-f.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// user returns the user with the given ID. Plays made without logins belong
+// to no user, and return the zero User.
+func (f *Forwarder) user(id int64) (models.User, error) {
+	if id == 0 {
+		return models.User{}, nil
+	}
+	u, err := f.collection.GetUser(id)
+	if models.IsNotFound(err) {
+		return u, nil
+	}
+	return u, err
+}
+
+// listen returns a listen of a track, without the time it was listened at.
+func (f *Forwarder) listen(trackID int64, player string) (services.Listen, error) {
+	t, err := f.collection.GetTrack(trackID)
+	if err != nil {
+		return services.Listen{}, err
+	}
+	var rel models.Release
+	if t.ReleaseID != 0 {
+		if rel, err = f.collection.GetRelease(t.ReleaseID); err != nil && !models.IsNotFound(err) {
+			return services.Listen{}, err
+		}
+	}
+	return listenOf(t, rel, player), nil
+}
+
+// listenOf returns a listen of a track on a release.
+func listenOf(t models.Track, rel models.Release, player string) services.Listen {
+	info := services.AdditionalInfo{
+		RecordingMBID:    t.MBID,
+		ReleaseMBID:      rel.MBID,
+		TrackNumber:      t.Position,
+		DurationMs:       int64(t.Duration() / time.Millisecond),
+		MediaPlayer:      player,
+		SubmissionClient: Client,
+	}
+	for _, a := range t.Artists {
+		if a.Artist.MBID != "" {
+			info.ArtistMBIDs = append(info.ArtistMBIDs, a.Artist.MBID)
+		}
+	}
+	return services.Listen{
+		TrackMetadata: services.TrackMetadata{
+			ArtistName:     t.ArtistCredit(),
+			TrackName:      t.Title,
+			ReleaseName:    rel.Title,
+			AdditionalInfo: info,
+		},
+	}
+}
+
+// serviceURL returns the API root of the service of u.
+func serviceURL(u models.User) string {
+	if u.ListenBrainzURL == "" {
+		return services.DefaultListenBrainzURL
+	}
+	return u.ListenBrainzURL
+}
+
+// backoff returns how long to wait before another attempt after failed
+// ones.
+func backoff(attempts int) time.Duration {
+	d := minRetry
+	for i := 0; i < attempts && d < maxRetry; i++ {
+		d *= 2
+	}
+	if d > maxRetry {
+		d = maxRetry
+	}
+	return d
+}
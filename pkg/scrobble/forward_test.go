@@ -0,0 +1,167 @@
+package scrobble
+
+import (
+	"encoding/json"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubService is a ListenBrainz service that records the submissions it
+// accepts, and fails with status while it is set.
+type stubService struct {
+	sync.Mutex
+	status      int
+	submissions []submission
+}
+
+type submission struct {
+	Token      string
+	ListenType string            `json:"listen_type"`
+	Payload    []services.Listen `json:"payload"`
+}
+
+func (s *stubService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.URL.Path != "/1/submit-listens" {
+		http.NotFound(w, r)
+		return
+	}
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		w.Write([]byte(`{"code": 0, "error": "stub failure"}`))
+		return
+	}
+	var sub submission
+	json.NewDecoder(r.Body).Decode(&sub)
+	sub.Token = r.Header.Get("Authorization")
+	s.submissions = append(s.submissions, sub)
+	w.Write([]byte(`{"status": "ok"}`))
+}
+
+func TestForwarder(t *testing.T) {
+	Convey("Test forwarder", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		store.Initialize(db)
+		c := store.NewDbCollection(db)
+
+		stub := &stubService{}
+		ts := httptest.NewServer(stub)
+		defer ts.Close()
+
+		u := models.User{Name: "alice", ListenBrainzURL: ts.URL, ListenBrainzToken: "secret"}
+		So(c.CreateUser(&u), ShouldBeNil)
+		other := models.User{Name: "bob"}
+		So(c.CreateUser(&other), ShouldBeNil)
+
+		artist := models.Artist{Name: "Artist", MBID: "artist-mbid"}
+		c.CreateArtist(&artist)
+		rel := models.Release{Title: "Release", MBID: "release-mbid"}
+		tr := models.Track{Title: "Track", MBID: "recording-mbid", Position: 3}
+		tr.AddArtist(artist)
+		rel.AddTrack(tr)
+		So(c.CreateRelease(&rel), ShouldBeNil)
+		tr = rel.Tracks[0]
+
+		f := NewForwarder(c, services.ListenBrainzClient{})
+		start := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+		play := func(user models.User, minutes int) models.Play {
+			p := models.Play{UserID: user.ID, TrackID: tr.ID, Client: "test",
+				PlayedAt: start.Add(time.Duration(minutes) * time.Minute)}
+			So(c.CreatePlay(&p), ShouldBeNil)
+			return p
+		}
+		queued := func() int {
+			n, _ := c.CountQueuedListens(u.ID)
+			return n
+		}
+
+		Convey("should submit plays of users with a service", func() {
+			So(f.Enqueue(play(u, 0), play(other, 1)), ShouldBeNil)
+			So(queued(), ShouldEqual, 1)
+			So(f.Flush(), ShouldBeNil)
+			So(len(stub.submissions), ShouldEqual, 1)
+			sub := stub.submissions[0]
+			So(sub.Token, ShouldEqual, "Token secret")
+			So(sub.ListenType, ShouldEqual, services.ListenSingle)
+			l := sub.Payload[0]
+			So(l.ListenedAt, ShouldEqual, start.Unix())
+			So(l.TrackMetadata.ArtistName, ShouldEqual, "Artist")
+			So(l.TrackMetadata.TrackName, ShouldEqual, "Track")
+			So(l.TrackMetadata.ReleaseName, ShouldEqual, "Release")
+			info := l.TrackMetadata.AdditionalInfo
+			So(info.RecordingMBID, ShouldEqual, "recording-mbid")
+			So(info.ReleaseMBID, ShouldEqual, "release-mbid")
+			So(info.ArtistMBIDs, ShouldResemble, []string{"artist-mbid"})
+			So(info.TrackNumber, ShouldEqual, 3)
+			So(info.MediaPlayer, ShouldEqual, "test")
+			So(queued(), ShouldEqual, 0)
+		})
+
+		Convey("should keep listens while the service is down", func() {
+			stub.status = http.StatusServiceUnavailable
+			So(f.Enqueue(play(u, 0)), ShouldBeNil)
+			So(f.Flush(), ShouldBeNil)
+			So(queued(), ShouldEqual, 1)
+			due, _ := c.DueListens(time.Now().Add(2 * time.Minute))
+			So(len(due), ShouldEqual, 1)
+			So(due[0].Attempts, ShouldEqual, 1)
+			So(due[0].LastError, ShouldContainSubstring, "stub failure")
+
+			Convey("and backfill them in order when it is back", func() {
+				So(f.Enqueue(play(u, 1)), ShouldBeNil)
+				stub.status = 0
+				db.Model(&models.QueuedListen{}).UpdateColumn("next_attempt", time.Now().UTC())
+				So(f.Flush(), ShouldBeNil)
+				So(len(stub.submissions), ShouldEqual, 1)
+				sub := stub.submissions[0]
+				So(sub.ListenType, ShouldEqual, services.ListenImport)
+				So(len(sub.Payload), ShouldEqual, 2)
+				So(sub.Payload[0].ListenedAt, ShouldEqual, start.Unix())
+				So(queued(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("should drop listens the service rejects", func() {
+			stub.status = http.StatusBadRequest
+			So(f.Enqueue(play(u, 0)), ShouldBeNil)
+			So(f.Flush(), ShouldBeNil)
+			So(queued(), ShouldEqual, 0)
+		})
+
+		Convey("should backfill past plays", func() {
+			play(u, 0)
+			play(u, 1)
+			play(u, 2)
+			n, err := f.Backfill(u, start.Add(time.Minute))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			So(f.Flush(), ShouldBeNil)
+			sub := stub.submissions[0]
+			So(len(sub.Payload), ShouldEqual, 2)
+			So(sub.Payload[0].ListenedAt, ShouldEqual, start.Add(time.Minute).Unix())
+		})
+
+		Convey("should send now playing without queueing", func() {
+			So(f.NowPlaying(u.ID, tr.ID, "test"), ShouldBeNil)
+			So(f.NowPlaying(other.ID, tr.ID, "test"), ShouldBeNil)
+			So(len(stub.submissions), ShouldEqual, 1)
+			So(stub.submissions[0].ListenType, ShouldEqual, services.ListenPlayingNow)
+			So(stub.submissions[0].Payload[0].ListenedAt, ShouldEqual, 0)
+			So(queued(), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithLogin requires users to log in. Everything but the login page, static
+// files and the Subsonic API, which has its own users, needs a session or an
+// API token, and only admins can upload and edit.
+func WithLogin() Option {
+	return func(s *Server) {
+		s.login = true
+	}
+}
+
+const (
+	sessionCookie   = "blueshift_session"
+	sessionLifetime = 30 * 24 * time.Hour
+	// exportLifetime is how long the stream URLs of playlist exports play.
+	exportLifetime = 7 * 24 * time.Hour
+)
+
+// WithSigningKey signs the stream URLs of playlist exports with key. Without
+// it a key is made when the server starts, and exports stop playing when it
+// restarts.
+func WithSigningKey(key []byte) Option {
+	return func(s *Server) {
+		s.signingKey = key
+	}
+}
+
+type contextKey int
+
+const userKey contextKey = iota
+
+// dummyUser has the hash of a password nobody knows, so that logging in as a
+// missing user takes as long as with a wrong password.
+var dummyUser = models.User{
+	PasswordHash: "$2a$10$IxFKFEFknVya0uNwFd3eA.q0U/WhiTDvLgYr3cDvtNPF7JBaRgtv2",
+}
+
+// authenticate passes requests with a valid API token or session cookie on
+// to next, with the user in their context. Tokens must have the scope the
+// request needs. Other requests are redirected to the login page if they come
+// from a browser, and refused otherwise.
+func (s Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t, ok, err := s.bearerToken(auth)
+			if err != nil {
+				s.fail(w, err)
+				return
+			}
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="blueshift"`)
+				s.error(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+				return
+			}
+			if scope := requiredScope(r); !t.HasScope(scope) {
+				s.error(w, http.StatusForbidden, fmt.Errorf("token needs the %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, t.User)))
+			return
+		}
+		if u, ok, err := s.signedUser(r); err != nil {
+			s.fail(w, err)
+			return
+		} else if ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, u)))
+			return
+		}
+		if u, ok := s.sessionUser(r); ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, u)))
+			return
+		}
+		if r.Method == "GET" && !wantsJSON(r) && !strings.HasSuffix(r.URL.Path, ".json") {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		s.error(w, http.StatusUnauthorized, fmt.Errorf("login required"))
+	})
+}
+
+// isPublic reports whether a path can be requested without logging in.
+func isPublic(path string) bool {
+	return path == "/login" || strings.HasPrefix(path, "/static/") ||
+		strings.HasPrefix(path, "/rest/")
+}
+
+// bearerToken returns the API token of an Authorization header, and records
+// that it was used.
+func (s Server) bearerToken(auth string) (models.Token, bool, error) {
+	parts := strings.Fields(auth)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return models.Token{}, false, nil
+	}
+	t, err := s.collection.GetTokenByHash(hashSecret(parts[1]))
+	if models.IsNotFound(err) {
+		return t, false, nil
+	} else if err != nil {
+		return t, false, err
+	}
+	// Streams are read with many range requests, which need not all be
+	// recorded.
+	now := time.Now()
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > time.Minute {
+		if err := s.collection.TouchToken(t.ID, now); err != nil {
+			return t, false, err
+		}
+	}
+	return t, true, nil
+}
+
+var (
+	streamPath = regexp.MustCompile(`^/tracks/[0-9]+/stream$`)
+	uploadPath = regexp.MustCompile(`^/(tracks|releases)/upload$|^/tracks/[0-9]+/streams$`)
+	ratingPath = regexp.MustCompile(`^/(tracks|releases|artists)/[0-9]+/rating$`)
+	exportPath = regexp.MustCompile(`^/playlists/[0-9]+\.(m3u8|pls|xspf)$`)
+)
+
+// requiredScope returns the scope an API token needs for a request. Players
+// stream, scrobble and rate, and requests that change anything but by
+// uploading need the admin scope. Playlist exports sign stream URLs, so
+// they need the stream scope too.
+func requiredScope(r *http.Request) string {
+	switch {
+	case streamPath.MatchString(r.URL.Path) || r.URL.Path == "/scrobble" ||
+		ratingPath.MatchString(r.URL.Path) || exportPath.MatchString(r.URL.Path):
+		return models.ScopeStream
+	case r.Method == "GET" || r.Method == "HEAD":
+		return models.ScopeRead
+	case uploadPath.MatchString(r.URL.Path):
+		return models.ScopeUpload
+	default:
+		return models.ScopeAdmin
+	}
+}
+
+// signedUser returns the user a stream URL was signed for by signStream,
+// and whether the request has such a URL that has not expired.
+func (s Server) signedUser(r *http.Request) (models.User, bool, error) {
+	query := r.URL.Query()
+	sig := query.Get("signature")
+	if sig == "" || len(s.signingKey) == 0 || (r.Method != "GET" && r.Method != "HEAD") ||
+		!streamPath.MatchString(r.URL.Path) {
+		return models.User{}, false, nil
+	}
+	want := streamSignature(s.signingKey, r.URL.Path, query.Get("user"), query.Get("expires"))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return models.User{}, false, nil
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return models.User{}, false, nil
+	}
+	id, err := strconv.ParseInt(query.Get("user"), 10, 64)
+	if err != nil {
+		return models.User{}, false, nil
+	}
+	u, err := s.collection.GetUser(id)
+	if models.IsNotFound(err) {
+		return u, false, nil
+	}
+	return u, err == nil, err
+}
+
+// signStream returns the query that lets the stream at path be played as
+// a user without logging in until expires. Players open the stream URLs of
+// playlist exports without a session or a token.
+func signStream(key []byte, path string, userID int64, expires time.Time) url.Values {
+	user := strconv.FormatInt(userID, 10)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{
+		"user":      {user},
+		"expires":   {exp},
+		"signature": {streamSignature(key, path, user, exp)},
+	}
+}
+
+func streamSignature(key []byte, path, user, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s", path, user, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sessionUser returns the user of the session named by the request's
+// session cookie.
+func (s Server) sessionUser(r *http.Request) (models.User, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return models.User{}, false
+	}
+	sess, err := s.collection.GetSession(hashSecret(c.Value))
+	if err != nil {
+		return models.User{}, false
+	}
+	return sess.User, true
+}
+
+// requireAdmin lets only admins use h when users have to log in.
+func (s Server) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if u, ok := currentUser(r); s.login && !(ok && u.Admin) {
+			s.error(w, http.StatusForbidden, fmt.Errorf("only admins can do this"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// currentUser returns the logged in user making a request.
+func currentUser(r *http.Request) (models.User, bool) {
+	u, ok := r.Context().Value(userKey).(models.User)
+	return u, ok
+}
+
+// loginPage is the context of the login template.
+type loginPage struct {
+	Name  string
+	Next  string
+	Error string
+}
+
+func (s Server) getLogin(w http.ResponseWriter, r *http.Request) {
+	s.render("login", w, loginPage{Next: localPath(r.FormValue("next"))})
+}
+
+// postLogin checks the name and password of the login form, and starts a
+// session for the user.
+func (s Server) postLogin(w http.ResponseWriter, r *http.Request) {
+	page := loginPage{Name: r.FormValue("name"), Next: localPath(r.FormValue("next"))}
+	u, err := s.collection.GetUserByName(page.Name)
+	if err != nil && !models.IsNotFound(err) {
+		s.fail(w, err)
+		return
+	}
+	if err != nil {
+		dummyUser.CheckPassword(r.FormValue("password"))
+	} else if u.CheckPassword(r.FormValue("password")) {
+		if err := s.startSession(w, r, u); err != nil {
+			s.fail(w, err)
+			return
+		}
+		http.Redirect(w, r, page.Next, http.StatusSeeOther)
+		return
+	}
+	page.Error = "Wrong name or password"
+	w.WriteHeader(http.StatusUnauthorized)
+	s.render("login", w, page)
+}
+
+// startSession creates a session for u and sets its cookie.
+func (s Server) startSession(w http.ResponseWriter, r *http.Request, u models.User) error {
+	token, err := newSecret()
+	if err != nil {
+		return err
+	}
+	sess := models.Session{
+		ID:        hashSecret(token),
+		UserID:    u.ID,
+		ExpiresAt: time.Now().Add(sessionLifetime),
+	}
+	if err := s.collection.CreateSession(&sess); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(baseURL(r), "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// logout ends the request's session.
+func (s Server) logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if err := s.collection.DeleteSession(hashSecret(c.Value)); err != nil {
+			s.fail(w, err)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// newSecret returns a random session or API token.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecret returns the hash a session or API token is stored under.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// localPath returns p if it is a path on this server, and / otherwise, so
+// that the login form cannot redirect elsewhere.
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, `/\`) {
+		return "/"
+	}
+	return p
+}
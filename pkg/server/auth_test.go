@@ -0,0 +1,110 @@
+package server
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLogin(t *testing.T) {
+	Convey("Test login", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		router := NewServer(coll, memStreamHandler{}, "../../templates", WithLogin())
+		for _, u := range []models.User{{Name: "admin", Admin: true}, {Name: "guest"}} {
+			u.SetPassword(u.Name + "-password")
+			coll.CreateUser(&u)
+		}
+
+		do := func(req *http.Request, cookie *http.Cookie) *httptest.ResponseRecorder {
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+		login := func(name, password, next string) *httptest.ResponseRecorder {
+			form := url.Values{"name": {name}, "password": {password}, "next": {next}}
+			req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+			return do(req, nil)
+		}
+		session := func(name string) *http.Cookie {
+			rec := login(name, name+"-password", "/")
+			So(rec.Code, ShouldEqual, http.StatusSeeOther)
+			return rec.Result().Cookies()[0]
+		}
+		get := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", path, nil)
+			return do(req, cookie)
+		}
+		addRelease := func(cookie *http.Cookie) int {
+			req, _ := http.NewRequest("POST", "/releases/", strings.NewReader(`{"title": "Foo"}`))
+			req.Header.Set("Content-type", "application/json")
+			return do(req, cookie).Code
+		}
+
+		Convey("should send browsers to login page", func() {
+			rec := get("/releases/", nil)
+			So(rec.Code, ShouldEqual, http.StatusSeeOther)
+			So(rec.Header().Get("Location"), ShouldEqual, "/login?next=%2Freleases%2F")
+			So(get("/login", nil).Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("should refuse other clients", func() {
+			So(get("/releases.json", nil).Code, ShouldEqual, http.StatusUnauthorized)
+			req, _ := http.NewRequest("GET", "/tracks/1/stream", nil)
+			req.Header.Set("Accept", "application/json")
+			So(do(req, nil).Code, ShouldEqual, http.StatusUnauthorized)
+			So(addRelease(nil), ShouldEqual, http.StatusUnauthorized)
+			So(get("/releases/", &http.Cookie{Name: sessionCookie, Value: "forged"}).Code,
+				ShouldEqual, http.StatusSeeOther)
+		})
+
+		Convey("should reject wrong password", func() {
+			rec := login("guest", "admin-password", "/")
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+			So(rec.Body.String(), ShouldContainSubstring, "Wrong name or password")
+			So(rec.Result().Cookies(), ShouldBeEmpty)
+			So(login("nobody", "x", "/").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("should log in and out", func() {
+			rec := login("guest", "guest-password", "/releases/")
+			So(rec.Header().Get("Location"), ShouldEqual, "/releases/")
+			cookie := rec.Result().Cookies()[0]
+			So(cookie.HttpOnly, ShouldBeTrue)
+			rec = get("/releases/", cookie)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldContainSubstring, "Log out")
+
+			req, _ := http.NewRequest("POST", "/logout", nil)
+			So(do(req, cookie).Code, ShouldEqual, http.StatusSeeOther)
+			So(get("/releases/", cookie).Code, ShouldEqual, http.StatusSeeOther)
+		})
+
+		Convey("should only redirect to this server", func() {
+			So(login("guest", "guest-password", "//example.com/").Header().Get("Location"),
+				ShouldEqual, "/")
+		})
+
+		Convey("should let only admins edit", func() {
+			So(addRelease(session("guest")), ShouldEqual, http.StatusForbidden)
+			So(addRelease(session("admin")), ShouldEqual, http.StatusOK)
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/importer"
+	"github.com/gravesm/blueshift/pkg/models"
+	"io"
+	"net/http"
+)
+
+// WithJobs imports uploaded releases in the background with j, rather than
+// while the upload request waits, and reports their progress at /jobs/.
+func WithJobs(j *importer.Jobs) Option {
+	return func(s *Server) {
+		s.jobs = j
+	}
+}
+
+// enqueueRelease queues a job to import the release archive of a request,
+// and points the client to it.
+func (s Server) enqueueRelease(w http.ResponseWriter, r *http.Request, archive io.Reader) {
+	u, _ := currentUser(r)
+	job, err := s.jobs.Enqueue(u.ID, archive)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	if isForm(r) {
+		http.Redirect(w, r, fmt.Sprintf("/jobs/%d", job.ID), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%d", job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(jsonJobOf(job))
+}
+
+func (s Server) getJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.job(w, r)
+	if !ok {
+		return
+	}
+	s.respond(w, r, "job/job", job, jsonJobOf(job))
+}
+
+// jobEvents streams the progress of a job as server-sent job events, each
+// with the job's JSON, until it finishes or the client goes away.
+func (s Server) jobEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.error(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	job, ok := s.job(w, r)
+	if !ok {
+		return
+	}
+	// The job is read again once it is watched, so that no change is
+	// missed.
+	changes, cancel := s.jobs.Watch(job.ID)
+	defer cancel()
+	job, err := s.jobs.Job(job.ID)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	w.Header().Set("Content-type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(job models.Job) {
+		data, _ := json.Marshal(jsonJobOf(job))
+		fmt.Fprintf(w, "event: job\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+	send(job)
+	for !job.Finished() {
+		select {
+		case job = <-changes:
+			send(job)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// job returns the job named by a request. Only admins and the user who
+// uploaded the archive may see it.
+func (s Server) job(w http.ResponseWriter, r *http.Request) (models.Job, bool) {
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return models.Job{}, false
+	}
+	job, err := s.jobs.Job(id)
+	if err != nil {
+		s.fail(w, err)
+		return job, false
+	}
+	if u, ok := currentUser(r); s.login && !(ok && (u.Admin || u.ID == job.UserID)) {
+		s.fail(w, forbiddenError{fmt.Errorf("job %d is not yours", id)})
+		return job, false
+	}
+	return job, true
+}
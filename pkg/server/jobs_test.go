@@ -0,0 +1,147 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/importer"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJobs(t *testing.T) {
+	Convey("Test import jobs", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		db.DB().SetMaxOpenConns(1)
+		tmp, err := ioutil.TempDir("", "blueshift-")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		sh := services.FileStreamHandler{Directory: tmp}
+		jobs := importer.NewJobs(coll, sh, filepath.Join(tmp, "spool"))
+		srv := httptest.NewServer(NewServer(coll, sh, "../../templates", WithJobs(jobs)))
+		defer srv.Close()
+
+		var buf bytes.Buffer
+		arxv := zip.NewWriter(&buf)
+		audio, _ := ioutil.ReadFile("../testdata/papageno.ogg")
+		f, _ := arxv.Create("Album/papageno.ogg")
+		f.Write(audio)
+		f, _ = arxv.Create("Album/rip.log")
+		f.Write([]byte("ripped"))
+		arxv.Close()
+		resp, err := http.Post(srv.URL+"/releases/upload", "application/zip", &buf)
+		if err != nil {
+			panic(err)
+		}
+		var job jsonJob
+		json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+
+		Convey("should queue uploaded release", func() {
+			So(resp.StatusCode, ShouldEqual, http.StatusAccepted)
+			So(resp.Header.Get("Location"), ShouldEqual, fmt.Sprintf("/jobs/%d", job.ID))
+			So(job.Status, ShouldEqual, models.JobQueued)
+			So(job.Total, ShouldEqual, 2)
+			So(job.Files, ShouldBeEmpty)
+		})
+
+		Convey("should stream progress until done", func() {
+			stop := make(chan struct{})
+			defer close(stop)
+			resp, err := http.Get(fmt.Sprintf("%s/jobs/%d/events", srv.URL, job.ID))
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			So(resp.Header.Get("Content-type"), ShouldEqual, "text/event-stream")
+			go jobs.Run(stop)
+
+			var last jsonJob
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+					last = jsonJob{}
+					json.Unmarshal([]byte(data), &last)
+				}
+			}
+			So(last.Status, ShouldEqual, models.JobDone)
+			So(last.Done, ShouldEqual, 2)
+			So(last.ReleaseID, ShouldNotEqual, 0)
+
+			resp, err = http.Get(fmt.Sprintf("%s/jobs/%d.json", srv.URL, job.ID))
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			var got jsonJob
+			json.NewDecoder(resp.Body).Decode(&got)
+			So(got.Status, ShouldEqual, models.JobDone)
+			So(got.ReleaseID, ShouldEqual, last.ReleaseID)
+			So(got.Files[1].Kind, ShouldEqual, "log")
+			rel, err := coll.GetRelease(got.ReleaseID)
+			So(err, ShouldBeNil)
+			So(rel.Tracks[0].Title, ShouldEqual, "Der Vogelfänger bin ich ja")
+		})
+
+		Convey("should show job page", func() {
+			resp, err := http.Get(fmt.Sprintf("%s/jobs/%d", srv.URL, job.ID))
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(string(body), ShouldContainSubstring, "Waiting to start")
+		})
+
+		Convey("should point form upload to its job", func() {
+			var buf bytes.Buffer
+			form := multipart.NewWriter(&buf)
+			f, _ := form.CreateFormFile("files", "Album/papageno.ogg")
+			f.Write(audio)
+			form.Close()
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}}
+			resp, err := client.Post(srv.URL+"/releases/upload", form.FormDataContentType(), &buf)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusSeeOther)
+			So(resp.Header.Get("Location"), ShouldEqual, fmt.Sprintf("/jobs/%d", job.ID+1))
+			queued, err := jobs.Job(job.ID + 1)
+			So(err, ShouldBeNil)
+			So(queued.Total, ShouldEqual, 1)
+		})
+
+		Convey("should refuse upload that is not an archive", func() {
+			resp, err := http.Post(srv.URL+"/releases/upload", "application/zip", strings.NewReader("x"))
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusUnsupportedMediaType)
+		})
+
+		Convey("should return not found for missing job", func() {
+			resp, err := http.Get(srv.URL + "/jobs/100.json")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
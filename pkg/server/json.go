@@ -0,0 +1,505 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/importer"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The JSON representations of the collection. Field names match the model
+// fields case-insensitively, so a representation that is read can be posted
+// back to the edit routes. Lists are never null. The tracks of a release and
+// the releases and tracks of an artist are left out where they have not
+// been loaded, as in lists.
+
+type jsonRelease struct {
+	ID        int64        `json:"id"`
+	MBID      string       `json:"mbid"`
+	Title     string       `json:"title"`
+	Year      int          `json:"year"`
+	Credit    string       `json:"credit"`
+	Artists   []jsonCredit `json:"artists"`
+	Tracks    []jsonTrack  `json:"tracks,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+	CoverURL  string       `json:"coverUrl,omitempty"`
+	Duration  float64      `json:"duration,omitempty"` // seconds
+	Starred   bool         `json:"starred,omitempty"`
+	Rating    int          `json:"rating,omitempty"`
+}
+
+type jsonTrack struct {
+	ID        int64        `json:"id"`
+	MBID      string       `json:"mbid"`
+	Title     string       `json:"title"`
+	Position  int          `json:"position"`
+	Disc      int          `json:"disc"`
+	ReleaseID int64        `json:"releaseId"`
+	Credit    string       `json:"credit"`
+	Artists   []jsonCredit `json:"artists"`
+	Streams   []jsonStream `json:"streams"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Duration  float64      `json:"duration"` // seconds
+	Starred   bool         `json:"starred,omitempty"`
+	Rating    int          `json:"rating,omitempty"`
+}
+
+// jsonStream has the audio properties of a stream, which are read-only.
+type jsonStream struct {
+	ID         int64      `json:"id"`
+	TrackID    int64      `json:"trackId"`
+	Format     jsonFormat `json:"format"`
+	URL        string     `json:"url"`
+	Duration   float64    `json:"duration"` // seconds
+	Bitrate    int        `json:"bitrate"`
+	SampleRate int        `json:"sampleRate"`
+	BitDepth   int        `json:"bitDepth"`
+	Channels   int        `json:"channels"`
+	Size       int64      `json:"size"`
+}
+
+type jsonFormat struct {
+	Name     string `json:"name"`
+	Mimetype string `json:"mimetype"`
+}
+
+// jsonCredit is a single artist of an artist credit.
+type jsonCredit struct {
+	ArtistID   int64  `json:"artistId"`
+	MBID       string `json:"mbid"`
+	Name       string `json:"name"`
+	Position   int    `json:"position"`
+	JoinPhrase string `json:"joinPhrase"`
+}
+
+type jsonArtist struct {
+	ID       int64         `json:"id"`
+	MBID     string        `json:"mbid"`
+	Name     string        `json:"name"`
+	Releases []jsonRelease `json:"releases,omitempty"`
+	Tracks   []jsonTrack   `json:"tracks,omitempty"`
+	Starred  bool          `json:"starred,omitempty"`
+	Rating   int           `json:"rating,omitempty"`
+}
+
+// jsonRating is whether the user starred an item of a kind, and how they
+// rated it.
+type jsonRating struct {
+	Kind      models.ItemKind `json:"kind"`
+	ID        int64           `json:"id"`
+	Starred   bool            `json:"starred"`
+	StarredAt *time.Time      `json:"starredAt"`
+	Rating    int             `json:"rating"`
+}
+
+type jsonPlaylist struct {
+	ID         int64               `json:"id"`
+	Name       string              `json:"name"`
+	Comment    string              `json:"comment"`
+	TrackCount int                 `json:"trackCount"`
+	Duration   float64             `json:"duration"` // seconds
+	Entries    []jsonPlaylistEntry `json:"entries,omitempty"`
+	Rules      *models.SmartRules  `json:"rules,omitempty"`
+	CreatedAt  time.Time           `json:"createdAt"`
+	UpdatedAt  time.Time           `json:"updatedAt"`
+}
+
+type jsonPlaylistEntry struct {
+	ID       int64     `json:"id"`
+	Position int       `json:"position"`
+	Track    jsonTrack `json:"track"`
+}
+
+// jsonToken is an API token. The secret token is only sent when it is
+// created.
+type jsonToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	Token      string     `json:"token,omitempty"`
+}
+
+// jsonListenBrainz is the ListenBrainz service of a user, without its
+// token. Queued counts the listens waiting to be submitted.
+type jsonListenBrainz struct {
+	URL     string `json:"url"`
+	Enabled bool   `json:"enabled"`
+	Queued  int    `json:"queued"`
+}
+
+// jsonJob is an import job. Done counts the files imported so far, and
+// Warnings lists the files that were skipped as they could not be read.
+type jsonJob struct {
+	ID        int64                 `json:"id"`
+	Status    models.JobStatus      `json:"status"`
+	Total     int                   `json:"total"`
+	Done      int                   `json:"done"`
+	Files     []models.ImportedFile `json:"files"`
+	Warnings  []string              `json:"warnings,omitempty"`
+	ReleaseID int64                 `json:"releaseId,omitempty"`
+	Error     string                `json:"error,omitempty"`
+	CreatedAt time.Time             `json:"createdAt"`
+	UpdatedAt time.Time             `json:"updatedAt"`
+}
+
+type jsonPlay struct {
+	ID       int64     `json:"id"`
+	Track    jsonTrack `json:"track"`
+	PlayedAt time.Time `json:"playedAt"`
+	Client   string    `json:"client,omitempty"`
+}
+
+// jsonPlayCount counts the plays of a track, release or artist, whichever is
+// set.
+type jsonPlayCount struct {
+	Track      *jsonTrack   `json:"track,omitempty"`
+	Release    *jsonRelease `json:"release,omitempty"`
+	Artist     *jsonArtist  `json:"artist,omitempty"`
+	Count      int          `json:"count"`
+	LastPlayed time.Time    `json:"lastPlayed"`
+}
+
+// jsonPlaylistImport reports how the items of an imported playlist file
+// matched tracks.
+type jsonPlaylistImport struct {
+	Playlist  jsonPlaylist        `json:"playlist"`
+	Items     []jsonPlaylistMatch `json:"items"`
+	Unmatched int                 `json:"unmatched"`
+}
+
+type jsonPlaylistMatch struct {
+	Location  string  `json:"location"`
+	Title     string  `json:"title,omitempty"`
+	Artist    string  `json:"artist,omitempty"`
+	Duration  float64 `json:"duration,omitempty"` // seconds
+	TrackID   int64   `json:"trackId,omitempty"`
+	MatchedBy string  `json:"matchedBy,omitempty"`
+}
+
+type jsonSearchResult struct {
+	Releases []jsonRelease `json:"releases"`
+	Tracks   []jsonTrack   `json:"tracks"`
+	Artists  []jsonArtist  `json:"artists"`
+}
+
+func jsonReleaseOf(r models.Release) jsonRelease {
+	rel := jsonRelease{
+		ID:        r.ID,
+		MBID:      r.MBID,
+		Title:     r.Title,
+		Year:      r.Year,
+		Credit:    r.ArtistCredit(),
+		Artists:   make([]jsonCredit, 0, len(r.Artists)),
+		CreatedAt: r.CreatedAt,
+	}
+	for _, c := range r.Artists {
+		rel.Artists = append(rel.Artists, jsonCredit{
+			ArtistID:   c.ArtistID,
+			MBID:       c.Artist.MBID,
+			Name:       c.Artist.Name,
+			Position:   c.Position,
+			JoinPhrase: c.JoinPhrase,
+		})
+	}
+	for _, t := range r.Tracks {
+		rel.Tracks = append(rel.Tracks, jsonTrackOf(t))
+	}
+	if len(r.Tracks) > 0 {
+		rel.Duration = r.Duration().Seconds()
+	}
+	if r.Cover != "" {
+		rel.CoverURL = "/releases/" + strconv.FormatInt(r.ID, 10) + "/cover"
+	}
+	return rel
+}
+
+func jsonTrackOf(t models.Track) jsonTrack {
+	trk := jsonTrack{
+		ID:        t.ID,
+		MBID:      t.MBID,
+		Title:     t.Title,
+		Position:  t.Position,
+		Disc:      t.Disc,
+		ReleaseID: t.ReleaseID,
+		Credit:    t.ArtistCredit(),
+		Artists:   make([]jsonCredit, 0, len(t.Artists)),
+		Streams:   make([]jsonStream, 0, len(t.Streams)),
+		CreatedAt: t.CreatedAt,
+		Duration:  t.Duration().Seconds(),
+	}
+	for _, c := range t.Artists {
+		trk.Artists = append(trk.Artists, jsonCredit{
+			ArtistID:   c.ArtistID,
+			MBID:       c.Artist.MBID,
+			Name:       c.Artist.Name,
+			Position:   c.Position,
+			JoinPhrase: c.JoinPhrase,
+		})
+	}
+	for _, s := range t.Streams {
+		trk.Streams = append(trk.Streams, jsonStreamOf(s))
+	}
+	return trk
+}
+
+func jsonStreamOf(s models.Stream) jsonStream {
+	return jsonStream{
+		ID:         s.ID,
+		TrackID:    s.TrackID,
+		Format:     jsonFormat{Name: s.Format.Name, Mimetype: s.Format.Mimetype},
+		URL:        "/tracks/" + strconv.FormatInt(s.TrackID, 10) + "/stream?stream=" + strconv.FormatInt(s.ID, 10),
+		Duration:   s.Duration.Seconds(),
+		Bitrate:    s.Bitrate,
+		SampleRate: s.SampleRate,
+		BitDepth:   s.BitDepth,
+		Channels:   s.Channels,
+		Size:       s.Size,
+	}
+}
+
+func jsonArtistOf(a models.Artist) jsonArtist {
+	artist := jsonArtist{ID: a.ID, MBID: a.MBID, Name: a.Name}
+	for _, r := range a.Releases {
+		artist.Releases = append(artist.Releases, jsonReleaseOf(r))
+	}
+	for _, t := range a.Tracks {
+		artist.Tracks = append(artist.Tracks, jsonTrackOf(t))
+	}
+	return artist
+}
+
+func jsonReleasesOf(releases []models.Release) []jsonRelease {
+	list := make([]jsonRelease, 0, len(releases))
+	for _, r := range releases {
+		list = append(list, jsonReleaseOf(r))
+	}
+	return list
+}
+
+func jsonTracksOf(tracks []models.Track) []jsonTrack {
+	list := make([]jsonTrack, 0, len(tracks))
+	for _, t := range tracks {
+		list = append(list, jsonTrackOf(t))
+	}
+	return list
+}
+
+func jsonArtistsOf(artists []models.Artist) []jsonArtist {
+	list := make([]jsonArtist, 0, len(artists))
+	for _, a := range artists {
+		list = append(list, jsonArtistOf(a))
+	}
+	return list
+}
+
+func jsonPlaylistOf(p models.Playlist) jsonPlaylist {
+	pl := jsonPlaylist{
+		ID:         p.ID,
+		Name:       p.Name,
+		Comment:    p.Comment,
+		TrackCount: len(p.Entries),
+		Duration:   p.Duration().Seconds(),
+		Entries:    make([]jsonPlaylistEntry, 0, len(p.Entries)),
+		CreatedAt:  p.CreatedAt,
+		UpdatedAt:  p.UpdatedAt,
+	}
+	if rules, err := p.SmartRules(); err == nil {
+		pl.Rules = &rules
+	}
+	for _, e := range p.Entries {
+		pl.Entries = append(pl.Entries, jsonPlaylistEntry{
+			ID:       e.ID,
+			Position: e.Position,
+			Track:    jsonTrackOf(e.Track),
+		})
+	}
+	return pl
+}
+
+// jsonPlaylistsOf leaves out the entries of the playlists, as in other
+// lists.
+func jsonPlaylistsOf(playlists []models.Playlist) []jsonPlaylist {
+	list := make([]jsonPlaylist, 0, len(playlists))
+	for _, p := range playlists {
+		pl := jsonPlaylistOf(p)
+		pl.Entries = nil
+		list = append(list, pl)
+	}
+	return list
+}
+
+func jsonJobOf(j models.Job) jsonJob {
+	files := j.Files()
+	if files == nil {
+		files = []models.ImportedFile{}
+	}
+	job := jsonJob{
+		ID:        j.ID,
+		Status:    j.Status,
+		Total:     j.Total,
+		Done:      len(files),
+		Files:     files,
+		ReleaseID: j.ReleaseID,
+		Error:     j.Error,
+		CreatedAt: j.CreatedAt,
+		UpdatedAt: j.UpdatedAt,
+	}
+	for _, f := range files {
+		if f.Result == models.FileSkipped && f.Error != "" {
+			job.Warnings = append(job.Warnings, fmt.Sprintf("%s: %s", f.Name, f.Error))
+		}
+	}
+	return job
+}
+
+func jsonPlayOf(p models.Play) jsonPlay {
+	return jsonPlay{ID: p.ID, Track: jsonTrackOf(p.Track), PlayedAt: p.PlayedAt, Client: p.Client}
+}
+
+func jsonPlaysOf(plays []models.Play) []jsonPlay {
+	list := make([]jsonPlay, 0, len(plays))
+	for _, p := range plays {
+		list = append(list, jsonPlayOf(p))
+	}
+	return list
+}
+
+func jsonPlayCountsOf(counts []models.PlayCount) []jsonPlayCount {
+	list := make([]jsonPlayCount, 0, len(counts))
+	for _, c := range counts {
+		jc := jsonPlayCount{Count: c.Count, LastPlayed: c.LastPlayed}
+		switch {
+		case c.Track.ID != 0:
+			t := jsonTrackOf(c.Track)
+			jc.Track = &t
+		case c.Release.ID != 0:
+			r := jsonReleaseOf(c.Release)
+			jc.Release = &r
+		case c.Artist.ID != 0:
+			a := jsonArtistOf(c.Artist)
+			jc.Artist = &a
+		}
+		list = append(list, jc)
+	}
+	return list
+}
+
+func jsonTokenOf(t models.Token) jsonToken {
+	return jsonToken{
+		ID:         t.ID,
+		Name:       t.Name,
+		Scopes:     t.ScopeList(),
+		CreatedAt:  t.CreatedAt,
+		LastUsedAt: t.LastUsedAt,
+	}
+}
+
+func jsonTokensOf(tokens []models.Token) []jsonToken {
+	list := make([]jsonToken, 0, len(tokens))
+	for _, t := range tokens {
+		list = append(list, jsonTokenOf(t))
+	}
+	return list
+}
+
+func jsonListenBrainzOf(u models.User, queued int) jsonListenBrainz {
+	lb := jsonListenBrainz{
+		URL:     u.ListenBrainzURL,
+		Enabled: u.ListenBrainzToken != "",
+		Queued:  queued,
+	}
+	if lb.URL == "" {
+		lb.URL = services.DefaultListenBrainzURL
+	}
+	return lb
+}
+
+func jsonPlaylistImportOf(p models.Playlist, report importer.PlaylistReport) jsonPlaylistImport {
+	imp := jsonPlaylistImport{
+		Playlist:  jsonPlaylistOf(p),
+		Items:     make([]jsonPlaylistMatch, 0, len(report.Matches)),
+		Unmatched: report.Unmatched,
+	}
+	for _, m := range report.Matches {
+		imp.Items = append(imp.Items, jsonPlaylistMatch{
+			Location:  m.Item.Location,
+			Title:     m.Item.Title,
+			Artist:    m.Item.Artist,
+			Duration:  m.Item.Duration.Seconds(),
+			TrackID:   m.TrackID,
+			MatchedBy: m.By,
+		})
+	}
+	return imp
+}
+
+func jsonSearchResultOf(res models.SearchResult) jsonSearchResult {
+	return jsonSearchResult{
+		Releases: jsonReleasesOf(res.Releases),
+		Tracks:   jsonTracksOf(res.Tracks),
+		Artists:  jsonArtistsOf(res.Artists),
+	}
+}
+
+// jsonStarredOf has the starred items in the shape of search results.
+func jsonStarredOf(items models.StarredItems) jsonSearchResult {
+	res := jsonSearchResult{
+		Releases: jsonReleasesOf(items.Releases),
+		Tracks:   jsonTracksOf(items.Tracks),
+		Artists:  jsonArtistsOf(items.Artists),
+	}
+	for i := range res.Releases {
+		res.Releases[i].Starred = true
+	}
+	for i := range res.Tracks {
+		res.Tracks[i].Starred = true
+	}
+	for i := range res.Artists {
+		res.Artists[i].Starred = true
+	}
+	return res
+}
+
+func jsonRatingOf(kind models.ItemKind, id int64, r models.Rating) jsonRating {
+	return jsonRating{
+		Kind:      kind,
+		ID:        id,
+		Starred:   r.StarredAt != nil,
+		StarredAt: r.StarredAt,
+		Rating:    r.Rating,
+	}
+}
+
+// wantsJSON reports whether the client prefers JSON to HTML, going by the
+// quality values of the Accept header. Wildcards count for HTML only, so
+// that browsers and clients that accept anything get HTML.
+func wantsJSON(r *http.Request) bool {
+	jsonQ, htmlQ := -1.0, -1.0
+	for _, a := range parseAccept(r.Header.Get("Accept")) {
+		switch a.mimetype {
+		case "application/json":
+			if a.q > jsonQ {
+				jsonQ = a.q
+			}
+		case "text/html", "text/*", "*/*":
+			if a.q > htmlQ {
+				htmlQ = a.q
+			}
+		}
+	}
+	return jsonQ > 0 && jsonQ > htmlQ
+}
+
+// jsonSuffix serves the JSON representation of a route that was requested
+// with a .json suffix.
+func jsonSuffix(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Accept", "application/json")
+		h(w, r)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/scrobble"
+	"github.com/gravesm/blueshift/pkg/services"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WithForwarder submits the plays of users to their ListenBrainz services
+// with f, which has to be running. See scrobble.Forwarder.Run.
+func WithForwarder(f *scrobble.Forwarder) Option {
+	return func(s *Server) {
+		s.forwarder = f
+	}
+}
+
+// listenBrainzRequest is the JSON body of a request to set up the
+// ListenBrainz service of a user. A missing token keeps the one set, and an
+// empty token stops submissions.
+type listenBrainzRequest struct {
+	URL   string  `json:"url"`
+	Token *string `json:"token"`
+}
+
+// forward queues a play for submission to the service of its user.
+func (s Server) forward(p models.Play) {
+	if s.forwarder == nil {
+		return
+	}
+	if err := s.forwarder.Enqueue(p); err != nil {
+		log.Printf("queue listen of track %d: %v", p.TrackID, err)
+	}
+}
+
+// nowPlaying tells the service of a user that they started playing t,
+// without waiting for it.
+func (s Server) nowPlaying(userID int64, t models.Track, client string) {
+	if s.forwarder == nil || userID == 0 {
+		return
+	}
+	go func() {
+		if err := s.forwarder.NowPlaying(userID, t.ID, client); err != nil {
+			log.Printf("now playing of track %d: %v", t.ID, err)
+		}
+	}()
+}
+
+// getListenBrainz shows the ListenBrainz service of the user.
+func (s Server) getListenBrainz(w http.ResponseWriter, r *http.Request) {
+	u, _ := currentUser(r)
+	// The user in the context may be stale.
+	u, err := s.collection.GetUser(u.ID)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	queued, err := s.collection.CountQueuedListens(u.ID)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	lb := jsonListenBrainzOf(u, queued)
+	s.respond(w, r, "account/listenbrainz", lb, lb)
+}
+
+// setListenBrainz sets up the ListenBrainz service of the user from a JSON
+// request, or from the form of the ListenBrainz page, which is redirected
+// back to it.
+func (s Server) setListenBrainz(w http.ResponseWriter, r *http.Request) {
+	var req listenBrainzRequest
+	isJSON := strings.HasPrefix(r.Header.Get("Content-type"), "application/json")
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.error(w, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			s.error(w, http.StatusBadRequest, err)
+			return
+		}
+		req.URL = r.PostForm.Get("url")
+		if r.PostForm.Get("disable") != "" {
+			req.Token = new(string)
+		} else if t := r.PostForm.Get("token"); t != "" {
+			req.Token = &t
+		}
+	}
+	u, _ := currentUser(r)
+	u, err := s.collection.GetUser(u.ID)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	if err := setListenBrainz(&u, req.URL, req.Token); err != nil {
+		s.fail(w, err)
+		return
+	}
+	if err := s.collection.SaveUser(u); err != nil {
+		s.fail(w, err)
+		return
+	}
+	if !isJSON {
+		http.Redirect(w, r, "/account/listenbrainz", http.StatusSeeOther)
+		return
+	}
+	queued, err := s.collection.CountQueuedListens(u.ID)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.writeJSON(w, jsonListenBrainzOf(u, queued))
+}
+
+// setListenBrainz sets the service of u. The default service is stored as
+// an empty URL. The server submits to the service itself, so only admins
+// can choose other services, which may be on hosts that only the server
+// can reach; other users can keep the one an admin chose for them.
+func setListenBrainz(u *models.User, rawurl string, token *string) error {
+	rawurl = strings.TrimRight(strings.TrimSpace(rawurl), "/")
+	if rawurl == services.DefaultListenBrainzURL {
+		rawurl = ""
+	}
+	if rawurl != "" {
+		parsed, err := url.Parse(rawurl)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return badRequestError{fmt.Errorf("invalid ListenBrainz URL %q", rawurl)}
+		}
+		if !u.Admin && rawurl != u.ListenBrainzURL {
+			return forbiddenError{fmt.Errorf("only admins can choose a ListenBrainz server")}
+		}
+	}
+	u.ListenBrainzURL = rawurl
+	if token != nil {
+		u.ListenBrainzToken = strings.TrimSpace(*token)
+	}
+	return nil
+}
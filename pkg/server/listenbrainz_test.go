@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/scrobble"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestListenBrainz(t *testing.T) {
+	Convey("Test ListenBrainz submissions", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+
+		var listens []string
+		lb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var sub struct {
+				Payload []services.Listen `json:"payload"`
+			}
+			json.NewDecoder(r.Body).Decode(&sub)
+			for _, l := range sub.Payload {
+				listens = append(listens, l.TrackMetadata.TrackName)
+			}
+		}))
+		defer lb.Close()
+
+		fwd := scrobble.NewForwarder(coll, services.ListenBrainzClient{})
+		router := NewServer(coll, memStreamHandler{}, "../../templates", WithLogin(),
+			WithForwarder(fwd))
+		admin := models.User{Name: "admin", Admin: true}
+		coll.CreateUser(&admin)
+		tr := models.Track{Title: "Foo"}
+		coll.CreateTrack(&tr)
+		_, secret, _ := CreateToken(coll, admin, "test", []string{models.ScopeAdmin})
+
+		do := func(method, path, body string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+secret)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+		settings := func(rec *httptest.ResponseRecorder) jsonListenBrainz {
+			var s jsonListenBrainz
+			json.NewDecoder(rec.Body).Decode(&s)
+			return s
+		}
+
+		Convey("should not submit without a token", func() {
+			rec := do("GET", "/account/listenbrainz.json", "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(settings(rec), ShouldResemble,
+				jsonListenBrainz{URL: services.DefaultListenBrainzURL})
+			do("POST", "/scrobble", `{"track": 1}`)
+			So(fwd.Flush(), ShouldBeNil)
+			So(listens, ShouldBeEmpty)
+		})
+
+		Convey("should submit scrobbles to the service of the user", func() {
+			rec := do("POST", "/account/listenbrainz", `{"url": "`+lb.URL+`/", "token": "abc"}`)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(settings(rec), ShouldResemble, jsonListenBrainz{URL: lb.URL, Enabled: true})
+			u, _ := coll.GetUser(admin.ID)
+			So(u.ListenBrainzToken, ShouldEqual, "abc")
+
+			So(do("POST", "/scrobble", `{"track": 1}`).Code, ShouldEqual, http.StatusOK)
+			So(settings(do("GET", "/account/listenbrainz.json", "")).Queued, ShouldEqual, 1)
+			So(fwd.Flush(), ShouldBeNil)
+			So(listens, ShouldResemble, []string{"Foo"})
+
+			rec = do("POST", "/account/listenbrainz", `{"url": "`+lb.URL+`", "token": ""}`)
+			So(settings(rec).Enabled, ShouldBeFalse)
+		})
+
+		Convey("should refuse invalid URLs", func() {
+			rec := do("POST", "/account/listenbrainz", `{"url": "ftp://example.com"}`)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("should only let admins choose the server", func() {
+			guest := models.User{Name: "guest"}
+			guest.SetPassword("guest-password")
+			coll.CreateUser(&guest)
+			form := url.Values{"name": {"guest"}, "password": {"guest-password"}, "next": {"/"}}
+			req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			cookie := rec.Result().Cookies()[0]
+			set := func(body string) int {
+				req, _ := http.NewRequest("POST", "/account/listenbrainz", strings.NewReader(body))
+				req.Header.Set("Content-type", "application/json")
+				req.AddCookie(cookie)
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, req)
+				return rec.Code
+			}
+
+			So(set(`{"url": "http://127.0.0.1:8080", "token": "abc"}`), ShouldEqual, http.StatusForbidden)
+			u, _ := coll.GetUser(guest.ID)
+			So(u.ListenBrainzURL, ShouldBeEmpty)
+			So(u.ListenBrainzToken, ShouldBeEmpty)
+			So(set(`{"url": "`+services.DefaultListenBrainzURL+`", "token": "abc"}`), ShouldEqual, http.StatusOK)
+
+			u.ListenBrainzURL = lb.URL
+			coll.SaveUser(u)
+			So(set(`{"url": "`+lb.URL+`", "token": "def"}`), ShouldEqual, http.StatusOK)
+			u, _ = coll.GetUser(guest.ID)
+			So(u.ListenBrainzToken, ShouldEqual, "def")
+		})
+	})
+}
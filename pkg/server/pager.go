@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// listPage is the context of the list templates.
+type listPage struct {
+	Items interface{}
+	Pager pager
+
+	// Ratings are the ratings of the user of the items by ID, where the
+	// list shows them.
+	Ratings map[int64]models.Rating
+}
+
+// pager links the pages of a list. Links keep the other query parameters of
+// the request the pager was made for.
+type pager struct {
+	path   string
+	query  url.Values
+	sort   models.Sort
+	desc   bool
+	Offset int
+	Limit  int
+	Total  int
+}
+
+func newPager(r *http.Request, opts models.ListOptions, total int) pager {
+	return pager{
+		path:   r.URL.Path,
+		query:  r.URL.Query(),
+		sort:   opts.Sort,
+		desc:   opts.Desc,
+		Offset: opts.Offset,
+		Limit:  opts.Limit,
+		Total:  total,
+	}
+}
+
+// Start and End are the positions of the first and last items on the page,
+// counting from one.
+func (p pager) Start() int {
+	if p.Offset >= p.Total {
+		return p.Total
+	}
+	return p.Offset + 1
+}
+
+func (p pager) End() int {
+	if p.Offset+p.Limit > p.Total {
+		return p.Total
+	}
+	return p.Offset + p.Limit
+}
+
+// First, Prev, Next and Last link to other pages of the list. Prev and Next
+// are empty on the first and last pages.
+func (p pager) First() string {
+	return p.link(0)
+}
+
+func (p pager) Prev() string {
+	if p.Offset == 0 {
+		return ""
+	}
+	offset := p.Offset - p.Limit
+	if offset < 0 {
+		offset = 0
+	}
+	return p.link(offset)
+}
+
+func (p pager) Next() string {
+	if p.Offset+p.Limit >= p.Total {
+		return ""
+	}
+	return p.link(p.Offset + p.Limit)
+}
+
+func (p pager) Last() string {
+	last := 0
+	if p.Total > 0 {
+		last = (p.Total - 1) / p.Limit * p.Limit
+	}
+	return p.link(last)
+}
+
+// Sort links to the first page of the list in the given order, which is
+// reversed if the list is already in it.
+func (p pager) Sort(sort string) string {
+	q := p.values(0)
+	q.Set("sort", sort)
+	q.Del("order")
+	if models.Sort(sort) == p.sort {
+		if p.desc {
+			q.Set("order", "asc")
+		} else {
+			q.Set("order", "desc")
+		}
+	}
+	return p.path + "?" + q.Encode()
+}
+
+func (p pager) values(offset int) url.Values {
+	q := make(url.Values)
+	for k, v := range p.query {
+		q[k] = v
+	}
+	q.Set("offset", strconv.Itoa(offset))
+	q.Set("limit", strconv.Itoa(p.Limit))
+	return q
+}
+
+func (p pager) link(offset int) string {
+	return p.path + "?" + p.values(offset).Encode()
+}
+
+// writeHeaders sets a Link header with the links to the other pages and an
+// X-Total-Count header with the length of the list.
+func (p pager) writeHeaders(w http.ResponseWriter) {
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, p.First())}
+	if prev := p.Prev(); prev != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, prev))
+	}
+	if next := p.Next(); next != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, next))
+	}
+	links = append(links, fmt.Sprintf(`<%s>; rel="last"`, p.Last()))
+	w.Header().Set("Link", strings.Join(links, ", "))
+	w.Header().Set("X-Total-Count", strconv.Itoa(p.Total))
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/importer"
+	"github.com/gravesm/blueshift/pkg/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// playlistRequest is the JSON body of the requests that create and change
+// playlists. Tracks are track IDs and Entries are playlist entry IDs. With
+// Rules the playlist is a smart playlist, which has no tracks of its own.
+type playlistRequest struct {
+	Name    string             `json:"name"`
+	Comment string             `json:"comment"`
+	Tracks  []int64            `json:"tracks"`
+	Entries []int64            `json:"entries"`
+	Rules   *models.SmartRules `json:"rules"`
+}
+
+// maxPlaylistSize limits the size of imported playlist files and of the
+// JSON requests that change playlists, which are read whole.
+const maxPlaylistSize = 8 << 20
+
+func (s Server) getPlaylists(w http.ResponseWriter, r *http.Request) {
+	playlists, err := s.collection.Playlists()
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.respond(w, r, "playlist/index", playlists, jsonPlaylistsOf(playlists))
+}
+
+func (s Server) getPlaylist(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.playlist(w, r)
+	if !ok {
+		return
+	}
+	s.respond(w, r, "playlist/playlist", p, jsonPlaylistOf(p))
+}
+
+// addPlaylist creates a playlist of the given tracks.
+func (s Server) addPlaylist(w http.ResponseWriter, r *http.Request) {
+	var req playlistRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPlaylistSize)).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		s.error(w, http.StatusBadRequest, fmt.Errorf("playlist has no name"))
+		return
+	}
+	u, _ := currentUser(r)
+	p := models.Playlist{Name: req.Name, Comment: req.Comment, UserID: u.ID}
+	if req.Rules != nil {
+		if len(req.Tracks) > 0 {
+			s.error(w, http.StatusBadRequest, fmt.Errorf("smart playlists have no tracks"))
+			return
+		}
+		if err := p.SetSmartRules(*req.Rules); err != nil {
+			s.error(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	for _, id := range req.Tracks {
+		p.AddTrack(models.Track{ID: id})
+	}
+	if err := s.collection.CreatePlaylist(&p); err != nil {
+		s.fail(w, err)
+		return
+	}
+	p, err := s.collection.GetPlaylist(p.ID)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.writeJSON(w, jsonPlaylistOf(p))
+}
+
+// editPlaylist changes the name and comment of a playlist, and the rules of
+// a smart playlist. Giving other playlists rules makes them smart. Fields
+// missing from the request are left as they are.
+func (s Server) editPlaylist(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.ownPlaylist(w, r)
+	if !ok {
+		return
+	}
+	// Only the fields of the request are decoded, so that the playlist
+	// keeps its ID and owner.
+	req := playlistRequest{Name: p.Name, Comment: p.Comment}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPlaylistSize)).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		s.error(w, http.StatusBadRequest, fmt.Errorf("playlist has no name"))
+		return
+	}
+	p.Name, p.Comment = req.Name, req.Comment
+	if req.Rules != nil {
+		if err := p.SetSmartRules(*req.Rules); err != nil {
+			s.error(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := s.collection.SavePlaylist(p); err != nil {
+		s.fail(w, err)
+	}
+}
+
+// appendToPlaylist adds tracks to the end of a playlist.
+func (s Server) appendToPlaylist(w http.ResponseWriter, r *http.Request) {
+	s.changePlaylist(w, r, func(id int64, req playlistRequest) error {
+		return s.collection.AppendToPlaylist(id, req.Tracks)
+	})
+}
+
+// reorderPlaylist puts the entries of a playlist in a new order, removing
+// the entries that are left out.
+func (s Server) reorderPlaylist(w http.ResponseWriter, r *http.Request) {
+	s.changePlaylist(w, r, func(id int64, req playlistRequest) error {
+		if req.Entries == nil {
+			return badRequestError{fmt.Errorf("entries are missing")}
+		}
+		return s.collection.ReorderPlaylist(id, req.Entries)
+	})
+}
+
+// changePlaylist decodes a playlistRequest, calls change with it and writes
+// the changed playlist. The entries of smart playlists cannot be changed.
+func (s Server) changePlaylist(w http.ResponseWriter, r *http.Request, change func(int64, playlistRequest) error) {
+	p, ok := s.ownPlaylist(w, r)
+	if !ok {
+		return
+	}
+	if p.IsSmart() {
+		s.error(w, http.StatusBadRequest, fmt.Errorf("the entries of smart playlists cannot be changed"))
+		return
+	}
+	id := p.ID
+	var req playlistRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPlaylistSize)).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := change(id, req); err != nil {
+		s.fail(w, err)
+		return
+	}
+	p, err := s.collection.GetPlaylist(id)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.writeJSON(w, jsonPlaylistOf(p))
+}
+
+func (s Server) deletePlaylist(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.ownPlaylist(w, r)
+	if !ok {
+		return
+	}
+	if err := s.collection.DeletePlaylist(p.ID); err != nil {
+		s.fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// playlist returns the playlist named by the id route variable, or writes
+// an error.
+func (s Server) playlist(w http.ResponseWriter, r *http.Request) (models.Playlist, bool) {
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return models.Playlist{}, false
+	}
+	p, err := s.collection.GetPlaylist(id)
+	if err != nil {
+		s.fail(w, err)
+		return p, false
+	}
+	return p, true
+}
+
+// ownPlaylist is playlist for requests that change it, which only its owner
+// and admins may make.
+func (s Server) ownPlaylist(w http.ResponseWriter, r *http.Request) (models.Playlist, bool) {
+	p, ok := s.playlist(w, r)
+	if !ok {
+		return p, false
+	}
+	if u, ok := currentUser(r); s.login && !(ok && (u.Admin || u.ID == p.UserID)) {
+		s.fail(w, forbiddenError{fmt.Errorf("playlist %d is not yours", p.ID)})
+		return p, false
+	}
+	return p, true
+}
+
+// Playlist exports. Players open the stream URLs in them directly, so they
+// are absolute, and signed when users have to log in.
+
+func (s Server) exportM3U(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.playlist(w, r)
+	if !ok {
+		return
+	}
+	streamURL := s.exportURLs(r)
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", oneLine(p.Name))
+	for _, e := range p.Entries {
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n", seconds(e.Track.Duration()), oneLine(entryTitle(e)))
+		b.WriteString(streamURL(e.TrackID) + "\n")
+	}
+	writeExport(w, p, "m3u8", "audio/x-mpegurl; charset=utf-8", b.String())
+}
+
+func (s Server) exportPLS(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.playlist(w, r)
+	if !ok {
+		return
+	}
+	streamURL := s.exportURLs(r)
+	var b strings.Builder
+	b.WriteString("[playlist]\n")
+	for i, e := range p.Entries {
+		n := i + 1
+		fmt.Fprintf(&b, "File%d=%s\n", n, streamURL(e.TrackID))
+		fmt.Fprintf(&b, "Title%d=%s\n", n, oneLine(entryTitle(e)))
+		length := seconds(e.Track.Duration())
+		if length == 0 {
+			length = -1
+		}
+		fmt.Fprintf(&b, "Length%d=%d\n", n, length)
+	}
+	fmt.Fprintf(&b, "NumberOfEntries=%d\nVersion=2\n", len(p.Entries))
+	writeExport(w, p, "pls", "audio/x-scpls; charset=utf-8", b.String())
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Comment string      `xml:"annotation,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	TrackNum int    `xml:"trackNum,omitempty"`
+	Duration int64  `xml:"duration,omitempty"` // milliseconds
+}
+
+func (s Server) exportXSPF(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.playlist(w, r)
+	if !ok {
+		return
+	}
+	streamURL := s.exportURLs(r)
+	doc := xspfPlaylist{Version: 1, Title: p.Name, Comment: p.Comment, Tracks: []xspfTrack{}}
+	for _, e := range p.Entries {
+		doc.Tracks = append(doc.Tracks, xspfTrack{
+			Location: streamURL(e.TrackID),
+			Title:    e.Track.Title,
+			Creator:  e.Track.ArtistCredit(),
+			TrackNum: e.Track.Position,
+			Duration: int64(e.Track.Duration() / time.Millisecond),
+		})
+	}
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	writeExport(w, p, "xspf", "application/xspf+xml", xml.Header+string(body)+"\n")
+}
+
+func writeExport(w http.ResponseWriter, p models.Playlist, ext, mimetype, body string) {
+	w.Header().Set("Content-type", mimetype)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`inline; filename="playlist-%d.%s"`, p.ID, ext))
+	w.Write([]byte(body))
+}
+
+// baseURL returns the scheme and host a request was made to, going by the
+// X-Forwarded-Proto header of a proxy if there is one.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func trackStreamURL(base string, id int64) string {
+	return base + trackStreamPath(id)
+}
+
+func trackStreamPath(id int64) string {
+	return "/tracks/" + strconv.FormatInt(id, 10) + "/stream"
+}
+
+// exportURLs returns a function that gives the stream URLs of tracks in a
+// playlist export. Players cannot log in, so when users have to, the URLs
+// are signed for the user for a while.
+func (s Server) exportURLs(r *http.Request) func(int64) string {
+	base := baseURL(r)
+	u, ok := currentUser(r)
+	if !s.login || !ok {
+		return func(id int64) string { return trackStreamURL(base, id) }
+	}
+	expires := time.Now().Add(exportLifetime)
+	return func(id int64) string {
+		path := trackStreamPath(id)
+		return base + path + "?" + signStream(s.signingKey, path, u.ID, expires).Encode()
+	}
+}
+
+// entryTitle returns the artist credit and title of an entry's track.
+func entryTitle(e models.PlaylistEntry) string {
+	if credit := e.Track.ArtistCredit(); credit != "" {
+		return credit + " - " + e.Track.Title
+	}
+	return e.Track.Title
+}
+
+// oneLine replaces the line breaks in s, which would end an entry of a
+// line-based playlist.
+func oneLine(s string) string {
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(s)
+}
+
+// seconds returns d in whole seconds, rounded.
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second/2) / time.Second)
+}
+
+// importPlaylist creates a playlist from an M3U, M3U8, PLS or XSPF file in
+// the request body, and reports how its entries matched tracks. The name
+// query parameter names the playlist, and the filename parameter gives the
+// name of the file, which tells M3U8 from M3U files. They are read from the
+// query alone, since parsing a form body would consume the file.
+func (s Server) importPlaylist(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pf, err := importer.ParsePlaylist(http.MaxBytesReader(w, r.Body, maxPlaylistSize), query.Get("filename"))
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if name := query.Get("name"); name != "" {
+		pf.Name = name
+	}
+	if pf.Name == "" {
+		pf.Name = "Imported playlist"
+	}
+	u, _ := currentUser(r)
+	report, err := s.importer().ImportPlaylist(pf, u.ID)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	p, err := s.collection.GetPlaylist(report.Playlist.ID)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.writeJSON(w, jsonPlaylistImportOf(p, report))
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaylists(t *testing.T) {
+	Convey("Test playlists", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		router := NewServer(coll, memStreamHandler{}, "../../templates")
+		do := func(method, path, body string) *httptest.ResponseRecorder {
+			var rdr io.Reader
+			if body != "" {
+				rdr = strings.NewReader(body)
+			}
+			req, _ := http.NewRequest(method, "http://music.example.com"+path, rdr)
+			if body != "" {
+				req.Header.Set("Content-type", "application/json")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+
+		a := models.Artist{Name: "Artist A"}
+		coll.CreateArtist(&a)
+		var tracks []models.Track
+		for i, title := range []string{"Track 1", "Track 2"} {
+			t := models.Track{Title: title, Position: i + 1}
+			t.AddArtist(a)
+			t.AddStream(models.Stream{Path: "foo", Duration: time.Duration(60*(i+1)) * time.Second})
+			coll.CreateTrack(&t)
+			tracks = append(tracks, t)
+		}
+		rec := do("POST", "/playlists/",
+			fmt.Sprintf(`{"name": "Road trip", "tracks": [%d, %d]}`, tracks[1].ID, tracks[0].ID))
+		var p jsonPlaylist
+		json.NewDecoder(rec.Body).Decode(&p)
+
+		Convey("should create playlist", func() {
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(p.Name, ShouldEqual, "Road trip")
+			So(p.TrackCount, ShouldEqual, 2)
+			So(p.Duration, ShouldEqual, 180)
+			So(p.Entries[0].Track.Title, ShouldEqual, "Track 2")
+		})
+
+		Convey("should reject playlist without name or with missing track", func() {
+			So(do("POST", "/playlists/", `{"tracks": []}`).Code, ShouldEqual, http.StatusBadRequest)
+			So(do("POST", "/playlists/", `{"name": "x", "tracks": [100]}`).Code,
+				ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("should list and show playlists", func() {
+			rec := do("GET", "/playlists/", "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldContainSubstring, "Road trip")
+			rec = do("GET", "/playlists.json", "")
+			var list []jsonPlaylist
+			json.NewDecoder(rec.Body).Decode(&list)
+			So(len(list), ShouldEqual, 1)
+			So(list[0].TrackCount, ShouldEqual, 2)
+			So(list[0].Entries, ShouldBeEmpty)
+			rec = do("GET", fmt.Sprintf("/playlists/%d", p.ID), "")
+			So(rec.Body.String(), ShouldContainSubstring, "Track 2")
+			So(rec.Body.String(), ShouldContainSubstring, "3:00")
+		})
+
+		Convey("should append, reorder and rename", func() {
+			path := fmt.Sprintf("/playlists/%d", p.ID)
+			rec := do("POST", path+"/tracks", fmt.Sprintf(`{"tracks": [%d]}`, tracks[1].ID))
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var changed jsonPlaylist
+			json.NewDecoder(rec.Body).Decode(&changed)
+			So(changed.TrackCount, ShouldEqual, 3)
+
+			e := changed.Entries
+			rec = do("POST", path+"/order", fmt.Sprintf(`{"entries": [%d, %d]}`, e[2].ID, e[1].ID))
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			json.NewDecoder(rec.Body).Decode(&changed)
+			So(changed.TrackCount, ShouldEqual, 2)
+			So(changed.Entries[1].Track.Title, ShouldEqual, "Track 1")
+			So(do("POST", path+"/order", `{}`).Code, ShouldEqual, http.StatusBadRequest)
+
+			So(do("POST", path, `{"name": "Commute"}`).Code, ShouldEqual, http.StatusOK)
+			pl, _ := coll.GetPlaylist(p.ID)
+			So(pl.Name, ShouldEqual, "Commute")
+			So(len(pl.Entries), ShouldEqual, 2)
+		})
+
+		Convey("should delete playlist", func() {
+			path := fmt.Sprintf("/playlists/%d", p.ID)
+			So(do("DELETE", path, "").Code, ShouldEqual, http.StatusNoContent)
+			So(do("GET", path, "").Code, ShouldEqual, http.StatusNotFound)
+			So(do("DELETE", path, "").Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("should import playlist", func() {
+			body := fmt.Sprintf("#EXTM3U\n#EXTINF:60,Artist A - Track 1\n/elsewhere/01.ogg\n"+
+				"http://music.example.com/tracks/%d/stream\n/elsewhere/unknown.ogg\n", tracks[1].ID)
+			req, _ := http.NewRequest("POST", "http://music.example.com/playlists/import?filename=mix.m3u8",
+				strings.NewReader(body))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var imp jsonPlaylistImport
+			json.NewDecoder(rec.Body).Decode(&imp)
+			So(imp.Playlist.Name, ShouldEqual, "mix")
+			So(imp.Playlist.TrackCount, ShouldEqual, 2)
+			So(imp.Unmatched, ShouldEqual, 1)
+			So(imp.Items[0].TrackID, ShouldEqual, tracks[0].ID)
+			So(imp.Items[0].MatchedBy, ShouldEqual, "title")
+			So(imp.Items[1].MatchedBy, ShouldEqual, "url")
+			So(imp.Items[2].Location, ShouldEqual, "/elsewhere/unknown.ogg")
+			So(imp.Items[2].TrackID, ShouldEqual, 0)
+
+			req, _ = http.NewRequest("POST", "http://music.example.com/playlists/import?name=Bad",
+				strings.NewReader("<playlist>"))
+			rec = httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("should refuse playlists that are too large", func() {
+			huge := "#EXTM3U\n" + strings.Repeat("# padding\n", maxPlaylistSize/10+1)
+			req, _ := http.NewRequest("POST", "http://music.example.com/playlists/import?filename=huge.m3u8",
+				strings.NewReader(huge))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+
+			name := strings.Repeat("x", maxPlaylistSize)
+			So(do("POST", fmt.Sprintf("/playlists/%d", p.ID), `{"name": "`+name+`"}`).Code,
+				ShouldEqual, http.StatusBadRequest)
+			So(do("GET", fmt.Sprintf("/playlists/%d.json", p.ID), "").Body.String(),
+				ShouldContainSubstring, "Road trip")
+		})
+
+		Convey("should import playlist posted as a form", func() {
+			// As curl --data-binary sends it without a Content-type.
+			req, _ := http.NewRequest("POST", "http://music.example.com/playlists/import?name=Posted",
+				strings.NewReader("#EXTM3U\n#EXTINF:60,Artist A - Track 1\n/elsewhere/01.ogg\n"))
+			req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var imp jsonPlaylistImport
+			json.NewDecoder(rec.Body).Decode(&imp)
+			So(imp.Playlist.Name, ShouldEqual, "Posted")
+			So(imp.Playlist.TrackCount, ShouldEqual, 1)
+		})
+
+		Convey("should export M3U8", func() {
+			rec := do("GET", fmt.Sprintf("/playlists/%d.m3u8", p.ID), "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("Content-type"), ShouldStartWith, "audio/x-mpegurl")
+			So(rec.Body.String(), ShouldEqual, fmt.Sprintf("#EXTM3U\n#PLAYLIST:Road trip\n"+
+				"#EXTINF:120,Artist A - Track 2\nhttp://music.example.com/tracks/%d/stream\n"+
+				"#EXTINF:60,Artist A - Track 1\nhttp://music.example.com/tracks/%d/stream\n",
+				tracks[1].ID, tracks[0].ID))
+		})
+
+		Convey("should export PLS", func() {
+			rec := do("GET", fmt.Sprintf("/playlists/%d.pls", p.ID), "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			body := rec.Body.String()
+			So(body, ShouldStartWith, "[playlist]\n")
+			So(body, ShouldContainSubstring,
+				fmt.Sprintf("File1=http://music.example.com/tracks/%d/stream\n", tracks[1].ID))
+			So(body, ShouldContainSubstring, "Title2=Artist A - Track 1\nLength2=60\n")
+			So(body, ShouldEndWith, "NumberOfEntries=2\nVersion=2\n")
+		})
+
+		Convey("should export XSPF", func() {
+			rec := do("GET", fmt.Sprintf("/playlists/%d.xspf", p.ID), "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("Content-type"), ShouldEqual, "application/xspf+xml")
+			var doc xspfPlaylist
+			So(xml.NewDecoder(rec.Body).Decode(&doc), ShouldBeNil)
+			So(doc.Title, ShouldEqual, "Road trip")
+			So(len(doc.Tracks), ShouldEqual, 2)
+			So(doc.Tracks[0].Location, ShouldEqual,
+				fmt.Sprintf("http://music.example.com/tracks/%d/stream", tracks[1].ID))
+			So(doc.Tracks[0].Creator, ShouldEqual, "Artist A")
+			So(doc.Tracks[0].Duration, ShouldEqual, 120000)
+		})
+
+		Convey("should evaluate smart playlist", func() {
+			rec := do("POST", "/playlists/", `{"name": "Long", "rules": {"rules": [
+				{"field": "duration", "op": "gt", "value": 90}]}}`)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var smart jsonPlaylist
+			json.NewDecoder(rec.Body).Decode(&smart)
+			So(smart.Rules, ShouldNotBeNil)
+			So(smart.Rules.Match, ShouldEqual, models.MatchAll)
+			So(smart.TrackCount, ShouldEqual, 1)
+			So(smart.Entries[0].Track.ID, ShouldEqual, tracks[1].ID)
+
+			rec = do("GET", fmt.Sprintf("/playlists/%d.m3u8", smart.ID), "")
+			So(rec.Body.String(), ShouldContainSubstring, "#EXTINF:120,Artist A - Track 2\n")
+
+			rec = do("POST", fmt.Sprintf("/playlists/%d", smart.ID), `{"name": "Short", "rules": {"rules": [
+				{"field": "duration", "op": "lt", "value": 90}]}}`)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			rec = do("GET", fmt.Sprintf("/playlists/%d.json", smart.ID), "")
+			json.NewDecoder(rec.Body).Decode(&smart)
+			So(smart.Name, ShouldEqual, "Short")
+			So(smart.TrackCount, ShouldEqual, 1)
+			So(smart.Entries[0].Track.ID, ShouldEqual, tracks[0].ID)
+
+			rec = do("POST", fmt.Sprintf("/playlists/%d/tracks", smart.ID),
+				fmt.Sprintf(`{"tracks": [%d]}`, tracks[1].ID))
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("should reject invalid smart playlist", func() {
+			So(do("POST", "/playlists/", `{"name": "x", "rules": {"rules": [
+				{"field": "mood", "op": "is", "value": "happy"}]}}`).Code, ShouldEqual, http.StatusBadRequest)
+			So(do("POST", "/playlists/", fmt.Sprintf(`{"name": "x", "tracks": [%d], "rules": {}}`,
+				tracks[0].ID)).Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestPlaylistsWithLogin(t *testing.T) {
+	Convey("Test playlists with login", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		key := []byte("signing key")
+		router := NewServer(coll, memStreamHandler{"foo": "0123456789"}, "../../templates", WithLogin(),
+			WithSigningKey(key))
+		for _, u := range []models.User{{Name: "admin", Admin: true}, {Name: "alice"}, {Name: "bob"}} {
+			u.SetPassword(u.Name + "-password")
+			coll.CreateUser(&u)
+		}
+		tr := models.Track{Title: "Foo"}
+		tr.AddStream(models.Stream{Path: "foo"})
+		coll.CreateTrack(&tr)
+
+		session := func(name string) *http.Cookie {
+			form := url.Values{"name": {name}, "password": {name + "-password"}, "next": {"/"}}
+			req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusSeeOther)
+			return rec.Result().Cookies()[0]
+		}
+		do := func(method, path, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			var rdr io.Reader
+			if body != "" {
+				rdr = strings.NewReader(body)
+			}
+			req, _ := http.NewRequest(method, path, rdr)
+			if body != "" {
+				req.Header.Set("Content-type", "application/json")
+			}
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+
+		alice, bob := session("alice"), session("bob")
+		rec := do("POST", "/playlists/", `{"name": "Alice's"}`, alice)
+		So(rec.Code, ShouldEqual, http.StatusOK)
+		var p jsonPlaylist
+		json.NewDecoder(rec.Body).Decode(&p)
+		path := fmt.Sprintf("/playlists/%d", p.ID)
+
+		Convey("should refuse changes by other users", func() {
+			So(do("POST", path, `{"name": "Bob's"}`, bob).Code, ShouldEqual, http.StatusForbidden)
+			So(do("POST", path+"/tracks", fmt.Sprintf(`{"tracks": [%d]}`, tr.ID), bob).Code,
+				ShouldEqual, http.StatusForbidden)
+			So(do("POST", path+"/order", `{"entries": []}`, bob).Code, ShouldEqual, http.StatusForbidden)
+			So(do("DELETE", path, "", bob).Code, ShouldEqual, http.StatusForbidden)
+			saved, _ := coll.GetPlaylist(p.ID)
+			So(saved.Name, ShouldEqual, "Alice's")
+			So(do("GET", path+".json", "", bob).Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("should not change other playlists named in the body", func() {
+			So(do("POST", path+"/tracks", fmt.Sprintf(`{"tracks": [%d]}`, tr.ID), alice).Code,
+				ShouldEqual, http.StatusOK)
+			rec := do("POST", "/playlists/", `{"name": "Bob's"}`, bob)
+			var own jsonPlaylist
+			json.NewDecoder(rec.Body).Decode(&own)
+			aliceUser, _ := coll.GetUserByName("alice")
+			body := fmt.Sprintf(`{"id": %d, "userid": %d, "name": "Taken", "rules": {"rules": [
+				{"field": "duration", "op": "gt", "value": 90}]}}`, p.ID, aliceUser.ID)
+			So(do("POST", fmt.Sprintf("/playlists/%d", own.ID), body, bob).Code, ShouldEqual, http.StatusOK)
+
+			saved, _ := coll.GetPlaylist(p.ID)
+			So(saved.Name, ShouldEqual, "Alice's")
+			So(saved.IsSmart(), ShouldBeFalse)
+			So(len(saved.Entries), ShouldEqual, 1)
+			saved, _ = coll.GetPlaylist(own.ID)
+			So(saved.Name, ShouldEqual, "Taken")
+			bobUser, _ := coll.GetUserByName("bob")
+			So(saved.UserID, ShouldEqual, bobUser.ID)
+		})
+
+		Convey("should let users change the playlists they import", func() {
+			body := fmt.Sprintf("#EXTM3U\nhttp://music.example.com/tracks/%d/stream\n", tr.ID)
+			rec := do("POST", "/playlists/import?filename=mix.m3u8", body, bob)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var imp jsonPlaylistImport
+			json.NewDecoder(rec.Body).Decode(&imp)
+			imported := fmt.Sprintf("/playlists/%d", imp.Playlist.ID)
+			So(do("POST", imported, `{"name": "Bob's mix"}`, bob).Code, ShouldEqual, http.StatusOK)
+			So(do("POST", imported, `{"name": "Alice's mix"}`, alice).Code, ShouldEqual, http.StatusForbidden)
+			So(do("DELETE", imported, "", bob).Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("should let owners and admins change playlists", func() {
+			So(do("POST", path, `{"name": "Still Alice's"}`, alice).Code, ShouldEqual, http.StatusOK)
+			So(do("POST", path+"/tracks", fmt.Sprintf(`{"tracks": [%d]}`, tr.ID), alice).Code,
+				ShouldEqual, http.StatusOK)
+			So(do("DELETE", path, "", session("admin")).Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("should export stream URLs that play without login", func() {
+			So(do("POST", path+"/tracks", fmt.Sprintf(`{"tracks": [%d]}`, tr.ID), alice).Code,
+				ShouldEqual, http.StatusOK)
+			rec := do("GET", path+".m3u8", "", bob)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+			stream, err := url.Parse(lines[len(lines)-1])
+			So(err, ShouldBeNil)
+			So(stream.Path, ShouldEqual, fmt.Sprintf("/tracks/%d/stream", tr.ID))
+			So(stream.Query().Get("signature"), ShouldNotBeEmpty)
+			bobUser, _ := coll.GetUserByName("bob")
+			tokens, _ := coll.Tokens(bobUser.ID)
+			So(tokens, ShouldBeEmpty)
+
+			rec = do("GET", stream.RequestURI(), "", nil)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "0123456789")
+			So(do("GET", "/releases.json?"+stream.RawQuery, "", nil).Code, ShouldEqual, http.StatusUnauthorized)
+			So(do("GET", fmt.Sprintf("/tracks/%d/stream?%s", tr.ID+1, stream.RawQuery), "", nil).Code,
+				ShouldEqual, http.StatusSeeOther)
+
+			expired := signStream(key, stream.Path, bobUser.ID, time.Now().Add(-time.Minute))
+			So(do("GET", stream.Path+"?"+expired.Encode(), "", nil).Code, ShouldEqual, http.StatusSeeOther)
+			forged := stream.Query()
+			forged.Set("user", "1")
+			So(do("GET", stream.Path+"?"+forged.Encode(), "", nil).Code, ShouldEqual, http.StatusSeeOther)
+		})
+	})
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gravesm/blueshift/pkg/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A stream counts as played once it is served past half its length or four
+// minutes, whichever comes first, as Last.fm scrobbles tracks.
+const (
+	playFraction = 0.5
+	playLength   = 4 * time.Minute
+)
+
+// playCounter is a ResponseWriter that follows how far into a stream a
+// response gets.
+type playCounter struct {
+	http.ResponseWriter
+	status  int
+	start   int64
+	size    int64
+	written int64
+}
+
+func (c *playCounter) WriteHeader(status int) {
+	if c.status != 0 {
+		return
+	}
+	c.status = status
+	h := c.Header()
+	switch status {
+	case http.StatusOK:
+		c.size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	case http.StatusPartialContent:
+		// bytes <start>-<end>/<size>; responses with several ranges have no
+		// Content-Range header and are not followed.
+		var end int64
+		fmt.Sscanf(h.Get("Content-Range"), "bytes %d-%d/%d", &c.start, &end, &c.size)
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *playCounter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	n, err := c.ResponseWriter.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+// finish notes that the whole stream was written. Streams written as they
+// are transcoded have no length, and only count as played once they end.
+func (c *playCounter) finish() {
+	c.size = c.start + c.written
+}
+
+// passed reports whether the response served the byte at fraction of the
+// stream, having started before it.
+func (c *playCounter) passed(fraction float64) bool {
+	if c.size <= 0 {
+		return false
+	}
+	mark := int64(float64(c.size) * fraction)
+	return c.start <= mark && c.start+c.written > mark
+}
+
+// playMark returns the fraction of a track that has to be served for it to
+// count as played.
+func playMark(t models.Track) float64 {
+	if d := t.Duration(); d > 0 && float64(playLength)/float64(d) < playFraction {
+		return float64(playLength) / float64(d)
+	}
+	return playFraction
+}
+
+// recordPlay records a play of t by the user making the request. The client
+// is named by the client parameter, or else by the User-Agent header.
+func (s Server) recordPlay(r *http.Request, t models.Track, at time.Time, client string) (models.Play, error) {
+	if client == "" {
+		client = r.FormValue("client")
+	}
+	if client == "" {
+		client = r.UserAgent()
+	}
+	u, _ := currentUser(r)
+	p := models.Play{UserID: u.ID, TrackID: t.ID, Track: t, PlayedAt: at, Client: client}
+	if err := s.collection.CreatePlay(&p); err != nil {
+		return p, err
+	}
+	s.forward(p)
+	return p, nil
+}
+
+// startsStream reports whether a stream request asks for the stream from
+// its start, rather than seeking or resuming.
+func startsStream(r *http.Request) bool {
+	rng := r.Header.Get("Range")
+	return rng == "" || strings.HasPrefix(rng, "bytes=0-")
+}
+
+// scrobbleRequest is the JSON body of a scrobble. PlayedAt defaults to the
+// time of the request. With NowPlaying the track is only being played, and
+// no play is recorded.
+type scrobbleRequest struct {
+	Track      int64      `json:"track"`
+	PlayedAt   *time.Time `json:"playedAt"`
+	Client     string     `json:"client"`
+	NowPlaying bool       `json:"nowPlaying"`
+}
+
+// scrobble records a play reported by a client, or passes on that it is
+// playing a track.
+func (s Server) scrobble(w http.ResponseWriter, r *http.Request) {
+	var req scrobbleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	at := time.Now()
+	if req.PlayedAt != nil {
+		if req.PlayedAt.After(at.Add(time.Minute)) {
+			s.error(w, http.StatusBadRequest, fmt.Errorf("playedAt is in the future"))
+			return
+		}
+		at = *req.PlayedAt
+	}
+	t, err := s.collection.GetTrack(req.Track)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	if req.NowPlaying {
+		u, _ := currentUser(r)
+		s.nowPlaying(u.ID, t, req.Client)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	p, err := s.recordPlay(r, t, at, req.Client)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.writeJSON(w, jsonPlayOf(p))
+}
+
+// playsPage is the context of the play templates.
+type playsPage struct {
+	Group  models.PlayGroup
+	Recent bool
+	Plays  []models.Play
+	Counts []models.PlayCount
+}
+
+// getPlays lists the tracks the user played, newest first. Without logins
+// it lists everyone's plays.
+func (s Server) getPlays(w http.ResponseWriter, r *http.Request) {
+	u, _ := currentUser(r)
+	offset, limit := pageParams(r)
+	plays, err := s.collection.Plays(u.ID, offset, limit)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.respond(w, r, "play/index", playsPage{Plays: plays}, jsonPlaysOf(plays))
+}
+
+// getPlayCounts lists the most played tracks, releases or artists, or with
+// sort=recent the most recently played.
+func (s Server) getPlayCounts(w http.ResponseWriter, r *http.Request) {
+	u, _ := currentUser(r)
+	_, limit := pageParams(r)
+	q := models.PlayQuery{
+		UserID: u.ID,
+		Group:  models.PlayGroup(mux.Vars(r)["group"]),
+		Limit:  limit,
+	}
+	switch sort := r.FormValue("sort"); sort {
+	case "", "most":
+	case "recent":
+		q.Recent = true
+	default:
+		s.error(w, http.StatusBadRequest, fmt.Errorf("unknown sort %q", sort))
+		return
+	}
+	counts, err := s.collection.PlayCounts(q)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	page := playsPage{Group: q.Group, Recent: q.Recent, Counts: counts}
+	s.respond(w, r, "play/counts", page, jsonPlayCountsOf(counts))
+}
+
+// logPlay records a play of a streamed track if the response got far
+// enough into the stream.
+func (s Server) logPlay(r *http.Request, t models.Track, c *playCounter) {
+	if !c.passed(playMark(t)) {
+		return
+	}
+	if _, err := s.recordPlay(r, t, time.Now(), ""); err != nil {
+		log.Printf("record play of track %d: %v", t.ID, err)
+	}
+}
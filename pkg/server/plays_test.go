@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlays(t *testing.T) {
+	Convey("Test plays", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		sh := memStreamHandler{"short": "0123456789", "long": strings.Repeat("x", 100)}
+		router := NewServer(coll, sh, "../../templates",
+			WithSubsonicUsers(map[string]string{"alice": "secret"}))
+
+		a := models.Artist{Name: "Artist A"}
+		coll.CreateArtist(&a)
+		track := func(title, path string, d time.Duration) models.Track {
+			t := models.Track{Title: title}
+			t.AddArtist(a)
+			t.AddStream(models.Stream{Path: path, Duration: d})
+			coll.CreateTrack(&t)
+			return t
+		}
+		short := track("Short", "short", 3*time.Minute)
+		long := track("Long", "long", 16*time.Minute)
+
+		do := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+			var rdr io.Reader
+			if body != "" {
+				rdr = strings.NewReader(body)
+			}
+			req, _ := http.NewRequest(method, path, rdr)
+			for i := 0; i < len(header); i += 2 {
+				req.Header.Set(header[i], header[i+1])
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+		plays := func() []models.Play {
+			list, err := coll.Plays(0, 0, 100)
+			So(err, ShouldBeNil)
+			return list
+		}
+
+		Convey("should record streams served past the threshold", func() {
+			So(do("GET", fmt.Sprintf("/tracks/%d/stream", short.ID), "", "User-Agent", "player/1.0").Code,
+				ShouldEqual, http.StatusOK)
+			list := plays()
+			So(len(list), ShouldEqual, 1)
+			So(list[0].TrackID, ShouldEqual, short.ID)
+			So(list[0].Client, ShouldEqual, "player/1.0")
+		})
+
+		Convey("should record transcoded streams served to the end", func() {
+			router = NewServer(coll, sh, "../../templates", WithTranscoder(services.CommandTranscoder{
+				Commands: map[string]services.TranscodeCommand{
+					"ogg": {Args: []string{"cat"}, Mimetype: "audio/ogg"},
+				},
+			}))
+			path := fmt.Sprintf("/tracks/%d/stream?format=ogg", short.ID)
+			rec := do("GET", path, "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("Content-type"), ShouldEqual, "audio/ogg")
+			So(rec.Body.String(), ShouldEqual, "0123456789")
+			So(len(plays()), ShouldEqual, 1)
+		})
+
+		Convey("should follow range requests", func() {
+			path := fmt.Sprintf("/tracks/%d/stream", short.ID)
+			So(do("GET", path, "", "Range", "bytes=0-4").Code, ShouldEqual, http.StatusPartialContent)
+			So(plays(), ShouldBeEmpty)
+			So(do("GET", path, "", "Range", "bytes=5-").Code, ShouldEqual, http.StatusPartialContent)
+			So(len(plays()), ShouldEqual, 1)
+			do("GET", path, "", "Range", "bytes=6-")
+			So(len(plays()), ShouldEqual, 1)
+		})
+
+		Convey("should count long tracks after four minutes", func() {
+			// Four of sixteen minutes is the 25th byte of 100.
+			path := fmt.Sprintf("/tracks/%d/stream", long.ID)
+			do("GET", path, "", "Range", "bytes=0-24")
+			So(plays(), ShouldBeEmpty)
+			do("GET", path, "", "Range", "bytes=20-30")
+			So(len(plays()), ShouldEqual, 1)
+		})
+
+		Convey("should record scrobbles", func() {
+			rec := do("POST", "/scrobble",
+				fmt.Sprintf(`{"track": %d, "playedAt": "2019-10-01T12:00:00Z", "client": "car"}`, long.ID),
+				"Content-type", "application/json")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var p jsonPlay
+			json.NewDecoder(rec.Body).Decode(&p)
+			So(p.Track.Title, ShouldEqual, "Long")
+			So(p.Client, ShouldEqual, "car")
+			So(p.PlayedAt.Equal(time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)), ShouldBeTrue)
+
+			So(do("POST", "/scrobble", `{"track": 100}`, "Content-type", "application/json").Code,
+				ShouldEqual, http.StatusNotFound)
+			future := time.Now().Add(time.Hour).Format(time.RFC3339)
+			So(do("POST", "/scrobble", fmt.Sprintf(`{"track": %d, "playedAt": "%s"}`, long.ID, future),
+				"Content-type", "application/json").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("should scrobble from Subsonic clients", func() {
+			alice := models.User{Name: "alice"}
+			coll.CreateUser(&alice)
+			api := "/rest/scrobble?u=alice&p=secret&c=sub&id=" + fmt.Sprintf("%s%d", songPrefix, short.ID)
+			So(do("GET", api+"&submission=false", "").Body.String(), ShouldContainSubstring, `status="ok"`)
+			So(plays(), ShouldBeEmpty)
+			So(do("GET", api+"&time=1569931200000", "").Body.String(), ShouldContainSubstring, `status="ok"`)
+			list := plays()
+			So(len(list), ShouldEqual, 1)
+			So(list[0].UserID, ShouldEqual, alice.ID)
+			So(list[0].Client, ShouldEqual, "sub")
+			So(list[0].PlayedAt.Unix(), ShouldEqual, 1569931200)
+		})
+
+		Convey("should show recently and most played", func() {
+			for _, t := range []models.Track{short, long, long} {
+				coll.CreatePlay(&models.Play{TrackID: t.ID, PlayedAt: time.Now()})
+			}
+			rec := do("GET", "/plays/", "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldContainSubstring, "Long")
+
+			rec = do("GET", "/plays/tracks.json", "")
+			var counts []jsonPlayCount
+			json.NewDecoder(rec.Body).Decode(&counts)
+			So(len(counts), ShouldEqual, 2)
+			So(counts[0].Track.Title, ShouldEqual, "Long")
+			So(counts[0].Count, ShouldEqual, 2)
+
+			rec = do("GET", "/plays/artists?sort=recent", "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldContainSubstring, "Artist A")
+			So(do("GET", "/plays/labels", "").Code, ShouldEqual, http.StatusNotFound)
+			So(do("GET", "/plays/tracks?sort=best", "").Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
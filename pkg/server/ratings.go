@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gravesm/blueshift/pkg/models"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ratingRequest is the JSON body of a request to star or rate an item.
+// Fields that are left out are not changed.
+type ratingRequest struct {
+	Starred *bool `json:"starred"`
+	Rating  *int  `json:"rating"`
+}
+
+// itemKinds maps the path of each kind of item that can be rated to the
+// kind.
+var itemKinds = map[string]models.ItemKind{
+	"tracks":   models.KindTrack,
+	"releases": models.KindRelease,
+	"artists":  models.KindArtist,
+}
+
+// releasePage is the context of the release template, with the ratings of
+// the user.
+type releasePage struct {
+	models.Release
+	Rating       models.Rating
+	TrackRatings map[int64]models.Rating
+}
+
+// rate stars or rates a track, release or artist for the user, from a JSON
+// request or from a form, which is redirected back to the item.
+func (s Server) rate(w http.ResponseWriter, r *http.Request) {
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	path := mux.Vars(r)["kind"]
+	kind := itemKinds[path]
+	var req ratingRequest
+	isJSON := strings.HasPrefix(r.Header.Get("Content-type"), "application/json")
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.error(w, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			s.error(w, http.StatusBadRequest, err)
+			return
+		}
+		if v := r.PostForm.Get("starred"); v != "" {
+			starred := v == "true"
+			req.Starred = &starred
+		}
+		if v := r.PostForm.Get("rating"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				s.error(w, http.StatusBadRequest, fmt.Errorf("invalid rating %q", v))
+				return
+			}
+			req.Rating = &n
+		}
+	}
+	if req.Rating != nil && (*req.Rating < 0 || *req.Rating > models.MaxRating) {
+		s.error(w, http.StatusBadRequest,
+			fmt.Errorf("rating %d is not from 0 to %d", *req.Rating, models.MaxRating))
+		return
+	}
+	u, _ := currentUser(r)
+	if req.Starred != nil {
+		if err := s.collection.SetStarred(u.ID, kind, id, *req.Starred); err != nil {
+			s.fail(w, err)
+			return
+		}
+	}
+	if req.Rating != nil {
+		if err := s.collection.SetRating(u.ID, kind, id, *req.Rating); err != nil {
+			s.fail(w, err)
+			return
+		}
+	}
+	if !isJSON {
+		http.Redirect(w, r, fmt.Sprintf("/%s/%d", path, id), http.StatusSeeOther)
+		return
+	}
+	ratings, err := s.ratings(r, kind, []int64{id})
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.writeJSON(w, jsonRatingOf(kind, id, ratings[id]))
+}
+
+// getStarred lists the releases, tracks and artists the user starred.
+func (s Server) getStarred(w http.ResponseWriter, r *http.Request) {
+	u, _ := currentUser(r)
+	items, err := s.collection.Starred(u.ID)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.respond(w, r, "starred/index", items, jsonStarredOf(items))
+}
+
+// ratings returns the ratings by the user of the items of a kind.
+func (s Server) ratings(r *http.Request, kind models.ItemKind, ids []int64) (map[int64]models.Rating, error) {
+	u, _ := currentUser(r)
+	return s.collection.Ratings(u.ID, kind, ids)
+}
+
+func releaseIDs(releases []models.Release) []int64 {
+	ids := make([]int64, len(releases))
+	for i, rel := range releases {
+		ids[i] = rel.ID
+	}
+	return ids
+}
+
+func trackIDs(tracks []models.Track) []int64 {
+	ids := make([]int64, len(tracks))
+	for i, t := range tracks {
+		ids[i] = t.ID
+	}
+	return ids
+}
+
+func artistIDs(artists []models.Artist) []int64 {
+	ids := make([]int64, len(artists))
+	for i, a := range artists {
+		ids[i] = a.ID
+	}
+	return ids
+}
+
+// rateReleases, rateTracks and rateArtists set the ratings of the user in
+// JSON items.
+func rateReleases(list []jsonRelease, ratings map[int64]models.Rating) {
+	for i := range list {
+		list[i].Starred, list[i].Rating = ratingOf(ratings[list[i].ID])
+	}
+}
+
+func rateTracks(list []jsonTrack, ratings map[int64]models.Rating) {
+	for i := range list {
+		list[i].Starred, list[i].Rating = ratingOf(ratings[list[i].ID])
+	}
+}
+
+func rateArtists(list []jsonArtist, ratings map[int64]models.Rating) {
+	for i := range list {
+		list[i].Starred, list[i].Rating = ratingOf(ratings[list[i].ID])
+	}
+}
+
+func ratingOf(r models.Rating) (bool, int) {
+	return r.StarredAt != nil, r.Rating
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRatings(t *testing.T) {
+	Convey("Test ratings", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		router := NewServer(coll, memStreamHandler{}, "../../templates")
+
+		a := models.Artist{Name: "Artist"}
+		coll.CreateArtist(&a)
+		var releases []models.Release
+		for _, title := range []string{"First", "Second"} {
+			rel := models.Release{Title: title}
+			rel.AddArtist(a)
+			rel.AddTrack(models.Track{Title: title + " track"})
+			coll.CreateRelease(&rel)
+			releases = append(releases, rel)
+		}
+
+		do := func(method, path, body, contentType string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest(method, path, strings.NewReader(body))
+			if contentType != "" {
+				req.Header.Set("Content-type", contentType)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+		rate := func(path, body string) jsonRating {
+			rec := do("POST", path, body, "application/json")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var jr jsonRating
+			json.NewDecoder(rec.Body).Decode(&jr)
+			return jr
+		}
+
+		Convey("should star and rate items", func() {
+			jr := rate("/releases/2/rating", `{"starred": true, "rating": 4}`)
+			So(jr.Kind, ShouldEqual, models.KindRelease)
+			So(jr.Starred, ShouldBeTrue)
+			So(jr.Rating, ShouldEqual, 4)
+			jr = rate("/releases/2/rating", `{"rating": 0}`)
+			So(jr.Starred, ShouldBeTrue)
+			So(jr.Rating, ShouldEqual, 0)
+			jr = rate("/artists/1/rating", `{"rating": 2}`)
+			So(jr.Starred, ShouldBeFalse)
+
+			var rel jsonRelease
+			json.NewDecoder(do("GET", "/releases/2.json", "", "").Body).Decode(&rel)
+			So(rel.Starred, ShouldBeTrue)
+			var artist jsonArtist
+			json.NewDecoder(do("GET", "/artists/1.json", "", "").Body).Decode(&artist)
+			So(artist.Rating, ShouldEqual, 2)
+		})
+
+		Convey("should rate artists in the artist list", func() {
+			rate("/artists/1/rating", `{"starred": true, "rating": 2}`)
+			var artists []jsonArtist
+			json.NewDecoder(do("GET", "/artists.json", "", "").Body).Decode(&artists)
+			So(len(artists), ShouldEqual, 1)
+			So(artists[0].Starred, ShouldBeTrue)
+			So(artists[0].Rating, ShouldEqual, 2)
+			So(do("GET", "/artists/", "", "").Body.String(), ShouldContainSubstring, "★★☆☆☆")
+		})
+
+		Convey("should rate from the release page", func() {
+			form := url.Values{"rating": {"3"}}.Encode()
+			rec := do("POST", "/releases/1/rating", form, "application/x-www-form-urlencoded")
+			So(rec.Code, ShouldEqual, http.StatusSeeOther)
+			So(rec.Header().Get("Location"), ShouldEqual, "/releases/1")
+			form = url.Values{"starred": {"true"}}.Encode()
+			do("POST", "/tracks/1/rating", form, "application/x-www-form-urlencoded")
+
+			rec = do("GET", "/releases/1", "", "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			body := rec.Body.String()
+			So(strings.Count(body, `rated"`), ShouldEqual, 3)
+			So(body, ShouldContainSubstring, `value="false" title="Unstar"`)
+		})
+
+		Convey("should refuse invalid ratings", func() {
+			So(do("POST", "/releases/1/rating", `{"rating": 6}`, "application/json").Code,
+				ShouldEqual, http.StatusBadRequest)
+			So(do("POST", "/releases/9/rating", `{"rating": 1}`, "application/json").Code,
+				ShouldEqual, http.StatusNotFound)
+			So(do("POST", "/releases/1/rating", "rating=x", "application/x-www-form-urlencoded").Code,
+				ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("should sort releases by rating", func() {
+			rate("/releases/1/rating", `{"rating": 2}`)
+			rate("/releases/2/rating", `{"rating": 5}`)
+			var list []jsonRelease
+			json.NewDecoder(do("GET", "/releases.json?sort=rating", "", "").Body).Decode(&list)
+			So(len(list), ShouldEqual, 2)
+			So(list[0].Title, ShouldEqual, "Second")
+			So(list[0].Rating, ShouldEqual, 5)
+
+			rec := do("GET", "/releases/?sort=rating", "", "")
+			So(rec.Body.String(), ShouldContainSubstring, "★★★★★")
+		})
+
+		Convey("should sort artists by rating", func() {
+			b := models.Artist{Name: "Another artist"}
+			coll.CreateArtist(&b)
+			names := func(query string) []string {
+				var list []jsonArtist
+				json.NewDecoder(do("GET", "/artists.json"+query, "", "").Body).Decode(&list)
+				var names []string
+				for _, a := range list {
+					names = append(names, a.Name)
+				}
+				return names
+			}
+			So(names(""), ShouldResemble, []string{"Another artist", "Artist"})
+			rate(fmt.Sprintf("/artists/%d/rating", a.ID), `{"rating": 4}`)
+			So(names("?sort=rating"), ShouldResemble, []string{"Artist", "Another artist"})
+			So(names("?sort=rating&order=asc"), ShouldResemble, []string{"Another artist", "Artist"})
+			So(do("GET", "/artists.json?sort=year", "", "").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("should list starred items", func() {
+			rate("/tracks/2/rating", `{"starred": true}`)
+			rate("/releases/1/rating", `{"starred": true}`)
+			var res jsonSearchResult
+			json.NewDecoder(do("GET", "/starred.json", "", "").Body).Decode(&res)
+			So(len(res.Releases), ShouldEqual, 1)
+			So(res.Releases[0].Title, ShouldEqual, "First")
+			So(res.Tracks[0].Title, ShouldEqual, "Second track")
+			So(res.Tracks[0].Starred, ShouldBeTrue)
+			So(res.Artists, ShouldBeEmpty)
+
+			rec := do("GET", "/starred/", "", "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldContainSubstring, "Second track")
+		})
+	})
+}
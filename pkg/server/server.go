@@ -1,12 +1,14 @@
 package server
 
 import (
-	"archive/zip"
+	"bytes"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
-	"github.com/dhowden/tag"
 	"github.com/gorilla/mux"
+	"github.com/gravesm/blueshift/pkg/importer"
 	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/scrobble"
 	"github.com/gravesm/blueshift/pkg/services"
 	"html/template"
 	"io"
@@ -16,35 +18,158 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Server struct {
 	collection models.Collection
 	streamhdlr services.StreamHandler
 	templates  map[string]*template.Template
+	subsonic   map[string]string
+	thumbnails services.Thumbnailer
+	transcoder services.Transcoder
+	login      bool
+	forwarder  *scrobble.Forwarder
+	jobs       *importer.Jobs
+	signingKey []byte
 }
 
-func NewServer(c models.Collection, sh services.StreamHandler, tmpl string) *mux.Router {
+// Option configures optional features of the server returned by NewServer.
+type Option func(*Server)
+
+// WithSubsonicUsers enables the Subsonic API at /rest/ for the given users,
+// a map of user name to password.
+func WithSubsonicUsers(users map[string]string) Option {
+	return func(s *Server) {
+		s.subsonic = users
+	}
+}
+
+// WithTranscoder enables transcoding of streams with t.
+func WithTranscoder(t services.Transcoder) Option {
+	return func(s *Server) {
+		s.transcoder = t
+	}
+}
+
+// WithThumbnailCache caches cover thumbnails in dir.
+func WithThumbnailCache(dir string) Option {
+	return func(s *Server) {
+		s.thumbnails.Directory = dir
+	}
+}
+
+// WithWebPThumbnails makes WebP cover thumbnails with command, see
+// services.Thumbnailer.
+func WithWebPThumbnails(command []string) Option {
+	return func(s *Server) {
+		s.thumbnails.WebPCommand = command
+	}
+}
+
+// errorResponse is the JSON body sent with every error response.
+type errorResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+func NewServer(c models.Collection, sh services.StreamHandler, tmpl string, opts ...Option) *mux.Router {
 	templates := loadTemplates(tmpl)
 	s := &Server{collection: c, streamhdlr: sh, templates: templates}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.login && len(s.signingKey) == 0 {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		s.signingKey = key
+	}
+	if s.login {
+		for _, t := range templates {
+			t.Funcs(template.FuncMap{"login": func() bool { return true }})
+		}
+	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/tracks/", s.getTracks).Methods("GET")
-	r.HandleFunc("/tracks/", s.addTrack).
+	admin := s.requireAdmin
+	// get adds a GET route whose JSON representation is also served at path
+	// with a .json suffix.
+	get := func(path string, h http.HandlerFunc) {
+		r.HandleFunc(path, h).Methods("GET")
+		r.HandleFunc(strings.TrimSuffix(path, "/")+".json", jsonSuffix(h)).Methods("GET")
+	}
+
+	get("/tracks/", s.getTracks)
+	r.HandleFunc("/tracks/", admin(s.addTrack)).
 		Methods("POST").Headers("Content-type", "application/json")
-	r.HandleFunc("/tracks/{id:[0-9]+}", s.getTrack).Methods("GET")
-	r.HandleFunc("/tracks/{id:[0-9]+}", s.editTrack).
+	get("/tracks/{id:[0-9]+}", s.getTrack)
+	r.HandleFunc("/tracks/{id:[0-9]+}", admin(s.editTrack)).
 		Methods("POST").Headers("Content-type", "application/json")
 	r.HandleFunc("/tracks/{id:[0-9]+}/stream", s.stream).Methods("GET")
-	r.HandleFunc("/tracks/upload", s.uploadTrack).Methods("POST")
+	r.HandleFunc("/tracks/{id:[0-9]+}/streams", admin(s.addStream)).Methods("POST")
+	r.HandleFunc("/tracks/upload", admin(s.uploadTrack)).Methods("POST")
+
+	get("/releases/", s.getReleases)
+	r.HandleFunc("/releases/", admin(s.addRelease)).
+		Methods("POST").Headers("Content-type", "application/json")
+	get("/releases/{id:[0-9]+}", s.getRelease)
+	r.HandleFunc("/releases/{id:[0-9]+}", admin(s.editRelease)).
+		Methods("POST").Headers("Content-type", "application/json")
+	r.HandleFunc("/releases/{id:[0-9]+}/cover", s.cover).Methods("GET")
+	r.HandleFunc("/releases/upload", admin(s.uploadRelease)).Methods("POST")
+	if s.jobs != nil {
+		get("/jobs/{id:[0-9]+}", s.getJob)
+		r.HandleFunc("/jobs/{id:[0-9]+}/events", s.jobEvents).Methods("GET")
+	}
 
-	r.HandleFunc("/releases/", s.getReleases).Methods("GET")
-	r.HandleFunc("/releases/", s.addRelease).
+	get("/playlists/", s.getPlaylists)
+	r.HandleFunc("/playlists/", s.addPlaylist).
+		Methods("POST").Headers("Content-type", "application/json")
+	get("/playlists/{id:[0-9]+}", s.getPlaylist)
+	r.HandleFunc("/playlists/{id:[0-9]+}", s.editPlaylist).
 		Methods("POST").Headers("Content-type", "application/json")
-	r.HandleFunc("/releases/{id:[0-9]+}", s.getRelease).Methods("GET")
-	r.HandleFunc("/releases/{id:[0-9]+}", s.editRelease).
+	r.HandleFunc("/playlists/{id:[0-9]+}", s.deletePlaylist).Methods("DELETE")
+	r.HandleFunc("/playlists/{id:[0-9]+}/tracks", s.appendToPlaylist).
 		Methods("POST").Headers("Content-type", "application/json")
-	r.HandleFunc("/releases/upload", s.uploadRelease).Methods("POST")
+	r.HandleFunc("/playlists/{id:[0-9]+}/order", s.reorderPlaylist).
+		Methods("POST").Headers("Content-type", "application/json")
+	r.HandleFunc("/playlists/import", s.importPlaylist).Methods("POST")
+	r.HandleFunc("/playlists/{id:[0-9]+}.m3u8", s.exportM3U).Methods("GET")
+	r.HandleFunc("/playlists/{id:[0-9]+}.pls", s.exportPLS).Methods("GET")
+	r.HandleFunc("/playlists/{id:[0-9]+}.xspf", s.exportXSPF).Methods("GET")
+
+	get("/artists/", s.getArtists)
+	get("/artists/{id:[0-9]+}", s.getArtist)
+
+	get("/search", s.search)
+
+	r.HandleFunc("/{kind:tracks|releases|artists}/{id:[0-9]+}/rating", s.rate).Methods("POST")
+	get("/starred/", s.getStarred)
+
+	r.HandleFunc("/scrobble", s.scrobble).
+		Methods("POST").Headers("Content-type", "application/json")
+	get("/plays/", s.getPlays)
+	get("/plays/{group:tracks|releases|artists}", s.getPlayCounts)
+
+	if s.login {
+		r.HandleFunc("/login", s.getLogin).Methods("GET")
+		r.HandleFunc("/login", s.postLogin).Methods("POST")
+		r.HandleFunc("/logout", s.logout).Methods("POST")
+		get("/tokens/", s.getTokens)
+		r.HandleFunc("/tokens/", s.addToken).Methods("POST")
+		r.HandleFunc("/tokens/{id:[0-9]+}", s.revokeToken).Methods("DELETE")
+		r.HandleFunc("/tokens/{id:[0-9]+}/revoke", s.revokeToken).Methods("POST")
+		get("/account/listenbrainz", s.getListenBrainz)
+		r.HandleFunc("/account/listenbrainz", s.setListenBrainz).Methods("POST")
+		r.Use(s.authenticate)
+	}
+
+	if s.subsonic != nil {
+		r.HandleFunc("/rest/{method}", s.subsonicAPI).Methods("GET", "POST")
+	}
 
 	r.PathPrefix("/static/").Handler(
 		http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
@@ -53,181 +178,692 @@ func NewServer(c models.Collection, sh services.StreamHandler, tmpl string) *mux
 }
 
 func (s Server) getTracks(w http.ResponseWriter, r *http.Request) {
-	s.render("track/index", w, s.collection.Tracks(0, 10))
+	opts, err := listOptions(r, models.SortAdded)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	tracks, total, err := s.collection.Tracks(opts)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	ratings, err := s.ratings(r, models.KindTrack, trackIDs(tracks))
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	list := jsonTracksOf(tracks)
+	rateTracks(list, ratings)
+	p := newPager(r, opts, total)
+	p.writeHeaders(w)
+	s.respond(w, r, "track/index", listPage{Items: tracks, Pager: p, Ratings: ratings}, list)
 }
 
 func (s Server) getTrack(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	t, err := s.collection.GetTrack(id)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	ratings, err := s.ratings(r, models.KindTrack, []int64{id})
 	if err != nil {
-		log.Fatal(err)
+		s.fail(w, err)
+		return
 	}
-	s.render("track/track", w, s.collection.GetTrack(id))
+	jt := jsonTrackOf(t)
+	jt.Starred, jt.Rating = ratingOf(ratings[id])
+	s.respond(w, r, "track/track", t, jt)
 }
 
 func (s Server) addTrack(w http.ResponseWriter, r *http.Request) {
 	var t models.Track
 	err := json.NewDecoder(r.Body).Decode(&t)
 	if err != nil {
-		log.Fatal(err)
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.collection.CreateTrack(&t); err != nil {
+		s.fail(w, err)
 	}
-	s.collection.CreateTrack(&t)
 }
 
 func (s Server) editTrack(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	t, err := s.collection.GetTrack(id)
 	if err != nil {
-		log.Fatal(err)
+		s.fail(w, err)
+		return
 	}
-	t := s.collection.GetTrack(id)
 	err = json.NewDecoder(r.Body).Decode(&t)
 	if err != nil {
-		log.Fatal(err)
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.collection.SaveTrack(t); err != nil {
+		s.fail(w, err)
 	}
-	s.collection.SaveTrack(t)
 }
 
 func (s Server) stream(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	t, err := s.collection.GetTrack(id)
 	if err != nil {
-		log.Fatal(err)
+		s.fail(w, err)
+		return
+	}
+	if len(t.Streams) == 0 {
+		s.fail(w, models.NotFoundError{Kind: "stream for track", Key: id})
+		return
+	}
+	strm, err := selectStream(r, t.Streams)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	if startsStream(r) {
+		u, _ := currentUser(r)
+		s.nowPlaying(u.ID, t, "")
 	}
-	t := s.collection.GetTrack(id)
-	strm := t.Streams[0]
-	w.Header().Set("Content-type", strm.Format.Mimetype)
-	http.ServeFile(w, r, strm.Path)
+	c := &playCounter{ResponseWriter: w}
+	if err := s.serveStream(c, r, strm); err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.logPlay(r, t, c)
+}
+
+// serveStream writes the stored data of strm, honouring range and
+// conditional requests. The stream is transcoded if the request asks for it;
+// see streamProfile. Transcoded streams that are not cached are written as
+// they are made, without ranges.
+func (s Server) serveStream(w http.ResponseWriter, r *http.Request, strm models.Stream) error {
+	p, transcode, err := s.streamProfile(r, strm)
+	if err != nil {
+		return err
+	}
+	if !transcode {
+		rdr, err := s.streamhdlr.Get(strm.Path)
+		if err != nil {
+			return err
+		}
+		defer rdr.Close()
+		w.Header().Set("Content-type", strm.Format.Mimetype)
+		w.Header().Set("ETag", streamETag(strm, rdr))
+		http.ServeContent(w, r, "", rdr.ModTime(), rdr)
+		return nil
+	}
+
+	key := fmt.Sprintf("%s:%d:%d", strm.Path, strm.Size, strm.SourceModTime.UnixNano())
+	out, err := s.transcoder.Transcode(r.Context(), key, p, func() (io.ReadCloser, error) {
+		return s.streamhdlr.Get(strm.Path)
+	})
+	if err != nil {
+		return err
+	}
+	mimetype, _ := s.transcoder.Mimetype(p.Format)
+	w.Header().Set("Content-type", mimetype)
+	if rdr, ok := out.(services.StreamReader); ok {
+		defer rdr.Close()
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%s-%d-%x"`,
+			strm.ID, strings.ToLower(p.Format), p.BitRate, rdr.ModTime().UnixNano()))
+		http.ServeContent(w, r, "", rdr.ModTime(), rdr)
+		return nil
+	}
+	if r.Method != http.MethodHead {
+		if _, err := io.Copy(w, out); err == nil {
+			if c, ok := w.(*playCounter); ok {
+				c.finish()
+			}
+		}
+	}
+	if err := out.Close(); err != nil {
+		log.Printf("stream %d: %v", strm.ID, err)
+	}
+	return nil
+}
+
+// defaultTranscodeFormat is the format streams are transcoded to when only a
+// lower bit rate is asked for, and the stream's own format cannot be
+// transcoded to.
+const defaultTranscodeFormat = "mp3"
+
+// streamProfile returns the profile strm should be transcoded to for a
+// request, and whether it should be transcoded at all. The format parameter
+// names the format, with raw or an empty value for the stream's own format,
+// and maxBitRate limits the bit rate in kilobits per second. A stream is
+// only transcoded if its format or bit rate has to change, and never if
+// the server has no transcoder and only the bit rate was asked for.
+func (s Server) streamProfile(r *http.Request, strm models.Stream) (services.Profile, bool, error) {
+	var p services.Profile
+	if v := r.FormValue("maxBitRate"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, false, badRequestError{fmt.Errorf("invalid maxBitRate %q", v)}
+		}
+		p.BitRate = n
+	}
+	format := strings.ToLower(r.FormValue("format"))
+	own := strings.ToLower(strm.Format.Name)
+	if format == "" || format == "raw" || format == own {
+		if p.BitRate == 0 || strm.Bitrate <= p.BitRate*1000 || s.transcoder == nil {
+			return p, false, nil
+		}
+		format = own
+		if _, ok := s.transcoder.Mimetype(format); !ok {
+			format = defaultTranscodeFormat
+		}
+	}
+	if s.transcoder == nil {
+		return p, false, badRequestError{fmt.Errorf("transcoding is not enabled")}
+	}
+	if _, ok := s.transcoder.Mimetype(format); !ok {
+		return p, false, badRequestError{fmt.Errorf("cannot transcode to %q", format)}
+	}
+	p.Format = format
+	return p, true, nil
+}
+
+// streamETag returns a strong entity tag for a stored stream. It changes
+// whenever the stored data is replaced.
+func streamETag(strm models.Stream, rdr services.StreamReader) string {
+	return fmt.Sprintf(`"%x-%x-%x"`, strm.ID, rdr.Size(), rdr.ModTime().UnixNano())
 }
 
 func (s Server) uploadTrack(w http.ResponseWriter, r *http.Request) {
 	tmp, err := ioutil.TempFile("", "blueshift-")
 	if err != nil {
-		log.Fatal(err)
+		s.fail(w, err)
+		return
 	}
 	defer os.Remove(tmp.Name())
-	io.Copy(tmp, r.Body)
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, r.Body); err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
 
 	var t models.Track
 	var strm models.Stream
-	meta := services.FileMetadata(tmp)
-	s.makeTrack(&t, meta)
-	s.makeStream(&strm, meta, tmp)
+	meta, err := services.FileMetadata(tmp)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	im := s.importer()
+	if err := im.Track(&t, meta); err != nil {
+		s.fail(w, err)
+		return
+	}
+	if err := im.Stream(&strm, meta, tmp); err != nil {
+		s.fail(w, err)
+		return
+	}
 	t.AddStream(strm)
-	s.collection.CreateTrack(&t)
+	if err := s.collection.CreateTrack(&t); err != nil {
+		s.fail(w, err)
+		return
+	}
 
-	encoder := json.NewEncoder(w)
-	encoder.Encode(t)
+	s.writeJSON(w, jsonTrackOf(t))
+}
+
+// addStream adds the uploaded audio file to the streams of a track, as
+// another encoding of it.
+func (s Server) addStream(w http.ResponseWriter, r *http.Request) {
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := s.collection.GetTrack(id); err != nil {
+		s.fail(w, err)
+		return
+	}
+	tmp, err := ioutil.TempFile("", "blueshift-")
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, r.Body); err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	meta, err := services.FileMetadata(tmp)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	strm := models.Stream{TrackID: id}
+	if err := s.importer().Stream(&strm, meta, tmp); err != nil {
+		s.fail(w, err)
+		return
+	}
+	strm.FormatID = strm.Format.ID
+	if err := s.collection.CreateStream(&strm); err != nil {
+		s.streamhdlr.Delete(strm.Path)
+		s.fail(w, err)
+		return
+	}
+	s.writeJSON(w, jsonStreamOf(strm))
 }
 
 func (s Server) getReleases(w http.ResponseWriter, r *http.Request) {
-	s.render("release/index", w, s.collection.Releases(0, 10))
+	opts, err := listOptions(r, models.SortAdded)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	releases, total, err := s.collection.Releases(opts)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	ratings, err := s.ratings(r, models.KindRelease, releaseIDs(releases))
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	list := jsonReleasesOf(releases)
+	rateReleases(list, ratings)
+	p := newPager(r, opts, total)
+	p.writeHeaders(w)
+	s.respond(w, r, "release/index", listPage{Items: releases, Pager: p, Ratings: ratings}, list)
 }
 
 func (s Server) getRelease(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	id, err := idParam(r)
 	if err != nil {
-		log.Fatal(err)
+		s.error(w, http.StatusBadRequest, err)
+		return
 	}
-	s.render("release/release", w, s.collection.GetRelease(id))
+	rel, err := s.collection.GetRelease(id)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	ratings, err := s.ratings(r, models.KindRelease, []int64{id})
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	trackRatings, err := s.ratings(r, models.KindTrack, trackIDs(rel.Tracks))
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	jr := jsonReleaseOf(rel)
+	jr.Starred, jr.Rating = ratingOf(ratings[id])
+	rateTracks(jr.Tracks, trackRatings)
+	page := releasePage{Release: rel, Rating: ratings[id], TrackRatings: trackRatings}
+	s.respond(w, r, "release/release", page, jr)
+}
+
+// cover serves the cover image of a release. With the size parameter it
+// serves a JPEG thumbnail that fits a square of that many pixels, or a WebP
+// thumbnail with format=webp.
+func (s Server) cover(w http.ResponseWriter, r *http.Request) {
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	size := 0
+	if v := r.FormValue("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 1 || size > maxThumbnail {
+			s.error(w, http.StatusBadRequest, fmt.Errorf("invalid size %q", v))
+			return
+		}
+	}
+	format := r.FormValue("format")
+	if _, ok := s.thumbnails.Mimetype(format); !ok {
+		s.error(w, http.StatusBadRequest, fmt.Errorf("cannot make %q thumbnails", format))
+		return
+	}
+	if err := s.serveCover(w, r, id, size, format); err != nil {
+		s.fail(w, err)
+	}
+}
+
+// maxThumbnail is the largest thumbnail size that can be requested.
+const maxThumbnail = 1200
+
+// serveCover writes the cover of the release with the given ID, or a
+// thumbnail of it in format if size is not zero. An error is returned only if
+// nothing has been written.
+func (s Server) serveCover(w http.ResponseWriter, r *http.Request, id int64, size int, format string) error {
+	rel, err := s.collection.GetRelease(id)
+	if err != nil {
+		return err
+	}
+	if rel.Cover == "" {
+		return models.NotFoundError{Kind: "cover of release", Key: id}
+	}
+	var rdr services.StreamReader
+	if size == 0 {
+		rdr, err = s.streamhdlr.Get(rel.Cover)
+	} else {
+		rdr, err = s.thumbnails.Thumbnail(rel.Cover, size, format, func() (io.ReadCloser, error) {
+			return s.streamhdlr.Get(rel.Cover)
+		})
+		mimetype, _ := s.thumbnails.Mimetype(format)
+		w.Header().Set("Content-type", mimetype)
+	}
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	http.ServeContent(w, r, "", rdr.ModTime(), rdr)
+	return nil
 }
 
 func (s Server) addRelease(w http.ResponseWriter, r *http.Request) {
 	var rel models.Release
 	err := json.NewDecoder(r.Body).Decode(&rel)
 	if err != nil {
-		log.Fatal(err)
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.collection.CreateRelease(&rel); err != nil {
+		s.fail(w, err)
 	}
-	s.collection.CreateRelease(&rel)
 }
 
 func (s Server) editRelease(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	rel, err := s.collection.GetRelease(id)
 	if err != nil {
-		log.Fatal(err)
+		s.fail(w, err)
+		return
 	}
-	rel := s.collection.GetRelease(id)
 	err = json.NewDecoder(r.Body).Decode(&rel)
 	if err != nil {
-		log.Fatal(err)
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.collection.SaveRelease(rel); err != nil {
+		s.fail(w, err)
 	}
-	s.collection.SaveRelease(rel)
 }
 
-func (s Server) uploadRelease(w http.ResponseWriter, r *http.Request) {
-	tmp, err := ioutil.TempFile("", "blueshift-")
+// getArtists lists artists, by name unless the request asks for another
+// order.
+func (s Server) getArtists(w http.ResponseWriter, r *http.Request) {
+	opts, err := listOptions(r, models.SortArtist)
+	if err == nil && opts.Sort == models.SortYear {
+		err = fmt.Errorf("artists cannot be sorted by year")
+	}
 	if err != nil {
-		log.Fatal(err)
+		s.error(w, http.StatusBadRequest, err)
+		return
 	}
-	defer os.Remove(tmp.Name())
-	io.Copy(tmp, r.Body)
-	arxv, err := zip.OpenReader(tmp.Name())
+	artists, total, err := s.collection.Artists(opts)
 	if err != nil {
-		log.Fatal(err)
+		s.fail(w, err)
+		return
 	}
-	defer arxv.Close()
-	var rel models.Release
-	for _, f := range arxv.File {
-		var t models.Track
-		var strm models.Stream
-		trk, err := f.Open()
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer trk.Close()
-		ftmp, err := ioutil.TempFile("", "blueshift-")
+	ratings, err := s.ratings(r, models.KindArtist, artistIDs(artists))
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	list := jsonArtistsOf(artists)
+	rateArtists(list, ratings)
+	p := newPager(r, opts, total)
+	p.writeHeaders(w)
+	s.respond(w, r, "artist/index", listPage{Items: artists, Pager: p, Ratings: ratings}, list)
+}
+
+func (s Server) getArtist(w http.ResponseWriter, r *http.Request) {
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	a, err := s.collection.GetArtist(id)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	ratings, err := s.ratings(r, models.KindArtist, []int64{id})
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	ja := jsonArtistOf(a)
+	ja.Starred, ja.Rating = ratingOf(ratings[id])
+	s.respond(w, r, "artist/artist", a, ja)
+}
+
+// searchPage is the context of the search template.
+type searchPage struct {
+	Query string
+	models.SearchResult
+}
+
+func (s Server) search(w http.ResponseWriter, r *http.Request) {
+	// The page starts with an empty form, while an empty JSON query lists
+	// everything.
+	page := searchPage{Query: r.FormValue("q")}
+	if page.Query != "" || wantsJSON(r) {
+		offset, limit := pageParams(r)
+		res, err := s.collection.Search(page.Query, offset, limit)
 		if err != nil {
-			log.Fatal(err)
+			s.fail(w, err)
+			return
 		}
-		defer os.Remove(ftmp.Name())
-		io.Copy(ftmp, trk)
-		meta := services.FileMetadata(ftmp)
-		s.makeRelease(&rel, meta)
-		s.makeTrack(&t, meta)
-		s.makeStream(&strm, meta, ftmp)
-		t.AddStream(strm)
-		rel.AddTrack(t)
+		page.SearchResult = res
 	}
-
-	s.collection.CreateRelease(&rel)
+	s.respond(w, r, "search/index", page, jsonSearchResultOf(page.SearchResult))
 }
 
-func (s Server) makeTrack(t *models.Track, m tag.Metadata) {
-	raw := m.Raw()
-	p, _ := m.Track()
-	d, _ := m.Disc()
-	t.Title = m.Title()
-	t.Position = p
-	t.Disc = d
-	t.MBID = fmt.Sprintf("%v", raw["musicbrainz_trackid"])
+// importer returns an Importer that stores streams with the server's stream
+// handler.
+func (s Server) importer() importer.Importer {
+	return importer.NewImporter(s.collection, s.streamhdlr)
 }
 
-func (s Server) makeStream(strm *models.Stream, m tag.Metadata, f io.Reader) {
-	path := s.streamhdlr.Store(f)
-	strm.Path = path
-	strm.Format = s.collection.GetFormat(string(m.FileType()))
+// respond writes v as JSON if the client prefers it, and otherwise renders
+// ctx with tmpl.
+func (s Server) respond(w http.ResponseWriter, r *http.Request, tmpl string, ctx interface{}, v interface{}) {
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		s.writeJSON(w, v)
+		return
+	}
+	s.render(tmpl, w, ctx)
 }
 
-func (s Server) makeRelease(r *models.Release, m tag.Metadata) {
-	raw := m.Raw()
-	r.Title = m.Album()
-	r.MBID = fmt.Sprintf("%v", raw["musicbrainz_albumid"])
-	r.Year, _ = strconv.Atoi(fmt.Sprintf("%v", raw["originalyear"]))
+func (s Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(v)
 }
 
 func (s Server) render(tmpl string, w http.ResponseWriter, ctx interface{}) {
-	err := s.templates[tmpl].ExecuteTemplate(w, "base", ctx)
+	var buf bytes.Buffer
+	err := s.templates[tmpl].ExecuteTemplate(&buf, "base", ctx)
 	if err != nil {
-		log.Fatal(err)
+		s.fail(w, err)
+		return
+	}
+	buf.WriteTo(w)
+}
+
+// fail writes an error response with a status code chosen by the type of
+// err. Errors that are not the client's fault are logged.
+func (s Server) fail(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Print(err)
+	}
+	s.error(w, status, err)
+}
+
+// errorStatus returns the status code of the response to a request that
+// failed with err.
+func errorStatus(err error) int {
+	switch {
+	case models.IsNotFound(err):
+		return http.StatusNotFound
+	case isBadRequest(err):
+		return http.StatusBadRequest
+	case isForbidden(err):
+		return http.StatusForbidden
+	case services.IsUnsupported(err):
+		return http.StatusUnsupportedMediaType
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// error writes a JSON error body with the given status code.
+func (s Server) error(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Status: status, Error: err.Error()})
+}
+
+// badRequestError is returned by helpers for requests with invalid
+// parameters.
+type badRequestError struct {
+	error
+}
+
+func isBadRequest(err error) bool {
+	_, ok := err.(badRequestError)
+	return ok
+}
+
+// forbiddenError is returned by helpers for requests the user may not make.
+type forbiddenError struct {
+	error
+}
+
+func isForbidden(err error) bool {
+	_, ok := err.(forbiddenError)
+	return ok
+}
+
+// idParam parses the id route variable.
+func idParam(r *http.Request) (int64, error) {
+	return strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+}
+
+// pageParams parses the offset and limit query parameters. The limit
+// defaults to 20 and is at most 100.
+func pageParams(r *http.Request) (int, int) {
+	offset, err := strconv.Atoi(r.FormValue("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	return offset, limit
+}
+
+// listOptions parses the paging parameters and the sort and order
+// parameters. Lists are sorted by def without a sort parameter. Lists by
+// date added or rating are newest or best first by default; other sorts are
+// ascending by default.
+func listOptions(r *http.Request, def models.Sort) (models.ListOptions, error) {
+	offset, limit := pageParams(r)
+	u, _ := currentUser(r)
+	opts := models.ListOptions{Offset: offset, Limit: limit, Sort: def, UserID: u.ID}
+	if sort := r.FormValue("sort"); sort != "" {
+		opts.Sort = ""
+		for _, s := range models.Sorts {
+			if string(s) == sort {
+				opts.Sort = s
+			}
+		}
+		if opts.Sort == "" {
+			return opts, fmt.Errorf("unknown sort %q", sort)
+		}
+	}
+	switch order := r.FormValue("order"); order {
+	case "":
+		opts.Desc = opts.Sort == models.SortAdded || opts.Sort == models.SortRating
+	case "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, fmt.Errorf("unknown order %q", order)
+	}
+	return opts, nil
+}
+
+// templateFuncs are the functions available to templates.
+var templateFuncs = template.FuncMap{
+	"duration": formatDuration,
+	"kbps": func(bitrate int) int {
+		return (bitrate + 500) / 1000
+	},
+	"inc": func(i int) int {
+		return i + 1
+	},
+	// stars shows a rating as filled and empty stars.
+	"stars": func(rating int) string {
+		return strings.Repeat("★", rating) + strings.Repeat("☆", models.MaxRating-rating)
+	},
+	// ratings lists the ratings an item can be given.
+	"ratings": func() []int {
+		ratings := make([]int, models.MaxRating)
+		for i := range ratings {
+			ratings[i] = i + 1
+		}
+		return ratings
+	},
+	// login reports whether users have to log in. See WithLogin.
+	"login": func() bool {
+		return false
+	},
+}
+
+// formatDuration formats d as minutes and seconds, with hours if it is an
+// hour or longer.
+func formatDuration(d time.Duration) string {
+	secs := seconds(d)
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
 	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
 }
 
 func loadTemplates(root string) map[string]*template.Template {
 	templates := make(map[string]*template.Template)
-	base := template.Must(template.ParseGlob(path.Join(root, "base.html")))
-	tmpls := []string{"release/index", "release/release", "track/index", "track/track"}
+	base := template.Must(template.New("base.html").Funcs(templateFuncs).
+		ParseGlob(path.Join(root, "base.html")))
+	tmpls := []string{"release/index", "release/release", "track/index", "track/track",
+		"artist/index", "artist/artist", "search/index", "playlist/index", "playlist/playlist", "login", "token/index", "play/index", "play/counts",
+		"account/listenbrainz", "starred/index", "job/job"}
 	for _, t := range tmpls {
 		b, err := base.Clone()
 		if err != nil {
@@ -1,8 +1,12 @@
 package server
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/gravesm/blueshift/pkg/models"
 	"github.com/gravesm/blueshift/pkg/services"
@@ -10,15 +14,74 @@ import (
 	"github.com/jinzhu/gorm"
 	_ "github.com/mattn/go-sqlite3"
 	. "github.com/smartystreets/goconvey/convey"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
+// memStreamHandler is a StreamHandler that serves streams from memory.
+type memStreamHandler map[string]string
+
+type memStream struct {
+	*strings.Reader
+}
+
+func (m memStream) Close() error {
+	return nil
+}
+
+func (m memStream) ModTime() time.Time {
+	return time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (m memStreamHandler) Store(d io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(d)
+	if err != nil {
+		return "", err
+	}
+	p := strconv.Itoa(len(m))
+	m[p] = string(b)
+	return p, nil
+}
+
+func (m memStreamHandler) Delete(path string) error {
+	delete(m, path)
+	return nil
+}
+
+func (m memStreamHandler) Get(path string) (services.StreamReader, error) {
+	d, ok := m[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memStream{strings.NewReader(d)}, nil
+}
+
+// failingStreamHandler fails to store anything after storing after files.
+type failingStreamHandler struct {
+	services.StreamHandler
+	after int
+}
+
+func (f *failingStreamHandler) Store(d io.Reader) (string, error) {
+	if f.after == 0 {
+		return "", fmt.Errorf("disk full")
+	}
+	f.after--
+	return f.StreamHandler.Store(d)
+}
+
 func TestServer(t *testing.T) {
 	Convey("Test Server", t, func() {
 		db, err := gorm.Open("sqlite3", ":memory:")
@@ -36,7 +99,7 @@ func TestServer(t *testing.T) {
 		store.Initialize(db)
 		s := Server{
 			collection: coll,
-			streamhdlr: services.FileStreamHandler{tmp},
+			streamhdlr: services.FileStreamHandler{Directory: tmp},
 			templates:  loadTemplates("../../templates"),
 		}
 
@@ -67,6 +130,19 @@ func TestServer(t *testing.T) {
 			So(strings.Contains(string(body), "Track 1"), ShouldBeTrue)
 		})
 
+		Convey("should return not found for missing track", func() {
+			req, _ := http.NewRequest("GET", "/tracks/", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.getTrack)
+			hdlr.ServeHTTP(rec, req)
+			var e errorResponse
+			json.NewDecoder(rec.Body).Decode(&e)
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+			So(e.Status, ShouldEqual, http.StatusNotFound)
+			So(e.Error, ShouldNotBeEmpty)
+		})
+
 		Convey("should add track", func() {
 			post, _ := json.Marshal(&models.Track{Title: "Track 1", Position: 1})
 			req, _ := http.NewRequest("POST", "/tracks/", bytes.NewReader(post))
@@ -81,6 +157,14 @@ func TestServer(t *testing.T) {
 			So(t.Disc, ShouldEqual, 0)
 		})
 
+		Convey("should reject malformed track", func() {
+			req, _ := http.NewRequest("POST", "/tracks/", strings.NewReader("{"))
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.addTrack)
+			hdlr.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
 		Convey("should edit track", func() {
 			t := models.Track{Title: "Track 1", Position: 1}
 			t.AddStream(models.Stream{Path: "foo/bar"})
@@ -115,6 +199,184 @@ func TestServer(t *testing.T) {
 			So(t.Title, ShouldEqual, "Der Hölle Rache kocht in meinem Herzen")
 			So(t.Position, ShouldEqual, 18)
 			So(t.Disc, ShouldEqual, 0)
+			trk, err := coll.GetTrack(t.ID)
+			So(err, ShouldBeNil)
+			So(len(trk.Artists), ShouldEqual, 1)
+			So(trk.Artists[0].Artist.Name, ShouldEqual, "Wolfgang Amadeus Mozart")
+			So(len(trk.Streams), ShouldEqual, 1)
+			So(trk.Streams[0].SampleRate, ShouldEqual, 44100)
+			So(trk.Streams[0].Duration, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("should reject upload that is not audio", func() {
+			req, _ := http.NewRequest("POST", "/tracks/upload", strings.NewReader("not audio"))
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.uploadTrack)
+			hdlr.ServeHTTP(rec, req)
+			var count int
+			db.Model(&models.Track{}).Count(&count)
+			So(rec.Code, ShouldEqual, http.StatusUnsupportedMediaType)
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("should stream byte range", func() {
+			path, _ := s.streamhdlr.Store(strings.NewReader("0123456789"))
+			t := models.Track{Title: "Track 1"}
+			t.AddStream(models.Stream{Path: path})
+			coll.CreateTrack(&t)
+			req, _ := http.NewRequest("GET", "/tracks/", nil)
+			req.Header.Set("Range", "bytes=2-5")
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(t.ID, 10)})
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.stream)
+			hdlr.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusPartialContent)
+			So(rec.Body.String(), ShouldEqual, "2345")
+			So(rec.Header().Get("Content-Range"), ShouldEqual, "bytes 2-5/10")
+		})
+
+		Convey("should answer conditional stream request", func() {
+			s.streamhdlr = memStreamHandler{"mem": "0123456789"}
+			t := models.Track{Title: "Track 1"}
+			t.AddStream(models.Stream{Path: "mem"})
+			coll.CreateTrack(&t)
+			req, _ := http.NewRequest("GET", "/tracks/", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(t.ID, 10)})
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.stream)
+			hdlr.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "0123456789")
+			etag := rec.Header().Get("ETag")
+			So(etag, ShouldNotBeEmpty)
+			req.Header.Set("If-None-Match", etag)
+			rec = httptest.NewRecorder()
+			hdlr.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusNotModified)
+		})
+
+		Convey("should transcode stream", func() {
+			s.streamhdlr = memStreamHandler{"mem": "flac"}
+			s.transcoder = services.CommandTranscoder{
+				Commands: map[string]services.TranscodeCommand{
+					"mp3": {
+						Args:           []string{"sh", "-c", "printf 'mp3 {bitrate}:'; cat"},
+						Mimetype:       "audio/mpeg",
+						DefaultBitRate: 192,
+					},
+				},
+				Directory: filepath.Join(tmp, "transcodes"),
+			}
+			flac, _ := coll.GetFormat("FLAC")
+			t := models.Track{Title: "Track 1"}
+			t.AddStream(models.Stream{Path: "mem", Format: flac, FormatID: flac.ID, Bitrate: 900000})
+			coll.CreateTrack(&t)
+			get := func(query string) *httptest.ResponseRecorder {
+				req, _ := http.NewRequest("GET", "/tracks/1/stream?"+query, nil)
+				req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(t.ID, 10)})
+				rec := httptest.NewRecorder()
+				http.HandlerFunc(s.stream).ServeHTTP(rec, req)
+				return rec
+			}
+
+			rec := get("format=mp3&maxBitRate=128")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "mp3 128:flac")
+			So(rec.Header().Get("Content-type"), ShouldEqual, "audio/mpeg")
+
+			rec = get("maxBitRate=320")
+			So(rec.Body.String(), ShouldEqual, "mp3 320:flac")
+			So(get("maxBitRate=0").Body.String(), ShouldEqual, "flac")
+			So(get("format=raw").Body.String(), ShouldEqual, "flac")
+			So(get("format=flac").Body.String(), ShouldEqual, "flac")
+			So(get("format=wav").Code, ShouldEqual, http.StatusBadRequest)
+			So(get("maxBitRate=fast").Code, ShouldEqual, http.StatusBadRequest)
+
+			s.transcoder = nil
+			So(get("maxBitRate=128").Body.String(), ShouldEqual, "flac")
+			So(get("format=mp3").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("should add stream to track", func() {
+			t := models.Track{Title: "Track 1"}
+			coll.CreateTrack(&t)
+			f, err := os.Open("../testdata/magic_flute.ogg")
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+			req, _ := http.NewRequest("POST", "/tracks/1/streams", f)
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(t.ID, 10)})
+			rec := httptest.NewRecorder()
+			http.HandlerFunc(s.addStream).ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var strm jsonStream
+			json.NewDecoder(rec.Body).Decode(&strm)
+			So(strm.Format.Name, ShouldEqual, "OGG")
+			trk, _ := coll.GetTrack(t.ID)
+			So(len(trk.Streams), ShouldEqual, 1)
+			So(trk.Streams[0].ID, ShouldEqual, strm.ID)
+			So(trk.Streams[0].SampleRate, ShouldEqual, 44100)
+		})
+
+		Convey("should not add stream to missing track", func() {
+			req, _ := http.NewRequest("POST", "/tracks/1/streams", strings.NewReader("audio"))
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			rec := httptest.NewRecorder()
+			http.HandlerFunc(s.addStream).ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("should select stream of track", func() {
+			s.streamhdlr = memStreamHandler{"flac": "flac", "mp3": "mp3", "ogg": "ogg"}
+			t := models.Track{Title: "Track 1"}
+			for _, name := range []string{"FLAC", "MP3", "OGG"} {
+				f, _ := coll.GetFormat(name)
+				strm := models.Stream{Path: strings.ToLower(name), Format: f, FormatID: f.ID}
+				switch name {
+				case "FLAC":
+					strm.Bitrate, strm.BitDepth = 900000, 16
+				case "MP3":
+					strm.Bitrate = 320000
+				case "OGG":
+					strm.Bitrate = 128000
+				}
+				t.AddStream(strm)
+			}
+			coll.CreateTrack(&t)
+			get := func(query, accept string) *httptest.ResponseRecorder {
+				req, _ := http.NewRequest("GET", "/tracks/1/stream?"+query, nil)
+				if accept != "" {
+					req.Header.Set("Accept", accept)
+				}
+				req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(t.ID, 10)})
+				rec := httptest.NewRecorder()
+				http.HandlerFunc(s.stream).ServeHTTP(rec, req)
+				return rec
+			}
+
+			So(get("", "").Body.String(), ShouldEqual, "flac")
+			So(get("stream="+strconv.FormatInt(t.Streams[2].ID, 10), "").Body.String(), ShouldEqual, "ogg")
+			So(get("stream=1000", "").Code, ShouldEqual, http.StatusNotFound)
+			So(get("format=mp3", "").Body.String(), ShouldEqual, "mp3")
+			So(get("", "audio/ogg").Body.String(), ShouldEqual, "ogg")
+			So(get("", "audio/mpeg;q=0.5, audio/*;q=0.9").Body.String(), ShouldEqual, "flac")
+			So(get("quality=low", "audio/mpeg, audio/flac").Body.String(), ShouldEqual, "mp3")
+			So(get("", "audio/wav").Body.String(), ShouldEqual, "flac")
+			So(get("quality=low", "").Body.String(), ShouldEqual, "ogg")
+			So(get("quality=high", "").Body.String(), ShouldEqual, "flac")
+			So(get("quality=best", "").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("should return not found for track without stream", func() {
+			t := models.Track{Title: "Track 1"}
+			coll.CreateTrack(&t)
+			req, _ := http.NewRequest("GET", "/tracks/", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(t.ID, 10)})
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.stream)
+			hdlr.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
 		})
 
 		Convey("should list releases", func() {
@@ -131,6 +393,51 @@ func TestServer(t *testing.T) {
 			So(strings.Contains(html, "Release 2"), ShouldBeTrue)
 		})
 
+		Convey("should page and sort releases", func() {
+			coll.CreateRelease(&models.Release{Title: "Release B"})
+			coll.CreateRelease(&models.Release{Title: "Release A"})
+			coll.CreateRelease(&models.Release{Title: "Release C"})
+			req, _ := http.NewRequest("GET", "/releases/?sort=title&limit=2", nil)
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.getReleases)
+			hdlr.ServeHTTP(rec, req)
+			body, _ := ioutil.ReadAll(rec.Body)
+			html := string(body)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(strings.Index(html, "Release A"), ShouldBeLessThan, strings.Index(html, "Release B"))
+			So(strings.Contains(html, "Release C"), ShouldBeFalse)
+			So(rec.Header().Get("X-Total-Count"), ShouldEqual, "3")
+			So(rec.Header().Get("Link"), ShouldContainSubstring,
+				`</releases/?limit=2&offset=2&sort=title>; rel="next"`)
+		})
+
+		Convey("should reject unknown sort", func() {
+			req, _ := http.NewRequest("GET", "/tracks/?sort=length", nil)
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.getTracks)
+			hdlr.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("should show release running time", func() {
+			r := models.Release{Title: "Release 1"}
+			coll.CreateRelease(&r)
+			for i, d := range []time.Duration{90 * time.Second, 185 * time.Second} {
+				t := models.Track{Title: "Track", Position: i + 1, ReleaseID: r.ID}
+				t.AddStream(models.Stream{Path: "foo", Duration: d, Bitrate: 192000})
+				coll.CreateTrack(&t)
+			}
+			req, _ := http.NewRequest("GET", "/releases/", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(r.ID, 10)})
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.getRelease)
+			hdlr.ServeHTTP(rec, req)
+			body, _ := ioutil.ReadAll(rec.Body)
+			So(string(body), ShouldContainSubstring, "1:30")
+			So(string(body), ShouldContainSubstring, "3:05")
+			So(string(body), ShouldContainSubstring, "2 tracks, 4:35")
+		})
+
 		Convey("should show release", func() {
 			r := models.Release{Title: "Release 1"}
 			coll.CreateRelease(&r)
@@ -144,6 +451,25 @@ func TestServer(t *testing.T) {
 			So(strings.Contains(string(body), "Release 1"), ShouldBeTrue)
 		})
 
+		Convey("should show release artist credit", func() {
+			a := models.Artist{Name: "Artist A"}
+			b := models.Artist{Name: "Artist B"}
+			coll.CreateArtist(&a)
+			coll.CreateArtist(&b)
+			r := models.Release{Title: "Release 1"}
+			r.AddCredit(a, " & ")
+			r.AddCredit(b, "")
+			coll.CreateRelease(&r)
+			req, _ := http.NewRequest("GET", "/releases/", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(r.ID, 10)})
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.getRelease)
+			hdlr.ServeHTTP(rec, req)
+			body, _ := ioutil.ReadAll(rec.Body)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(strings.Contains(string(body), "Artist A</a> &amp; <a"), ShouldBeTrue)
+		})
+
 		Convey("should add release", func() {
 			post, _ := json.Marshal(&models.Release{Title: "Release 1"})
 			req, _ := http.NewRequest("POST", "/releases/", bytes.NewReader(post))
@@ -173,6 +499,340 @@ func TestServer(t *testing.T) {
 			So(len(rel.Tracks), ShouldEqual, 1)
 		})
 
-		SkipConvey("should add release from upload", func() {})
+		Convey("should return not found when editing missing release", func() {
+			req, _ := http.NewRequest("POST", "/releases/", strings.NewReader(`{"title": "Release 2"}`))
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.editRelease)
+			hdlr.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("should add release from upload", func() {
+			var buf bytes.Buffer
+			arxv := zip.NewWriter(&buf)
+			arxv.Create("Album/")
+			for _, name := range []string{"magic_flute.ogg", "papageno.ogg"} {
+				audio, _ := ioutil.ReadFile("../testdata/" + name)
+				f, _ := arxv.Create("Album/" + name)
+				f.Write(audio)
+			}
+			f, _ := arxv.Create("Album/Album.cue")
+			f.Write([]byte("FILE \"magic_flute.ogg\" WAVE\n"))
+			f, _ = arxv.Create("Album/notes.bin")
+			f.Write([]byte("not audio"))
+			arxv.Close()
+			req, _ := http.NewRequest("POST", "/releases/upload", &buf)
+			rec := httptest.NewRecorder()
+			http.HandlerFunc(s.uploadRelease).ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var report uploadReport
+			So(json.NewDecoder(rec.Body).Decode(&report), ShouldBeNil)
+			So(report.Release, ShouldNotBeNil)
+			So(len(report.Release.Tracks), ShouldEqual, 2)
+			So(len(report.Files), ShouldEqual, 4)
+			So(report.Files[0].Result, ShouldEqual, models.FileTrack)
+			So(report.Files[0].TrackID, ShouldNotEqual, 0)
+			So(report.Files[2].Result, ShouldEqual, models.FileSkipped)
+			So(report.Files[2].Kind, ShouldEqual, "cue")
+			So(report.Files[3].Kind, ShouldEqual, "unsupported")
+		})
+
+		Convey("should add release from gzipped tar upload", func() {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(gz)
+			audio, _ := ioutil.ReadFile("../testdata/papageno.ogg")
+			tw.WriteHeader(&tar.Header{Name: "Album/papageno.ogg", Mode: 0644, Size: int64(len(audio))})
+			tw.Write(audio)
+			tw.Close()
+			gz.Close()
+			req, _ := http.NewRequest("POST", "/releases/upload", &buf)
+			rec := httptest.NewRecorder()
+			http.HandlerFunc(s.uploadRelease).ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var report uploadReport
+			json.NewDecoder(rec.Body).Decode(&report)
+			So(len(report.Release.Tracks), ShouldEqual, 1)
+			So(report.Files[0].Name, ShouldEqual, "Album/papageno.ogg")
+		})
+
+		Convey("should add release from form upload", func() {
+			var buf bytes.Buffer
+			form := multipart.NewWriter(&buf)
+			for _, name := range []string{"magic_flute.ogg", "papageno.ogg"} {
+				audio, _ := ioutil.ReadFile("../testdata/" + name)
+				f, _ := form.CreateFormFile("files", "Album/"+name)
+				f.Write(audio)
+			}
+			form.WriteField("note", "not a file")
+			form.Close()
+			req, _ := http.NewRequest("POST", "/releases/upload", &buf)
+			req.Header.Set("Content-type", form.FormDataContentType())
+			rec := httptest.NewRecorder()
+			http.HandlerFunc(s.uploadRelease).ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusSeeOther)
+			var rel models.Release
+			db.Preload("Tracks").First(&rel)
+			So(rec.Header().Get("Location"), ShouldEqual, fmt.Sprintf("/releases/%d", rel.ID))
+			So(len(rel.Tracks), ShouldEqual, 2)
+		})
+
+		Convey("should leave nothing behind when release upload fails", func() {
+			var buf bytes.Buffer
+			arxv := zip.NewWriter(&buf)
+			for _, name := range []string{"magic_flute.ogg", "papageno.ogg"} {
+				audio, _ := ioutil.ReadFile("../testdata/" + name)
+				f, _ := arxv.Create("Album/" + name)
+				f.Write(audio)
+			}
+			f, _ := arxv.Create("Album/cover.png")
+			png.Encode(f, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+			arxv.Close()
+			failing := s
+			failing.streamhdlr = &failingStreamHandler{StreamHandler: s.streamhdlr, after: 2}
+			req, _ := http.NewRequest("POST", "/releases/upload", &buf)
+			rec := httptest.NewRecorder()
+			http.HandlerFunc(failing.uploadRelease).ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+			var report uploadReport
+			So(json.NewDecoder(rec.Body).Decode(&report), ShouldBeNil)
+			So(report.Release, ShouldBeNil)
+			So(report.Error, ShouldNotBeEmpty)
+			So(report.Files[0].Result, ShouldEqual, models.FileTrack)
+			So(report.Files[1].Result, ShouldEqual, models.FileFailed)
+			So(report.Files[2].Result, ShouldEqual, models.FileCover)
+
+			var count int
+			db.Model(&models.Release{}).Count(&count)
+			So(count, ShouldEqual, 0)
+			db.Model(&models.Artist{}).Count(&count)
+			So(count, ShouldEqual, 0)
+			stored, _ := ioutil.ReadDir(tmp)
+			So(stored, ShouldBeEmpty)
+		})
+
+		Convey("should store cover from release upload", func() {
+			var buf bytes.Buffer
+			arxv := zip.NewWriter(&buf)
+			audio, _ := ioutil.ReadFile("../testdata/magic_flute.ogg")
+			f, _ := arxv.Create("Album/18.ogg")
+			f.Write(audio)
+			f, _ = arxv.Create("Album/Cover.PNG")
+			png.Encode(f, image.NewRGBA(image.Rect(0, 0, 400, 200)))
+			arxv.Close()
+			req, _ := http.NewRequest("POST", "/releases/upload", &buf)
+			rec := httptest.NewRecorder()
+			http.HandlerFunc(s.uploadRelease).ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var rel models.Release
+			db.First(&rel)
+			So(rel.Cover, ShouldNotBeEmpty)
+			So(rel.Title, ShouldEqual, "Die Zauberflöte")
+
+			req, _ = http.NewRequest("GET", "/releases/cover?size=100", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(rel.ID, 10)})
+			rec = httptest.NewRecorder()
+			http.HandlerFunc(s.cover).ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("Content-type"), ShouldEqual, "image/jpeg")
+			thumb, err := jpeg.DecodeConfig(rec.Body)
+			So(err, ShouldBeNil)
+			So(thumb.Width, ShouldEqual, 100)
+			So(thumb.Height, ShouldEqual, 50)
+		})
+
+		Convey("should serve WebP thumbnail", func() {
+			var img bytes.Buffer
+			png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 400, 200)))
+			cover, _ := s.streamhdlr.Store(&img)
+			rel := models.Release{Title: "Release 1", Cover: cover}
+			coll.CreateRelease(&rel)
+			thumbnail := func(query string) *httptest.ResponseRecorder {
+				req, _ := http.NewRequest("GET", "/releases/cover?"+query, nil)
+				req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(rel.ID, 10)})
+				rec := httptest.NewRecorder()
+				http.HandlerFunc(s.cover).ServeHTTP(rec, req)
+				return rec
+			}
+			So(thumbnail("size=100&format=webp").Code, ShouldEqual, http.StatusBadRequest)
+			s.thumbnails.WebPCommand = []string{"sh", "-c", "printf RIFF; cat >/dev/null"}
+			rec := thumbnail("size=100&format=webp")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("Content-type"), ShouldEqual, "image/webp")
+			So(rec.Body.String(), ShouldEqual, "RIFF")
+			So(thumbnail("size=100&format=gif").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("should return not found for release without cover", func() {
+			r := models.Release{Title: "Release 1"}
+			coll.CreateRelease(&r)
+			req, _ := http.NewRequest("GET", "/releases/cover", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(r.ID, 10)})
+			rec := httptest.NewRecorder()
+			http.HandlerFunc(s.cover).ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("should list artists", func() {
+			coll.CreateArtist(&models.Artist{Name: "Artist 1"})
+			coll.CreateArtist(&models.Artist{Name: "Artist 2"})
+			req, _ := http.NewRequest("GET", "/artists/", nil)
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.getArtists)
+			hdlr.ServeHTTP(rec, req)
+			body, _ := ioutil.ReadAll(rec.Body)
+			html := string(body)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(strings.Contains(html, "Artist 1"), ShouldBeTrue)
+			So(strings.Contains(html, "Artist 2"), ShouldBeTrue)
+		})
+
+		Convey("should page artists", func() {
+			for i := 1; i <= 12; i++ {
+				coll.CreateArtist(&models.Artist{Name: fmt.Sprintf("Artist %02d", i)})
+			}
+			req, _ := http.NewRequest("GET", "/artists/?offset=10&limit=5", nil)
+			rec := httptest.NewRecorder()
+			http.HandlerFunc(s.getArtists).ServeHTTP(rec, req)
+			body, _ := ioutil.ReadAll(rec.Body)
+			html := string(body)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(strings.Contains(html, "Artist 11"), ShouldBeTrue)
+			So(strings.Contains(html, "Artist 12"), ShouldBeTrue)
+			So(strings.Contains(html, "Artist 10"), ShouldBeFalse)
+			So(rec.Header().Get("X-Total-Count"), ShouldEqual, "12")
+			So(rec.Header().Get("Link"), ShouldContainSubstring,
+				`</artists/?limit=5&offset=5>; rel="prev"`)
+		})
+
+		Convey("should show artist", func() {
+			a := models.Artist{Name: "Artist 1"}
+			coll.CreateArtist(&a)
+			r := models.Release{Title: "Release 1"}
+			r.AddArtist(a)
+			coll.CreateRelease(&r)
+			req, _ := http.NewRequest("GET", "/artists/", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(a.ID, 10)})
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.getArtist)
+			hdlr.ServeHTTP(rec, req)
+			body, _ := ioutil.ReadAll(rec.Body)
+			html := string(body)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(strings.Contains(html, "Artist 1"), ShouldBeTrue)
+			So(strings.Contains(html, "Release 1"), ShouldBeTrue)
+		})
+
+		Convey("should search", func() {
+			coll.CreateTrack(&models.Track{Title: "Blue Moon"})
+			coll.CreateTrack(&models.Track{Title: "Red Sky"})
+			req, _ := http.NewRequest("GET", "/search?q=blue", nil)
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.search)
+			hdlr.ServeHTTP(rec, req)
+			body, _ := ioutil.ReadAll(rec.Body)
+			html := string(body)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(strings.Contains(html, "Blue Moon"), ShouldBeTrue)
+			So(strings.Contains(html, "Red Sky"), ShouldBeFalse)
+		})
+
+		Convey("should search as JSON", func() {
+			coll.CreateTrack(&models.Track{Title: "Blue Moon"})
+			coll.CreateTrack(&models.Track{Title: "Blue Sky"})
+			req, _ := http.NewRequest("GET", "/search?q=title:blue&limit=1", nil)
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.search)
+			hdlr.ServeHTTP(rec, req)
+			var res jsonSearchResult
+			json.NewDecoder(rec.Body).Decode(&res)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(len(res.Tracks), ShouldEqual, 1)
+		})
+
+		Convey("should show track as JSON", func() {
+			var format models.Format
+			db.Where("name = ?", "OGG").First(&format)
+			t := models.Track{Title: "Track 1", Position: 3}
+			t.AddCredit(models.Artist{Name: "Artist A"}, " & ")
+			t.AddArtist(models.Artist{Name: "Artist B"})
+			t.AddStream(models.Stream{Path: "foo", Format: format})
+			coll.CreateTrack(&t)
+			req, _ := http.NewRequest("GET", "/tracks/", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": strconv.FormatInt(t.ID, 10)})
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			hdlr := http.HandlerFunc(s.getTrack)
+			hdlr.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("Content-type"), ShouldEqual, "application/json")
+			var trk jsonTrack
+			json.NewDecoder(rec.Body).Decode(&trk)
+			So(trk.Title, ShouldEqual, "Track 1")
+			So(trk.Credit, ShouldEqual, "Artist A & Artist B")
+			So(trk.Artists[1].Name, ShouldEqual, "Artist B")
+			So(trk.Streams[0].Format.Mimetype, ShouldEqual, "audio/ogg")
+			So(trk.Streams[0].URL, ShouldEqual,
+				fmt.Sprintf("/tracks/%d/stream?stream=%d", t.ID, trk.Streams[0].ID))
+		})
+
+		Convey("should accept track JSON back", func() {
+			t := models.Track{Title: "Track 1"}
+			t.AddArtist(models.Artist{Name: "Artist 1"})
+			t.AddStream(models.Stream{Path: "foo"})
+			coll.CreateTrack(&t)
+			router := NewServer(coll, s.streamhdlr, "../../templates")
+			url := fmt.Sprintf("/tracks/%d", t.ID)
+			req, _ := http.NewRequest("GET", url+".json", nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			body := strings.Replace(rec.Body.String(), `"Track 1"`, `"Track 2"`, 1)
+			req, _ = http.NewRequest("POST", url, strings.NewReader(body))
+			req.Header.Set("Content-type", "application/json")
+			rec = httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			trk, _ := coll.GetTrack(t.ID)
+			So(trk.Title, ShouldEqual, "Track 2")
+			So(trk.ArtistCredit(), ShouldEqual, "Artist 1")
+			So(trk.Streams[0].Path, ShouldEqual, "foo")
+		})
+
+		Convey("should serve JSON at .json suffix", func() {
+			r := models.Release{Title: "Release 1"}
+			r.AddArtist(models.Artist{Name: "Artist 1"})
+			r.AddTrack(models.Track{Title: "Track 1"})
+			coll.CreateRelease(&r)
+			router := NewServer(coll, s.streamhdlr, "../../templates")
+			req, _ := http.NewRequest("GET", fmt.Sprintf("/releases/%d.json", r.ID), nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var rel jsonRelease
+			json.NewDecoder(rec.Body).Decode(&rel)
+			So(rel.Title, ShouldEqual, "Release 1")
+			So(rel.Artists[0].Name, ShouldEqual, "Artist 1")
+			So(len(rel.Tracks), ShouldEqual, 1)
+
+			req, _ = http.NewRequest("GET", "/releases.json", nil)
+			rec = httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			var list []jsonRelease
+			json.NewDecoder(rec.Body).Decode(&list)
+			So(len(list), ShouldEqual, 1)
+			So(rec.Header().Get("Link"), ShouldNotBeEmpty)
+		})
+
+		Convey("should prefer HTML for browsers", func() {
+			req, _ := http.NewRequest("GET", "/releases/", nil)
+			req.Header.Set("Accept", "text/html,application/xhtml+xml,application/json;q=0.9,*/*;q=0.8")
+			So(wantsJSON(req), ShouldBeFalse)
+			req.Header.Set("Accept", "application/json, text/html;q=0.5")
+			So(wantsJSON(req), ShouldBeTrue)
+			req.Header.Set("Accept", "*/*")
+			So(wantsJSON(req), ShouldBeFalse)
+		})
 	})
 }
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Quality preferences for choosing between the streams of a track.
+const (
+	qualityHigh = "high" // lossless first, then the highest bit rate
+	qualityLow  = "low"  // the lowest bit rate
+)
+
+// selectStream chooses the stream of a track to serve for a request. The
+// stream parameter picks a stream by ID. Otherwise streams in the format
+// named by the format parameter come first, then those the Accept header
+// prefers, and then those best matching the quality parameter, which is high
+// or low. Preferences that no stream matches are ignored, and streams that
+// are equally preferred are chosen in order.
+func selectStream(r *http.Request, streams []models.Stream) (models.Stream, error) {
+	if len(streams) == 0 {
+		return models.Stream{}, fmt.Errorf("no streams")
+	}
+	if v := r.FormValue("stream"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return models.Stream{}, badRequestError{fmt.Errorf("invalid stream %q", v)}
+		}
+		for _, s := range streams {
+			if s.ID == id {
+				return s, nil
+			}
+		}
+		return models.Stream{}, models.NotFoundError{Kind: "stream", Key: id}
+	}
+	quality := r.FormValue("quality")
+	if quality != "" && quality != qualityHigh && quality != qualityLow {
+		return models.Stream{}, badRequestError{fmt.Errorf("unknown quality %q", quality)}
+	}
+	format := strings.ToLower(r.FormValue("format"))
+	accept := parseAccept(r.Header.Get("Accept"))
+
+	best := streams[0]
+	for _, s := range streams[1:] {
+		if preferStream(s, best, format, accept, quality) {
+			best = s
+		}
+	}
+	return best, nil
+}
+
+// preferStream reports whether a is preferred to b.
+func preferStream(a, b models.Stream, format string, accept []acceptRange, quality string) bool {
+	if format != "" {
+		am := strings.ToLower(a.Format.Name) == format
+		bm := strings.ToLower(b.Format.Name) == format
+		if am != bm {
+			return am
+		}
+	}
+	if aq, bq := acceptQuality(accept, a.Format.Mimetype), acceptQuality(accept, b.Format.Mimetype); aq != bq {
+		return aq > bq
+	}
+	switch quality {
+	case qualityHigh:
+		if al, bl := lossless(a), lossless(b); al != bl {
+			return al
+		}
+		return a.Bitrate > b.Bitrate
+	case qualityLow:
+		// Streams of unknown bit rate are the least likely to be small.
+		if a.Bitrate == 0 || b.Bitrate == 0 {
+			return b.Bitrate == 0 && a.Bitrate != 0
+		}
+		return a.Bitrate < b.Bitrate
+	}
+	return false
+}
+
+// lossless reports whether a stream is in a lossless format.
+func lossless(s models.Stream) bool {
+	return s.BitDepth > 0 || strings.EqualFold(s.Format.Name, "flac")
+}
+
+// acceptRange is a media range of an Accept header with its quality value.
+type acceptRange struct {
+	mimetype string
+	q        float64
+}
+
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mimetype: mt, q: q})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality value of the most specific range in
+// accept that matches mimetype. Mimetypes are all acceptable if there are no
+// ranges, and not acceptable if none match.
+func acceptQuality(accept []acceptRange, mimetype string) float64 {
+	if len(accept) == 0 {
+		return 1
+	}
+	mimetype = strings.ToLower(mimetype)
+	typ := strings.SplitN(mimetype, "/", 2)[0]
+	q, specificity := 0.0, -1
+	for _, a := range accept {
+		n := -1
+		switch {
+		case a.mimetype == mimetype:
+			n = 2
+		case a.mimetype == typ+"/*":
+			n = 1
+		case a.mimetype == "*/*":
+			n = 0
+		}
+		if n > specificity {
+			q, specificity = a.q, n
+		}
+	}
+	return q
+}
@@ -0,0 +1,712 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gravesm/blueshift/pkg/models"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The Subsonic API is described at http://www.subsonic.org/pages/api.jsp.
+// Artists, albums and songs are identified by the Blueshift ID of the
+// artist, release or track with a prefix, since Subsonic clients expect IDs
+// to be unique across all kinds of item.
+const (
+	subsonicVersion = "1.16.1"
+	subsonicXmlns   = "http://subsonic.org/restapi"
+	ignoredArticles = "The El La Los Las Le Les"
+
+	artistPrefix   = "ar-"
+	albumPrefix    = "al-"
+	songPrefix     = "tr-"
+	playlistPrefix = "pl-"
+
+	// subsonicPage is the number of rows fetched at a time when a Subsonic
+	// method needs to read the whole collection.
+	subsonicPage = 500
+)
+
+// Subsonic error codes.
+const (
+	subsonicGeneric        = 0
+	subsonicMissingParam   = 10
+	subsonicBadCredentials = 40
+	subsonicNotFound       = 70
+)
+
+type subsonicResponse struct {
+	XMLName       xml.Name          `xml:"subsonic-response" json:"-"`
+	Xmlns         string            `xml:"xmlns,attr" json:"-"`
+	Status        string            `xml:"status,attr" json:"status"`
+	Version       string            `xml:"version,attr" json:"version"`
+	Error         *subsonicError    `xml:"error,omitempty" json:"error,omitempty"`
+	License       *subLicense       `xml:"license,omitempty" json:"license,omitempty"`
+	MusicFolders  *subMusicFolders  `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Indexes       *subIndexes       `xml:"indexes,omitempty" json:"indexes,omitempty"`
+	Artists       *subArtists       `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist        *subArtist        `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album         *subAlbum         `xml:"album,omitempty" json:"album,omitempty"`
+	Song          *subChild         `xml:"song,omitempty" json:"song,omitempty"`
+	SearchResult3 *subSearchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+	Playlists     *subPlaylists     `xml:"playlists,omitempty" json:"playlists,omitempty"`
+	Playlist      *subPlaylist      `xml:"playlist,omitempty" json:"playlist,omitempty"`
+}
+
+// subsonicError is both the error element of a failed response and the
+// error returned by Subsonic method handlers.
+type subsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+func (e subsonicError) Error() string {
+	return e.Message
+}
+
+type subLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type subMusicFolders struct {
+	MusicFolder []subMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type subMusicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type subIndexes struct {
+	LastModified    int64      `xml:"lastModified,attr" json:"lastModified"`
+	IgnoredArticles string     `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []subIndex `xml:"index" json:"index,omitempty"`
+}
+
+type subArtists struct {
+	IgnoredArticles string     `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []subIndex `xml:"index" json:"index,omitempty"`
+}
+
+type subIndex struct {
+	Name   string      `xml:"name,attr" json:"name"`
+	Artist []subArtist `xml:"artist" json:"artist"`
+}
+
+type subArtist struct {
+	ID         string     `xml:"id,attr" json:"id"`
+	Name       string     `xml:"name,attr" json:"name"`
+	AlbumCount int        `xml:"albumCount,attr,omitempty" json:"albumCount,omitempty"`
+	Album      []subAlbum `xml:"album" json:"album,omitempty"`
+}
+
+type subAlbum struct {
+	ID        string     `xml:"id,attr" json:"id"`
+	Name      string     `xml:"name,attr" json:"name"`
+	Artist    string     `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	ArtistID  string     `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	SongCount int        `xml:"songCount,attr" json:"songCount"`
+	Duration  int        `xml:"duration,attr" json:"duration"`
+	Year      int        `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Created   string     `xml:"created,attr,omitempty" json:"created,omitempty"`
+	CoverArt  string     `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Song      []subChild `xml:"song" json:"song,omitempty"`
+}
+
+type subChild struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track       int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+	Year        int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	DiscNumber  int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	AlbumID     string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID    string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Type        string `xml:"type,attr" json:"type"`
+	Created     string `xml:"created,attr,omitempty" json:"created,omitempty"`
+	CoverArt    string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Duration    int    `xml:"duration,attr,omitempty" json:"duration,omitempty"`
+	Size        int64  `xml:"size,attr,omitempty" json:"size,omitempty"`
+	BitRate     int    `xml:"bitRate,attr,omitempty" json:"bitRate,omitempty"`
+}
+
+type subSearchResult3 struct {
+	Artist []subArtist `xml:"artist" json:"artist,omitempty"`
+	Album  []subAlbum  `xml:"album" json:"album,omitempty"`
+	Song   []subChild  `xml:"song" json:"song,omitempty"`
+}
+
+type subPlaylists struct {
+	Playlist []subPlaylist `xml:"playlist" json:"playlist,omitempty"`
+}
+
+type subPlaylist struct {
+	ID        string     `xml:"id,attr" json:"id"`
+	Name      string     `xml:"name,attr" json:"name"`
+	Comment   string     `xml:"comment,attr,omitempty" json:"comment,omitempty"`
+	Owner     string     `xml:"owner,attr,omitempty" json:"owner,omitempty"`
+	Public    bool       `xml:"public,attr" json:"public"`
+	SongCount int        `xml:"songCount,attr" json:"songCount"`
+	Duration  int        `xml:"duration,attr" json:"duration"`
+	Created   string     `xml:"created,attr" json:"created"`
+	Changed   string     `xml:"changed,attr" json:"changed"`
+	Entry     []subChild `xml:"entry" json:"entry,omitempty"`
+}
+
+// subsonicMethods maps Subsonic method names to their handlers. A handler
+// fills in its part of the response, or returns an error.
+var subsonicMethods = map[string]func(Server, *http.Request, *subsonicResponse) error{
+	"ping":            func(Server, *http.Request, *subsonicResponse) error { return nil },
+	"getLicense":      Server.subGetLicense,
+	"getMusicFolders": Server.subGetMusicFolders,
+	"getIndexes":      Server.subGetIndexes,
+	"getArtists":      Server.subGetArtists,
+	"getArtist":       Server.subGetArtist,
+	"getAlbum":        Server.subGetAlbum,
+	"getSong":         Server.subGetSong,
+	"search3":         Server.subSearch3,
+	"getPlaylists":    Server.subGetPlaylists,
+	"getPlaylist":     Server.subGetPlaylist,
+	"scrobble":        Server.subScrobble,
+}
+
+func (s Server) subsonicAPI(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimSuffix(mux.Vars(r)["method"], ".view")
+	if err := s.subsonicAuth(r); err != nil {
+		s.subsonicWrite(w, r, subsonicResponse{}, err)
+		return
+	}
+	if method == "stream" || method == "download" {
+		if err := s.subStream(w, r); err != nil {
+			s.subsonicWrite(w, r, subsonicResponse{}, err)
+		}
+		return
+	}
+	if method == "getCoverArt" {
+		if err := s.subCoverArt(w, r); err != nil {
+			s.subsonicWrite(w, r, subsonicResponse{}, err)
+		}
+		return
+	}
+	handler, ok := subsonicMethods[method]
+	if !ok {
+		s.subsonicWrite(w, r, subsonicResponse{},
+			subsonicError{subsonicNotFound, "Unknown method " + method})
+		return
+	}
+	var resp subsonicResponse
+	err := handler(s, r, &resp)
+	s.subsonicWrite(w, r, resp, err)
+}
+
+// subsonicAuth checks the credentials of a request, given either as a
+// password, possibly hex encoded, or as an MD5 token of the password and a
+// salt.
+func (s Server) subsonicAuth(r *http.Request) error {
+	user := r.FormValue("u")
+	if user == "" {
+		return subsonicError{subsonicMissingParam, "Required parameter is missing: u"}
+	}
+	password, ok := s.subsonic[user]
+	var given, expected string
+	if token, salt := r.FormValue("t"), r.FormValue("s"); token != "" && salt != "" {
+		sum := md5.Sum([]byte(password + salt))
+		given, expected = strings.ToLower(token), hex.EncodeToString(sum[:])
+	} else if p := r.FormValue("p"); p != "" {
+		if strings.HasPrefix(p, "enc:") {
+			b, err := hex.DecodeString(p[4:])
+			if err != nil {
+				return subsonicError{subsonicBadCredentials, "Wrong username or password"}
+			}
+			p = string(b)
+		}
+		given, expected = p, password
+	} else {
+		return subsonicError{subsonicMissingParam, "Required parameter is missing: p or t and s"}
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+		return subsonicError{subsonicBadCredentials, "Wrong username or password"}
+	}
+	return nil
+}
+
+// jsonpCallback matches the callbacks JSONP responses may call, which are
+// names of functions, possibly properties of objects, and no other script.
+var jsonpCallback = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$.]*$`)
+
+// subsonicWrite writes resp, or a failed response if err is not nil, in the
+// format requested by the f parameter.
+func (s Server) subsonicWrite(w http.ResponseWriter, r *http.Request, resp subsonicResponse, err error) {
+	if err != nil {
+		e, ok := err.(subsonicError)
+		if !ok {
+			e = subsonicError{Code: subsonicGeneric, Message: err.Error()}
+			if models.IsNotFound(err) {
+				e.Code = subsonicNotFound
+			}
+		}
+		resp = subsonicResponse{Status: "failed", Error: &e}
+	} else {
+		resp.Status = "ok"
+	}
+	resp.Xmlns = subsonicXmlns
+	resp.Version = subsonicVersion
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	switch r.FormValue("f") {
+	case "json", "jsonp":
+		body, err := json.Marshal(map[string]subsonicResponse{"subsonic-response": resp})
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+		if cb := r.FormValue("callback"); r.FormValue("f") == "jsonp" && cb != "" {
+			if !jsonpCallback.MatchString(cb) {
+				s.error(w, http.StatusBadRequest, fmt.Errorf("invalid callback %q", cb))
+				return
+			}
+			w.Header().Set("Content-type", "application/javascript")
+			fmt.Fprintf(w, "%s(%s);", cb, body)
+			return
+		}
+		w.Header().Set("Content-type", "application/json")
+		w.Write(body)
+	default:
+		body, err := xml.Marshal(resp)
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+		w.Header().Set("Content-type", "text/xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		w.Write(body)
+	}
+}
+
+func (s Server) subGetLicense(r *http.Request, resp *subsonicResponse) error {
+	resp.License = &subLicense{Valid: true}
+	return nil
+}
+
+func (s Server) subGetMusicFolders(r *http.Request, resp *subsonicResponse) error {
+	resp.MusicFolders = &subMusicFolders{
+		MusicFolder: []subMusicFolder{{ID: 1, Name: "Music"}},
+	}
+	return nil
+}
+
+func (s Server) subGetIndexes(r *http.Request, resp *subsonicResponse) error {
+	index, err := s.subIndex()
+	if err != nil {
+		return err
+	}
+	resp.Indexes = &subIndexes{
+		LastModified:    time.Now().UnixNano() / int64(time.Millisecond),
+		IgnoredArticles: ignoredArticles,
+		Index:           index,
+	}
+	return nil
+}
+
+func (s Server) subGetArtists(r *http.Request, resp *subsonicResponse) error {
+	index, err := s.subIndex()
+	if err != nil {
+		return err
+	}
+	resp.Artists = &subArtists{IgnoredArticles: ignoredArticles, Index: index}
+	return nil
+}
+
+func (s Server) subGetArtist(r *http.Request, resp *subsonicResponse) error {
+	id, err := subsonicID(r, "id", artistPrefix)
+	if err != nil {
+		return err
+	}
+	a, err := s.collection.GetArtist(id)
+	if err != nil {
+		return err
+	}
+	artist := subArtistOf(a)
+	for _, rel := range a.Releases {
+		artist.Album = append(artist.Album, subAlbumOf(rel))
+	}
+	resp.Artist = &artist
+	return nil
+}
+
+func (s Server) subGetAlbum(r *http.Request, resp *subsonicResponse) error {
+	id, err := subsonicID(r, "id", albumPrefix)
+	if err != nil {
+		return err
+	}
+	rel, err := s.collection.GetRelease(id)
+	if err != nil {
+		return err
+	}
+	album := subAlbumOf(rel)
+	for _, t := range rel.Tracks {
+		album.Song = append(album.Song, subChildOf(t, rel))
+	}
+	resp.Album = &album
+	return nil
+}
+
+func (s Server) subGetSong(r *http.Request, resp *subsonicResponse) error {
+	id, err := subsonicID(r, "id", songPrefix)
+	if err != nil {
+		return err
+	}
+	t, err := s.collection.GetTrack(id)
+	if err != nil {
+		return err
+	}
+	var rel models.Release
+	if t.ReleaseID != 0 {
+		rel, err = s.collection.GetRelease(t.ReleaseID)
+		if err != nil {
+			return err
+		}
+	}
+	song := subChildOf(t, rel)
+	resp.Song = &song
+	return nil
+}
+
+func (s Server) subStream(w http.ResponseWriter, r *http.Request) error {
+	id, err := subsonicID(r, "id", songPrefix)
+	if err != nil {
+		return err
+	}
+	t, err := s.collection.GetTrack(id)
+	if err != nil {
+		return err
+	}
+	if len(t.Streams) == 0 {
+		return models.NotFoundError{Kind: "stream for track", Key: id}
+	}
+	strm, err := selectStream(r, t.Streams)
+	if err != nil {
+		return err
+	}
+	return s.serveStream(w, r, strm)
+}
+
+// subCoverArt serves the cover of an album. Songs have the cover of their
+// album.
+func (s Server) subCoverArt(w http.ResponseWriter, r *http.Request) error {
+	id, err := subsonicID(r, "id", albumPrefix)
+	if err != nil {
+		songID, serr := subsonicID(r, "id", songPrefix)
+		if serr != nil {
+			return err
+		}
+		t, err := s.collection.GetTrack(songID)
+		if err != nil {
+			return err
+		}
+		id = t.ReleaseID
+	}
+	size, _ := strconv.Atoi(r.FormValue("size"))
+	if size < 0 || size > maxThumbnail {
+		size = maxThumbnail
+	}
+	return s.serveCover(w, r, id, size, "")
+}
+
+func (s Server) subSearch3(r *http.Request, resp *subsonicResponse) error {
+	query := r.FormValue("query")
+	var result subSearchResult3
+
+	// Each kind of result has its own page, so the collection is searched
+	// once for each.
+	offset, count := subsonicRange(r, "artistOffset", "artistCount")
+	found, err := s.collection.Search(query, offset, count)
+	if err != nil {
+		return err
+	}
+	for _, a := range found.Artists {
+		result.Artist = append(result.Artist, subArtistOf(a))
+	}
+
+	offset, count = subsonicRange(r, "albumOffset", "albumCount")
+	found, err = s.collection.Search(query, offset, count)
+	if err != nil {
+		return err
+	}
+	for _, rel := range found.Releases {
+		result.Album = append(result.Album, subAlbumOf(rel))
+	}
+
+	offset, count = subsonicRange(r, "songOffset", "songCount")
+	found, err = s.collection.Search(query, offset, count)
+	if err != nil {
+		return err
+	}
+	if result.Song, err = s.subSongs(found.Tracks); err != nil {
+		return err
+	}
+
+	resp.SearchResult3 = &result
+	return nil
+}
+
+func (s Server) subGetPlaylists(r *http.Request, resp *subsonicResponse) error {
+	playlists, err := s.collection.Playlists()
+	if err != nil {
+		return err
+	}
+	resp.Playlists = &subPlaylists{}
+	for _, p := range playlists {
+		resp.Playlists.Playlist = append(resp.Playlists.Playlist, subPlaylistOf(p, r.FormValue("u")))
+	}
+	return nil
+}
+
+func (s Server) subGetPlaylist(r *http.Request, resp *subsonicResponse) error {
+	id, err := subsonicID(r, "id", playlistPrefix)
+	if err != nil {
+		return err
+	}
+	p, err := s.collection.GetPlaylist(id)
+	if err != nil {
+		return err
+	}
+	playlist := subPlaylistOf(p, r.FormValue("u"))
+	tracks := make([]models.Track, len(p.Entries))
+	for i, e := range p.Entries {
+		tracks[i] = e.Track
+	}
+	if playlist.Entry, err = s.subSongs(tracks); err != nil {
+		return err
+	}
+	resp.Playlist = &playlist
+	return nil
+}
+
+// subScrobble records a play of a song. Notifications that a song is now
+// playing, with submission=false, are passed on to the ListenBrainz service
+// of the user.
+func (s Server) subScrobble(r *http.Request, resp *subsonicResponse) error {
+	id, err := subsonicID(r, "id", songPrefix)
+	if err != nil {
+		return err
+	}
+	t, err := s.collection.GetTrack(id)
+	if err != nil {
+		return err
+	}
+	// Subsonic users have their own passwords, but are the user of the same
+	// name if there is one.
+	var userID int64
+	if u, err := s.collection.GetUserByName(r.FormValue("u")); err == nil {
+		userID = u.ID
+	} else if !models.IsNotFound(err) {
+		return err
+	}
+	if strings.EqualFold(r.FormValue("submission"), "false") {
+		s.nowPlaying(userID, t, r.FormValue("c"))
+		return nil
+	}
+	at := time.Now()
+	if v := r.FormValue("time"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return subsonicError{subsonicGeneric, "Invalid time " + v}
+		}
+		at = time.Unix(0, ms*int64(time.Millisecond))
+	}
+	p := models.Play{UserID: userID, TrackID: t.ID, PlayedAt: at, Client: r.FormValue("c")}
+	if err := s.collection.CreatePlay(&p); err != nil {
+		return err
+	}
+	s.forward(p)
+	return nil
+}
+
+// subIndex returns every artist in the collection grouped by the first
+// letter of their name, ignoring leading articles.
+func (s Server) subIndex() ([]subIndex, error) {
+	groups := make(map[string][]subArtist)
+	for offset := 0; ; offset += subsonicPage {
+		artists, _, err := s.collection.Artists(models.ListOptions{
+			Offset: offset, Limit: subsonicPage, Sort: models.SortArtist})
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range artists {
+			key := indexKey(a.Name)
+			groups[key] = append(groups[key], subArtistOf(a))
+		}
+		if len(artists) < subsonicPage {
+			break
+		}
+	}
+	var index []subIndex
+	for name, artists := range groups {
+		index = append(index, subIndex{Name: name, Artist: artists})
+	}
+	sort.Slice(index, func(i, j int) bool { return index[i].Name < index[j].Name })
+	return index, nil
+}
+
+// indexKey returns the index an artist name is listed under.
+func indexKey(name string) string {
+	for _, article := range strings.Fields(ignoredArticles) {
+		if strings.HasPrefix(name, article+" ") {
+			name = strings.TrimPrefix(name, article+" ")
+			break
+		}
+	}
+	for _, c := range name {
+		if unicode.IsLetter(c) {
+			return string(unicode.ToUpper(c))
+		}
+		break
+	}
+	return "#"
+}
+
+// subsonicRange parses an offset and count parameter pair. The count
+// defaults to 20 as in the Subsonic API.
+func subsonicRange(r *http.Request, offsetParam string, countParam string) (int, int) {
+	offset, err := strconv.Atoi(r.FormValue(offsetParam))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	count, err := strconv.Atoi(r.FormValue(countParam))
+	if err != nil || count < 0 {
+		count = 20
+	}
+	return offset, count
+}
+
+// subsonicID parses a prefixed Subsonic ID from the named parameter.
+func subsonicID(r *http.Request, param string, prefix string) (int64, error) {
+	v := r.FormValue(param)
+	if v == "" {
+		return 0, subsonicError{subsonicMissingParam, "Required parameter is missing: " + param}
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(v, prefix), 10, 64)
+	if err != nil || !strings.HasPrefix(v, prefix) {
+		return 0, subsonicError{subsonicNotFound, "Not found: " + v}
+	}
+	return id, nil
+}
+
+func subArtistOf(a models.Artist) subArtist {
+	return subArtist{
+		ID:         artistPrefix + strconv.FormatInt(a.ID, 10),
+		Name:       a.Name,
+		AlbumCount: len(a.Releases),
+	}
+}
+
+func subAlbumOf(r models.Release) subAlbum {
+	album := subAlbum{
+		ID:        albumPrefix + strconv.FormatInt(r.ID, 10),
+		Name:      r.Title,
+		Artist:    r.ArtistCredit(),
+		SongCount: len(r.Tracks),
+		Duration:  int(r.Duration() / time.Second),
+		Year:      r.Year,
+	}
+	if len(r.Artists) > 0 {
+		album.ArtistID = artistPrefix + strconv.FormatInt(r.Artists[0].ArtistID, 10)
+	}
+	if !r.CreatedAt.IsZero() {
+		album.Created = r.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	if r.Cover != "" {
+		album.CoverArt = album.ID
+	}
+	return album
+}
+
+// subPlaylistOf returns the Subsonic playlist for p, without its entries.
+// Playlists are owned by the user asking for them.
+func subPlaylistOf(p models.Playlist, owner string) subPlaylist {
+	return subPlaylist{
+		ID:        playlistPrefix + strconv.FormatInt(p.ID, 10),
+		Name:      p.Name,
+		Comment:   p.Comment,
+		Owner:     owner,
+		SongCount: len(p.Entries),
+		Duration:  int(p.Duration() / time.Second),
+		Created:   p.CreatedAt.UTC().Format(time.RFC3339),
+		Changed:   p.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// subSongs returns the Subsonic songs for tracks from any releases, which
+// are loaded together.
+func (s Server) subSongs(tracks []models.Track) ([]subChild, error) {
+	var ids []int64
+	for _, t := range tracks {
+		if t.ReleaseID != 0 {
+			ids = append(ids, t.ReleaseID)
+		}
+	}
+	releases, err := s.collection.GetReleases(ids)
+	if err != nil {
+		return nil, err
+	}
+	var songs []subChild
+	for _, t := range tracks {
+		songs = append(songs, subChildOf(t, releases[t.ReleaseID]))
+	}
+	return songs, nil
+}
+
+// subChildOf returns the Subsonic song for a track on release r. A track
+// without an artist credit of its own is credited to the release.
+func subChildOf(t models.Track, r models.Release) subChild {
+	song := subChild{
+		ID:         songPrefix + strconv.FormatInt(t.ID, 10),
+		Title:      t.Title,
+		Album:      r.Title,
+		Artist:     t.ArtistCredit(),
+		Track:      t.Position,
+		Year:       r.Year,
+		DiscNumber: t.Disc,
+		Type:       "music",
+	}
+	if r.ID != 0 {
+		song.Parent = albumPrefix + strconv.FormatInt(r.ID, 10)
+		song.AlbumID = song.Parent
+	}
+	if r.Cover != "" {
+		song.CoverArt = song.AlbumID
+	}
+	if len(t.Artists) > 0 {
+		song.ArtistID = artistPrefix + strconv.FormatInt(t.Artists[0].ArtistID, 10)
+	} else if len(r.Artists) > 0 {
+		song.Artist = r.ArtistCredit()
+		song.ArtistID = artistPrefix + strconv.FormatInt(r.Artists[0].ArtistID, 10)
+	}
+	if len(t.Streams) > 0 {
+		song.ContentType = t.Streams[0].Format.Mimetype
+		song.Suffix = strings.ToLower(t.Streams[0].Format.Name)
+		song.Duration = int(t.Streams[0].Duration / time.Second)
+		song.Size = t.Streams[0].Size
+		song.BitRate = t.Streams[0].Bitrate / 1000
+	}
+	if !t.CreatedAt.IsZero() {
+		song.Created = t.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	return song
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/gorilla/mux"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubsonic(t *testing.T) {
+	Convey("Test Subsonic API", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		s := Server{
+			collection: coll,
+			streamhdlr: memStreamHandler{},
+			subsonic:   map[string]string{"alice": "sesame"},
+		}
+		call := func(method string, params url.Values) *httptest.ResponseRecorder {
+			if params.Get("u") == "" {
+				params.Set("u", "alice")
+				params.Set("s", "c19b2d")
+				sum := md5.Sum([]byte("sesame" + "c19b2d"))
+				params.Set("t", hex.EncodeToString(sum[:]))
+			}
+			params.Set("v", "1.16.1")
+			params.Set("c", "test")
+			req, _ := http.NewRequest("GET", "/rest/"+method+"?"+params.Encode(), nil)
+			req = mux.SetURLVars(req, map[string]string{"method": method})
+			rec := httptest.NewRecorder()
+			http.HandlerFunc(s.subsonicAPI).ServeHTTP(rec, req)
+			return rec
+		}
+		decode := func(rec *httptest.ResponseRecorder) subsonicResponse {
+			var resp map[string]subsonicResponse
+			json.NewDecoder(rec.Body).Decode(&resp)
+			return resp["subsonic-response"]
+		}
+
+		Convey("should answer ping in XML with token auth", func() {
+			rec := call("ping.view", url.Values{})
+			var resp subsonicResponse
+			err := xml.NewDecoder(rec.Body).Decode(&resp)
+			So(err, ShouldBeNil)
+			So(rec.Header().Get("Content-type"), ShouldStartWith, "text/xml")
+			So(resp.Status, ShouldEqual, "ok")
+			So(resp.Version, ShouldEqual, subsonicVersion)
+		})
+
+		Convey("should accept encoded password", func() {
+			params := url.Values{"u": {"alice"}, "p": {"enc:" + hex.EncodeToString([]byte("sesame"))},
+				"f": {"json"}}
+			resp := decode(call("ping", params))
+			So(resp.Status, ShouldEqual, "ok")
+		})
+
+		Convey("should reject wrong password", func() {
+			params := url.Values{"u": {"alice"}, "p": {"open"}, "f": {"json"}}
+			resp := decode(call("ping", params))
+			So(resp.Status, ShouldEqual, "failed")
+			So(resp.Error.Code, ShouldEqual, subsonicBadCredentials)
+		})
+
+		Convey("should list artists by index", func() {
+			coll.CreateArtist(&models.Artist{Name: "The Beatles"})
+			coll.CreateArtist(&models.Artist{Name: "ABBA"})
+			coll.CreateArtist(&models.Artist{Name: "2Pac"})
+			resp := decode(call("getArtists", url.Values{"f": {"json"}}))
+			So(resp.Status, ShouldEqual, "ok")
+			index := resp.Artists.Index
+			So(len(index), ShouldEqual, 3)
+			So(index[0].Name, ShouldEqual, "#")
+			So(index[1].Name, ShouldEqual, "A")
+			So(index[2].Name, ShouldEqual, "B")
+			So(index[2].Artist[0].Name, ShouldEqual, "The Beatles")
+		})
+
+		Convey("should return album with songs", func() {
+			a := models.Artist{Name: "Artist 1"}
+			coll.CreateArtist(&a)
+			r := models.Release{Title: "Release 1", Year: 1999}
+			r.AddArtist(a)
+			r.AddTrack(models.Track{Title: "Track 1", Position: 1})
+			t := models.Track{Title: "Track 2", Position: 2}
+			t.AddStream(models.Stream{Path: "foo", Duration: 61500 * time.Millisecond,
+				Bitrate: 192000, Size: 1476000})
+			r.AddTrack(t)
+			coll.CreateRelease(&r)
+			id := albumPrefix + strconv.FormatInt(r.ID, 10)
+			resp := decode(call("getAlbum", url.Values{"id": {id}, "f": {"json"}}))
+			So(resp.Status, ShouldEqual, "ok")
+			So(resp.Album.Name, ShouldEqual, "Release 1")
+			So(resp.Album.Artist, ShouldEqual, "Artist 1")
+			So(resp.Album.SongCount, ShouldEqual, 2)
+			So(resp.Album.Song[1].Title, ShouldEqual, "Track 2")
+			So(resp.Album.Song[1].AlbumID, ShouldEqual, id)
+			So(resp.Album.Created, ShouldNotBeEmpty)
+			So(resp.Album.Duration, ShouldEqual, 61)
+			So(resp.Album.Song[1].Duration, ShouldEqual, 61)
+			So(resp.Album.Song[1].BitRate, ShouldEqual, 192)
+			So(resp.Album.Song[1].Size, ShouldEqual, 1476000)
+		})
+
+		Convey("should return not found for missing song", func() {
+			resp := decode(call("getSong", url.Values{"id": {"tr-1"}, "f": {"json"}}))
+			So(resp.Status, ShouldEqual, "failed")
+			So(resp.Error.Code, ShouldEqual, subsonicNotFound)
+		})
+
+		Convey("should return song", func() {
+			t := models.Track{Title: "Track 1"}
+			coll.CreateTrack(&t)
+			id := songPrefix + strconv.FormatInt(t.ID, 10)
+			resp := decode(call("getSong", url.Values{"id": {id}, "f": {"json"}}))
+			So(resp.Status, ShouldEqual, "ok")
+			So(resp.Song.Title, ShouldEqual, "Track 1")
+		})
+
+		Convey("should stream song", func() {
+			path, _ := s.streamhdlr.Store(strings.NewReader("0123456789"))
+			t := models.Track{Title: "Track 1"}
+			t.AddStream(models.Stream{Path: path})
+			coll.CreateTrack(&t)
+			rec := call("stream", url.Values{"id": {songPrefix + strconv.FormatInt(t.ID, 10)}})
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "0123456789")
+		})
+
+		Convey("should transcode song", func() {
+			s.transcoder = services.CommandTranscoder{
+				Commands: map[string]services.TranscodeCommand{
+					"mp3": {Args: []string{"sh", "-c", "printf 'mp3 {bitrate}:'; cat"}, Mimetype: "audio/mpeg"},
+				},
+			}
+			path, _ := s.streamhdlr.Store(strings.NewReader("0123456789"))
+			t := models.Track{Title: "Track 1"}
+			t.AddStream(models.Stream{Path: path})
+			coll.CreateTrack(&t)
+			rec := call("stream", url.Values{"id": {songPrefix + strconv.FormatInt(t.ID, 10)},
+				"format": {"mp3"}, "maxBitRate": {"96"}})
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "mp3 96:0123456789")
+		})
+
+		Convey("should list and return playlists", func() {
+			t := models.Track{Title: "Track 1"}
+			t.AddStream(models.Stream{Path: "foo", Duration: 90 * time.Second})
+			coll.CreateTrack(&t)
+			p := models.Playlist{Name: "Mix"}
+			p.AddTrack(t)
+			p.AddTrack(t)
+			coll.CreatePlaylist(&p)
+			resp := decode(call("getPlaylists", url.Values{"f": {"json"}}))
+			So(resp.Status, ShouldEqual, "ok")
+			So(len(resp.Playlists.Playlist), ShouldEqual, 1)
+			pl := resp.Playlists.Playlist[0]
+			So(pl.Name, ShouldEqual, "Mix")
+			So(pl.Owner, ShouldEqual, "alice")
+			So(pl.SongCount, ShouldEqual, 2)
+			So(pl.Duration, ShouldEqual, 180)
+
+			resp = decode(call("getPlaylist", url.Values{"id": {pl.ID}, "f": {"json"}}))
+			So(resp.Status, ShouldEqual, "ok")
+			So(len(resp.Playlist.Entry), ShouldEqual, 2)
+			So(resp.Playlist.Entry[1].Title, ShouldEqual, "Track 1")
+			resp = decode(call("getPlaylist", url.Values{"id": {"pl-100"}, "f": {"json"}}))
+			So(resp.Error.Code, ShouldEqual, subsonicNotFound)
+		})
+
+		Convey("should search", func() {
+			coll.CreateTrack(&models.Track{Title: "Blue Moon"})
+			coll.CreateTrack(&models.Track{Title: "Red Sky"})
+			coll.CreateTrack(&models.Track{Title: "Blue Sky"})
+			resp := decode(call("search3", url.Values{"query": {"blue"}, "f": {"json"}}))
+			So(resp.Status, ShouldEqual, "ok")
+			So(len(resp.SearchResult3.Song), ShouldEqual, 2)
+			resp = decode(call("search3", url.Values{"query": {"sky"}, "songOffset": {"1"},
+				"f": {"json"}}))
+			So(len(resp.SearchResult3.Song), ShouldEqual, 1)
+			So(resp.SearchResult3.Song[0].Title, ShouldEqual, "Red Sky")
+		})
+
+		Convey("should search songs with their albums", func() {
+			a := models.Artist{Name: "Artist 1"}
+			coll.CreateArtist(&a)
+			r := models.Release{Title: "Release 1", Year: 1999, Cover: "cover"}
+			r.AddArtist(a)
+			r.AddTrack(models.Track{Title: "Blue Moon"})
+			coll.CreateRelease(&r)
+			resp := decode(call("search3", url.Values{"query": {"moon"}, "f": {"json"}}))
+			So(len(resp.SearchResult3.Song), ShouldEqual, 1)
+			song := resp.SearchResult3.Song[0]
+			So(song.Album, ShouldEqual, "Release 1")
+			So(song.Year, ShouldEqual, 1999)
+			So(song.Artist, ShouldEqual, "Artist 1")
+			So(song.CoverArt, ShouldEqual, "al-"+strconv.FormatInt(r.ID, 10))
+		})
+
+		Convey("should serve cover art of album and song", func() {
+			var img bytes.Buffer
+			png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 40, 40)))
+			cover, _ := s.streamhdlr.Store(&img)
+			r := models.Release{Title: "Release 1", Cover: cover}
+			r.AddTrack(models.Track{Title: "Track 1"})
+			coll.CreateRelease(&r)
+			id := "al-" + strconv.FormatInt(r.ID, 10)
+			resp := decode(call("getAlbum", url.Values{"id": {id}, "f": {"json"}}))
+			So(resp.Album.CoverArt, ShouldEqual, id)
+			rec := call("getCoverArt", url.Values{"id": {id}})
+			So(rec.Header().Get("Content-type"), ShouldEqual, "image/png")
+			rec = call("getCoverArt", url.Values{"id": {"tr-" + strconv.FormatInt(r.Tracks[0].ID, 10)},
+				"size": {"20"}})
+			So(rec.Header().Get("Content-type"), ShouldEqual, "image/jpeg")
+			resp = decode(call("getCoverArt", url.Values{"id": {"al-999"}, "f": {"json"}}))
+			So(resp.Error.Code, ShouldEqual, subsonicNotFound)
+		})
+
+		Convey("should wrap JSONP", func() {
+			rec := call("getLicense", url.Values{"f": {"jsonp"}, "callback": {"cb"}})
+			So(rec.Body.String(), ShouldStartWith, `cb({"subsonic-response":`)
+			So(rec.Header().Get("X-Content-Type-Options"), ShouldEqual, "nosniff")
+			rec = call("getLicense", url.Values{"f": {"jsonp"}, "callback": {"app.cb"}})
+			So(rec.Body.String(), ShouldStartWith, `app.cb(`)
+		})
+
+		Convey("should refuse JSONP callback that is not a name", func() {
+			rec := call("getLicense", url.Values{"f": {"jsonp"}, "callback": {"alert(1);cb"}})
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			So(rec.Body.String(), ShouldNotContainSubstring, "subsonic-response")
+		})
+	})
+}
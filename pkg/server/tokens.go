@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"net/http"
+	"strings"
+)
+
+// tokenRequest is the JSON body of a request to create an API token.
+type tokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// tokenPage is the context of the token template. Secret is the token that
+// was just created.
+type tokenPage struct {
+	Tokens []models.Token
+	Scopes []string
+	Secret string
+}
+
+// CreateToken creates an API token of u with the given scopes, and returns
+// it with its secret. Only admins can have tokens that upload or edit.
+func CreateToken(c models.Collection, u models.User, name string, scopes []string) (models.Token, string, error) {
+	t := models.Token{UserID: u.ID, User: u, Name: strings.TrimSpace(name)}
+	if t.Name == "" {
+		return t, "", badRequestError{fmt.Errorf("token has no name")}
+	}
+	if err := t.SetScopes(scopes); err != nil {
+		return t, "", badRequestError{err}
+	}
+	if !u.Admin && (t.HasScope(models.ScopeUpload) || t.HasScope(models.ScopeAdmin)) {
+		return t, "", forbiddenError{fmt.Errorf("only admins can upload and edit")}
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return t, "", err
+	}
+	t.Hash = hashSecret(secret)
+	return t, secret, c.CreateToken(&t)
+}
+
+// getTokens lists the API tokens of the user.
+func (s Server) getTokens(w http.ResponseWriter, r *http.Request) {
+	s.tokenPage(w, r, "")
+}
+
+func (s Server) tokenPage(w http.ResponseWriter, r *http.Request, secret string) {
+	u, _ := currentUser(r)
+	tokens, err := s.collection.Tokens(u.ID)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	page := tokenPage{Tokens: tokens, Scopes: models.Scopes, Secret: secret}
+	s.respond(w, r, "token/index", page, jsonTokensOf(tokens))
+}
+
+// addToken creates an API token from a JSON request, or from the form of
+// the token page, which shows the new token.
+func (s Server) addToken(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	isJSON := strings.HasPrefix(r.Header.Get("Content-type"), "application/json")
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.error(w, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			s.error(w, http.StatusBadRequest, err)
+			return
+		}
+		req = tokenRequest{Name: r.PostForm.Get("name"), Scopes: r.PostForm["scope"]}
+	}
+	u, _ := currentUser(r)
+	t, secret, err := CreateToken(s.collection, u, req.Name, req.Scopes)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	if isJSON {
+		jt := jsonTokenOf(t)
+		jt.Token = secret
+		s.writeJSON(w, jt)
+		return
+	}
+	s.tokenPage(w, r, secret)
+}
+
+// revokeToken deletes an API token of the user. Requests from the form of
+// the token page are redirected back to it.
+func (s Server) revokeToken(w http.ResponseWriter, r *http.Request) {
+	id, err := idParam(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err)
+		return
+	}
+	u, _ := currentUser(r)
+	if err := s.collection.DeleteToken(u.ID, id); err != nil {
+		s.fail(w, err)
+		return
+	}
+	if r.Method == "DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/tokens/", http.StatusSeeOther)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/store"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTokens(t *testing.T) {
+	Convey("Test API tokens", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		coll := store.NewDbCollection(db)
+		store.Initialize(db)
+		router := NewServer(coll, memStreamHandler{}, "../../templates", WithLogin())
+		admin := models.User{Name: "admin", Admin: true}
+		guest := models.User{Name: "guest"}
+		coll.CreateUser(&admin)
+		coll.CreateUser(&guest)
+		tr := models.Track{Title: "Foo"}
+		coll.CreateTrack(&tr)
+
+		do := func(method, path, body, token string) *httptest.ResponseRecorder {
+			var rdr io.Reader
+			if body != "" {
+				rdr = strings.NewReader(body)
+			}
+			req, _ := http.NewRequest(method, path, rdr)
+			if body != "" {
+				req.Header.Set("Content-type", "application/json")
+			}
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+		token := func(u models.User, scopes ...string) string {
+			_, secret, err := CreateToken(coll, u, "test", scopes)
+			So(err, ShouldBeNil)
+			return secret
+		}
+
+		Convey("should create token", func() {
+			all := token(admin, models.ScopeAdmin)
+			rec := do("POST", "/tokens/", `{"name": "upload script", "scopes": ["upload"]}`, all)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var jt jsonToken
+			json.NewDecoder(rec.Body).Decode(&jt)
+			So(jt.Name, ShouldEqual, "upload script")
+			So(jt.Scopes, ShouldResemble, []string{"upload"})
+			So(jt.Token, ShouldNotBeEmpty)
+			So(do("POST", "/tracks/upload", "not audio", jt.Token).Code, ShouldNotBeIn,
+				[]int{http.StatusUnauthorized, http.StatusForbidden})
+
+			rec = do("GET", "/tokens.json", "", all)
+			var list []jsonToken
+			json.NewDecoder(rec.Body).Decode(&list)
+			So(len(list), ShouldEqual, 2)
+			So(list[0].Token, ShouldBeEmpty)
+		})
+
+		Convey("should accept token with scope", func() {
+			secret := token(guest, models.ScopeRead)
+			So(do("GET", "/releases.json", "", secret).Code, ShouldEqual, http.StatusOK)
+			tokens, _ := coll.Tokens(guest.ID)
+			So(tokens[0].LastUsedAt, ShouldNotBeNil)
+			So(do("GET", fmt.Sprintf("/tracks/%d/stream", tr.ID), "", secret).Code,
+				ShouldEqual, http.StatusForbidden)
+			So(do("POST", "/releases/", `{"title": "Bar"}`, secret).Code, ShouldEqual, http.StatusForbidden)
+
+			secret = token(guest, models.ScopeStream)
+			So(do("GET", fmt.Sprintf("/tracks/%d/stream", tr.ID), "", secret).Code,
+				ShouldEqual, http.StatusNotFound)
+			So(do("GET", "/releases.json", "", secret).Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("should let admin tokens edit", func() {
+			So(do("POST", "/releases/", `{"title": "Bar"}`, token(admin, models.ScopeAdmin)).Code,
+				ShouldEqual, http.StatusOK)
+		})
+
+		Convey("should refuse invalid token", func() {
+			rec := do("GET", "/releases/", "", "nonsense")
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+			So(rec.Header().Get("WWW-Authenticate"), ShouldStartWith, "Bearer")
+		})
+
+		Convey("should only give admins upload and admin scopes", func() {
+			_, _, err := CreateToken(coll, guest, "x", []string{models.ScopeUpload})
+			So(isForbidden(err), ShouldBeTrue)
+			_, _, err = CreateToken(coll, guest, "x", []string{"everything"})
+			So(isBadRequest(err), ShouldBeTrue)
+			_, _, err = CreateToken(coll, guest, "x", nil)
+			So(isBadRequest(err), ShouldBeTrue)
+		})
+
+		Convey("should revoke token", func() {
+			secret := token(guest, models.ScopeRead)
+			other := token(admin, models.ScopeAdmin)
+			tokens, _ := coll.Tokens(guest.ID)
+			path := fmt.Sprintf("/tokens/%d", tokens[0].ID)
+			So(do("DELETE", path, "", other).Code, ShouldEqual, http.StatusNotFound)
+			So(do("GET", "/releases.json", "", secret).Code, ShouldEqual, http.StatusOK)
+			So(coll.DeleteToken(guest.ID, tokens[0].ID), ShouldBeNil)
+			So(do("GET", "/releases.json", "", secret).Code, ShouldEqual, http.StatusUnauthorized)
+
+			tokens, _ = coll.Tokens(admin.ID)
+			So(do("DELETE", fmt.Sprintf("/tokens/%d", tokens[0].ID), "", other).Code,
+				ShouldEqual, http.StatusNoContent)
+			So(do("GET", "/releases.json", "", other).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/importer"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/gravesm/blueshift/pkg/services"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// uploadReport is the response to a release upload. Either the release
+// was created or, with Error, nothing was.
+type uploadReport struct {
+	Release *jsonRelease          `json:"release,omitempty"`
+	Files   []models.ImportedFile `json:"files"`
+	Error   string                `json:"error,omitempty"`
+}
+
+// uploadRelease creates a release from an archive of its files, or from the
+// files of a multipart form, as sent by a browser's folder picker. Either
+// every audio file is imported or, if any fails, none is and nothing is left
+// in storage. Files that hold no audio are skipped. With jobs, the release is
+// imported in the background.
+func (s Server) uploadRelease(w http.ResponseWriter, r *http.Request) {
+	body, err := releaseArchive(r)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	defer body.Close()
+	if s.jobs != nil {
+		s.enqueueRelease(w, r, body)
+		return
+	}
+	tmp, err := ioutil.TempFile("", "blueshift-")
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := importer.SpoolArchive(tmp, body); err != nil {
+		if !services.IsUnsupported(err) {
+			err = badRequestError{err}
+		}
+		s.fail(w, err)
+		return
+	}
+	arxv, err := zip.OpenReader(tmp.Name())
+	if err != nil {
+		s.fail(w, services.UnsupportedError{Err: err})
+		return
+	}
+	defer arxv.Close()
+
+	var report uploadReport
+	rel, files, err := s.importer().ImportArchive(arxv.File, nil)
+	report.Files = files
+	if err == nil && isForm(r) {
+		http.Redirect(w, r, fmt.Sprintf("/releases/%d", rel.ID), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	if err != nil {
+		status := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Print(err)
+		}
+		report.Error = err.Error()
+		w.WriteHeader(status)
+	} else {
+		jr := jsonReleaseOf(rel)
+		report.Release = &jr
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// releaseArchive returns the archive of a release upload. The files of a
+// multipart form are packed into a zip archive as it is read.
+func releaseArchive(r *http.Request) (io.ReadCloser, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-type"), "multipart/form-data") {
+		return r.Body, nil
+	}
+	form, err := r.MultipartReader()
+	if err != nil {
+		return nil, badRequestError{err}
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		aw := importer.NewArchiveWriter(pw)
+		err := addFormFiles(aw, form)
+		if cerr := aw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// addFormFiles adds the files of a multipart form to an archive. Their
+// names are kept as paths, which folder pickers send and Part.FileName
+// leaves out.
+func addFormFiles(aw *importer.ArchiveWriter, form *multipart.Reader) error {
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return badRequestError{err}
+		}
+		_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if err != nil {
+			return badRequestError{err}
+		}
+		if name := params["filename"]; name != "" {
+			if err := aw.Add(name, part); err != nil {
+				return err
+			}
+		}
+		part.Close()
+	}
+}
+
+// isForm reports whether a request was posted from an HTML form, whose
+// response is a redirect, rather than by a client that asks for JSON.
+func isForm(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-type"), "multipart/form-data") && !wantsJSON(r)
+}
@@ -0,0 +1,329 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dhowden/tag"
+	"io"
+	"time"
+)
+
+// AudioInfo holds the technical properties of an audio file.
+type AudioInfo struct {
+	Duration   time.Duration
+	Bitrate    int // average bits per second
+	SampleRate int
+	BitDepth   int // zero for lossy formats
+	Channels   int
+	Size       int64
+}
+
+var errNoAudio = errors.New("no audio header found")
+
+// ReadAudioInfo reads the properties of an audio file of type ft from its
+// headers. Files whose headers cannot be read return an UnsupportedError,
+// with only the size set. The file is left at its start.
+func ReadAudioInfo(f io.ReadSeeker, ft tag.FileType) (AudioInfo, error) {
+	var info AudioInfo
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return info, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return info, err
+	}
+	switch ft {
+	case tag.MP3:
+		info, err = mp3Info(f, size)
+	case tag.FLAC:
+		info, err = flacInfo(f, size)
+	case tag.OGG:
+		info, err = oggInfo(f, size)
+	default:
+		err = fmt.Errorf("unknown file type %s", ft)
+	}
+	if _, serr := f.Seek(0, io.SeekStart); err == nil {
+		err = serr
+	}
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errNoAudio
+		}
+		return AudioInfo{Size: size}, UnsupportedError{Err: err}
+	}
+	info.Size = size
+	if info.Duration > 0 && info.Bitrate == 0 {
+		info.Bitrate = int(float64(size*8) / info.Duration.Seconds())
+	}
+	return info, nil
+}
+
+// seconds converts a number of samples at rate to a duration.
+func seconds(samples int64, rate int) time.Duration {
+	return time.Duration(float64(samples) / float64(rate) * float64(time.Second))
+}
+
+// skipID3v2 positions f after an ID3v2 tag at its current position, and
+// returns the tag's length.
+func skipID3v2(f io.ReadSeeker) (int64, error) {
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	hdr := make([]byte, 10)
+	if _, err := io.ReadFull(f, hdr); err != nil || string(hdr[:3]) != "ID3" {
+		_, serr := f.Seek(start, io.SeekStart)
+		return 0, serr
+	}
+	n := int64(hdr[6])<<21 | int64(hdr[7])<<14 | int64(hdr[8])<<7 | int64(hdr[9])
+	n += 10
+	if hdr[5]&0x10 != 0 {
+		n += 10 // footer
+	}
+	_, err = f.Seek(start+n, io.SeekStart)
+	return n, err
+}
+
+var (
+	mp3Bitrates = [2][3][16]int{
+		{ // MPEG 1, layers I, II and III
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		},
+		{ // MPEG 2 and 2.5
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		},
+	}
+	mp3SampleRates = [3]int{44100, 48000, 32000}
+)
+
+// mp3Frame is a parsed MPEG audio frame header.
+type mp3Frame struct {
+	mpeg1      bool
+	layer      int // 1, 2 or 3
+	bitrate    int // bits per second
+	sampleRate int
+	channels   int
+	size       int // bytes, including the header
+	samples    int // per frame
+}
+
+func parseMP3Frame(h []byte) (mp3Frame, bool) {
+	var fr mp3Frame
+	if h[0] != 0xff || h[1]&0xe0 != 0xe0 {
+		return fr, false
+	}
+	version := h[1] >> 3 & 3 // 0: 2.5, 2: 2, 3: 1
+	layer := h[1] >> 1 & 3   // 1: III, 2: II, 3: I
+	br := h[2] >> 4
+	sr := h[2] >> 2 & 3
+	if version == 1 || layer == 0 || br == 0 || br == 15 || sr == 3 {
+		return fr, false
+	}
+	fr.mpeg1 = version == 3
+	fr.layer = 4 - int(layer)
+	v := 1
+	if fr.mpeg1 {
+		v = 0
+	}
+	fr.bitrate = mp3Bitrates[v][fr.layer-1][br] * 1000
+	fr.sampleRate = mp3SampleRates[sr]
+	switch version {
+	case 2:
+		fr.sampleRate /= 2
+	case 0:
+		fr.sampleRate /= 4
+	}
+	fr.channels = 2
+	if h[3]>>6 == 3 {
+		fr.channels = 1
+	}
+	padding := int(h[2] >> 1 & 1)
+	switch {
+	case fr.layer == 1:
+		fr.samples = 384
+		fr.size = (12*fr.bitrate/fr.sampleRate + padding) * 4
+	case fr.layer == 3 && !fr.mpeg1:
+		fr.samples = 576
+		fr.size = 72*fr.bitrate/fr.sampleRate + padding
+	default:
+		fr.samples = 1152
+		fr.size = 144*fr.bitrate/fr.sampleRate + padding
+	}
+	return fr, true
+}
+
+// mp3Info reads the first frame of an MP3 file. The duration comes from a
+// Xing, Info or VBRI header if the frame has one, and is otherwise worked out
+// from the frame's bitrate.
+func mp3Info(f io.ReadSeeker, size int64) (AudioInfo, error) {
+	var info AudioInfo
+	start, err := skipID3v2(f)
+	if err != nil {
+		return info, err
+	}
+	// Look for the first frame in the data following the tag. A second frame
+	// must follow it, to avoid being misled by stray sync bits.
+	buf := make([]byte, 64*1024)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return info, err
+	}
+	buf = buf[:n]
+	var fr mp3Frame
+	off := -1
+	for i := 0; i+4 <= len(buf); i++ {
+		var ok bool
+		if fr, ok = parseMP3Frame(buf[i:]); !ok {
+			continue
+		}
+		next := i + fr.size
+		if next+4 <= len(buf) {
+			if _, ok := parseMP3Frame(buf[next:]); !ok {
+				continue
+			}
+		}
+		off = i
+		break
+	}
+	if off < 0 {
+		return info, errNoAudio
+	}
+	info.SampleRate = fr.sampleRate
+	info.Channels = fr.channels
+
+	audio := size - start - int64(off)
+	if _, err := f.Seek(-128, io.SeekEnd); err == nil {
+		tail := make([]byte, 3)
+		if _, err := io.ReadFull(f, tail); err == nil && string(tail) == "TAG" {
+			audio -= 128
+		}
+	}
+	frame := buf[off:]
+	if frames := mp3FrameCount(frame, fr); frames > 0 {
+		info.Duration = seconds(frames*int64(fr.samples), fr.sampleRate)
+		info.Bitrate = int(float64(audio*8) / info.Duration.Seconds())
+	} else {
+		info.Bitrate = fr.bitrate
+		info.Duration = time.Duration(float64(audio*8) / float64(fr.bitrate) * float64(time.Second))
+	}
+	return info, nil
+}
+
+// mp3FrameCount returns the number of frames given by the Xing, Info or VBRI
+// header in frame, or zero if it has none.
+func mp3FrameCount(frame []byte, fr mp3Frame) int64 {
+	// The Xing header follows the side information, whose length depends on
+	// the version and channels.
+	side := 17
+	switch {
+	case fr.mpeg1 && fr.channels == 2:
+		side = 32
+	case !fr.mpeg1 && fr.channels == 1:
+		side = 9
+	}
+	if x := 4 + side; len(frame) >= x+12 {
+		tag := string(frame[x : x+4])
+		flags := binary.BigEndian.Uint32(frame[x+4:])
+		if (tag == "Xing" || tag == "Info") && flags&1 != 0 {
+			return int64(binary.BigEndian.Uint32(frame[x+8:]))
+		}
+	}
+	if v := 4 + 32; len(frame) >= v+18 && string(frame[v:v+4]) == "VBRI" {
+		return int64(binary.BigEndian.Uint32(frame[v+14:]))
+	}
+	return 0
+}
+
+// flacInfo reads the STREAMINFO block of a FLAC file.
+func flacInfo(f io.ReadSeeker, size int64) (AudioInfo, error) {
+	var info AudioInfo
+	if _, err := skipID3v2(f); err != nil {
+		return info, err
+	}
+	// The marker is followed by the STREAMINFO block header and 34 bytes of
+	// STREAMINFO.
+	b := make([]byte, 4+4+34)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return info, err
+	}
+	if string(b[:4]) != "fLaC" || b[4]&0x7f != 0 {
+		return info, errNoAudio
+	}
+	si := b[8:]
+	info.SampleRate = int(si[10])<<12 | int(si[11])<<4 | int(si[12])>>4
+	info.Channels = int(si[12]>>1&7) + 1
+	info.BitDepth = int(si[12]&1)<<4 | int(si[13])>>4 + 1
+	samples := int64(si[13]&0xf)<<32 | int64(binary.BigEndian.Uint32(si[14:]))
+	if info.SampleRate == 0 {
+		return info, errNoAudio
+	}
+	info.Duration = seconds(samples, info.SampleRate)
+	return info, nil
+}
+
+// oggInfo reads the identification header of the Vorbis or Opus stream in an
+// Ogg file. The duration comes from the granule position of the last page.
+func oggInfo(f io.ReadSeeker, size int64) (AudioInfo, error) {
+	var info AudioInfo
+	page := make([]byte, 27)
+	if _, err := io.ReadFull(f, page); err != nil {
+		return info, err
+	}
+	if string(page[:4]) != "OggS" {
+		return info, errNoAudio
+	}
+	segments := make([]byte, page[26])
+	if _, err := io.ReadFull(f, segments); err != nil {
+		return info, err
+	}
+	packet := make([]byte, 19)
+	if _, err := io.ReadFull(f, packet); err != nil {
+		return info, err
+	}
+	// Granule positions count samples at the sample rate for Vorbis, and
+	// always at 48kHz for Opus after skipping pre-skip samples.
+	rate, preSkip := 0, 0
+	switch {
+	case string(packet[:7]) == "\x01vorbis":
+		info.Channels = int(packet[11])
+		info.SampleRate = int(binary.LittleEndian.Uint32(packet[12:]))
+		rate = info.SampleRate
+	case string(packet[:8]) == "OpusHead":
+		info.Channels = int(packet[9])
+		preSkip = int(binary.LittleEndian.Uint16(packet[10:]))
+		info.SampleRate = int(binary.LittleEndian.Uint32(packet[12:]))
+		rate = 48000
+	default:
+		return info, errNoAudio
+	}
+	if rate == 0 {
+		return info, errNoAudio
+	}
+
+	tail := int64(64 * 1024)
+	if tail > size {
+		tail = size
+	}
+	if _, err := f.Seek(-tail, io.SeekEnd); err != nil {
+		return info, err
+	}
+	buf := make([]byte, tail)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return info, err
+	}
+	last := bytes.LastIndex(buf, []byte("OggS"))
+	if last < 0 || last+14 > len(buf) {
+		return info, nil
+	}
+	granule := int64(binary.LittleEndian.Uint64(buf[last+6:])) - int64(preSkip)
+	if granule > 0 {
+		info.Duration = seconds(granule, rate)
+	}
+	return info, nil
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/dhowden/tag"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"testing"
+	"time"
+)
+
+// mp3Data returns n frames of 128kbps 44.1kHz stereo MPEG 1 layer III audio,
+// the first of them holding xing if it is not empty.
+func mp3Data(n int, xing []byte) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		frame := make([]byte, 417)
+		copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+		if i == 0 {
+			copy(frame[36:], xing)
+		}
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+// flacData returns the start of a FLAC file of 16 bit 44.1kHz stereo audio
+// with the given number of samples.
+func flacData(samples uint32) []byte {
+	si := make([]byte, 34)
+	si[10], si[11], si[12], si[13] = 0x0a, 0xc4, 0x42, 0xf0
+	binary.BigEndian.PutUint32(si[14:], samples)
+	data := append([]byte("fLaC\x80\x00\x00\x22"), si...)
+	return append(data, make([]byte, 100)...)
+}
+
+func TestReadAudioInfo(t *testing.T) {
+	Convey("Test ReadAudioInfo", t, func() {
+		Convey("should read a constant bitrate MP3", func() {
+			data := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x0a"), make([]byte, 10)...)
+			data = append(data, mp3Data(10, nil)...)
+			data = append(data, append([]byte("TAG"), make([]byte, 125)...)...)
+			info, err := ReadAudioInfo(bytes.NewReader(data), tag.MP3)
+			So(err, ShouldBeNil)
+			So(info.SampleRate, ShouldEqual, 44100)
+			So(info.Channels, ShouldEqual, 2)
+			So(info.Bitrate, ShouldEqual, 128000)
+			So(info.BitDepth, ShouldEqual, 0)
+			So(info.Size, ShouldEqual, len(data))
+			So(info.Duration, ShouldAlmostEqual, 260625*time.Microsecond, time.Millisecond)
+		})
+
+		Convey("should read the frame count of a variable bitrate MP3", func() {
+			xing := []byte("Xing\x00\x00\x00\x01\x00\x00\x00\x64")
+			info, err := ReadAudioInfo(bytes.NewReader(mp3Data(10, xing)), tag.MP3)
+			So(err, ShouldBeNil)
+			So(info.Duration, ShouldAlmostEqual, 2612*time.Millisecond, time.Millisecond)
+		})
+
+		Convey("should read FLAC STREAMINFO", func() {
+			info, err := ReadAudioInfo(bytes.NewReader(flacData(441000)), tag.FLAC)
+			So(err, ShouldBeNil)
+			So(info.SampleRate, ShouldEqual, 44100)
+			So(info.Channels, ShouldEqual, 2)
+			So(info.BitDepth, ShouldEqual, 16)
+			So(info.Duration, ShouldEqual, 10*time.Second)
+		})
+
+		Convey("should read Ogg Vorbis headers", func() {
+			f, err := os.Open("../testdata/papageno.ogg")
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+			info, err := ReadAudioInfo(f, tag.OGG)
+			So(err, ShouldBeNil)
+			So(info.SampleRate, ShouldEqual, 44100)
+			So(info.Channels, ShouldEqual, 2)
+			So(info.Size, ShouldEqual, 22679)
+			So(info.Duration, ShouldAlmostEqual, 3398*time.Millisecond, time.Millisecond)
+			pos, _ := f.Seek(0, 1)
+			So(pos, ShouldEqual, 0)
+		})
+
+		Convey("should return an UnsupportedError for other data", func() {
+			_, err := ReadAudioInfo(bytes.NewReader(make([]byte, 100)), tag.FLAC)
+			So(IsUnsupported(err), ShouldBeTrue)
+			_, err = ReadAudioInfo(bytes.NewReader(make([]byte, 100)), tag.MP3)
+			So(IsUnsupported(err), ShouldBeTrue)
+		})
+	})
+}
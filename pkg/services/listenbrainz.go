@@ -0,0 +1,115 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultListenBrainzURL is the API root of ListenBrainz itself.
+const DefaultListenBrainzURL = "https://api.listenbrainz.org"
+
+// Kinds of listen submissions.
+const (
+	ListenSingle     = "single"      // one listen as it happens
+	ListenImport     = "import"      // listens from the past
+	ListenPlayingNow = "playing_now" // a track that is being played
+)
+
+// MaxListens is the most listens that are submitted at once.
+const MaxListens = 100
+
+// Listen is a listen in the format of the ListenBrainz API. ListenedAt is a
+// Unix time, and is left out of now playing notifications.
+type Listen struct {
+	ListenedAt    int64         `json:"listened_at,omitempty"`
+	TrackMetadata TrackMetadata `json:"track_metadata"`
+}
+
+type TrackMetadata struct {
+	ArtistName     string         `json:"artist_name"`
+	TrackName      string         `json:"track_name"`
+	ReleaseName    string         `json:"release_name,omitempty"`
+	AdditionalInfo AdditionalInfo `json:"additional_info"`
+}
+
+type AdditionalInfo struct {
+	RecordingMBID    string   `json:"recording_mbid,omitempty"`
+	ReleaseMBID      string   `json:"release_mbid,omitempty"`
+	ArtistMBIDs      []string `json:"artist_mbids,omitempty"`
+	TrackNumber      int      `json:"tracknumber,omitempty"`
+	DurationMs       int64    `json:"duration_ms,omitempty"`
+	MediaPlayer      string   `json:"media_player,omitempty"`
+	SubmissionClient string   `json:"submission_client,omitempty"`
+}
+
+// ListenBrainzError is an error response of a ListenBrainz service.
+type ListenBrainzError struct {
+	Status  int
+	Message string
+}
+
+func (e ListenBrainzError) Error() string {
+	return fmt.Sprintf("listenbrainz: %d %s", e.Status, e.Message)
+}
+
+// IsPermanent reports whether err is a ListenBrainz error that submitting
+// the same listens again cannot fix, because they were rejected as invalid.
+// Rejected tokens are not permanent, as the user may replace them.
+func IsPermanent(err error) bool {
+	e, ok := err.(ListenBrainzError)
+	return ok && e.Status >= 400 && e.Status < 500 &&
+		e.Status != http.StatusUnauthorized && e.Status != http.StatusTooManyRequests
+}
+
+// ListenBrainzClient submits listens to ListenBrainz-compatible services.
+type ListenBrainzClient struct {
+	// Client makes the requests, or a client with a 30 second timeout if it
+	// is nil.
+	Client *http.Client
+}
+
+// Submit submits listens of the given kind to the service at the API root
+// url with a user token.
+func (c ListenBrainzClient) Submit(url, token, kind string, listens []Listen) error {
+	body, err := json.Marshal(struct {
+		ListenType string   `json:"listen_type"`
+		Payload    []Listen `json:"payload"`
+	}{kind, listens})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(url, "/")+"/1/submit-listens",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+token)
+	req.Header.Set("Content-type", "application/json")
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(msg, &e) == nil && e.Error != "" {
+		return ListenBrainzError{Status: resp.StatusCode, Message: e.Error}
+	}
+	return ListenBrainzError{Status: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
@@ -1,60 +1,119 @@
 package services
 
 import (
+	"fmt"
 	"github.com/dhowden/tag"
 	"github.com/google/uuid"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
+	"time"
 )
 
-func FileMetadata(f io.ReadSeeker) tag.Metadata {
-	f.Seek(0, io.SeekStart)
+// UnsupportedError is returned by FileMetadata when the metadata of a file
+// cannot be read, usually because it is not an audio file.
+type UnsupportedError struct {
+	Err error
+}
+
+func (e UnsupportedError) Error() string {
+	return fmt.Sprintf("unsupported media: %v", e.Err)
+}
+
+// IsUnsupported reports whether err is an UnsupportedError.
+func IsUnsupported(err error) bool {
+	_, ok := err.(UnsupportedError)
+	return ok
+}
+
+func FileMetadata(f io.ReadSeeker) (tag.Metadata, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
 	m, err := tag.ReadFrom(f)
 	if err != nil {
-		log.Fatal(err)
+		return nil, UnsupportedError{Err: err}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
 	}
-	f.Seek(0, io.SeekStart)
-	return m
+	return m, nil
+}
+
+// StreamReader is a stored stream opened for reading. It is seekable so that
+// byte ranges can be served, and reports the size and modification time used
+// for conditional requests.
+type StreamReader interface {
+	io.ReadSeeker
+	io.Closer
+	Size() int64
+	ModTime() time.Time
 }
 
 type StreamHandler interface {
-	Store(data io.Reader) string
-	Get(path string) io.ReadCloser
+	Store(data io.Reader) (string, error)
+	Get(path string) (StreamReader, error)
+	Delete(path string) error
 }
 
 type FileStreamHandler struct {
 	Directory string
 }
 
-func (sh FileStreamHandler) Store(d io.Reader) string {
-	p := sh.path()
+func (sh FileStreamHandler) Store(d io.Reader) (string, error) {
+	p, err := sh.path()
+	if err != nil {
+		return "", err
+	}
 	fp, err := os.Create(p)
 	if err != nil {
-		log.Fatalf("Could not create file %s: %v", p, err)
+		return "", fmt.Errorf("could not create file %s: %v", p, err)
 	}
 	defer fp.Close()
 
 	_, err = io.Copy(fp, d)
 	if err != nil {
-		log.Fatalf("Could not copy file %s: %v", p, err)
+		os.Remove(p)
+		return "", fmt.Errorf("could not copy file %s: %v", p, err)
 	}
-	return p
+	return p, nil
 }
 
-func (sh FileStreamHandler) Get(path string) io.ReadCloser {
+func (sh FileStreamHandler) Get(path string) (StreamReader, error) {
 	fp, err := os.Open(path)
 	if err != nil {
-		log.Fatalf("Could not open file %s: %v", path, err)
+		return nil, err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
 	}
-	return fp
+	return fileStream{File: fp, info: info}, nil
+}
+
+func (sh FileStreamHandler) Delete(path string) error {
+	return os.Remove(path)
+}
+
+// fileStream is the StreamReader returned by FileStreamHandler.
+type fileStream struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (f fileStream) Size() int64 {
+	return f.info.Size()
+}
+
+func (f fileStream) ModTime() time.Time {
+	return f.info.ModTime()
 }
 
-func (sh FileStreamHandler) path() string {
+func (sh FileStreamHandler) path() (string, error) {
 	root, err := filepath.Abs(sh.Directory)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	return filepath.Join(root, uuid.New().String())
+	return filepath.Join(root, uuid.New().String()), nil
 }
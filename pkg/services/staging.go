@@ -0,0 +1,56 @@
+package services
+
+import (
+	"io"
+)
+
+// StagedStreams is a StreamHandler for imports that may fail. It remembers
+// what it stores so that Rollback can remove it again, and holds deletions
+// back until Commit, so that a failed import leaves storage as it was.
+type StagedStreams struct {
+	StreamHandler
+	stored  []string
+	deleted []string
+}
+
+func NewStagedStreams(sh StreamHandler) *StagedStreams {
+	return &StagedStreams{StreamHandler: sh}
+}
+
+func (st *StagedStreams) Store(d io.Reader) (string, error) {
+	p, err := st.StreamHandler.Store(d)
+	if err == nil {
+		st.stored = append(st.stored, p)
+	}
+	return p, err
+}
+
+// Delete records path to be deleted by Commit.
+func (st *StagedStreams) Delete(path string) error {
+	st.deleted = append(st.deleted, path)
+	return nil
+}
+
+// Commit deletes what was deleted since the handler was made.
+func (st *StagedStreams) Commit() error {
+	var first error
+	for _, p := range st.deleted {
+		if err := st.StreamHandler.Delete(p); err != nil && first == nil {
+			first = err
+		}
+	}
+	st.stored, st.deleted = nil, nil
+	return first
+}
+
+// Rollback deletes what was stored since the handler was made.
+func (st *StagedStreams) Rollback() error {
+	var first error
+	for _, p := range st.stored {
+		if err := st.StreamHandler.Delete(p); err != nil && first == nil {
+			first = err
+		}
+	}
+	st.stored, st.deleted = nil, nil
+	return first
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Thumbnailer scales images down to JPEG or WebP thumbnails. Thumbnails are
+// cached in Directory if it is set, and made for every request otherwise.
+// There is no WebP encoder for Go, so WebP thumbnails are made by
+// WebPCommand, which converts a PNG read from its standard input to WebP
+// written to its standard output. Without it only JPEG thumbnails are made.
+type Thumbnailer struct {
+	Directory   string
+	WebPCommand []string
+}
+
+// DefaultWebPCommand makes WebP thumbnails with cwebp.
+var DefaultWebPCommand = strings.Fields("cwebp -quiet -q 80 -o - -- -")
+
+// MaxThumbnailPixels is the largest image, in pixels, that thumbnails are
+// made of, which limits the memory it is decoded into.
+const MaxThumbnailPixels = 40 << 20
+
+// Mimetype returns the mimetype of thumbnails in format, jpeg or webp, and
+// whether they can be made at all. The empty format is jpeg.
+func (th Thumbnailer) Mimetype(format string) (string, bool) {
+	switch strings.ToLower(format) {
+	case "", "jpeg", "jpg":
+		return "image/jpeg", true
+	case "webp":
+		return "image/webp", len(th.WebPCommand) > 0
+	}
+	return "", false
+}
+
+// Thumbnail returns the image opened by open in format, scaled down to fit
+// a square of size pixels. Key identifies the image in the cache, and must
+// change when the image does. Images in a format that cannot be decoded or
+// larger than MaxThumbnailPixels, and formats that thumbnails cannot be made
+// in, return an UnsupportedError.
+func (th Thumbnailer) Thumbnail(key string, size int, format string, open func() (io.ReadCloser, error)) (StreamReader, error) {
+	if _, ok := th.Mimetype(format); !ok {
+		return nil, UnsupportedError{Err: fmt.Errorf("cannot make %q thumbnails", format)}
+	}
+	ext := "jpg"
+	if strings.ToLower(format) == "webp" {
+		ext = "webp"
+	}
+	var cached string
+	if th.Directory != "" {
+		sum := sha1.Sum([]byte(key))
+		cached = filepath.Join(th.Directory, fmt.Sprintf("%s-%d.%s", hex.EncodeToString(sum[:]), size, ext))
+		if strm, err := (FileStreamHandler{}).Get(cached); err == nil {
+			return strm, nil
+		}
+	}
+
+	src, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	img, err := decodeImage(src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if ext == "webp" {
+		err = th.encodeWebP(&buf, scale(img, size))
+	} else {
+		err = jpeg.Encode(&buf, scale(img, size), &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cached == "" {
+		return memStream{Reader: bytes.NewReader(buf.Bytes()), modTime: time.Now()}, nil
+	}
+
+	// Write the thumbnail under a temporary name so that concurrent requests
+	// never see part of it.
+	if err := os.MkdirAll(th.Directory, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(th.Directory, ".thumbnail-")
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.WriteTo(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cached)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return FileStreamHandler{}.Get(cached)
+}
+
+// decodeImage decodes an image, after its header shows that it is no
+// larger than MaxThumbnailPixels.
+func decodeImage(r io.Reader) (image.Image, error) {
+	var head bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &head))
+	if err != nil {
+		return nil, UnsupportedError{Err: err}
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxThumbnailPixels {
+		return nil, UnsupportedError{Err: fmt.Errorf("image of %dx%d pixels is too large", cfg.Width, cfg.Height)}
+	}
+	img, _, err := image.Decode(io.MultiReader(&head, r))
+	if err != nil {
+		return nil, UnsupportedError{Err: err}
+	}
+	return img, nil
+}
+
+// encodeWebP writes img to w as WebP with WebPCommand.
+func (th Thumbnailer) encodeWebP(w io.Writer, img image.Image) error {
+	var src bytes.Buffer
+	if err := png.Encode(&src, img); err != nil {
+		return err
+	}
+	cmd := exec.Command(th.WebPCommand[0], th.WebPCommand[1:]...)
+	cmd.Stdin = &src
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return commandError("making a thumbnail", th.WebPCommand[0], err, stderr)
+	}
+	return nil
+}
+
+// scale returns img scaled down to fit a square of size pixels. Images that
+// already fit are returned unchanged.
+func scale(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	if w > h {
+		w, h = size, h*size/w
+	} else {
+		w, h = w*size/h, size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// memStream is a StreamReader of data held in memory.
+type memStream struct {
+	*bytes.Reader
+	modTime time.Time
+}
+
+func (m memStream) Close() error {
+	return nil
+}
+
+func (m memStream) ModTime() time.Time {
+	return m.modTime
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestThumbnailer(t *testing.T) {
+	Convey("Test Thumbnailer", t, func() {
+		tmp, err := ioutil.TempDir("", "blueshift-")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		var img bytes.Buffer
+		png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 400, 200)))
+		opened := 0
+		open := func() (io.ReadCloser, error) {
+			opened++
+			return ioutil.NopCloser(bytes.NewReader(img.Bytes())), nil
+		}
+		th := Thumbnailer{}
+
+		Convey("should scale image down to JPEG", func() {
+			rdr, err := th.Thumbnail("key", 100, "", open)
+			So(err, ShouldBeNil)
+			defer rdr.Close()
+			cfg, format, err := image.DecodeConfig(rdr)
+			So(err, ShouldBeNil)
+			So(format, ShouldEqual, "jpeg")
+			So(cfg.Width, ShouldEqual, 100)
+			So(cfg.Height, ShouldEqual, 50)
+		})
+
+		Convey("should cache thumbnails by key, size and format", func() {
+			th.Directory = tmp
+			th.WebPCommand = []string{"cat"}
+			for i := 0; i < 2; i++ {
+				rdr, err := th.Thumbnail("key", 100, "jpeg", open)
+				So(err, ShouldBeNil)
+				rdr.Close()
+			}
+			So(opened, ShouldEqual, 1)
+			rdr, err := th.Thumbnail("key", 50, "jpeg", open)
+			So(err, ShouldBeNil)
+			rdr.Close()
+			rdr, err = th.Thumbnail("key", 50, "webp", open)
+			So(err, ShouldBeNil)
+			rdr.Close()
+			So(opened, ShouldEqual, 3)
+			files, _ := ioutil.ReadDir(tmp)
+			So(len(files), ShouldEqual, 3)
+		})
+
+		Convey("should make WebP with the command", func() {
+			_, err := th.Thumbnail("key", 100, "webp", open)
+			So(IsUnsupported(err), ShouldBeTrue)
+			th.WebPCommand = []string{"sh", "-c", "printf 'webp:'; cat"}
+			mimetype, ok := th.Mimetype("webp")
+			So(ok, ShouldBeTrue)
+			So(mimetype, ShouldEqual, "image/webp")
+			rdr, err := th.Thumbnail("key", 100, "webp", open)
+			So(err, ShouldBeNil)
+			defer rdr.Close()
+			data, _ := ioutil.ReadAll(rdr)
+			So(string(data), ShouldStartWith, "webp:")
+			cfg, err := png.DecodeConfig(bytes.NewReader(data[len("webp:"):]))
+			So(err, ShouldBeNil)
+			So(cfg.Width, ShouldEqual, 100)
+		})
+
+		Convey("should report the output of a failed WebP command", func() {
+			th.WebPCommand = []string{"sh", "-c", "echo broken >&2; exit 1"}
+			_, err := th.Thumbnail("key", 100, "webp", open)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "broken")
+		})
+
+		Convey("should refuse images too large to decode", func() {
+			// A GIF header of 65535 by 65535 pixels.
+			huge := "GIF89a\xff\xff\xff\xff\x00\x00\x00"
+			_, err := th.Thumbnail("huge", 100, "", func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(huge)), nil
+			})
+			So(IsUnsupported(err), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "too large")
+		})
+
+		Convey("should refuse data that is not an image", func() {
+			_, err := th.Thumbnail("text", 100, "", func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader("not an image")), nil
+			})
+			So(IsUnsupported(err), ShouldBeTrue)
+		})
+	})
+}
+
+func TestScale(t *testing.T) {
+	Convey("Test scale", t, func() {
+		Convey("should keep aspect ratio", func() {
+			So(scale(image.NewRGBA(image.Rect(0, 0, 200, 400)), 100).Bounds().Size(),
+				ShouldResemble, image.Pt(50, 100))
+		})
+
+		Convey("should not scale small images up", func() {
+			img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+			So(scale(img, 100), ShouldEqual, img)
+		})
+
+		Convey("should keep at least one pixel", func() {
+			So(scale(image.NewRGBA(image.Rect(0, 0, 1000, 1)), 100).Bounds().Size(),
+				ShouldResemble, image.Pt(100, 1))
+		})
+	})
+}
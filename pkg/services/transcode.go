@@ -0,0 +1,288 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Profile describes a transcoded version of a stream.
+type Profile struct {
+	Format  string // the name of the target format, such as mp3
+	BitRate int    // kilobits per second, or zero for the format's default
+}
+
+// Transcoder converts streams to other formats.
+type Transcoder interface {
+	// Mimetype returns the mimetype of the streams transcoded to format, and
+	// whether format is supported at all.
+	Mimetype(format string) (string, bool)
+
+	// Transcode returns the data read from open converted to profile p. Key
+	// identifies the source in the cache, and must change when its data
+	// does. Output from the cache is a StreamReader; other output is read
+	// as it is made, and its errors are returned by Close. Transcoding stops
+	// when ctx is done. Unsupported formats return an UnsupportedError.
+	Transcode(ctx context.Context, key string, p Profile, open func() (io.ReadCloser, error)) (io.ReadCloser, error)
+}
+
+// TranscodeCommand is an external command that converts audio read from its
+// standard input to a format written to its standard output. The string
+// {bitrate} in an argument is replaced by the target bit rate in kilobits
+// per second.
+type TranscodeCommand struct {
+	Args           []string
+	Mimetype       string
+	DefaultBitRate int
+}
+
+// DefaultTranscodeCommands convert to MP3, Ogg Vorbis and Opus with ffmpeg.
+var DefaultTranscodeCommands = map[string]TranscodeCommand{
+	"mp3": {
+		Args:           strings.Fields("ffmpeg -v error -i pipe:0 -map 0:a:0 -c:a libmp3lame -b:a {bitrate}k -f mp3 pipe:1"),
+		Mimetype:       "audio/mpeg",
+		DefaultBitRate: 192,
+	},
+	"ogg": {
+		Args:           strings.Fields("ffmpeg -v error -i pipe:0 -map 0:a:0 -c:a libvorbis -b:a {bitrate}k -f ogg pipe:1"),
+		Mimetype:       "audio/ogg",
+		DefaultBitRate: 160,
+	},
+	"opus": {
+		Args:           strings.Fields("ffmpeg -v error -i pipe:0 -map 0:a:0 -c:a libopus -b:a {bitrate}k -f opus pipe:1"),
+		Mimetype:       "audio/ogg",
+		DefaultBitRate: 128,
+	},
+}
+
+// CommandTranscoder is a Transcoder that runs an external command for each
+// format. Transcoded streams are cached in Directory if it is set, and
+// transcoded for every request otherwise.
+type CommandTranscoder struct {
+	Commands  map[string]TranscodeCommand
+	Directory string
+}
+
+func (tc CommandTranscoder) Mimetype(format string) (string, bool) {
+	cmd, ok := tc.Commands[strings.ToLower(format)]
+	return cmd.Mimetype, ok
+}
+
+func (tc CommandTranscoder) Transcode(ctx context.Context, key string, p Profile, open func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	format := strings.ToLower(p.Format)
+	command, ok := tc.Commands[format]
+	if !ok || len(command.Args) == 0 {
+		return nil, UnsupportedError{Err: fmt.Errorf("cannot transcode to %q", p.Format)}
+	}
+	bitrate := p.BitRate
+	if bitrate <= 0 {
+		bitrate = command.DefaultBitRate
+	}
+	r := strings.NewReplacer("{bitrate}", strconv.Itoa(bitrate))
+	args := make([]string, len(command.Args))
+	for i, a := range command.Args {
+		args[i] = r.Replace(a)
+	}
+	if tc.Directory == "" {
+		return streamCommand(ctx, args, open)
+	}
+
+	sum := sha1.Sum([]byte(key))
+	cached := filepath.Join(tc.Directory,
+		fmt.Sprintf("%s-%d.%s", hex.EncodeToString(sum[:]), bitrate, format))
+	if strm, err := (FileStreamHandler{}).Get(cached); err == nil {
+		return strm, nil
+	}
+	err := transcodes.wait(ctx, cached, func(ctx context.Context) error {
+		return tc.cache(ctx, cached, args, open)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return FileStreamHandler{}.Get(cached)
+}
+
+// cache runs a command and keeps its output in the file cached. The output
+// is written under a temporary name so that concurrent requests never see
+// part of it.
+func (tc CommandTranscoder) cache(ctx context.Context, cached string, args []string, open func() (io.ReadCloser, error)) error {
+	src, err := open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := os.MkdirAll(tc.Directory, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(tc.Directory, ".transcode-")
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = src
+	cmd.Stdout = tmp
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		err = commandError("transcoding", args[0], err, stderr)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cached)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// streamCommand starts a command and returns its output as it is made. A
+// command that fails before writing anything returns its error.
+func streamCommand(ctx context.Context, args []string, open func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	src, err := open()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = src
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	co := &commandOutput{ctx: ctx, cmd: cmd, src: src, name: args[0], out: bufio.NewReader(out)}
+	cmd.Stderr = &co.stderr
+	if err := cmd.Start(); err != nil {
+		src.Close()
+		return nil, err
+	}
+	if _, err := co.out.Peek(1); err != nil {
+		co.eof = err == io.EOF
+		if err := co.Close(); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	return co, nil
+}
+
+// commandOutput is the output of a running command. Close waits for the
+// command, or stops it if its output has not all been read.
+type commandOutput struct {
+	ctx    context.Context
+	cmd    *exec.Cmd
+	src    io.Closer
+	name   string
+	out    *bufio.Reader
+	eof    bool
+	stderr bytes.Buffer
+}
+
+func (co *commandOutput) Read(p []byte) (int, error) {
+	n, err := co.out.Read(p)
+	if err == io.EOF {
+		co.eof = true
+	}
+	return n, err
+}
+
+func (co *commandOutput) Close() error {
+	// A command stopped before its output was read, or because the request
+	// was done, has not failed.
+	if !co.eof {
+		co.cmd.Process.Kill()
+	}
+	err := co.cmd.Wait()
+	co.src.Close()
+	if err != nil && co.eof && co.ctx.Err() == nil {
+		return commandError("transcoding", co.name, err, co.stderr)
+	}
+	return nil
+}
+
+// transcodes are the transcodes being cached, which requests for the same
+// output share.
+var transcodes = &inflight{calls: make(map[string]*inflightCall)}
+
+// inflight runs functions for keys, one at a time for each key.
+type inflight struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+type inflightCall struct {
+	done    chan struct{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// wait runs fn for key, unless it is already running, and waits until it
+// returns or ctx is done. The context of fn is done once every caller that
+// waits for it has stopped waiting.
+func (f *inflight) wait(ctx context.Context, key string, fn func(context.Context) error) error {
+	f.mu.Lock()
+	c, ok := f.calls[key]
+	if !ok {
+		fnctx, cancel := context.WithCancel(context.Background())
+		c = &inflightCall{done: make(chan struct{}), cancel: cancel}
+		f.calls[key] = c
+		go func() {
+			c.err = fn(fnctx)
+			cancel()
+			f.mu.Lock()
+			if f.calls[key] == c {
+				delete(f.calls, key)
+			}
+			f.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	f.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Later callers start again rather than wait for a
+			// cancelled call.
+			c.cancel()
+			if f.calls[key] == c {
+				delete(f.calls, key)
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// commandError describes a failed command by what it was doing and the
+// start of what it wrote to standard error.
+func commandError(doing, name string, err error, stderr bytes.Buffer) error {
+	msg := strings.TrimSpace(stderr.String())
+	if len(msg) > 500 {
+		msg = msg[:500]
+	}
+	if msg == "" {
+		return fmt.Errorf("%s with %s failed: %v", doing, name, err)
+	}
+	return fmt.Errorf("%s with %s failed: %v: %s", doing, name, err, msg)
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCommandTranscoder(t *testing.T) {
+	Convey("Test CommandTranscoder", t, func() {
+		tmp, err := ioutil.TempDir("", "blueshift-")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		var mu sync.Mutex
+		opened := 0
+		open := func() (io.ReadCloser, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			opened++
+			return ioutil.NopCloser(strings.NewReader("audio")), nil
+		}
+		ctx := context.Background()
+		tc := CommandTranscoder{
+			Commands: map[string]TranscodeCommand{
+				"mp3": {
+					Args:           []string{"sh", "-c", "printf 'mp3 {bitrate}:'; cat"},
+					Mimetype:       "audio/mpeg",
+					DefaultBitRate: 192,
+				},
+				"fail": {Args: []string{"sh", "-c", "echo broken >&2; exit 1"}},
+				"slow": {Args: []string{"sh", "-c", "printf slow:; exec sleep 10"}},
+				"late": {Args: []string{"sh", "-c", "sleep 0.2; printf late:; cat"}},
+			},
+		}
+
+		Convey("should run the command for the format", func() {
+			rdr, err := tc.Transcode(ctx, "key", Profile{Format: "MP3", BitRate: 128}, open)
+			So(err, ShouldBeNil)
+			data, _ := ioutil.ReadAll(rdr)
+			So(string(data), ShouldEqual, "mp3 128:audio")
+			So(rdr.Close(), ShouldBeNil)
+		})
+
+		Convey("should stream output that is not cached", func() {
+			ctx, cancel := context.WithCancel(ctx)
+			rdr, err := tc.Transcode(ctx, "key", Profile{Format: "slow"}, open)
+			So(err, ShouldBeNil)
+			_, seekable := rdr.(StreamReader)
+			So(seekable, ShouldBeFalse)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(rdr, buf)
+			So(err, ShouldBeNil)
+			So(string(buf), ShouldEqual, "slow:")
+			// The command is stopped once the request is done.
+			start := time.Now()
+			cancel()
+			ioutil.ReadAll(rdr)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+			So(rdr.Close(), ShouldBeNil)
+		})
+
+		Convey("should share cached output being made", func() {
+			tc.Directory = tmp
+			var wg sync.WaitGroup
+			outputs := make([]string, 3)
+			for i := range outputs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					rdr, err := tc.Transcode(ctx, "key", Profile{Format: "late"}, open)
+					if err == nil {
+						data, _ := ioutil.ReadAll(rdr)
+						rdr.Close()
+						outputs[i] = string(data)
+					}
+				}(i)
+			}
+			wg.Wait()
+			So(outputs, ShouldResemble, []string{"late:audio", "late:audio", "late:audio"})
+			So(opened, ShouldEqual, 1)
+		})
+
+		Convey("should stop waiting for cached output when the request is done", func() {
+			tc.Directory = tmp
+			ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer cancel()
+			_, err := tc.Transcode(ctx, "key", Profile{Format: "slow"}, open)
+			So(err, ShouldResemble, context.DeadlineExceeded)
+		})
+
+		Convey("should use the default bit rate", func() {
+			rdr, err := tc.Transcode(ctx, "key", Profile{Format: "mp3"}, open)
+			So(err, ShouldBeNil)
+			defer rdr.Close()
+			data, _ := ioutil.ReadAll(rdr)
+			So(string(data), ShouldEqual, "mp3 192:audio")
+		})
+
+		Convey("should cache output by key and profile", func() {
+			tc.Directory = tmp
+			for i := 0; i < 2; i++ {
+				rdr, err := tc.Transcode(ctx, "key", Profile{Format: "mp3"}, open)
+				So(err, ShouldBeNil)
+				data, _ := ioutil.ReadAll(rdr)
+				rdr.Close()
+				So(string(data), ShouldEqual, "mp3 192:audio")
+			}
+			So(opened, ShouldEqual, 1)
+			rdr, err := tc.Transcode(ctx, "key", Profile{Format: "mp3", BitRate: 96}, open)
+			So(err, ShouldBeNil)
+			rdr.Close()
+			So(opened, ShouldEqual, 2)
+			files, _ := ioutil.ReadDir(tmp)
+			So(len(files), ShouldEqual, 2)
+		})
+
+		Convey("should report the output of a failed command", func() {
+			_, err := tc.Transcode(ctx, "key", Profile{Format: "fail"}, open)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "broken")
+			tc.Directory = tmp
+			_, err = tc.Transcode(ctx, "key", Profile{Format: "fail"}, open)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "broken")
+			files, _ := ioutil.ReadDir(tmp)
+			So(len(files), ShouldEqual, 0)
+		})
+
+		Convey("should not transcode to unknown formats", func() {
+			_, err := tc.Transcode(ctx, "key", Profile{Format: "wav"}, open)
+			So(IsUnsupported(err), ShouldBeTrue)
+			_, ok := tc.Mimetype("wav")
+			So(ok, ShouldBeFalse)
+			mt, ok := tc.Mimetype("mp3")
+			So(ok, ShouldBeTrue)
+			So(mt, ShouldEqual, "audio/mpeg")
+		})
+	})
+}
@@ -1,10 +1,14 @@
 package store
 
 import (
+	"database/sql"
+	"fmt"
 	"github.com/dhowden/tag"
 	"github.com/gravesm/blueshift/pkg/models"
 	"github.com/jinzhu/gorm"
-	"log"
+	"math"
+	"path/filepath"
+	"strings"
 )
 
 const (
@@ -18,87 +22,505 @@ type DbCollection struct {
 	handler *gorm.DB
 }
 
-func (db DbCollection) GetFormat(name string) models.Format {
+func (db DbCollection) GetFormat(name string) (models.Format, error) {
 	var f models.Format
 	err := db.handler.Where("name = ?", name).First(&f).Error
-	if err != nil {
-		log.Fatal(err)
-	}
-	return f
+	return f, notFound(err, "format", name)
 }
 
-func (db DbCollection) CreateRelease(release *models.Release) {
-	db.handler.Create(release)
+func (db DbCollection) CreateRelease(release *models.Release) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(release).Error; err != nil {
+			return err
+		}
+		return indexReleases(tx, []int64{release.ID}, true)
+	})
 }
 
-func (db DbCollection) SaveRelease(release models.Release) {
-	db.handler.Save(release)
+// SaveRelease saves release and its tracks. The release's artist credit is
+// replaced with the one it holds.
+func (db DbCollection) SaveRelease(release models.Release) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		err := tx.Where("release_id = ?", release.ID).Delete(models.ReleaseArtist{}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Save(&release).Error; err != nil {
+			return err
+		}
+		return indexReleases(tx, []int64{release.ID}, true)
+	})
 }
 
-func (db DbCollection) GetRelease(id int64) models.Release {
+func (db DbCollection) GetRelease(id int64) (models.Release, error) {
 	var r models.Release
-	db.handler.Preload("Tracks", func(db *gorm.DB) *gorm.DB {
-		return db.Order("tracks.position asc")
-	}).First(&r, id)
-	return r
+	err := db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+		Preload("Tracks", func(db *gorm.DB) *gorm.DB {
+			return db.Order("tracks.position asc")
+		}).Preload("Tracks.Artists", byPosition).Preload("Tracks.Artists.Artist").
+		Preload("Tracks.Streams.Format").First(&r, id).Error
+	return r, notFound(err, "release", id)
+}
+
+func (db DbCollection) GetReleases(ids []int64) (map[int64]models.Release, error) {
+	releases := make(map[int64]models.Release)
+	err := batches(ids, func(ids []int64) error {
+		var batch []models.Release
+		err := db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+			Where("id in (?)", ids).Find(&batch).Error
+		for _, r := range batch {
+			releases[r.ID] = r
+		}
+		return err
+	})
+	return releases, err
 }
 
-func (db DbCollection) Releases(offset int, rows int) []models.Release {
+func (db DbCollection) GetReleaseByMBID(mbid string) (models.Release, error) {
+	var r models.Release
+	err := db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+		Where("mb_id = ?", mbid).First(&r).Error
+	return r, notFound(err, "release", mbid)
+}
+
+func (db DbCollection) Releases(opts models.ListOptions) ([]models.Release, int, error) {
 	var releases []models.Release
-	db.handler.Order("id desc").Offset(offset).Limit(rows).Find(&releases)
-	return releases
+	var total int
+	if err := db.handler.Model(&models.Release{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	q, err := list(db.handler, "releases", releaseOrders, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = q.Preload("Artists", byPosition).Preload("Artists.Artist").Find(&releases).Error
+	return releases, total, err
+}
+
+// DeleteRelease deletes a release with its artist credit and tracks. The
+// stored data of the tracks' streams is not removed.
+func (db DbCollection) DeleteRelease(id int64) error {
+	var ids []int64
+	err := db.handler.Model(&models.Track{}).Where("release_id = ?", id).Pluck("id", &ids).Error
+	if err != nil {
+		return err
+	}
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := deleteTracks(tx, ids); err != nil {
+			return err
+		}
+		if err := tx.Where("release_id = ?", id).Delete(models.ReleaseArtist{}).Error; err != nil {
+			return err
+		}
+		err := tx.Where("kind = ? AND item_id = ?", models.KindRelease, id).Delete(models.Rating{}).Error
+		if err != nil {
+			return err
+		}
+		res := tx.Where("id = ?", id).Delete(models.Release{})
+		if res.Error == nil && res.RowsAffected == 0 {
+			return models.NotFoundError{Kind: "release", Key: id}
+		} else if res.Error != nil {
+			return res.Error
+		}
+		return unindex(tx, releaseKind, []int64{id})
+	})
 }
 
-func (db DbCollection) CreateTrack(t *models.Track) {
-	db.handler.Create(t)
+func (db DbCollection) CreateTrack(t *models.Track) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(t).Error; err != nil {
+			return err
+		}
+		return indexTracks(tx, []int64{t.ID})
+	})
 }
 
-func (db DbCollection) SaveTrack(t models.Track) {
-	db.handler.Save(t)
+// SaveTrack saves t and its streams. The track's artist credit is replaced
+// with the one it holds.
+func (db DbCollection) SaveTrack(t models.Track) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		err := tx.Where("track_id = ?", t.ID).Delete(models.TrackArtist{}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Save(&t).Error; err != nil {
+			return err
+		}
+		return indexTracks(tx, []int64{t.ID})
+	})
+}
+
+func (db DbCollection) GetTrack(id int64) (models.Track, error) {
+	var t models.Track
+	err := db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+		Preload("Streams.Format").First(&t, id).Error
+	return t, notFound(err, "track", id)
 }
 
-func (db DbCollection) GetTrack(id int64) models.Track {
+func (db DbCollection) GetTrackByMBID(mbid string) (models.Track, error) {
 	var t models.Track
-	err := db.handler.Preload("Streams.Format").First(&t, id).Error
+	err := db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+		Preload("Streams.Format").Where("mb_id = ?", mbid).First(&t).Error
+	return t, notFound(err, "track", mbid)
+}
+
+func (db DbCollection) Tracks(opts models.ListOptions) ([]models.Track, int, error) {
+	var tracks []models.Track
+	var total int
+	if err := db.handler.Model(&models.Track{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	q, err := list(db.handler, "tracks", trackOrders, opts)
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, err
 	}
-	return t
+	err = q.Preload("Artists", byPosition).Preload("Artists.Artist").
+		Preload("Streams.Format").Find(&tracks).Error
+	return tracks, total, err
 }
 
-func (db DbCollection) Tracks(offset int, rows int) []models.Track {
-	var tracks []models.Track
-	db.handler.Order("id desc").Offset(offset).Limit(rows).Find(&tracks)
-	return tracks
+// DeleteTrack deletes a track with its artist credit and streams. The stored
+// data of the streams is not removed.
+func (db DbCollection) DeleteTrack(id int64) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		var n int
+		if err := tx.Model(&models.Track{}).Where("id = ?", id).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 {
+			return models.NotFoundError{Kind: "track", Key: id}
+		}
+		return deleteTracks(tx, []int64{id})
+	})
+}
+
+func deleteTracks(tx *gorm.DB, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := tx.Where("track_id in (?)", ids).Delete(models.TrackArtist{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("track_id in (?)", ids).Delete(models.Stream{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("track_id in (?)", ids).Delete(models.PlaylistEntry{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("track_id in (?)", ids).Delete(models.Play{}).Error; err != nil {
+		return err
+	}
+	err := tx.Where("kind = ? AND item_id in (?)", models.KindTrack, ids).Delete(models.Rating{}).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("id in (?)", ids).Delete(models.Track{}).Error; err != nil {
+		return err
+	}
+	return unindex(tx, trackKind, ids)
+}
+
+// CreateStream adds stream to the track given by its TrackID.
+func (db DbCollection) CreateStream(stream *models.Stream) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		var n int
+		err := tx.Model(&models.Track{}).Where("id = ?", stream.TrackID).Count(&n).Error
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return models.NotFoundError{Kind: "track", Key: stream.TrackID}
+		}
+		return tx.Create(stream).Error
+	})
+}
+
+func (db DbCollection) GetStreamBySource(source string) (models.Stream, error) {
+	var strm models.Stream
+	err := db.handler.Preload("Format").Where("source = ?", source).First(&strm).Error
+	return strm, notFound(err, "stream", source)
+}
+
+// GetStreamsBySourceDir returns the streams imported from files below dir.
+func (db DbCollection) GetStreamsBySourceDir(dir string) ([]models.Stream, error) {
+	var streams []models.Stream
+	// Sources below dir sort between dir followed by the separator and dir
+	// followed by the next character.
+	dir = strings.TrimSuffix(dir, string(filepath.Separator))
+	lower := dir + string(filepath.Separator)
+	upper := dir + string(filepath.Separator+1)
+	err := db.handler.Preload("Format").Where("source >= ? AND source < ?", lower, upper).
+		Order("source asc").Find(&streams).Error
+	return streams, err
+}
+
+// GetStreamsBySourceSuffix returns the streams imported from files whose
+// path is suffix or ends with a separator followed by suffix.
+func (db DbCollection) GetStreamsBySourceSuffix(suffix string) ([]models.Stream, error) {
+	var streams []models.Stream
+	pattern := "%" + string(filepath.Separator) + likeEscaper.Replace(suffix)
+	err := db.handler.Preload("Format").
+		Where(`source = ? OR source LIKE ? ESCAPE '\'`, suffix, pattern).
+		Order("source asc").Find(&streams).Error
+	return streams, err
+}
+
+// UsedPaths returns which of paths are the path of a stream or the cover of
+// a release.
+func (db DbCollection) UsedPaths(paths []string) (map[string]bool, error) {
+	used := make(map[string]bool)
+	for len(paths) > 0 {
+		n := batchSize
+		if n > len(paths) {
+			n = len(paths)
+		}
+		var found []string
+		err := db.handler.Model(&models.Stream{}).Where("path in (?)", paths[:n]).
+			Pluck("path", &found).Error
+		if err == nil {
+			var covers []string
+			err = db.handler.Model(&models.Release{}).Where("cover in (?)", paths[:n]).
+				Pluck("cover", &covers).Error
+			found = append(found, covers...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range found {
+			used[p] = true
+		}
+		paths = paths[n:]
+	}
+	return used, nil
 }
 
-func (db DbCollection) CreateArtist(artist *models.Artist) {
+func (db DbCollection) CreateArtist(artist *models.Artist) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(artist).Error; err != nil {
+			return err
+		}
+		return indexArtists(tx, []int64{artist.ID})
+	})
 }
 
-func (db DbCollection) SaveArtist(artist models.Artist) {
+func (db DbCollection) SaveArtist(artist models.Artist) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&artist).Error; err != nil {
+			return err
+		}
+		if err := indexArtists(tx, []int64{artist.ID}); err != nil {
+			return err
+		}
+		return indexArtistCredits(tx, artist.ID)
+	})
 }
 
-func (db DbCollection) GetArtist(id int64) models.Artist {
-	a := models.Artist{}
-	return a
+func (db DbCollection) GetArtist(id int64) (models.Artist, error) {
+	var a models.Artist
+	err := db.handler.Preload("Releases", func(db *gorm.DB) *gorm.DB {
+		return db.Order("releases.year asc, releases.title asc")
+	}).Preload("Tracks", func(db *gorm.DB) *gorm.DB {
+		return db.Order("tracks.title asc")
+	}).First(&a, id).Error
+	return a, notFound(err, "artist", id)
 }
 
-func (db DbCollection) Artists(offset int, rows int) []models.Artist {
-	arts := []models.Artist{}
-	return arts
+func (db DbCollection) GetArtistByName(name string) (models.Artist, error) {
+	var a models.Artist
+	err := db.handler.Where("name = ?", name).First(&a).Error
+	return a, notFound(err, "artist", name)
 }
 
-func Migrate(db *gorm.DB) {
-	db.AutoMigrate(&models.Track{}, &models.Stream{}, &models.Format{},
-		&models.Release{})
+func (db DbCollection) Artists(opts models.ListOptions) ([]models.Artist, int, error) {
+	var artists []models.Artist
+	var total int
+	if err := db.handler.Model(&models.Artist{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	q, err := list(db.handler, "artists", artistOrders, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = q.Preload("Releases").Find(&artists).Error
+	return artists, total, err
+}
+
+// transaction runs fn in a database transaction, which is committed if fn
+// returns nil and rolled back otherwise.
+func (db DbCollection) transaction(fn func(tx *gorm.DB) error) error {
+	// Within Transaction the handler is already a transaction, which the
+	// changes join.
+	if _, ok := db.handler.CommonDB().(*sql.Tx); ok {
+		return fn(db.handler)
+	}
+	tx := db.handler.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (db DbCollection) Transaction(fn func(models.Collection) error) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		return fn(DbCollection{handler: tx})
+	})
+}
+
+// releaseOrders, trackOrders and artistOrders map each sort to the
+// expression a list is ordered by. Items that sort equally are ordered by
+// ID.
+var releaseOrders = map[models.Sort]string{
+	models.SortAdded: "releases.created_at",
+	models.SortTitle: "releases.title COLLATE NOCASE",
+	models.SortYear:  "releases.year",
+	models.SortArtist: `(SELECT artists.name FROM release_artists
+		JOIN artists ON artists.id = release_artists.artist_id
+		WHERE release_artists.release_id = releases.id
+		ORDER BY release_artists.position LIMIT 1) COLLATE NOCASE`,
+	models.SortRating: ratingOrder(models.KindRelease, "releases"),
+}
+
+var trackOrders = map[models.Sort]string{
+	models.SortAdded: "tracks.created_at",
+	models.SortTitle: "tracks.title COLLATE NOCASE",
+	models.SortYear:  "(SELECT releases.year FROM releases WHERE releases.id = tracks.release_id)",
+	// Tracks without an artist credit of their own sort by the release's.
+	models.SortArtist: `COALESCE((SELECT artists.name FROM track_artists
+		JOIN artists ON artists.id = track_artists.artist_id
+		WHERE track_artists.track_id = tracks.id
+		ORDER BY track_artists.position LIMIT 1),
+		(SELECT artists.name FROM release_artists
+		JOIN artists ON artists.id = release_artists.artist_id
+		WHERE release_artists.release_id = tracks.release_id
+		ORDER BY release_artists.position LIMIT 1)) COLLATE NOCASE`,
+	models.SortRating: ratingOrder(models.KindTrack, "tracks"),
 }
 
-func Initialize(db *gorm.DB) {
-	Migrate(db)
-	db.Create(&models.Format{Name: unknown})
-	db.Create(&models.Format{Name: mp3, Mimetype: "audio/mpeg"})
-	db.Create(&models.Format{Name: ogg, Mimetype: "audio/ogg"})
-	db.Create(&models.Format{Name: flac, Mimetype: "audio/flac"})
+// Artists have no date they were added, but are added in the order of
+// their IDs.
+var artistOrders = map[models.Sort]string{
+	models.SortAdded:  "artists.id",
+	models.SortTitle:  "artists.name COLLATE NOCASE",
+	models.SortArtist: "artists.name COLLATE NOCASE",
+	models.SortRating: ratingOrder(models.KindArtist, "artists"),
+}
+
+// ratingOrder returns the expression that orders the items of table by
+// their ratings. The user whose ratings they are is its parameter.
+func ratingOrder(kind models.ItemKind, table string) string {
+	return fmt.Sprintf(`COALESCE((SELECT ratings.rating FROM ratings
+		WHERE ratings.user_id = ? AND ratings.kind = '%s' AND ratings.item_id = %s.id), 0)`,
+		kind, table)
+}
+
+// list orders and limits a query of table as selected by opts.
+func list(db *gorm.DB, table string, orders map[models.Sort]string, opts models.ListOptions) (*gorm.DB, error) {
+	sort := opts.Sort
+	if sort == "" {
+		sort = models.SortAdded
+	}
+	expr, ok := orders[sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort %q", sort)
+	}
+	dir := "asc"
+	if opts.Desc {
+		dir = "desc"
+	}
+	// SQLite only accepts an offset after a limit.
+	limit := int64(opts.Limit)
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	order := fmt.Sprintf("%s %s, %s.id %s", expr, dir, table, dir)
+	q := db.Order(order)
+	if sort == models.SortRating {
+		q = db.Order(gorm.Expr(order, opts.UserID))
+	}
+	return q.Offset(opts.Offset).Limit(limit), nil
+}
+
+// byPosition orders artist credits by their position in the credit.
+func byPosition(db *gorm.DB) *gorm.DB {
+	return db.Order("position asc")
+}
+
+// notFound converts a gorm record not found error into a NotFoundError.
+// Any other error is returned unchanged.
+func notFound(err error, kind string, key interface{}) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return models.NotFoundError{Kind: kind, Key: key}
+	}
+	return err
+}
+
+func Migrate(db *gorm.DB) error {
+	err := db.AutoMigrate(&models.Track{}, &models.Stream{}, &models.Format{},
+		&models.Release{}, &models.ReleaseArtist{}, &models.TrackArtist{},
+		&models.Artist{}, &models.Playlist{}, &models.PlaylistEntry{},
+		&models.User{}, &models.Session{}, &models.Token{},
+		&models.Play{}, &models.QueuedListen{}, &models.Rating{},
+		&models.Job{}).Error
+	if err != nil {
+		return err
+	}
+	if err := migrateArtistCredits(db); err != nil {
+		return err
+	}
+	return migrateSearchIndex(db)
+}
+
+// migrateArtistCredits moves artist links out of the user_languages join
+// table, which earlier versions shared between releases and tracks, into
+// release_artists and track_artists. Credit order follows insertion order.
+func migrateArtistCredits(db *gorm.DB) error {
+	if !db.HasTable("user_languages") {
+		return nil
+	}
+	tx := db.Begin()
+	for _, owner := range []string{"release", "track"} {
+		if !tx.Dialect().HasColumn("user_languages", owner+"_id") {
+			continue
+		}
+		err := tx.Exec(fmt.Sprintf(`INSERT OR IGNORE INTO %[1]s_artists
+			(%[1]s_id, artist_id, position, join_phrase)
+			SELECT u.%[1]s_id, u.artist_id,
+				(SELECT COUNT(*) FROM user_languages p
+					WHERE p.%[1]s_id = u.%[1]s_id AND p.rowid < u.rowid),
+				''
+			FROM user_languages u WHERE u.%[1]s_id IS NOT NULL`, owner)).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.DropTable("user_languages").Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func Initialize(db *gorm.DB) error {
+	if err := Migrate(db); err != nil {
+		return err
+	}
+	formats := []models.Format{
+		{Name: unknown},
+		{Name: mp3, Mimetype: "audio/mpeg"},
+		{Name: ogg, Mimetype: "audio/ogg"},
+		{Name: flac, Mimetype: "audio/flac"},
+	}
+	for _, f := range formats {
+		if err := db.Create(&f).Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func NewDbCollection(handler *gorm.DB) models.Collection {
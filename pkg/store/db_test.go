@@ -20,10 +20,16 @@ func TestDb(t *testing.T) {
 		Initialize(db)
 
 		Convey("should return format", func() {
-			f := store.GetFormat(flac)
+			f, err := store.GetFormat(flac)
+			So(err, ShouldBeNil)
 			So(f.Name, ShouldEqual, flac)
 		})
 
+		Convey("should return not found for missing format", func() {
+			_, err := store.GetFormat("M4A")
+			So(models.IsNotFound(err), ShouldBeTrue)
+		})
+
 		Convey("should create release", func() {
 			r := models.Release{Title: "New release"}
 			r.AddTrack(models.Track{Title: "Track 1"})
@@ -49,20 +55,79 @@ func TestDb(t *testing.T) {
 			r := models.Release{Title: "New release"}
 			r.AddTrack(models.Track{Title: "Track 1"})
 			store.CreateRelease(&r)
-			release := store.GetRelease(r.ID)
+			release, err := store.GetRelease(r.ID)
+			So(err, ShouldBeNil)
 			So(release.Title, ShouldEqual, "New release")
 			So(len(release.Tracks), ShouldEqual, 1)
 		})
 
+		Convey("should retrieve release by MusicBrainz ID", func() {
+			r := models.Release{Title: "Release 1", MBID: "mbid"}
+			store.CreateRelease(&r)
+			release, err := store.GetReleaseByMBID("mbid")
+			So(err, ShouldBeNil)
+			So(release.ID, ShouldEqual, r.ID)
+			_, err = store.GetReleaseByMBID("other")
+			So(models.IsNotFound(err), ShouldBeTrue)
+		})
+
+		Convey("should retrieve releases by ID", func() {
+			a := models.Artist{Name: "Artist 1"}
+			store.CreateArtist(&a)
+			r1 := models.Release{Title: "Release 1"}
+			r1.AddArtist(a)
+			store.CreateRelease(&r1)
+			r2 := models.Release{Title: "Release 2"}
+			store.CreateRelease(&r2)
+			releases, err := store.GetReleases([]int64{r1.ID, r2.ID, 100})
+			So(err, ShouldBeNil)
+			So(len(releases), ShouldEqual, 2)
+			So(releases[r1.ID].ArtistCredit(), ShouldEqual, "Artist 1")
+			So(releases[r2.ID].Title, ShouldEqual, "Release 2")
+		})
+
+		Convey("should return not found for missing release", func() {
+			_, err := store.GetRelease(1)
+			So(models.IsNotFound(err), ShouldBeTrue)
+		})
+
 		Convey("should retrieve releases", func() {
 			store.CreateRelease(&models.Release{Title: "Release 1"})
 			store.CreateRelease(&models.Release{Title: "Release 2"})
 			store.CreateRelease(&models.Release{Title: "Release 3"})
-			releases := store.Releases(0, 2)
+			releases, total, err := store.Releases(models.ListOptions{Limit: 2, Desc: true})
+			So(err, ShouldBeNil)
+			So(total, ShouldEqual, 3)
 			So(len(releases), ShouldEqual, 2)
 			So(releases[1].Title, ShouldEqual, "Release 2")
 		})
 
+		Convey("should sort releases", func() {
+			a := models.Release{Title: "b", Year: 2001}
+			a.AddArtist(models.Artist{Name: "Zappa"})
+			b := models.Release{Title: "C", Year: 1999}
+			b.AddArtist(models.Artist{Name: "Abba"})
+			c := models.Release{Title: "a", Year: 2000}
+			store.CreateRelease(&a)
+			store.CreateRelease(&b)
+			store.CreateRelease(&c)
+			titles := func(sort models.Sort, desc bool) []string {
+				releases, _, err := store.Releases(models.ListOptions{Sort: sort, Desc: desc})
+				So(err, ShouldBeNil)
+				var ts []string
+				for _, rel := range releases {
+					ts = append(ts, rel.Title)
+				}
+				return ts
+			}
+			So(titles(models.SortTitle, false), ShouldResemble, []string{"a", "b", "C"})
+			So(titles(models.SortYear, true), ShouldResemble, []string{"b", "a", "C"})
+			So(titles(models.SortArtist, false), ShouldResemble, []string{"a", "C", "b"})
+			So(titles(models.SortAdded, false), ShouldResemble, []string{"b", "C", "a"})
+			_, _, err := store.Releases(models.ListOptions{Sort: "length"})
+			So(err, ShouldNotBeNil)
+		})
+
 		Convey("should create track", func() {
 			var format models.Format
 			db.Where("name = ?", ogg).First(&format)
@@ -95,19 +160,215 @@ func TestDb(t *testing.T) {
 			t := models.Track{Title: "Track 1"}
 			t.AddStream(models.Stream{Path: "foo/bar"})
 			store.CreateTrack(&t)
-			trk := store.GetTrack(t.ID)
+			trk, err := store.GetTrack(t.ID)
+			So(err, ShouldBeNil)
 			So(trk.Title, ShouldEqual, "Track 1")
 			So(len(trk.Streams), ShouldEqual, 1)
 		})
 
+		Convey("should replace track artist credit on save", func() {
+			a := models.Artist{Name: "Artist A"}
+			b := models.Artist{Name: "Artist B"}
+			store.CreateArtist(&a)
+			store.CreateArtist(&b)
+			t := models.Track{Title: "Track 1"}
+			t.AddArtist(a)
+			store.CreateTrack(&t)
+			t.Artists = nil
+			t.AddArtist(b)
+			So(store.SaveTrack(t), ShouldBeNil)
+			trk, err := store.GetTrack(t.ID)
+			So(err, ShouldBeNil)
+			So(trk.ArtistCredit(), ShouldEqual, "Artist B")
+		})
+
+		Convey("should retrieve stream by source", func() {
+			t := models.Track{Title: "Track 1"}
+			t.AddStream(models.Stream{Path: "foo/bar", Source: "/music/bar.ogg"})
+			store.CreateTrack(&t)
+			strm, err := store.GetStreamBySource("/music/bar.ogg")
+			So(err, ShouldBeNil)
+			So(strm.TrackID, ShouldEqual, t.ID)
+			_, err = store.GetStreamBySource("/music/baz.ogg")
+			So(models.IsNotFound(err), ShouldBeTrue)
+		})
+
+		Convey("should retrieve streams by source directory", func() {
+			for _, src := range []string{"/music/a/1.ogg", "/music/a/b/2.ogg", "/music/ab/3.ogg"} {
+				t := models.Track{Title: src}
+				t.AddStream(models.Stream{Path: src, Source: src})
+				store.CreateTrack(&t)
+			}
+			strms, err := store.GetStreamsBySourceDir("/music/a")
+			So(err, ShouldBeNil)
+			So(len(strms), ShouldEqual, 2)
+		})
+
+		Convey("should tell paths used by streams and covers", func() {
+			t := models.Track{Title: "Track 1"}
+			t.AddStream(models.Stream{Path: "files/stream"})
+			store.CreateTrack(&t)
+			store.CreateRelease(&models.Release{Title: "Release 1", Cover: "files/cover"})
+			used, err := store.UsedPaths([]string{"files/stream", "files/cover", "files/orphan"})
+			So(err, ShouldBeNil)
+			So(used, ShouldResemble, map[string]bool{"files/stream": true, "files/cover": true})
+		})
+
+		Convey("should delete track", func() {
+			t := models.Track{Title: "Track 1"}
+			t.AddArtist(models.Artist{Name: "Artist 1"})
+			t.AddStream(models.Stream{Path: "foo/bar"})
+			store.CreateTrack(&t)
+			So(store.DeleteTrack(t.ID), ShouldBeNil)
+			_, err := store.GetTrack(t.ID)
+			So(models.IsNotFound(err), ShouldBeTrue)
+			var n int
+			db.Model(&models.Stream{}).Count(&n)
+			So(n, ShouldEqual, 0)
+			So(models.IsNotFound(store.DeleteTrack(t.ID)), ShouldBeTrue)
+		})
+
+		Convey("should delete release with its tracks", func() {
+			r := models.Release{Title: "Release 1"}
+			r.AddArtist(models.Artist{Name: "Artist 1"})
+			r.AddTrack(models.Track{Title: "Track 1"})
+			store.CreateRelease(&r)
+			So(store.DeleteRelease(r.ID), ShouldBeNil)
+			_, err := store.GetRelease(r.ID)
+			So(models.IsNotFound(err), ShouldBeTrue)
+			var n int
+			db.Model(&models.Track{}).Count(&n)
+			So(n, ShouldEqual, 0)
+			So(models.IsNotFound(store.DeleteRelease(r.ID)), ShouldBeTrue)
+		})
+
+		Convey("should return not found for missing track", func() {
+			_, err := store.GetTrack(1)
+			So(models.IsNotFound(err), ShouldBeTrue)
+		})
+
 		Convey("should retrieve tracks", func() {
 			store.CreateTrack(&models.Track{Title: "Track 1"})
 			store.CreateTrack(&models.Track{Title: "Track 2"})
 			store.CreateTrack(&models.Track{Title: "Track 3"})
-			trks := store.Tracks(1, 10)
+			trks, total, err := store.Tracks(models.ListOptions{Offset: 1, Limit: 10, Desc: true})
+			So(err, ShouldBeNil)
+			So(total, ShouldEqual, 3)
 			So(len(trks), ShouldEqual, 2)
 			So(trks[0].Title, ShouldEqual, "Track 2")
 		})
+
+		Convey("should sort tracks by release", func() {
+			r := models.Release{Title: "Release 1", Year: 1990}
+			r.AddArtist(models.Artist{Name: "B"})
+			r.AddTrack(models.Track{Title: "Track 1"})
+			store.CreateRelease(&r)
+			t := models.Track{Title: "Track 2"}
+			t.AddArtist(models.Artist{Name: "A"})
+			store.CreateTrack(&t)
+			trks, _, err := store.Tracks(models.ListOptions{Sort: models.SortArtist})
+			So(err, ShouldBeNil)
+			So(trks[0].Title, ShouldEqual, "Track 2")
+			trks, _, err = store.Tracks(models.ListOptions{Sort: models.SortYear, Desc: true})
+			So(err, ShouldBeNil)
+			So(trks[0].Title, ShouldEqual, "Track 1")
+		})
+
+		Convey("should create artist", func() {
+			a := models.Artist{Name: "Artist 1"}
+			store.CreateArtist(&a)
+			var artist models.Artist
+			db.First(&artist, a.ID)
+			So(artist.Name, ShouldEqual, "Artist 1")
+		})
+
+		Convey("should save artist", func() {
+			a := models.Artist{Name: "Artist 1"}
+			store.CreateArtist(&a)
+			a.Name = "Artist 2"
+			store.SaveArtist(a)
+			var artist models.Artist
+			db.First(&artist)
+			So(artist.Name, ShouldEqual, "Artist 2")
+		})
+
+		Convey("should retrieve artist", func() {
+			a := models.Artist{Name: "Artist 1"}
+			store.CreateArtist(&a)
+			r := models.Release{Title: "Release 1"}
+			r.AddArtist(a)
+			t := models.Track{Title: "Track 1"}
+			t.AddArtist(a)
+			r.AddTrack(t)
+			store.CreateRelease(&r)
+			artist, err := store.GetArtist(a.ID)
+			So(err, ShouldBeNil)
+			So(artist.Name, ShouldEqual, "Artist 1")
+			So(len(artist.Releases), ShouldEqual, 1)
+			So(len(artist.Tracks), ShouldEqual, 1)
+			release, err := store.GetRelease(r.ID)
+			So(err, ShouldBeNil)
+			So(len(release.Artists), ShouldEqual, 1)
+			So(len(release.Tracks[0].Artists), ShouldEqual, 1)
+		})
+
+		Convey("should retrieve artist credits in order", func() {
+			a := models.Artist{Name: "Artist A"}
+			b := models.Artist{Name: "Artist B"}
+			store.CreateArtist(&a)
+			store.CreateArtist(&b)
+			t := models.Track{Title: "Track 1"}
+			t.AddCredit(b, " feat. ")
+			t.AddCredit(a, "")
+			store.CreateTrack(&t)
+			trk, err := store.GetTrack(t.ID)
+			So(err, ShouldBeNil)
+			So(len(trk.Artists), ShouldEqual, 2)
+			So(trk.Artists[0].Artist.Name, ShouldEqual, "Artist B")
+			So(trk.ArtistCredit(), ShouldEqual, "Artist B feat. Artist A")
+		})
+
+		Convey("should migrate artists from shared join table", func() {
+			a := models.Artist{Name: "Artist A"}
+			b := models.Artist{Name: "Artist B"}
+			store.CreateArtist(&a)
+			store.CreateArtist(&b)
+			t := models.Track{Title: "Track 1"}
+			store.CreateTrack(&t)
+			db.Exec("CREATE TABLE user_languages (track_id integer, artist_id integer)")
+			db.Exec("INSERT INTO user_languages VALUES (?, ?), (?, ?)", t.ID, b.ID, t.ID, a.ID)
+			So(Migrate(db), ShouldBeNil)
+			trk, err := store.GetTrack(t.ID)
+			So(err, ShouldBeNil)
+			So(trk.ArtistCredit(), ShouldEqual, "Artist B, Artist A")
+			So(db.HasTable("user_languages"), ShouldBeFalse)
+		})
+
+		Convey("should retrieve artist by name", func() {
+			a := models.Artist{Name: "Artist 1"}
+			store.CreateArtist(&a)
+			artist, err := store.GetArtistByName("Artist 1")
+			So(err, ShouldBeNil)
+			So(artist.ID, ShouldEqual, a.ID)
+			_, err = store.GetArtistByName("Artist 2")
+			So(models.IsNotFound(err), ShouldBeTrue)
+		})
+
+		Convey("should retrieve artists", func() {
+			store.CreateArtist(&models.Artist{Name: "C"})
+			store.CreateArtist(&models.Artist{Name: "A"})
+			store.CreateArtist(&models.Artist{Name: "B"})
+			arts, total, err := store.Artists(models.ListOptions{Offset: 1, Limit: 10, Sort: models.SortArtist})
+			So(err, ShouldBeNil)
+			So(total, ShouldEqual, 3)
+			So(len(arts), ShouldEqual, 2)
+			So(arts[0].Name, ShouldEqual, "B")
+			arts, _, err = store.Artists(models.ListOptions{Sort: models.SortAdded, Desc: true})
+			So(err, ShouldBeNil)
+			So(arts[0].Name, ShouldEqual, "B")
+			_, _, err = store.Artists(models.ListOptions{Sort: models.SortYear})
+			So(err, ShouldNotBeNil)
+		})
 	})
 
 }
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+)
+
+func (db DbCollection) CreateJob(job *models.Job) error {
+	if job.Status == "" {
+		job.Status = models.JobQueued
+	}
+	return db.handler.Create(job).Error
+}
+
+func (db DbCollection) SaveJob(job models.Job) error {
+	return db.handler.Save(&job).Error
+}
+
+func (db DbCollection) GetJob(id int64) (models.Job, error) {
+	var j models.Job
+	err := db.handler.First(&j, id).Error
+	return j, notFound(err, "job", id)
+}
+
+// ClaimJob marks the oldest queued job running and returns it. A job is
+// only claimed once even if several workers ask at the same time.
+func (db DbCollection) ClaimJob() (models.Job, error) {
+	for {
+		var j models.Job
+		err := db.handler.Where("status = ?", models.JobQueued).Order("id asc").First(&j).Error
+		if err != nil {
+			return j, notFound(err, "job", models.JobQueued)
+		}
+		res := db.handler.Model(&models.Job{}).
+			Where("id = ? AND status = ?", j.ID, models.JobQueued).
+			Update("status", models.JobRunning)
+		if res.Error != nil {
+			return j, res.Error
+		}
+		if res.RowsAffected == 1 {
+			j.Status = models.JobRunning
+			return j, nil
+		}
+	}
+}
+
+// RunningJobs returns the jobs marked running.
+func (db DbCollection) RunningJobs() ([]models.Job, error) {
+	var jobs []models.Job
+	err := db.handler.Where("status = ?", models.JobRunning).Order("id asc").Find(&jobs).Error
+	return jobs, err
+}
+
+// RequeueJobs queues the jobs that were running again, such as those left
+// by a restart.
+func (db DbCollection) RequeueJobs() error {
+	return db.handler.Model(&models.Job{}).Where("status = ?", models.JobRunning).
+		Update("status", models.JobQueued).Error
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestJobs(t *testing.T) {
+	Convey("Test jobs", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		store := NewDbCollection(db)
+		Initialize(db)
+
+		j1 := models.Job{Archive: "a.zip"}
+		j2 := models.Job{Archive: "b.zip"}
+		store.CreateJob(&j1)
+		store.CreateJob(&j2)
+
+		Convey("should queue new jobs", func() {
+			j, err := store.GetJob(j1.ID)
+			So(err, ShouldBeNil)
+			So(j.Status, ShouldEqual, models.JobQueued)
+			So(j.Archive, ShouldEqual, "a.zip")
+		})
+
+		Convey("should claim jobs oldest first and once", func() {
+			j, err := store.ClaimJob()
+			So(err, ShouldBeNil)
+			So(j.ID, ShouldEqual, j1.ID)
+			So(j.Status, ShouldEqual, models.JobRunning)
+			j, err = store.ClaimJob()
+			So(err, ShouldBeNil)
+			So(j.ID, ShouldEqual, j2.ID)
+			_, err = store.ClaimJob()
+			So(models.IsNotFound(err), ShouldBeTrue)
+		})
+
+		Convey("should requeue running jobs", func() {
+			j, _ := store.ClaimJob()
+			j.SetFiles([]models.ImportedFile{{Name: "01.flac", Result: models.FileTrack}})
+			So(store.SaveJob(j), ShouldBeNil)
+			So(store.RequeueJobs(), ShouldBeNil)
+			j, err := store.ClaimJob()
+			So(err, ShouldBeNil)
+			So(j.ID, ShouldEqual, j1.ID)
+			So(j.Files()[0].Name, ShouldEqual, "01.flac")
+		})
+
+		Convey("should return running jobs", func() {
+			j, _ := store.ClaimJob()
+			j.AddStaged("files/a")
+			j.AddStaged("files/b")
+			So(store.SaveJob(j), ShouldBeNil)
+			jobs, err := store.RunningJobs()
+			So(err, ShouldBeNil)
+			So(len(jobs), ShouldEqual, 1)
+			So(jobs[0].ID, ShouldEqual, j1.ID)
+			So(jobs[0].StagedPaths(), ShouldResemble, []string{"files/a", "files/b"})
+		})
+
+		Convey("should return not found for missing job", func() {
+			_, err := store.GetJob(100)
+			So(models.IsNotFound(err), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,203 @@
+package store
+
+import (
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// CreatePlay records a play of the track given by its TrackID. Times are
+// stored in UTC, so that they sort as text.
+func (db DbCollection) CreatePlay(play *models.Play) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := checkTracks(tx, []int64{play.TrackID}); err != nil {
+			return err
+		}
+		play.PlayedAt = play.PlayedAt.UTC()
+		return tx.Create(play).Error
+	})
+}
+
+// Plays returns the plays of a user, or of everyone if userID is zero, newest
+// first, with their tracks.
+func (db DbCollection) Plays(userID int64, offset int, rows int) ([]models.Play, error) {
+	var plays []models.Play
+	q := db.handler.Preload("Track").Preload("Track.Artists", byPosition).
+		Preload("Track.Artists.Artist").Preload("Track.Streams")
+	if userID != 0 {
+		q = q.Where("user_id = ?", userID)
+	}
+	err := q.Order("played_at desc, id desc").Offset(offset).Limit(rows).Find(&plays).Error
+	return plays, err
+}
+
+// PlayCounts counts plays by track, release or artist. A track counts for
+// every artist in its credit.
+func (db DbCollection) PlayCounts(query models.PlayQuery) ([]models.PlayCount, error) {
+	q := db.handler.Table("plays")
+	var col string
+	switch query.Group {
+	case models.PlaysByTrack:
+		col = "plays.track_id"
+	case models.PlaysByRelease:
+		col = "tracks.release_id"
+		q = q.Joins("JOIN tracks ON tracks.id = plays.track_id").Where("tracks.release_id > 0")
+	case models.PlaysByArtist:
+		col = "track_artists.artist_id"
+		q = q.Joins("JOIN track_artists ON track_artists.track_id = plays.track_id")
+	default:
+		return nil, fmt.Errorf("unknown play group %q", query.Group)
+	}
+	if query.UserID != 0 {
+		q = q.Where("plays.user_id = ?", query.UserID)
+	}
+	order := "count desc, last_played desc"
+	if query.Recent {
+		order = "last_played desc"
+	}
+	q = q.Select(col + " AS id, COUNT(*) AS count, MAX(plays.played_at) AS last_played").
+		Group(col).Order(order)
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+	rows, err := q.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []models.PlayCount
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var pc models.PlayCount
+		var last string
+		if err := rows.Scan(&id, &pc.Count, &last); err != nil {
+			return nil, err
+		}
+		if pc.LastPlayed, err = parseTime(last); err != nil {
+			return nil, err
+		}
+		counts = append(counts, pc)
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, db.loadPlayed(query.Group, ids, counts)
+}
+
+// loadPlayed sets the items of counts to those with the given IDs.
+func (db DbCollection) loadPlayed(group models.PlayGroup, ids []int64, counts []models.PlayCount) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	switch group {
+	case models.PlaysByTrack:
+		var tracks []models.Track
+		err := db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+			Preload("Streams").Where("id in (?)", ids).Find(&tracks).Error
+		if err != nil {
+			return err
+		}
+		byID := make(map[int64]models.Track)
+		for _, t := range tracks {
+			byID[t.ID] = t
+		}
+		for i, id := range ids {
+			counts[i].Track = byID[id]
+		}
+	case models.PlaysByRelease:
+		var releases []models.Release
+		err := db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+			Where("id in (?)", ids).Find(&releases).Error
+		if err != nil {
+			return err
+		}
+		byID := make(map[int64]models.Release)
+		for _, r := range releases {
+			byID[r.ID] = r
+		}
+		for i, id := range ids {
+			counts[i].Release = byID[id]
+		}
+	case models.PlaysByArtist:
+		var artists []models.Artist
+		if err := db.handler.Where("id in (?)", ids).Find(&artists).Error; err != nil {
+			return err
+		}
+		byID := make(map[int64]models.Artist)
+		for _, a := range artists {
+			byID[a.ID] = a
+		}
+		for i, id := range ids {
+			counts[i].Artist = byID[id]
+		}
+	}
+	return nil
+}
+
+// sqliteTime is the layout the SQLite driver stores times in.
+const sqliteTime = "2006-01-02 15:04:05.999999999-07:00"
+
+// parseTime parses a time read as text, as the results of SQL functions
+// are.
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(sqliteTime, s)
+	if err != nil {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	return t, nil
+}
+
+// QueueListens adds listens to the end of the submission queue.
+func (db DbCollection) QueueListens(listens []models.QueuedListen) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		for i := range listens {
+			if listens[i].NextAttempt.IsZero() {
+				listens[i].NextAttempt = time.Now()
+			}
+			listens[i].NextAttempt = listens[i].NextAttempt.UTC()
+			if err := tx.Create(&listens[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DueListens returns the queued listens to be submitted by the given time,
+// oldest first.
+func (db DbCollection) DueListens(at time.Time) ([]models.QueuedListen, error) {
+	var listens []models.QueuedListen
+	err := db.handler.Where("next_attempt <= ?", at.UTC()).Order("id asc").Find(&listens).Error
+	return listens, err
+}
+
+// PostponeListens records a failed attempt to submit queued listens, which
+// are tried again from until.
+func (db DbCollection) PostponeListens(ids []int64, until time.Time, reason string) error {
+	return batches(ids, func(ids []int64) error {
+		return db.handler.Model(&models.QueuedListen{}).Where("id in (?)", ids).
+			Updates(map[string]interface{}{
+				"attempts":     gorm.Expr("attempts + 1"),
+				"next_attempt": until.UTC(),
+				"last_error":   reason,
+			}).Error
+	})
+}
+
+// DeleteQueuedListens removes listens from the queue.
+func (db DbCollection) DeleteQueuedListens(ids []int64) error {
+	return batches(ids, func(ids []int64) error {
+		return db.handler.Where("id in (?)", ids).Delete(models.QueuedListen{}).Error
+	})
+}
+
+// CountQueuedListens returns the number of listens of a user waiting to be
+// submitted.
+func (db DbCollection) CountQueuedListens(userID int64) (int, error) {
+	var n int
+	err := db.handler.Model(&models.QueuedListen{}).Where("user_id = ?", userID).Count(&n).Error
+	return n, err
+}
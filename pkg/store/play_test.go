@@ -0,0 +1,127 @@
+package store
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestPlays(t *testing.T) {
+	Convey("Test plays", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		store := NewDbCollection(db)
+		Initialize(db)
+
+		a := models.Artist{Name: "Artist A"}
+		b := models.Artist{Name: "Artist B"}
+		store.CreateArtist(&a)
+		store.CreateArtist(&b)
+		rel := models.Release{Title: "Release"}
+		t1 := models.Track{Title: "Track 1"}
+		t1.AddArtist(a)
+		rel.AddTrack(t1)
+		store.CreateRelease(&rel)
+		t1 = rel.Tracks[0]
+		t2 := models.Track{Title: "Track 2"}
+		t2.AddArtist(a)
+		t2.AddArtist(b)
+		store.CreateTrack(&t2)
+
+		start := time.Date(2019, 10, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+		play := func(user int64, track models.Track, minutes int) {
+			p := models.Play{UserID: user, TrackID: track.ID, Client: "test",
+				PlayedAt: start.Add(time.Duration(minutes) * time.Minute)}
+			So(store.CreatePlay(&p), ShouldBeNil)
+		}
+		play(1, t1, 0)
+		play(1, t1, 10)
+		play(1, t2, 20)
+		play(2, t2, 30)
+
+		Convey("should reject missing track", func() {
+			So(models.IsNotFound(store.CreatePlay(&models.Play{TrackID: 100})), ShouldBeTrue)
+		})
+
+		Convey("should list plays newest first", func() {
+			plays, err := store.Plays(1, 0, 10)
+			So(err, ShouldBeNil)
+			So(len(plays), ShouldEqual, 3)
+			So(plays[0].Track.Title, ShouldEqual, "Track 2")
+			So(plays[0].Track.ArtistCredit(), ShouldEqual, "Artist A, Artist B")
+			So(plays[0].PlayedAt.Equal(start.Add(20*time.Minute)), ShouldBeTrue)
+			plays, _ = store.Plays(0, 1, 10)
+			So(len(plays), ShouldEqual, 3)
+		})
+
+		Convey("should count plays of tracks", func() {
+			counts, err := store.PlayCounts(models.PlayQuery{UserID: 1, Group: models.PlaysByTrack})
+			So(err, ShouldBeNil)
+			So(len(counts), ShouldEqual, 2)
+			So(counts[0].Track.Title, ShouldEqual, "Track 1")
+			So(counts[0].Count, ShouldEqual, 2)
+			So(counts[0].LastPlayed.Equal(start.Add(10*time.Minute)), ShouldBeTrue)
+
+			counts, _ = store.PlayCounts(models.PlayQuery{Group: models.PlaysByTrack, Recent: true, Limit: 1})
+			So(len(counts), ShouldEqual, 1)
+			So(counts[0].Track.Title, ShouldEqual, "Track 2")
+			So(counts[0].Count, ShouldEqual, 2)
+		})
+
+		Convey("should count plays of releases and artists", func() {
+			counts, err := store.PlayCounts(models.PlayQuery{Group: models.PlaysByRelease})
+			So(err, ShouldBeNil)
+			So(len(counts), ShouldEqual, 1)
+			So(counts[0].Release.Title, ShouldEqual, "Release")
+			So(counts[0].Count, ShouldEqual, 2)
+
+			counts, _ = store.PlayCounts(models.PlayQuery{Group: models.PlaysByArtist})
+			So(len(counts), ShouldEqual, 2)
+			So(counts[0].Artist.Name, ShouldEqual, "Artist A")
+			So(counts[0].Count, ShouldEqual, 4)
+			So(counts[1].Count, ShouldEqual, 2)
+
+			_, err = store.PlayCounts(models.PlayQuery{Group: "labels"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("should delete plays with their track", func() {
+			So(store.DeleteTrack(t2.ID), ShouldBeNil)
+			plays, _ := store.Plays(0, 0, 10)
+			So(len(plays), ShouldEqual, 2)
+		})
+
+		Convey("should queue listens until they are due", func() {
+			now := time.Now()
+			So(store.QueueListens([]models.QueuedListen{
+				{UserID: 1, Listen: `{"n":1}`},
+				{UserID: 1, Listen: `{"n":2}`, NextAttempt: now.Add(time.Hour)},
+				{UserID: 2, Listen: `{"n":3}`},
+			}), ShouldBeNil)
+			due, err := store.DueListens(now.Add(time.Second))
+			So(err, ShouldBeNil)
+			So(len(due), ShouldEqual, 2)
+			So(due[0].Listen, ShouldEqual, `{"n":1}`)
+
+			So(store.PostponeListens([]int64{due[0].ID}, now.Add(time.Minute), "down"), ShouldBeNil)
+			due, _ = store.DueListens(now.Add(time.Second))
+			So(len(due), ShouldEqual, 1)
+			So(due[0].UserID, ShouldEqual, 2)
+			due, _ = store.DueListens(now.Add(2 * time.Minute))
+			So(len(due), ShouldEqual, 2)
+			So(due[0].Attempts, ShouldEqual, 1)
+			So(due[0].LastError, ShouldEqual, "down")
+
+			So(store.DeleteQueuedListens([]int64{due[0].ID}), ShouldBeNil)
+			n, _ := store.CountQueuedListens(1)
+			So(n, ShouldEqual, 1)
+		})
+	})
+}
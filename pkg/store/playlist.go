@@ -0,0 +1,250 @@
+package store
+
+import (
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// CreatePlaylist creates playlist with its entries, which are numbered in
+// order. The tracks of the entries must exist. Smart playlists are created
+// without entries.
+func (db DbCollection) CreatePlaylist(playlist *models.Playlist) error {
+	if playlist.IsSmart() && len(playlist.Entries) > 0 {
+		return fmt.Errorf("smart playlist %q has entries", playlist.Name)
+	}
+	return db.transaction(func(tx *gorm.DB) error {
+		ids := make([]int64, len(playlist.Entries))
+		for i := range playlist.Entries {
+			playlist.Entries[i].Position = i
+			ids[i] = playlist.Entries[i].TrackID
+		}
+		if err := checkTracks(tx, ids); err != nil {
+			return err
+		}
+		return tx.Create(playlist).Error
+	})
+}
+
+// SavePlaylist saves the name and comment of playlist, and the rules of a
+// smart playlist. The entries of other playlists are changed with
+// AppendToPlaylist and ReorderPlaylist. Playlists that are made smart lose
+// their entries.
+func (db DbCollection) SavePlaylist(playlist models.Playlist) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		fields := map[string]interface{}{
+			"name":    playlist.Name,
+			"comment": playlist.Comment,
+		}
+		if playlist.IsSmart() {
+			fields["rules"] = playlist.Rules
+			err := tx.Where("playlist_id = ?", playlist.ID).Delete(models.PlaylistEntry{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		res := tx.Model(&models.Playlist{ID: playlist.ID}).Updates(fields)
+		if res.Error == nil && res.RowsAffected == 0 {
+			return models.NotFoundError{Kind: "playlist", Key: playlist.ID}
+		}
+		return res.Error
+	})
+}
+
+// GetPlaylist returns a playlist with its entries. The entries of a smart
+// playlist are the tracks that match its rules now.
+func (db DbCollection) GetPlaylist(id int64) (models.Playlist, error) {
+	var p models.Playlist
+	err := db.handler.Preload("Entries", byEntryPosition).Preload("Entries.Track").
+		Preload("Entries.Track.Artists", byPosition).Preload("Entries.Track.Artists.Artist").
+		Preload("Entries.Track.Streams.Format").First(&p, id).Error
+	if err != nil {
+		return p, notFound(err, "playlist", id)
+	}
+	if p.IsSmart() {
+		err = db.loadSmartEntries(&p)
+	}
+	return p, err
+}
+
+// Playlists returns every playlist by name. The tracks of the entries are
+// loaded with their streams, but without their artist credits.
+func (db DbCollection) Playlists() ([]models.Playlist, error) {
+	var playlists []models.Playlist
+	err := db.handler.Preload("Entries", byEntryPosition).Preload("Entries.Track").
+		Preload("Entries.Track.Streams").Order("name COLLATE NOCASE asc, id asc").
+		Find(&playlists).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range playlists {
+		if playlists[i].IsSmart() {
+			if err := db.loadSmartEntries(&playlists[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return playlists, nil
+}
+
+// loadSmartEntries sets the entries of a smart playlist to the tracks that
+// match its rules. The entries are not stored, and have no IDs.
+func (db DbCollection) loadSmartEntries(p *models.Playlist) error {
+	ids, err := smartTracks(db.handler, *p, time.Now())
+	if err != nil {
+		return fmt.Errorf("smart playlist %d: %v", p.ID, err)
+	}
+	byID := make(map[int64]models.Track)
+	err = batches(ids, func(batch []int64) error {
+		var tracks []models.Track
+		err := db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+			Preload("Streams.Format").Where("id in (?)", batch).Find(&tracks).Error
+		for _, t := range tracks {
+			byID[t.ID] = t
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	p.Entries = make([]models.PlaylistEntry, 0, len(ids))
+	for _, id := range ids {
+		p.Entries = append(p.Entries, models.PlaylistEntry{
+			PlaylistID: p.ID,
+			Position:   len(p.Entries),
+			TrackID:    id,
+			Track:      byID[id],
+		})
+	}
+	return nil
+}
+
+// AppendToPlaylist adds the tracks to the end of a playlist, in order.
+func (db DbCollection) AppendToPlaylist(id int64, trackIDs []int64) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := touchPlaylist(tx, id); err != nil {
+			return err
+		}
+		if err := checkTracks(tx, trackIDs); err != nil {
+			return err
+		}
+		var last struct{ Max *int }
+		err := tx.Model(&models.PlaylistEntry{}).Select("max(position) as max").
+			Where("playlist_id = ?", id).Scan(&last).Error
+		if err != nil {
+			return err
+		}
+		pos := 0
+		if last.Max != nil {
+			pos = *last.Max + 1
+		}
+		for i, t := range trackIDs {
+			e := models.PlaylistEntry{PlaylistID: id, TrackID: t, Position: pos + i}
+			if err := tx.Create(&e).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReorderPlaylist puts the entries of a playlist in the order of entryIDs.
+// Entries that are left out are removed from the playlist. Entries of other
+// playlists return a NotFoundError.
+func (db DbCollection) ReorderPlaylist(id int64, entryIDs []int64) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := touchPlaylist(tx, id); err != nil {
+			return err
+		}
+		var existing []int64
+		err := tx.Model(&models.PlaylistEntry{}).Where("playlist_id = ?", id).
+			Pluck("id", &existing).Error
+		if err != nil {
+			return err
+		}
+		keep := make(map[int64]bool)
+		for _, e := range existing {
+			keep[e] = false
+		}
+		for _, e := range entryIDs {
+			kept, ok := keep[e]
+			if !ok {
+				return models.NotFoundError{Kind: "playlist entry", Key: e}
+			}
+			if kept {
+				return fmt.Errorf("playlist entry %d is given more than once", e)
+			}
+			keep[e] = true
+		}
+		for e, kept := range keep {
+			if !kept {
+				if err := tx.Where("id = ?", e).Delete(models.PlaylistEntry{}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		for i, e := range entryIDs {
+			err := tx.Model(&models.PlaylistEntry{}).Where("id = ?", e).
+				UpdateColumn("position", i).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db DbCollection) DeletePlaylist(id int64) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("playlist_id = ?", id).Delete(models.PlaylistEntry{}).Error; err != nil {
+			return err
+		}
+		res := tx.Where("id = ?", id).Delete(models.Playlist{})
+		if res.Error == nil && res.RowsAffected == 0 {
+			return models.NotFoundError{Kind: "playlist", Key: id}
+		}
+		return res.Error
+	})
+}
+
+func byEntryPosition(db *gorm.DB) *gorm.DB {
+	return db.Order("position asc, id asc")
+}
+
+// touchPlaylist sets the time a playlist was updated, and returns a
+// NotFoundError if it does not exist. The entries of smart playlists cannot
+// be changed, so they return an error.
+func touchPlaylist(tx *gorm.DB, id int64) error {
+	var p models.Playlist
+	if err := tx.Select("id, rules").First(&p, id).Error; err != nil {
+		return notFound(err, "playlist", id)
+	}
+	if p.IsSmart() {
+		return fmt.Errorf("the entries of smart playlist %d cannot be changed", id)
+	}
+	return tx.Model(&p).UpdateColumn("updated_at", time.Now()).Error
+}
+
+// checkTracks returns a NotFoundError for the first of ids that is not a
+// track.
+func checkTracks(tx *gorm.DB, ids []int64) error {
+	exists := make(map[int64]bool)
+	err := batches(ids, func(batch []int64) error {
+		var found []int64
+		err := tx.Model(&models.Track{}).Where("id in (?)", batch).Pluck("id", &found).Error
+		for _, id := range found {
+			exists[id] = true
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if !exists[id] {
+			return models.NotFoundError{Kind: "track", Key: id}
+		}
+	}
+	return nil
+}
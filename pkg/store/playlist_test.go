@@ -0,0 +1,123 @@
+package store
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestPlaylists(t *testing.T) {
+	Convey("Test playlists", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		store := NewDbCollection(db)
+		Initialize(db)
+
+		var tracks []models.Track
+		for _, title := range []string{"Track 1", "Track 2", "Track 3"} {
+			t := models.Track{Title: title}
+			store.CreateTrack(&t)
+			tracks = append(tracks, t)
+		}
+		titles := func(p models.Playlist) []string {
+			var list []string
+			for _, e := range p.Entries {
+				list = append(list, e.Track.Title)
+			}
+			return list
+		}
+
+		p := models.Playlist{Name: "Mix"}
+		p.AddTrack(tracks[2])
+		p.AddTrack(tracks[0])
+		p.AddTrack(tracks[2])
+		So(store.CreatePlaylist(&p), ShouldBeNil)
+
+		Convey("should create playlist with entries in order", func() {
+			pl, err := store.GetPlaylist(p.ID)
+			So(err, ShouldBeNil)
+			So(pl.Name, ShouldEqual, "Mix")
+			So(titles(pl), ShouldResemble, []string{"Track 3", "Track 1", "Track 3"})
+			var count int
+			db.Model(&models.Track{}).Count(&count)
+			So(count, ShouldEqual, 3)
+		})
+
+		Convey("should not create playlist with missing track", func() {
+			bad := models.Playlist{Name: "Bad"}
+			bad.AddTrack(models.Track{ID: 100})
+			err := store.CreatePlaylist(&bad)
+			So(models.IsNotFound(err), ShouldBeTrue)
+			playlists, _ := store.Playlists()
+			So(len(playlists), ShouldEqual, 1)
+		})
+
+		Convey("should append tracks", func() {
+			So(store.AppendToPlaylist(p.ID, []int64{tracks[1].ID, tracks[0].ID}), ShouldBeNil)
+			pl, _ := store.GetPlaylist(p.ID)
+			So(titles(pl), ShouldResemble,
+				[]string{"Track 3", "Track 1", "Track 3", "Track 2", "Track 1"})
+			So(pl.UpdatedAt.After(p.UpdatedAt) || pl.UpdatedAt.Equal(p.UpdatedAt), ShouldBeTrue)
+		})
+
+		Convey("should reorder and remove entries", func() {
+			e := p.Entries
+			So(store.ReorderPlaylist(p.ID, []int64{e[1].ID, e[0].ID}), ShouldBeNil)
+			pl, _ := store.GetPlaylist(p.ID)
+			So(titles(pl), ShouldResemble, []string{"Track 1", "Track 3"})
+		})
+
+		Convey("should not reorder with entries of other playlists", func() {
+			other := models.Playlist{Name: "Other"}
+			other.AddTrack(tracks[1])
+			store.CreatePlaylist(&other)
+			err := store.ReorderPlaylist(p.ID, []int64{other.Entries[0].ID})
+			So(models.IsNotFound(err), ShouldBeTrue)
+			err = store.ReorderPlaylist(p.ID, []int64{p.Entries[0].ID, p.Entries[0].ID})
+			So(err, ShouldNotBeNil)
+			pl, _ := store.GetPlaylist(p.ID)
+			So(len(pl.Entries), ShouldEqual, 3)
+		})
+
+		Convey("should rename playlist", func() {
+			p.Name = "Renamed"
+			p.Comment = "For the road"
+			So(store.SavePlaylist(p), ShouldBeNil)
+			pl, _ := store.GetPlaylist(p.ID)
+			So(pl.Name, ShouldEqual, "Renamed")
+			So(pl.Comment, ShouldEqual, "For the road")
+			So(models.IsNotFound(store.SavePlaylist(models.Playlist{ID: 100})), ShouldBeTrue)
+		})
+
+		Convey("should remove deleted tracks from playlists", func() {
+			So(store.DeleteTrack(tracks[2].ID), ShouldBeNil)
+			pl, _ := store.GetPlaylist(p.ID)
+			So(titles(pl), ShouldResemble, []string{"Track 1"})
+		})
+
+		Convey("should delete playlist", func() {
+			So(store.DeletePlaylist(p.ID), ShouldBeNil)
+			_, err := store.GetPlaylist(p.ID)
+			So(models.IsNotFound(err), ShouldBeTrue)
+			var count int
+			db.Model(&models.PlaylistEntry{}).Count(&count)
+			So(count, ShouldEqual, 0)
+			So(models.IsNotFound(store.DeletePlaylist(p.ID)), ShouldBeTrue)
+		})
+
+		Convey("should list playlists by name", func() {
+			store.CreatePlaylist(&models.Playlist{Name: "another"})
+			playlists, err := store.Playlists()
+			So(err, ShouldBeNil)
+			So(len(playlists), ShouldEqual, 2)
+			So(playlists[0].Name, ShouldEqual, "another")
+			So(len(playlists[1].Entries), ShouldEqual, 3)
+		})
+	})
+}
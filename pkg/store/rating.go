@@ -0,0 +1,169 @@
+package store
+
+import (
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// itemTables maps each kind of item that can be rated to its table.
+var itemTables = map[models.ItemKind]string{
+	models.KindTrack:   "tracks",
+	models.KindRelease: "releases",
+	models.KindArtist:  "artists",
+}
+
+// SetStarred stars or unstars an item for a user. Starring an item that is
+// starred keeps the time it was first starred.
+func (db DbCollection) SetStarred(userID int64, kind models.ItemKind, id int64, starred bool) error {
+	return db.updateRating(userID, kind, id, func(r *models.Rating) {
+		if !starred {
+			r.StarredAt = nil
+		} else if r.StarredAt == nil {
+			now := time.Now().UTC()
+			r.StarredAt = &now
+		}
+	})
+}
+
+func (db DbCollection) SetRating(userID int64, kind models.ItemKind, id int64, rating int) error {
+	if rating < 0 || rating > models.MaxRating {
+		return fmt.Errorf("rating %d is not from 0 to %d", rating, models.MaxRating)
+	}
+	return db.updateRating(userID, kind, id, func(r *models.Rating) {
+		r.Rating = rating
+	})
+}
+
+// updateRating changes the rating of an item by a user with fn. Ratings
+// that are neither starred nor rated are removed.
+func (db DbCollection) updateRating(userID int64, kind models.ItemKind, id int64, fn func(*models.Rating)) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		table, ok := itemTables[kind]
+		if !ok {
+			return fmt.Errorf("cannot rate a %s", kind)
+		}
+		var n int
+		if err := tx.Table(table).Where("id = ?", id).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 {
+			return models.NotFoundError{Kind: string(kind), Key: id}
+		}
+		key := tx.Where("user_id = ? AND kind = ? AND item_id = ?", userID, kind, id)
+		r := models.Rating{UserID: userID, Kind: kind, ItemID: id}
+		err := key.First(&r).Error
+		exists := err == nil
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		fn(&r)
+		switch {
+		case r.StarredAt == nil && r.Rating == 0:
+			return key.Delete(models.Rating{}).Error
+		case exists:
+			return key.Model(&models.Rating{}).Updates(map[string]interface{}{
+				"starred_at": r.StarredAt,
+				"rating":     r.Rating,
+			}).Error
+		default:
+			return tx.Create(&r).Error
+		}
+	})
+}
+
+// Ratings returns the ratings by a user of the items of a kind with the
+// given IDs, by item ID. Items the user has not starred or rated are left
+// out.
+func (db DbCollection) Ratings(userID int64, kind models.ItemKind, ids []int64) (map[int64]models.Rating, error) {
+	ratings := make(map[int64]models.Rating)
+	err := batches(ids, func(batch []int64) error {
+		var found []models.Rating
+		err := db.handler.Where("user_id = ? AND kind = ? AND item_id in (?)", userID, kind, batch).
+			Find(&found).Error
+		for _, r := range found {
+			ratings[r.ItemID] = r
+		}
+		return err
+	})
+	return ratings, err
+}
+
+func (db DbCollection) Starred(userID int64) (models.StarredItems, error) {
+	var items models.StarredItems
+	ids := make(map[models.ItemKind][]int64)
+	for kind := range itemTables {
+		var found []int64
+		err := db.handler.Model(&models.Rating{}).
+			Where("user_id = ? AND kind = ? AND starred_at IS NOT NULL", userID, kind).
+			Order("starred_at desc, id desc").Pluck("item_id", &found).Error
+		if err != nil {
+			return items, err
+		}
+		ids[kind] = found
+	}
+
+	var releases []models.Release
+	err := batches(ids[models.KindRelease], func(batch []int64) error {
+		var found []models.Release
+		err := db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+			Where("id in (?)", batch).Find(&found).Error
+		releases = append(releases, found...)
+		return err
+	})
+	if err != nil {
+		return items, err
+	}
+	var tracks []models.Track
+	err = batches(ids[models.KindTrack], func(batch []int64) error {
+		var found []models.Track
+		err := db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+			Preload("Streams.Format").Where("id in (?)", batch).Find(&found).Error
+		tracks = append(tracks, found...)
+		return err
+	})
+	if err != nil {
+		return items, err
+	}
+	var artists []models.Artist
+	err = batches(ids[models.KindArtist], func(batch []int64) error {
+		var found []models.Artist
+		err := db.handler.Where("id in (?)", batch).Find(&found).Error
+		artists = append(artists, found...)
+		return err
+	})
+	if err != nil {
+		return items, err
+	}
+
+	// Put the items back in the order they were starred.
+	releaseByID := make(map[int64]models.Release)
+	for _, rel := range releases {
+		releaseByID[rel.ID] = rel
+	}
+	for _, id := range ids[models.KindRelease] {
+		if rel, ok := releaseByID[id]; ok {
+			items.Releases = append(items.Releases, rel)
+		}
+	}
+	trackByID := make(map[int64]models.Track)
+	for _, t := range tracks {
+		trackByID[t.ID] = t
+	}
+	for _, id := range ids[models.KindTrack] {
+		if t, ok := trackByID[id]; ok {
+			items.Tracks = append(items.Tracks, t)
+		}
+	}
+	artistByID := make(map[int64]models.Artist)
+	for _, a := range artists {
+		artistByID[a.ID] = a
+	}
+	for _, id := range ids[models.KindArtist] {
+		if a, ok := artistByID[id]; ok {
+			items.Artists = append(items.Artists, a)
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestRatings(t *testing.T) {
+	Convey("Test ratings", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		store := NewDbCollection(db)
+		Initialize(db)
+
+		artist := models.Artist{Name: "Artist"}
+		store.CreateArtist(&artist)
+		var releases []models.Release
+		for _, title := range []string{"Release 1", "Release 2", "Release 3"} {
+			rel := models.Release{Title: title}
+			rel.AddTrack(models.Track{Title: title + " track"})
+			store.CreateRelease(&rel)
+			releases = append(releases, rel)
+		}
+		track := releases[0].Tracks[0]
+
+		Convey("should rate items", func() {
+			So(store.SetRating(1, models.KindRelease, releases[0].ID, 4), ShouldBeNil)
+			So(store.SetRating(1, models.KindRelease, releases[1].ID, 2), ShouldBeNil)
+			So(store.SetRating(2, models.KindRelease, releases[1].ID, 5), ShouldBeNil)
+			So(store.SetRating(1, models.KindRelease, releases[0].ID, 3), ShouldBeNil)
+
+			ratings, err := store.Ratings(1, models.KindRelease,
+				[]int64{releases[0].ID, releases[1].ID, releases[2].ID})
+			So(err, ShouldBeNil)
+			So(len(ratings), ShouldEqual, 2)
+			So(ratings[releases[0].ID].Rating, ShouldEqual, 3)
+			So(ratings[releases[1].ID].Rating, ShouldEqual, 2)
+			So(ratings[releases[0].ID].StarredAt, ShouldBeNil)
+		})
+
+		Convey("should not rate out of range or missing items", func() {
+			So(store.SetRating(1, models.KindTrack, track.ID, 6), ShouldNotBeNil)
+			So(store.SetRating(1, models.KindTrack, track.ID, -1), ShouldNotBeNil)
+			So(models.IsNotFound(store.SetRating(1, models.KindTrack, 100, 1)), ShouldBeTrue)
+			So(store.SetRating(1, "label", 1, 1), ShouldNotBeNil)
+		})
+
+		Convey("should sort lists by rating", func() {
+			store.SetRating(1, models.KindRelease, releases[1].ID, 5)
+			store.SetRating(1, models.KindRelease, releases[0].ID, 1)
+			store.SetRating(2, models.KindRelease, releases[2].ID, 5)
+			list, _, err := store.Releases(models.ListOptions{Sort: models.SortRating, Desc: true, UserID: 1})
+			So(err, ShouldBeNil)
+			So(list[0].Title, ShouldEqual, "Release 2")
+			So(list[1].Title, ShouldEqual, "Release 1")
+			So(list[2].Title, ShouldEqual, "Release 3")
+
+			store.SetRating(1, models.KindTrack, releases[2].Tracks[0].ID, 3)
+			tracks, _, err := store.Tracks(models.ListOptions{Sort: models.SortRating, Desc: true, UserID: 1})
+			So(err, ShouldBeNil)
+			So(tracks[0].Title, ShouldEqual, "Release 3 track")
+		})
+
+		Convey("should list starred items, most recent first", func() {
+			So(store.SetStarred(0, models.KindRelease, releases[2].ID, true), ShouldBeNil)
+			So(store.SetStarred(0, models.KindRelease, releases[0].ID, true), ShouldBeNil)
+			So(store.SetStarred(0, models.KindTrack, track.ID, true), ShouldBeNil)
+			So(store.SetStarred(0, models.KindArtist, artist.ID, true), ShouldBeNil)
+			So(store.SetStarred(1, models.KindRelease, releases[1].ID, true), ShouldBeNil)
+
+			starred, err := store.Starred(0)
+			So(err, ShouldBeNil)
+			So(len(starred.Releases), ShouldEqual, 2)
+			So(starred.Releases[0].Title, ShouldEqual, "Release 1")
+			So(starred.Releases[1].Title, ShouldEqual, "Release 3")
+			So(starred.Tracks[0].Title, ShouldEqual, "Release 1 track")
+			So(starred.Artists[0].Name, ShouldEqual, "Artist")
+
+			Convey("and unstar them", func() {
+				So(store.SetStarred(0, models.KindRelease, releases[0].ID, false), ShouldBeNil)
+				starred, _ := store.Starred(0)
+				So(len(starred.Releases), ShouldEqual, 1)
+				var count int
+				db.Model(&models.Rating{}).Count(&count)
+				So(count, ShouldEqual, 4)
+			})
+
+			Convey("and keep the rating of unstarred items", func() {
+				store.SetRating(0, models.KindArtist, artist.ID, 2)
+				store.SetStarred(0, models.KindArtist, artist.ID, false)
+				ratings, _ := store.Ratings(0, models.KindArtist, []int64{artist.ID})
+				So(ratings[artist.ID].Rating, ShouldEqual, 2)
+			})
+
+			Convey("and remove the ratings of deleted items", func() {
+				So(store.DeleteRelease(releases[0].ID), ShouldBeNil)
+				starred, _ := store.Starred(0)
+				So(len(starred.Releases), ShouldEqual, 1)
+				So(len(starred.Tracks), ShouldEqual, 0)
+				var count int
+				db.Model(&models.Rating{}).Count(&count)
+				So(count, ShouldEqual, 3)
+			})
+		})
+	})
+}
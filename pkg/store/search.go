@@ -0,0 +1,447 @@
+package store
+
+import (
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The search index holds a row for each release, track and artist. Kind and
+// ref identify the item; the other columns hold the text it is found by.
+// The index is an FTS5 table if SQLite was built with FTS5, which the sqlite3
+// driver does with the sqlite_fts5 build tag. Otherwise it is a plain table
+// searched with LIKE, which matches terms anywhere in a field.
+const (
+	searchTable = "search_index"
+	ftsSchema   = `CREATE VIRTUAL TABLE search_index USING fts5(kind UNINDEXED,
+		ref UNINDEXED, title, artist, album, year,
+		tokenize = 'unicode61 remove_diacritics 1')`
+	plainSchema = `CREATE TABLE search_index (kind TEXT, ref INTEGER,
+		title TEXT, artist TEXT, album TEXT, year TEXT)`
+)
+
+const (
+	releaseKind = "release"
+	trackKind   = "track"
+	artistKind  = "artist"
+)
+
+// searchFields maps the field names of a query to index columns.
+var searchFields = map[string]string{
+	"title":   "title",
+	"artist":  "artist",
+	"release": "album",
+	"album":   "album",
+	"year":    "year",
+}
+
+// batchSize is the number of IDs bound in a single "in" clause, which keeps
+// queries below SQLite's limit on parameters.
+const batchSize = 500
+
+// term is a single term of a search query.
+type term struct {
+	column string // empty to match any column
+	text   string
+	prefix bool
+}
+
+func (db DbCollection) Search(query string, offset int, rows int) (models.SearchResult, error) {
+	var result models.SearchResult
+	fts, err := hasFTS(db.handler)
+	if err != nil {
+		return result, err
+	}
+	terms := parseQuery(query)
+	ids := make(map[string][]int64)
+	for _, kind := range []string{releaseKind, trackKind, artistKind} {
+		q := db.handler.Table(searchTable).Where("kind = ?", kind)
+		if len(terms) == 0 {
+			q = q.Order("ref desc")
+		} else if fts {
+			q = q.Where("search_index MATCH ?", ftsQuery(terms)).Order("rank, ref desc")
+		} else {
+			for _, t := range terms {
+				q = likeTerm(q, t)
+			}
+			q = q.Order("ref desc")
+		}
+		var refs []int64
+		if err := q.Offset(offset).Limit(rows).Pluck("ref", &refs).Error; err != nil {
+			return result, err
+		}
+		ids[kind] = refs
+	}
+
+	var releases []models.Release
+	err = db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+		Where("id in (?)", ids[releaseKind]).Find(&releases).Error
+	if err != nil {
+		return result, err
+	}
+	var tracks []models.Track
+	err = db.handler.Preload("Artists", byPosition).Preload("Artists.Artist").
+		Preload("Streams.Format").Where("id in (?)", ids[trackKind]).Find(&tracks).Error
+	if err != nil {
+		return result, err
+	}
+	var artists []models.Artist
+	err = db.handler.Preload("Releases").Where("id in (?)", ids[artistKind]).Find(&artists).Error
+	if err != nil {
+		return result, err
+	}
+
+	// Put the items back in the order of the index query.
+	releaseByID := make(map[int64]models.Release)
+	for _, rel := range releases {
+		releaseByID[rel.ID] = rel
+	}
+	for _, id := range ids[releaseKind] {
+		if rel, ok := releaseByID[id]; ok {
+			result.Releases = append(result.Releases, rel)
+		}
+	}
+	trackByID := make(map[int64]models.Track)
+	for _, t := range tracks {
+		trackByID[t.ID] = t
+	}
+	for _, id := range ids[trackKind] {
+		if t, ok := trackByID[id]; ok {
+			result.Tracks = append(result.Tracks, t)
+		}
+	}
+	artistByID := make(map[int64]models.Artist)
+	for _, a := range artists {
+		artistByID[a.ID] = a
+	}
+	for _, id := range ids[artistKind] {
+		if a, ok := artistByID[id]; ok {
+			result.Artists = append(result.Artists, a)
+		}
+	}
+	return result, nil
+}
+
+// parseQuery splits a search query into terms.
+func parseQuery(query string) []term {
+	var terms []term
+	rs := []rune(query)
+	for i := 0; i < len(rs); {
+		if unicode.IsSpace(rs[i]) {
+			i++
+			continue
+		}
+		var t term
+		// A field name is a run of letters followed by a colon.
+		j := i
+		for j < len(rs) && unicode.IsLetter(rs[j]) {
+			j++
+		}
+		if j < len(rs) && rs[j] == ':' {
+			if col, ok := searchFields[strings.ToLower(string(rs[i:j]))]; ok {
+				t.column = col
+				i = j + 1
+			}
+		}
+		if i < len(rs) && rs[i] == '"' {
+			j = i + 1
+			for j < len(rs) && rs[j] != '"' {
+				j++
+			}
+			t.text = string(rs[i+1 : j])
+			i = j + 1
+			if i < len(rs) && rs[i] == '*' {
+				t.prefix = true
+				i++
+			}
+		} else {
+			j = i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) {
+				j++
+			}
+			t.text = string(rs[i:j])
+			i = j
+			if strings.HasSuffix(t.text, "*") {
+				t.text = strings.TrimRight(t.text, "*")
+				t.prefix = true
+			}
+		}
+		if strings.TrimSpace(t.text) != "" {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// ftsQuery returns an FTS5 query matching all terms. Every term is quoted,
+// so that the user's text is never read as query syntax.
+func ftsQuery(terms []term) string {
+	parts := make([]string, len(terms))
+	for i, t := range terms {
+		s := `"` + strings.Replace(t.text, `"`, `""`, -1) + `"`
+		if t.prefix {
+			s += " *"
+		}
+		if t.column != "" {
+			s = t.column + " : " + s
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, which use \ as the
+// escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// likeTerm adds a condition matching t to q, for an index without FTS5.
+func likeTerm(q *gorm.DB, t term) *gorm.DB {
+	pattern := "%" + likeEscaper.Replace(t.text) + "%"
+	if t.column == "year" && !t.prefix {
+		return q.Where("year = ?", t.text)
+	}
+	if t.column != "" {
+		return q.Where(t.column+` LIKE ? ESCAPE '\'`, pattern)
+	}
+	return q.Where(`title LIKE ? ESCAPE '\' OR artist LIKE ? ESCAPE '\' OR
+		album LIKE ? ESCAPE '\' OR year LIKE ? ESCAPE '\'`, pattern, pattern, pattern, pattern)
+}
+
+// hasFTS reports whether the search index is an FTS5 table.
+func hasFTS(db *gorm.DB) (bool, error) {
+	var tables []string
+	err := db.Table("sqlite_master").Where("name = ?", searchTable).Pluck("sql", &tables).Error
+	if err != nil || len(tables) == 0 {
+		return false, err
+	}
+	return strings.Contains(strings.ToLower(tables[0]), "fts5"), nil
+}
+
+// FullTextSearch reports whether the search index is an FTS5 table, which
+// ranks results. Otherwise search falls back to unranked LIKE matching.
+func FullTextSearch(db *gorm.DB) (bool, error) {
+	return hasFTS(db)
+}
+
+// ftsCompiled reports whether SQLite was built with FTS5.
+func ftsCompiled(db *gorm.DB) (bool, error) {
+	var used []bool
+	err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Pluck("used", &used).Error
+	return len(used) > 0 && used[0], err
+}
+
+// migrateSearchIndex creates the search index and fills it with the items
+// already in the collection. A plain index is made again as an FTS5 table
+// once SQLite is built with FTS5.
+func migrateSearchIndex(db *gorm.DB) error {
+	if db.HasTable(searchTable) {
+		fts, err := hasFTS(db)
+		if err != nil || fts {
+			return err
+		}
+		compiled, err := ftsCompiled(db)
+		if err != nil || !compiled {
+			return err
+		}
+		if err := db.Exec("DROP TABLE " + searchTable).Error; err != nil {
+			return err
+		}
+	}
+	err := db.Exec(ftsSchema).Error
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		err = db.Exec(plainSchema).Error
+		if err == nil {
+			err = db.Exec("CREATE INDEX idx_search_index_ref ON search_index (kind, ref)").Error
+		}
+	}
+	if err != nil {
+		return err
+	}
+	var releases, tracks, artists []int64
+	if err := db.Model(&models.Release{}).Pluck("id", &releases).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&models.Track{}).Pluck("id", &tracks).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&models.Artist{}).Pluck("id", &artists).Error; err != nil {
+		return err
+	}
+	tx := db.Begin()
+	err = batches(releases, func(ids []int64) error { return indexReleases(tx, ids, false) })
+	if err == nil {
+		err = batches(tracks, func(ids []int64) error { return indexTracks(tx, ids) })
+	}
+	if err == nil {
+		err = batches(artists, func(ids []int64) error { return indexArtists(tx, ids) })
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// indexReleases updates the index entries of the releases with the given
+// IDs. Releases that no longer exist are removed from the index. If cascade
+// is true the tracks and artists of the releases are updated as well.
+func indexReleases(tx *gorm.DB, ids []int64, cascade bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := unindex(tx, releaseKind, ids); err != nil {
+		return err
+	}
+	var releases []models.Release
+	err := tx.Preload("Artists", byPosition).Preload("Artists.Artist").
+		Where("id in (?)", ids).Find(&releases).Error
+	if err != nil {
+		return err
+	}
+	var artists []int64
+	for _, rel := range releases {
+		err := addIndex(tx, releaseKind, rel.ID, rel.Title, rel.ArtistCredit(), rel.Title, rel.Year)
+		if err != nil {
+			return err
+		}
+		for _, c := range rel.Artists {
+			artists = append(artists, c.ArtistID)
+		}
+	}
+	if !cascade {
+		return nil
+	}
+	var tracks []int64
+	err = tx.Model(&models.Track{}).Where("release_id in (?)", ids).Pluck("id", &tracks).Error
+	if err != nil {
+		return err
+	}
+	if err := batches(tracks, func(ids []int64) error { return indexTracks(tx, ids) }); err != nil {
+		return err
+	}
+	return indexArtists(tx, artists)
+}
+
+// indexTracks updates the index entries of the tracks with the given IDs and
+// their artists. Tracks that no longer exist are removed from the index.
+func indexTracks(tx *gorm.DB, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := unindex(tx, trackKind, ids); err != nil {
+		return err
+	}
+	var tracks []models.Track
+	err := tx.Preload("Artists", byPosition).Preload("Artists.Artist").
+		Where("id in (?)", ids).Find(&tracks).Error
+	if err != nil {
+		return err
+	}
+	var relIDs []int64
+	for _, t := range tracks {
+		relIDs = append(relIDs, t.ReleaseID)
+	}
+	var releases []models.Release
+	err = tx.Preload("Artists", byPosition).Preload("Artists.Artist").
+		Where("id in (?)", relIDs).Find(&releases).Error
+	if err != nil {
+		return err
+	}
+	byID := make(map[int64]models.Release)
+	for _, rel := range releases {
+		byID[rel.ID] = rel
+	}
+	var artists []int64
+	for _, t := range tracks {
+		rel := byID[t.ReleaseID]
+		credit := t.ArtistCredit()
+		if credit == "" {
+			credit = rel.ArtistCredit()
+		}
+		if err := addIndex(tx, trackKind, t.ID, t.Title, credit, rel.Title, rel.Year); err != nil {
+			return err
+		}
+		for _, c := range t.Artists {
+			artists = append(artists, c.ArtistID)
+		}
+	}
+	return indexArtists(tx, artists)
+}
+
+// indexArtists updates the index entries of the artists with the given IDs.
+func indexArtists(tx *gorm.DB, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := unindex(tx, artistKind, ids); err != nil {
+		return err
+	}
+	var artists []models.Artist
+	if err := tx.Where("id in (?)", ids).Find(&artists).Error; err != nil {
+		return err
+	}
+	for _, a := range artists {
+		if err := addIndex(tx, artistKind, a.ID, "", a.Name, "", 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexArtistCredits updates the index entries of the releases and tracks
+// credited to an artist, whose name may have changed.
+func indexArtistCredits(tx *gorm.DB, id int64) error {
+	var releases, tracks []int64
+	err := tx.Model(&models.ReleaseArtist{}).Where("artist_id = ?", id).
+		Pluck("release_id", &releases).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Model(&models.TrackArtist{}).Where("artist_id = ?", id).
+		Pluck("track_id", &tracks).Error
+	if err != nil {
+		return err
+	}
+	err = batches(releases, func(ids []int64) error { return indexReleases(tx, ids, true) })
+	if err != nil {
+		return err
+	}
+	return batches(tracks, func(ids []int64) error { return indexTracks(tx, ids) })
+}
+
+func addIndex(tx *gorm.DB, kind string, ref int64, title, artist, album string, year int) error {
+	var y string
+	if year != 0 {
+		y = strconv.Itoa(year)
+	}
+	return tx.Exec(fmt.Sprintf(`INSERT INTO %s (kind, ref, title, artist, album, year)
+		VALUES (?, ?, ?, ?, ?, ?)`, searchTable), kind, ref, title, artist, album, y).Error
+}
+
+// unindex removes the index entries of the items of a kind with the given
+// IDs.
+func unindex(tx *gorm.DB, kind string, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE kind = ? AND ref IN (?)", searchTable),
+		kind, ids).Error
+}
+
+// batches calls fn with successive slices of ids of at most batchSize.
+func batches(ids []int64, fn func(ids []int64) error) error {
+	for len(ids) > 0 {
+		n := batchSize
+		if n > len(ids) {
+			n = len(ids)
+		}
+		if err := fn(ids[:n]); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
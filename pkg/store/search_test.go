@@ -0,0 +1,133 @@
+package store
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	Convey("Test Search", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		store := NewDbCollection(db)
+		Initialize(db)
+
+		mozart := models.Artist{Name: "Wolfgang Amadeus Mozart"}
+		store.CreateArtist(&mozart)
+		flute := models.Release{Title: "Die Zauberflöte", Year: 1791}
+		flute.AddArtist(mozart)
+		flute.AddTrack(models.Track{Title: "Der Vogelfänger bin ich ja"})
+		flute.AddTrack(models.Track{Title: "Der Hölle Rache kocht in meinem Herzen"})
+		store.CreateRelease(&flute)
+		blue := models.Release{Title: "Kind of Blue", Year: 1959}
+		blue.AddArtist(models.Artist{Name: "Miles Davis"})
+		blue.AddTrack(models.Track{Title: "So What"})
+		store.CreateRelease(&blue)
+
+		titles := func(res models.SearchResult) []string {
+			var ts []string
+			for _, rel := range res.Releases {
+				ts = append(ts, "release "+rel.Title)
+			}
+			for _, t := range res.Tracks {
+				ts = append(ts, "track "+t.Title)
+			}
+			for _, a := range res.Artists {
+				ts = append(ts, "artist "+a.Name)
+			}
+			return ts
+		}
+
+		Convey("should find releases, tracks and artists", func() {
+			res, err := store.Search("mozart", 0, 10)
+			So(err, ShouldBeNil)
+			So(len(res.Releases), ShouldEqual, 1)
+			So(len(res.Tracks), ShouldEqual, 2)
+			So(len(res.Artists), ShouldEqual, 1)
+			So(res.Releases[0].ArtistCredit(), ShouldEqual, "Wolfgang Amadeus Mozart")
+		})
+
+		Convey("should match prefix", func() {
+			res, err := store.Search("vogel*", 0, 10)
+			So(err, ShouldBeNil)
+			So(titles(res), ShouldResemble, []string{"track Der Vogelfänger bin ich ja"})
+		})
+
+		Convey("should match phrase", func() {
+			res, err := store.Search(`"rache kocht"`, 0, 10)
+			So(err, ShouldBeNil)
+			So(titles(res), ShouldResemble, []string{"track Der Hölle Rache kocht in meinem Herzen"})
+		})
+
+		Convey("should match field", func() {
+			res, err := store.Search("artist:davis", 0, 10)
+			So(err, ShouldBeNil)
+			So(titles(res), ShouldResemble,
+				[]string{"release Kind of Blue", "track So What", "artist Miles Davis"})
+			res, err = store.Search("year:1791 title:rache", 0, 10)
+			So(err, ShouldBeNil)
+			So(titles(res), ShouldResemble, []string{"track Der Hölle Rache kocht in meinem Herzen"})
+		})
+
+		Convey("should match everything with empty query", func() {
+			res, err := store.Search("", 1, 10)
+			So(err, ShouldBeNil)
+			So(len(res.Releases), ShouldEqual, 1)
+			So(res.Releases[0].Title, ShouldEqual, "Die Zauberflöte")
+			So(len(res.Tracks), ShouldEqual, 2)
+		})
+
+		Convey("should update index on save and delete", func() {
+			rel, _ := store.GetRelease(blue.ID)
+			rel.Title = "Sketches of Spain"
+			So(store.SaveRelease(rel), ShouldBeNil)
+			res, _ := store.Search("blue", 0, 10)
+			So(titles(res), ShouldBeEmpty)
+			res, _ = store.Search("release:sketches", 0, 10)
+			So(titles(res), ShouldResemble, []string{"release Sketches of Spain", "track So What"})
+
+			mozart.Name = "W. A. Mozart"
+			So(store.SaveArtist(mozart), ShouldBeNil)
+			res, _ = store.Search("artist:amadeus", 0, 10)
+			So(titles(res), ShouldBeEmpty)
+
+			So(store.DeleteRelease(flute.ID), ShouldBeNil)
+			res, _ = store.Search("zauberflöte", 0, 10)
+			So(titles(res), ShouldBeEmpty)
+		})
+
+		Convey("should index existing items on migration", func() {
+			db.Exec("DROP TABLE search_index")
+			So(Migrate(db), ShouldBeNil)
+			res, err := store.Search("so what", 0, 10)
+			So(err, ShouldBeNil)
+			So(titles(res), ShouldResemble, []string{"track So What"})
+		})
+
+		Convey("should use FTS5 when SQLite has it", func() {
+			db.Exec("DROP TABLE search_index")
+			db.Exec(plainSchema)
+			So(Migrate(db), ShouldBeNil)
+			compiled, err := ftsCompiled(db)
+			So(err, ShouldBeNil)
+			fts, err := FullTextSearch(db)
+			So(err, ShouldBeNil)
+			So(fts, ShouldEqual, compiled)
+			res, err := store.Search("so what", 0, 10)
+			So(err, ShouldBeNil)
+			if fts {
+				So(titles(res), ShouldResemble, []string{"track So What"})
+			} else {
+				// The plain index is kept as it was.
+				So(titles(res), ShouldBeEmpty)
+			}
+		})
+	})
+}
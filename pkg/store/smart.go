@@ -0,0 +1,242 @@
+package store
+
+import (
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	"math"
+	"strings"
+	"time"
+)
+
+// timeLayout is how times are passed to SQLite to compare with julianday.
+const timeLayout = "2006-01-02 15:04:05"
+
+// ruleExprs maps each rule field to the expression of its value for a
+// track. The user whose ratings and plays they are is their parameter.
+var ruleExprs = map[models.RuleField]string{
+	models.FieldYear:   trackOrders[models.SortYear],
+	models.FieldRating: ratingOrder(models.KindTrack, "tracks"),
+	models.FieldPlays: `(SELECT COUNT(*) FROM plays
+		WHERE plays.track_id = tracks.id AND plays.user_id = ?)`,
+	models.FieldAdded: "julianday(tracks.created_at)",
+	models.FieldPlayed: `(SELECT julianday(MAX(plays.played_at)) FROM plays
+		WHERE plays.track_id = tracks.id AND plays.user_id = ?)`,
+	// The duration of a track is that of its first stream, in nanoseconds.
+	models.FieldDuration: `(SELECT streams.duration FROM streams
+		WHERE streams.track_id = tracks.id ORDER BY streams.id LIMIT 1)`,
+}
+
+// smartOrders maps the sorts of smart playlists that lists do not have to
+// their expressions. See ruleExprs.
+var smartOrders = map[models.Sort]string{
+	models.SortRandom:   "RANDOM()",
+	models.SortPlays:    ruleExprs[models.FieldPlays],
+	models.SortPlayed:   "COALESCE(" + ruleExprs[models.FieldPlayed] + ", 0)",
+	models.SortDuration: "COALESCE(" + ruleExprs[models.FieldDuration] + ", 0)",
+}
+
+// ruleQuery is SQL with its parameters.
+type ruleQuery struct {
+	sql  strings.Builder
+	args []interface{}
+}
+
+// expr writes an expression, with userID for each of its parameters.
+func (q *ruleQuery) expr(sql string, userID int64) {
+	q.sql.WriteString(sql)
+	for i := strings.Count(sql, "?"); i > 0; i-- {
+		q.args = append(q.args, userID)
+	}
+}
+
+func (q *ruleQuery) param(sql string, args ...interface{}) {
+	q.sql.WriteString(sql)
+	q.args = append(q.args, args...)
+}
+
+// smartTracks returns the IDs of the tracks matching the rules of a smart
+// playlist, in order.
+func smartTracks(db *gorm.DB, p models.Playlist, now time.Time) ([]int64, error) {
+	rules, err := p.SmartRules()
+	if err != nil {
+		return nil, err
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	var where ruleQuery
+	if err := where.group(rules.Match, rules.Rules, p.UserID, now); err != nil {
+		return nil, err
+	}
+
+	sort := rules.Sort
+	if sort == "" {
+		sort = models.SortAdded
+	}
+	expr, ok := smartOrders[sort]
+	if !ok {
+		expr = trackOrders[sort]
+	}
+	dir := "asc"
+	if rules.Desc {
+		dir = "desc"
+	}
+	var order ruleQuery
+	order.expr(fmt.Sprintf("%s %s, tracks.id %s", expr, dir, dir), p.UserID)
+	limit := int64(rules.Limit)
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+
+	var ids []int64
+	err = db.Model(&models.Track{}).Where(where.sql.String(), where.args...).
+		Order(gorm.Expr(order.sql.String(), order.args...)).Limit(limit).
+		Pluck("tracks.id", &ids).Error
+	return ids, err
+}
+
+// group writes rules combined by match. Empty groups match every track.
+func (q *ruleQuery) group(match models.Match, rules []models.Rule, userID int64, now time.Time) error {
+	if len(rules) == 0 {
+		q.sql.WriteString("1 = 1")
+		return nil
+	}
+	join := " AND "
+	if match == models.MatchAny {
+		join = " OR "
+	}
+	q.sql.WriteString("(")
+	for i, r := range rules {
+		if i > 0 {
+			q.sql.WriteString(join)
+		}
+		var err error
+		if r.Rules != nil || r.Match != "" {
+			err = q.group(r.Match, r.Rules, userID, now)
+		} else {
+			err = q.rule(r, userID, now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	q.sql.WriteString(")")
+	return nil
+}
+
+// rule writes a single rule. The rules must have been validated.
+func (q *ruleQuery) rule(r models.Rule, userID int64, now time.Time) error {
+	switch r.Field {
+	case models.FieldFormat:
+		if r.Op == models.OpIsNot {
+			q.sql.WriteString("NOT ")
+		}
+		q.param(`EXISTS (SELECT 1 FROM streams JOIN formats ON formats.id = streams.format_id
+			WHERE streams.track_id = tracks.id AND formats.name = ? COLLATE NOCASE)`, string(r.Value))
+		return nil
+	case models.FieldArtist:
+		return q.artistRule(r)
+	case models.FieldAdded, models.FieldPlayed:
+		return q.dateRule(r, userID, now)
+	}
+
+	from, err := r.Value.Int()
+	if err != nil {
+		return err
+	}
+	to := from
+	if r.Op == models.OpBetween {
+		if to, err = r.To.Int(); err != nil {
+			return err
+		}
+	}
+	if r.Field == models.FieldDuration {
+		from *= int64(time.Second)
+		to *= int64(time.Second)
+	}
+	expr := ruleExprs[r.Field]
+	if r.Field == models.FieldDuration {
+		expr = "COALESCE(" + expr + ", 0)"
+	}
+	q.expr(expr, userID)
+	switch r.Op {
+	case models.OpIs:
+		q.param(" = ?", from)
+	case models.OpIsNot:
+		q.param(" != ?", from)
+	case models.OpLess:
+		q.param(" < ?", from)
+	case models.OpGreater:
+		q.param(" > ?", from)
+	case models.OpBetween:
+		q.param(" BETWEEN ? AND ?", from, to)
+	default:
+		return fmt.Errorf("rule of %s cannot use %q", r.Field, r.Op)
+	}
+	return nil
+}
+
+// artistRule matches the names of the artists of a track, or of its release
+// if it has none of its own.
+func (q *ruleQuery) artistRule(r models.Rule) error {
+	var cond string
+	arg := string(r.Value)
+	switch r.Op {
+	case models.OpIs, models.OpIsNot:
+		cond = "artists.name = ? COLLATE NOCASE"
+	case models.OpContains, models.OpNotContains:
+		cond = `artists.name LIKE ? ESCAPE '\'`
+		arg = "%" + likeEscaper.Replace(arg) + "%"
+	default:
+		return fmt.Errorf("rule of %s cannot use %q", r.Field, r.Op)
+	}
+	if r.Op == models.OpIsNot || r.Op == models.OpNotContains {
+		q.sql.WriteString("NOT ")
+	}
+	q.param(`(EXISTS (SELECT 1 FROM track_artists JOIN artists ON artists.id = track_artists.artist_id
+		WHERE track_artists.track_id = tracks.id AND `+cond+`)
+		OR EXISTS (SELECT 1 FROM release_artists JOIN artists ON artists.id = release_artists.artist_id
+		WHERE release_artists.release_id = tracks.release_id AND `+cond+`))`, arg, arg)
+	return nil
+}
+
+// dateRule compares the day a track was added or last played. Tracks that
+// were never played are only matched by notinlast.
+func (q *ruleQuery) dateRule(r models.Rule, userID int64, now time.Time) error {
+	expr := ruleExprs[r.Field]
+	var at time.Time
+	switch r.Op {
+	case models.OpBefore, models.OpAfter:
+		day, err := r.Value.Date(now.Location())
+		if err != nil {
+			return err
+		}
+		at = day
+		if r.Op == models.OpAfter {
+			at = day.AddDate(0, 0, 1)
+		}
+	case models.OpInLast, models.OpNotInLast:
+		days, err := r.Value.Int()
+		if err != nil {
+			return err
+		}
+		at = now.AddDate(0, 0, -int(days))
+	default:
+		return fmt.Errorf("rule of %s cannot use %q", r.Field, r.Op)
+	}
+	param := at.UTC().Format(timeLayout)
+	switch r.Op {
+	case models.OpBefore:
+		q.expr(expr, userID)
+		q.param(" < julianday(?)", param)
+	case models.OpAfter, models.OpInLast:
+		q.expr(expr, userID)
+		q.param(" >= julianday(?)", param)
+	case models.OpNotInLast:
+		q.sql.WriteString("COALESCE(")
+		q.expr(expr, userID)
+		q.param(", 0) < julianday(?)", param)
+	}
+	return nil
+}
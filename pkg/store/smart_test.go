@@ -0,0 +1,199 @@
+package store
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestSmartPlaylists(t *testing.T) {
+	Convey("Test smart playlists", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		store := NewDbCollection(db)
+		Initialize(db)
+		flac, _ := store.GetFormat("FLAC")
+		mp3, _ := store.GetFormat("MP3")
+
+		beatles := models.Artist{Name: "The Beatles"}
+		store.CreateArtist(&beatles)
+		kinks := models.Artist{Name: "The Kinks"}
+		store.CreateArtist(&kinks)
+		now := time.Now()
+		release := func(artist models.Artist, year int, titles ...string) []models.Track {
+			rel := models.Release{Title: artist.Name, Year: year}
+			rel.AddArtist(artist)
+			for i, title := range titles {
+				t := models.Track{Title: title}
+				format := mp3
+				if year < 1966 {
+					format = flac
+				}
+				t.AddStream(models.Stream{Format: format, FormatID: format.ID,
+					Duration: time.Duration(i+2) * time.Minute})
+				rel.AddTrack(t)
+			}
+			So(store.CreateRelease(&rel), ShouldBeNil)
+			return rel.Tracks
+		}
+		help := release(beatles, 1965, "Help!", "Yesterday")
+		revolver := release(beatles, 1966, "Taxman", "Eleanor Rigby")
+		kinda := release(kinks, 1965, "Tired of Waiting")
+		// Help! was added long ago.
+		db.Model(&models.Track{}).Where("id = ?", help[0].ID).
+			UpdateColumn("created_at", now.AddDate(0, 0, -100))
+
+		play := func(t models.Track, daysAgo int) {
+			p := models.Play{UserID: 1, TrackID: t.ID, PlayedAt: now.AddDate(0, 0, -daysAgo)}
+			So(store.CreatePlay(&p), ShouldBeNil)
+		}
+		play(revolver[0], 1)
+		play(revolver[0], 2)
+		play(help[1], 40)
+		play(kinda[0], 3)
+		store.SetRating(1, models.KindTrack, revolver[1].ID, 5)
+		store.SetRating(1, models.KindTrack, kinda[0].ID, 3)
+		store.SetRating(2, models.KindTrack, help[1].ID, 5)
+
+		smart := func(rules models.SmartRules) []string {
+			p := models.Playlist{Name: "Smart", UserID: 1}
+			So(p.SetSmartRules(rules), ShouldBeNil)
+			So(store.CreatePlaylist(&p), ShouldBeNil)
+			p, err := store.GetPlaylist(p.ID)
+			So(err, ShouldBeNil)
+			titles := []string{}
+			for _, e := range p.Entries {
+				titles = append(titles, e.Track.Title)
+			}
+			return titles
+		}
+		rule := func(field models.RuleField, op models.RuleOp, value models.RuleValue) models.Rule {
+			return models.Rule{Field: field, Op: op, Value: value}
+		}
+
+		Convey("should match years and formats", func() {
+			titles := smart(models.SmartRules{Rules: []models.Rule{
+				{Field: models.FieldYear, Op: models.OpBetween, Value: "1960", To: "1965"},
+				rule(models.FieldFormat, models.OpIs, "FLAC"),
+			}, Sort: models.SortTitle})
+			So(titles, ShouldResemble, []string{"Help!", "Tired of Waiting", "Yesterday"})
+			titles = smart(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldFormat, models.OpIsNot, "flac"),
+			}, Sort: models.SortTitle})
+			So(titles, ShouldResemble, []string{"Eleanor Rigby", "Taxman"})
+		})
+
+		Convey("should match artists", func() {
+			titles := smart(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldArtist, models.OpContains, "kink"),
+			}})
+			So(titles, ShouldResemble, []string{"Tired of Waiting"})
+			titles = smart(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldArtist, models.OpIsNot, "the beatles"),
+			}})
+			So(titles, ShouldResemble, []string{"Tired of Waiting"})
+		})
+
+		Convey("should match ratings and plays of the user", func() {
+			titles := smart(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldRating, models.OpGreater, "2"),
+			}, Sort: models.SortRating, Desc: true})
+			So(titles, ShouldResemble, []string{"Eleanor Rigby", "Tired of Waiting"})
+			titles = smart(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldPlays, models.OpIs, "0"),
+			}, Sort: models.SortTitle})
+			So(titles, ShouldResemble, []string{"Eleanor Rigby", "Help!"})
+		})
+
+		Convey("should match dates", func() {
+			titles := smart(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldPlayed, models.OpInLast, "7"),
+			}, Sort: models.SortPlays, Desc: true})
+			So(titles, ShouldResemble, []string{"Taxman", "Tired of Waiting"})
+			titles = smart(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldPlayed, models.OpNotInLast, "30"),
+			}, Sort: models.SortTitle})
+			So(titles, ShouldResemble, []string{"Eleanor Rigby", "Help!", "Yesterday"})
+			titles = smart(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldAdded, models.OpBefore, models.RuleValue(now.AddDate(0, 0, -50).Format("2006-01-02"))),
+			}})
+			So(titles, ShouldResemble, []string{"Help!"})
+			titles = smart(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldAdded, models.OpInLast, "10"),
+			}})
+			So(len(titles), ShouldEqual, 4)
+		})
+
+		Convey("should combine rules with groups, sort and limit", func() {
+			titles := smart(models.SmartRules{Match: models.MatchAny, Rules: []models.Rule{
+				rule(models.FieldDuration, models.OpGreater, "150"),
+				{Match: models.MatchAll, Rules: []models.Rule{
+					rule(models.FieldArtist, models.OpIs, "The Kinks"),
+					rule(models.FieldRating, models.OpIs, "3"),
+				}},
+			}, Sort: models.SortDuration, Desc: true, Limit: 2})
+			So(titles, ShouldResemble, []string{"Eleanor Rigby", "Yesterday"})
+		})
+
+		Convey("should update as the collection changes", func() {
+			p := models.Playlist{Name: "Unplayed", UserID: 1}
+			p.SetSmartRules(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldPlays, models.OpIs, "0"),
+			}})
+			store.CreatePlaylist(&p)
+			pl, _ := store.GetPlaylist(p.ID)
+			So(len(pl.Entries), ShouldEqual, 2)
+			play(help[0], 0)
+			pl, _ = store.GetPlaylist(p.ID)
+			So(len(pl.Entries), ShouldEqual, 1)
+			playlists, err := store.Playlists()
+			So(err, ShouldBeNil)
+			So(len(playlists[0].Entries), ShouldEqual, 1)
+
+			Convey("but not be changed by hand", func() {
+				So(store.AppendToPlaylist(p.ID, []int64{help[0].ID}), ShouldNotBeNil)
+				So(store.ReorderPlaylist(p.ID, nil), ShouldNotBeNil)
+				bad := models.Playlist{Name: "Bad", Rules: p.Rules}
+				bad.AddTrack(help[0])
+				So(store.CreatePlaylist(&bad), ShouldNotBeNil)
+			})
+		})
+
+		Convey("should make playlists smart", func() {
+			p := models.Playlist{Name: "Mix"}
+			p.AddTrack(help[0])
+			store.CreatePlaylist(&p)
+			p.SetSmartRules(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldYear, models.OpIs, "1966"),
+			}})
+			So(store.SavePlaylist(p), ShouldBeNil)
+			pl, _ := store.GetPlaylist(p.ID)
+			So(len(pl.Entries), ShouldEqual, 2)
+			var count int
+			db.Model(&models.PlaylistEntry{}).Count(&count)
+			So(count, ShouldEqual, 0)
+		})
+
+		Convey("should refuse invalid rules", func() {
+			var p models.Playlist
+			So(p.SetSmartRules(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldYear, models.OpContains, "19"),
+			}}), ShouldNotBeNil)
+			So(p.SetSmartRules(models.SmartRules{Rules: []models.Rule{
+				rule(models.FieldPlays, models.OpIs, "many"),
+			}}), ShouldNotBeNil)
+			So(p.SetSmartRules(models.SmartRules{Rules: []models.Rule{
+				rule("genre", models.OpIs, "rock"),
+			}}), ShouldNotBeNil)
+			So(p.SetSmartRules(models.SmartRules{Sort: "loudness"}), ShouldNotBeNil)
+			So(p.IsSmart(), ShouldBeFalse)
+		})
+	})
+}
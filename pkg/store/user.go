@@ -0,0 +1,131 @@
+package store
+
+import (
+	"fmt"
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// CreateUser creates user, whose name must not be taken.
+func (db DbCollection) CreateUser(user *models.User) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		var n int
+		if err := tx.Model(&models.User{}).Where("name = ?", user.Name).Count(&n).Error; err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("user %q already exists", user.Name)
+		}
+		return tx.Create(user).Error
+	})
+}
+
+func (db DbCollection) SaveUser(user models.User) error {
+	res := db.handler.Model(&models.User{ID: user.ID}).Updates(map[string]interface{}{
+		"name":          user.Name,
+		"password_hash": user.PasswordHash,
+		"admin":         user.Admin,
+
+		"listen_brainz_url":   user.ListenBrainzURL,
+		"listen_brainz_token": user.ListenBrainzToken,
+	})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return models.NotFoundError{Kind: "user", Key: user.ID}
+	}
+	return res.Error
+}
+
+func (db DbCollection) GetUser(id int64) (models.User, error) {
+	var u models.User
+	err := db.handler.First(&u, id).Error
+	return u, notFound(err, "user", id)
+}
+
+func (db DbCollection) GetUserByName(name string) (models.User, error) {
+	var u models.User
+	err := db.handler.Where("name = ?", name).First(&u).Error
+	return u, notFound(err, "user", name)
+}
+
+// Users returns every user by name.
+func (db DbCollection) Users() ([]models.User, error) {
+	var users []models.User
+	err := db.handler.Order("name asc").Find(&users).Error
+	return users, err
+}
+
+// DeleteUser deletes a user and their play history, and logs them out,
+// revoking their tokens.
+func (db DbCollection) DeleteUser(id int64) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{models.Session{}, models.Token{}, models.Play{},
+			models.QueuedListen{}, models.Rating{}} {
+			if err := tx.Where("user_id = ?", id).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		res := tx.Where("id = ?", id).Delete(models.User{})
+		if res.Error == nil && res.RowsAffected == 0 {
+			return models.NotFoundError{Kind: "user", Key: id}
+		}
+		return res.Error
+	})
+}
+
+// CreateSession creates session, and deletes the sessions that have
+// expired.
+func (db DbCollection) CreateSession(session *models.Session) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at < ?", time.Now()).Delete(models.Session{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(session).Error
+	})
+}
+
+// GetSession returns an unexpired session with its user.
+func (db DbCollection) GetSession(id string) (models.Session, error) {
+	var s models.Session
+	err := db.handler.Preload("User").Where("id = ? AND expires_at > ?", id, time.Now()).
+		First(&s).Error
+	return s, notFound(err, "session", id)
+}
+
+func (db DbCollection) DeleteSession(id string) error {
+	return db.handler.Where("id = ?", id).Delete(models.Session{}).Error
+}
+
+func (db DbCollection) CreateToken(token *models.Token) error {
+	return db.handler.Create(token).Error
+}
+
+// GetTokenByHash returns a token with its user.
+func (db DbCollection) GetTokenByHash(hash string) (models.Token, error) {
+	var t models.Token
+	err := db.handler.Preload("User").Where("hash = ?", hash).First(&t).Error
+	return t, notFound(err, "token", "")
+}
+
+// Tokens returns the tokens of a user, newest first.
+func (db DbCollection) Tokens(userID int64) ([]models.Token, error) {
+	var tokens []models.Token
+	err := db.handler.Where("user_id = ?", userID).Order("created_at desc, id desc").
+		Find(&tokens).Error
+	return tokens, err
+}
+
+// TouchToken records when a token was last used.
+func (db DbCollection) TouchToken(id int64, at time.Time) error {
+	return db.handler.Model(&models.Token{}).Where("id = ?", id).
+		UpdateColumn("last_used_at", at).Error
+}
+
+// DeleteToken revokes a token of a user.
+func (db DbCollection) DeleteToken(userID int64, id int64) error {
+	res := db.handler.Where("id = ? AND user_id = ?", id, userID).Delete(models.Token{})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return models.NotFoundError{Kind: "token", Key: id}
+	}
+	return res.Error
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"github.com/gravesm/blueshift/pkg/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestUsers(t *testing.T) {
+	Convey("Test users", t, func() {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		store := NewDbCollection(db)
+		Initialize(db)
+
+		u := models.User{Name: "alice", Admin: true}
+		So(u.SetPassword("secret"), ShouldBeNil)
+		So(store.CreateUser(&u), ShouldBeNil)
+
+		Convey("should check password", func() {
+			found, err := store.GetUserByName("alice")
+			So(err, ShouldBeNil)
+			So(found.Admin, ShouldBeTrue)
+			So(found.CheckPassword("secret"), ShouldBeTrue)
+			So(found.CheckPassword("Secret"), ShouldBeFalse)
+			So(found.SetPassword(""), ShouldNotBeNil)
+		})
+
+		Convey("should reject taken name", func() {
+			So(store.CreateUser(&models.User{Name: "alice"}), ShouldNotBeNil)
+		})
+
+		Convey("should change password", func() {
+			u.SetPassword("other")
+			So(store.SaveUser(u), ShouldBeNil)
+			found, _ := store.GetUser(u.ID)
+			So(found.CheckPassword("other"), ShouldBeTrue)
+			So(store.SaveUser(models.User{ID: 100}), ShouldHaveSameTypeAs, models.NotFoundError{})
+		})
+
+		Convey("should find unexpired sessions", func() {
+			s := models.Session{ID: "abc", UserID: u.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			So(store.CreateSession(&s), ShouldBeNil)
+			found, err := store.GetSession("abc")
+			So(err, ShouldBeNil)
+			So(found.User.Name, ShouldEqual, "alice")
+
+			old := models.Session{ID: "old", UserID: u.ID, ExpiresAt: time.Now().Add(-time.Hour)}
+			So(store.CreateSession(&old), ShouldBeNil)
+			_, err = store.GetSession("old")
+			So(models.IsNotFound(err), ShouldBeTrue)
+
+			So(store.DeleteSession("abc"), ShouldBeNil)
+			_, err = store.GetSession("abc")
+			So(models.IsNotFound(err), ShouldBeTrue)
+		})
+
+		Convey("should find, touch and revoke tokens", func() {
+			tok := models.Token{UserID: u.ID, Name: "script", Hash: "h1", Scopes: "read"}
+			So(store.CreateToken(&tok), ShouldBeNil)
+			found, err := store.GetTokenByHash("h1")
+			So(err, ShouldBeNil)
+			So(found.User.Name, ShouldEqual, "alice")
+			So(found.LastUsedAt, ShouldBeNil)
+
+			now := time.Now()
+			So(store.TouchToken(tok.ID, now), ShouldBeNil)
+			tokens, _ := store.Tokens(u.ID)
+			So(len(tokens), ShouldEqual, 1)
+			So(tokens[0].LastUsedAt.Equal(now), ShouldBeTrue)
+
+			So(models.IsNotFound(store.DeleteToken(u.ID+1, tok.ID)), ShouldBeTrue)
+			So(store.DeleteToken(u.ID, tok.ID), ShouldBeNil)
+			_, err = store.GetTokenByHash("h1")
+			So(models.IsNotFound(err), ShouldBeTrue)
+		})
+
+		Convey("should delete user, sessions and tokens", func() {
+			store.CreateSession(&models.Session{ID: "abc", UserID: u.ID, ExpiresAt: time.Now().Add(time.Hour)})
+			store.CreateToken(&models.Token{UserID: u.ID, Name: "script", Hash: "h1", Scopes: "read"})
+			So(store.DeleteUser(u.ID), ShouldBeNil)
+			_, err := store.GetSession("abc")
+			So(models.IsNotFound(err), ShouldBeTrue)
+			_, err = store.GetTokenByHash("h1")
+			So(models.IsNotFound(err), ShouldBeTrue)
+			So(models.IsNotFound(store.DeleteUser(u.ID)), ShouldBeTrue)
+			users, _ := store.Users()
+			So(users, ShouldBeEmpty)
+		})
+	})
+}